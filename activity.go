@@ -0,0 +1,333 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	activityUsage = "usage: shp activity [-f] [--json] [--type exec|open] <container>"
+
+	activityFile = "activity.jsonl"
+
+	activityExec      = "exec"
+	activityOpen      = "open"
+	activitySetupPoll = 10 * time.Millisecond
+
+	// The proc connector of netlink(7), which reports process events
+	netlinkConnector  = 11 // NETLINK_CONNECTOR
+	cnIdxProc         = 1  // CN_IDX_PROC
+	cnValProc         = 1  // CN_VAL_PROC
+	procCnMcastListen = 1  // PROC_CN_MCAST_LISTEN
+	procEventExec     = 2  // PROC_EVENT_EXEC
+	cnMsgLen          = 20 // sizeof(struct cn_msg)
+
+	fanClassNotif = 0x0  // FAN_CLASS_NOTIF
+	fanCloexec    = 0x1  // FAN_CLOEXEC
+	fanNonblock   = 0x2  // FAN_NONBLOCK
+	fanMarkAdd    = 0x1  // FAN_MARK_ADD
+	fanMarkMount  = 0x10 // FAN_MARK_MOUNT
+	fanOpen       = 0x20 // FAN_OPEN
+	fanEventLen   = 24   // sizeof(struct fanotify_event_metadata)
+	fanNoFD       = -1   // FAN_NOFD
+)
+
+// activityMountSkip lists the mounts of a container whose files are not
+// watched for opens: pseudo filesystems, which every process opens all the
+// time.
+var activityMountSkip = map[string]bool{
+	"/proc": true,
+	"/sys":  true,
+	"/dev":  true,
+}
+
+// activityEvent is a record of the activity log: a program a process of
+// the container executed, or a file it opened.
+type activityEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	PID     int       `json:"pid"`
+	Exe     string    `json:"exe,omitempty"`
+	Command []string  `json:"command,omitempty"`
+	Path    string    `json:"path,omitempty"`
+}
+
+// activityMonitor records the process executions and file opens of a
+// container to its activity log, without tracing it: executions come from
+// the kernel's proc connector and opens from fanotify marks on the
+// container's mounts. Both report the whole host, so events are kept only
+// for processes in the container's PID namespace.
+type activityMonitor struct {
+	pidNS string
+	mu    sync.Mutex
+	log   *os.File
+	procs *os.File
+	opens *os.File
+	stop  chan struct{}
+	done  sync.WaitGroup
+}
+
+func startActivityMonitor(st *containerState) (*activityMonitor, error) {
+	pidNS, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", st.PID))
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(scratchPath(st.ID, activityFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := &activityMonitor{pidNS: pidNS, log: log, stop: make(chan struct{})}
+	if m.procs, err = listenProcEvents(); err != nil {
+		log.Close()
+		return nil, fmt.Errorf("cannot listen to process events: %w", err)
+	}
+	fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT, fanClassNotif|fanCloexec|fanNonblock, syscall.O_RDONLY|syscall.O_LARGEFILE, 0)
+	if errno != 0 {
+		m.procs.Close()
+		log.Close()
+		return nil, fmt.Errorf("cannot watch file opens: %w", errno)
+	}
+	m.opens = os.NewFile(fd, "fanotify")
+	m.done.Add(2)
+	go m.readProcEvents()
+	go func() {
+		defer m.done.Done()
+		// The container's mounts are complete once the init started the
+		// command; until then its mounts are still those of the host
+		for workloadPID(st.PID) == 0 {
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(activitySetupPoll):
+			}
+		}
+		if err := watchOpens(fd, st.PID); err != nil {
+			fmt.Printf("Warning: cannot watch file opens of container %s: %v\n", st.ID, err)
+			return
+		}
+		m.readOpens()
+	}()
+	return m, nil
+}
+
+// listenProcEvents subscribes to the process events of the proc connector.
+func listenProcEvents() (*os.File, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, netlinkConnector)
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// nlmsghdr, cn_msg and the operation
+	msg := make([]byte, syscall.NLMSG_HDRLEN+cnMsgLen+4)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], syscall.NLMSG_DONE)
+	binary.LittleEndian.PutUint32(msg[12:], uint32(os.Getpid()))
+	cn := msg[syscall.NLMSG_HDRLEN:]
+	binary.LittleEndian.PutUint32(cn[0:], cnIdxProc)
+	binary.LittleEndian.PutUint32(cn[4:], cnValProc)
+	binary.LittleEndian.PutUint16(cn[16:], 4)
+	binary.LittleEndian.PutUint32(cn[cnMsgLen:], procCnMcastListen)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "proc-connector"), nil
+}
+
+// watchOpens marks the mounts of the container whose init is pid for
+// fanotify open events. The marks are placed through /proc/<pid>/root, so
+// they land on the container's mounts rather than the host's.
+func watchOpens(fd uintptr, pid int) error {
+	mounts, err := readMounts(pid)
+	if err != nil {
+		return err
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	for _, mnt := range mounts {
+		if activityMountSkip[mnt.Target] || activityMountSkip[filepath.Dir(mnt.Target)] {
+			continue
+		}
+		p, err := syscall.BytePtrFromString(root + mnt.Target)
+		if err != nil {
+			continue
+		}
+		if _, _, errno := fanotifyMark(int(fd), fanMarkAdd|fanMarkMount, fanOpen, p); errno != 0 && mnt.Target == "/" {
+			return fmt.Errorf("cannot watch %s: %w", mnt.Target, errno)
+		}
+	}
+	return nil
+}
+
+func (m *activityMonitor) readProcEvents() {
+	defer m.done.Done()
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, err := m.procs.Read(buf)
+		if err != nil {
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			// cn_msg, then struct proc_event: what, cpu, timestamp and the
+			// exec event's pid and tgid
+			ev := msg.Data
+			if len(ev) < cnMsgLen+24 || binary.LittleEndian.Uint32(ev[cnMsgLen:]) != procEventExec {
+				continue
+			}
+			tgid := int(binary.LittleEndian.Uint32(ev[cnMsgLen+20:]))
+			if !m.inContainer(tgid) {
+				continue
+			}
+			e := activityEvent{Time: time.Now().UTC(), Event: activityExec, PID: tgid}
+			e.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", tgid))
+			if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", tgid)); err == nil {
+				e.Command = strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+			}
+			m.record(e)
+		}
+	}
+}
+
+func (m *activityMonitor) readOpens() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := m.opens.Read(buf)
+		if err != nil {
+			return
+		}
+		// A series of struct fanotify_event_metadata: event_len, vers,
+		// reserved, metadata_len, mask, fd and pid
+		for b := buf[:n]; len(b) >= fanEventLen; {
+			size := int(binary.LittleEndian.Uint32(b))
+			if size < fanEventLen || size > len(b) {
+				break
+			}
+			fd := int(int32(binary.LittleEndian.Uint32(b[16:])))
+			pid := int(int32(binary.LittleEndian.Uint32(b[20:])))
+			b = b[size:]
+			if fd == fanNoFD {
+				continue
+			}
+			path, _ := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+			syscall.Close(fd)
+			if m.inContainer(pid) {
+				m.record(activityEvent{Time: time.Now().UTC(), Event: activityOpen, PID: pid, Path: path})
+			}
+		}
+	}
+}
+
+// inContainer reports whether a process is in the container's PID
+// namespace. A process that exited already cannot be attributed.
+func (m *activityMonitor) inContainer(pid int) bool {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	return err == nil && ns == m.pidNS
+}
+
+func (m *activityMonitor) record(e activityEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.log.Write(append(data, '\n'))
+}
+
+// close stops recording. The activity log stays until the container's
+// runtime directory is removed.
+func (m *activityMonitor) close() {
+	close(m.stop)
+	m.procs.Close()
+	m.opens.Close()
+	m.done.Wait()
+	m.log.Close()
+}
+
+func activity(args []string) {
+	fs := flag.NewFlagSet("activity", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var follow bool
+	fs.BoolVar(&follow, "f", false, "keep printing new events until the container exits")
+	fs.BoolVar(&follow, "follow", false, "keep printing new events until the container exits")
+	asJSON := fs.Bool("json", false, "print the events as JSON lines")
+	kind := fs.String("type", "", "print only exec or open events")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || *kind != "" && *kind != activityExec && *kind != activityOpen {
+		fmt.Println(activityUsage)
+		os.Exit(1)
+	}
+	st, err := findContainer(fs.Arg(0))
+	handle(err)
+	f, err := os.Open(scratchPath(st.ID, activityFile))
+	if os.IsNotExist(err) {
+		handle(fmt.Errorf("container %s does not record its activity; run it with --activity", st.ID))
+	}
+	handle(err)
+	defer f.Close()
+
+	if !*asJSON {
+		fmt.Printf("%-29s %7s %-5s %s\n", "TIME", "PID", "EVENT", "DETAIL")
+	}
+	r := bufio.NewReader(f)
+	var partial []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			partial = append(partial, line...)
+			if !follow || !processAlive(st.PID) {
+				return
+			}
+			time.Sleep(logsPollInterval)
+			continue
+		}
+		handle(err)
+		line, partial = append(partial, line...), nil
+		var e activityEvent
+		if json.Unmarshal(line, &e) != nil || *kind != "" && e.Event != *kind {
+			continue
+		}
+		if *asJSON {
+			os.Stdout.Write(line)
+			continue
+		}
+		detail := e.Path
+		if e.Event == activityExec {
+			detail = strings.Join(e.Command, " ")
+			if e.Exe != "" && (len(e.Command) == 0 || e.Command[0] != e.Exe) {
+				detail = e.Exe + ": " + detail
+			}
+		}
+		fmt.Printf("%-29s %7d %-5s %s\n", e.Time.Local().Format(logsTimeFormat), e.PID, e.Event, strings.TrimSpace(detail))
+	}
+}
+
+// fanotifyMark calls fanotify_mark(2) on the path p. Its 64-bit mask takes
+// two arguments on 32-bit architectures.
+func fanotifyMark(fd int, flags uintptr, mask uint64, p *byte) (uintptr, uintptr, syscall.Errno) {
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		return syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, uintptr(fd), flags, uintptr(mask), uintptr(mask>>32),
+			uintptr(atFdcwd), uintptr(unsafe.Pointer(p)))
+	}
+	return syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, uintptr(fd), flags, uintptr(mask),
+		uintptr(atFdcwd), uintptr(unsafe.Pointer(p)), 0)
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	admissionOff    = "off"
+	admissionReject = "reject"
+	admissionQueue  = "queue"
+
+	procMeminfo          = "/proc/meminfo"
+	procLoadavg          = "/proc/loadavg"
+	admissionMinFreeDisk = 100 << 20
+	admissionPollPeriod  = time.Second
+)
+
+// hostCapacity is a snapshot of the resources still available on the host.
+type hostCapacity struct {
+	memoryBytes int64
+	cpus        float64
+	diskBytes   int64
+}
+
+// fits reports why the requested limits do not fit into the available
+// capacity, or nil if they do.
+func (c hostCapacity) fits(req resourceLimits) error {
+	if req.memoryBytes > 0 && req.memoryBytes > c.memoryBytes {
+		return fmt.Errorf("requested memory %d bytes exceeds available %d bytes", req.memoryBytes, c.memoryBytes)
+	}
+	if req.cpus > 0 && req.cpus > c.cpus {
+		return fmt.Errorf("requested %.2f cpus exceeds available %.2f", req.cpus, c.cpus)
+	}
+	if c.diskBytes < admissionMinFreeDisk {
+		return fmt.Errorf("only %d bytes free on the rootfs filesystem", c.diskBytes)
+	}
+	return nil
+}
+
+// admit checks the requested limits against the remaining host capacity.
+// In reject mode an oversubscribing request fails immediately; in queue
+// mode it waits until capacity frees up or the timeout expires.
+func admit(mode string, req resourceLimits, rootfs string, timeout time.Duration) error {
+	if mode == admissionOff {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		capacity, err := availableCapacity(rootfs)
+		if err != nil {
+			return fmt.Errorf("admission check failed: %w", err)
+		}
+		err = capacity.fits(req)
+		if err == nil {
+			return nil
+		}
+		if mode == admissionReject || time.Now().After(deadline) {
+			return fmt.Errorf("admission denied: %w", err)
+		}
+		time.Sleep(admissionPollPeriod)
+	}
+}
+
+func availableCapacity(rootfs string) (hostCapacity, error) {
+	var c hostCapacity
+
+	mem, err := memAvailable()
+	if err != nil {
+		return c, err
+	}
+	c.memoryBytes = mem
+
+	load, err := loadAverage()
+	if err != nil {
+		return c, err
+	}
+	c.cpus = float64(runtime.NumCPU()) - load
+	if c.cpus < 0 {
+		c.cpus = 0
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(rootfs, &st); err != nil {
+		return c, fmt.Errorf("statfs %s: %w", rootfs, err)
+	}
+	c.diskBytes = int64(st.Bavail) * int64(st.Bsize)
+	return c, nil
+}
+
+func memAvailable() (int64, error) {
+	f, err := os.Open(procMeminfo)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %w", procMeminfo, err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemAvailable in %s: %w", procMeminfo, err)
+			}
+			return kb << 10, nil
+		}
+	}
+	return 0, fmt.Errorf("no MemAvailable in %s", procMeminfo)
+}
+
+// loadAverage returns the one-minute load average, used as an estimate of
+// the CPUs already in use.
+func loadAverage() (float64, error) {
+	data, err := os.ReadFile(procLoadavg)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %w", procLoadavg, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty %s", procLoadavg)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
@@ -0,0 +1,257 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	alertMemory = "memory"
+	alertCPU    = "cpu"
+	hookAlert   = "alert"
+
+	alertInterval = 5 * time.Second
+
+	// USER_HZ, the unit of CPU times in /proc, is 100 on all architectures
+	// Linux supports
+	clockTicks = 100
+)
+
+// resourceAlert is an --alert threshold such as memory>90%:cmd. Memory
+// percentages are relative to the container's --memory limit, or to the
+// host's RAM; a CPU usage of 100% is one fully used CPU.
+type resourceAlert struct {
+	spec      string
+	metric    string
+	above     bool
+	threshold float64
+	percent   bool
+	action    string
+}
+
+// parseAlert parses <metric><op><value>:<action>, where metric is memory or
+// cpu, op is > or <, and action is a host shell command or a webhook URL.
+func parseAlert(v string) (resourceAlert, error) {
+	cond, action, ok := strings.Cut(v, ":")
+	i := strings.IndexAny(cond, "<>")
+	if !ok || action == "" || i < 0 {
+		return resourceAlert{}, fmt.Errorf("invalid alert %q, expected e.g. memory>90%%:cmd", v)
+	}
+	a := resourceAlert{spec: cond, metric: cond[:i], above: cond[i] == '>', action: action}
+	value := cond[i+1:]
+	if p, ok := strings.CutSuffix(value, "%"); ok {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil || f < 0 {
+			return resourceAlert{}, fmt.Errorf("invalid alert threshold %q", value)
+		}
+		a.threshold, a.percent = f, true
+	}
+	switch a.metric {
+	case alertMemory:
+		if !a.percent {
+			n, err := parseSize(value)
+			if err != nil {
+				return resourceAlert{}, fmt.Errorf("invalid alert threshold %q", value)
+			}
+			a.threshold = float64(n)
+		}
+	case alertCPU:
+		if !a.percent {
+			return resourceAlert{}, fmt.Errorf("cpu alert thresholds are percentages, e.g. cpu>150%%")
+		}
+	default:
+		return resourceAlert{}, fmt.Errorf("unknown alert metric %q, expected memory or cpu", a.metric)
+	}
+	return a, nil
+}
+
+// resourceUsage is a sample of the resources used by all processes of a
+// container.
+type resourceUsage struct {
+	memoryBytes int64
+	cpuTicks    int64
+}
+
+// namespacePIDs returns the host PIDs of the processes in the PID namespace
+// of the container whose init is pid.
+func namespacePIDs(pid int) ([]int, error) {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, dir := range dirs {
+		if link, err := os.Readlink(dir + "/ns/pid"); err != nil || link != ns {
+			continue
+		}
+		if p, err := strconv.Atoi(filepath.Base(dir)); err == nil {
+			pids = append(pids, p)
+		}
+	}
+	return pids, nil
+}
+
+// sampleResources sums the resident memory and CPU time of the processes in
+// the PID namespace of the container whose init is pid.
+func sampleResources(pid int) (resourceUsage, error) {
+	var u resourceUsage
+	pids, err := namespacePIDs(pid)
+	if err != nil {
+		return u, err
+	}
+	page := int64(os.Getpagesize())
+	for _, p := range pids {
+		dir := fmt.Sprintf("/proc/%d", p)
+		// Processes may exit at any time; those are skipped
+		if statm, err := os.ReadFile(dir + "/statm"); err == nil {
+			if fields := strings.Fields(string(statm)); len(fields) > 1 {
+				rss, _ := strconv.ParseInt(fields[1], 10, 64)
+				u.memoryBytes += rss * page
+			}
+		}
+		if stat, err := os.ReadFile(dir + "/stat"); err == nil {
+			// The command name may contain spaces, fields follow its ')'
+			if i := bytes.LastIndexByte(stat, ')'); i >= 0 {
+				fields := strings.Fields(string(stat[i+1:]))
+				if len(fields) > 12 {
+					utime, _ := strconv.ParseInt(fields[11], 10, 64)
+					stime, _ := strconv.ParseInt(fields[12], 10, 64)
+					u.cpuTicks += utime + stime
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// alertMonitor evaluates the alerts of a container on every sample. An alert
+// fires when its condition becomes true and is re-armed once it is false
+// again, so a lasting condition is reported once.
+type alertMonitor struct {
+	st          *containerState
+	alerts      []resourceAlert
+	memoryLimit int64
+	firing      []bool
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func startAlerts(st *containerState, alerts []resourceAlert, memoryLimit int64) *alertMonitor {
+	if memoryLimit <= 0 {
+		var info syscall.Sysinfo_t
+		if err := syscall.Sysinfo(&info); err == nil {
+			memoryLimit = int64(info.Totalram) * int64(info.Unit)
+		}
+	}
+	m := &alertMonitor{
+		st:          st,
+		alerts:      alerts,
+		memoryLimit: memoryLimit,
+		firing:      make([]bool, len(alerts)),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *alertMonitor) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(alertInterval)
+	defer ticker.Stop()
+	last, err := sampleResources(m.st.PID)
+	lastTime := time.Now()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		u, serr := sampleResources(m.st.PID)
+		now := time.Now()
+		if serr != nil || err != nil {
+			last, lastTime, err = u, now, serr
+			continue
+		}
+		// Exited processes take their CPU time with them
+		cpu := float64(u.cpuTicks-last.cpuTicks) / clockTicks / now.Sub(lastTime).Seconds() * 100
+		if cpu < 0 {
+			cpu = 0
+		}
+		last, lastTime = u, now
+		for i, a := range m.alerts {
+			value, shown := m.value(a, u, cpu)
+			hit := value > a.threshold
+			if !a.above {
+				hit = value < a.threshold
+			}
+			if hit && !m.firing[i] {
+				m.fire(a, shown)
+			}
+			m.firing[i] = hit
+		}
+	}
+}
+
+// value returns the current value of an alert's metric, in the unit of its
+// threshold, and how to show it.
+func (m *alertMonitor) value(a resourceAlert, u resourceUsage, cpu float64) (float64, string) {
+	switch {
+	case a.metric == alertCPU:
+		return cpu, fmt.Sprintf("%.0f%%", cpu)
+	case a.percent && m.memoryLimit > 0:
+		v := float64(u.memoryBytes) / float64(m.memoryLimit) * 100
+		return v, fmt.Sprintf("%.0f%%", v)
+	case a.percent:
+		return 0, "unknown"
+	}
+	return float64(u.memoryBytes), strconv.FormatInt(u.memoryBytes, 10)
+}
+
+// fire reports an alert on stderr and runs its action: a POST of the alert
+// as JSON for webhook URLs, the host shell otherwise.
+func (m *alertMonitor) fire(a resourceAlert, value string) {
+	fmt.Fprintf(os.Stderr, "alert: %s %s (%s)\n", m.st.ID, a.spec, value)
+	if !strings.HasPrefix(a.action, "http://") && !strings.HasPrefix(a.action, "https://") {
+		runHook(hookAlert, a.action, m.st, "SHP_ALERT="+a.spec, "SHP_ALERT_VALUE="+value)
+		return
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false) // keep > and < of the alert readable
+	enc.Encode(map[string]string{
+		"id":    m.st.ID,
+		"name":  m.st.Name,
+		"alert": a.spec,
+		"value": value,
+	})
+	client := &http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(a.action, "application/json", &body)
+	if err != nil {
+		fmt.Printf("Warning: alert webhook failed: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("Warning: alert webhook failed: %s\n", resp.Status)
+	}
+}
+
+func (m *alertMonitor) close() {
+	close(m.stop)
+	<-m.done
+}
@@ -0,0 +1,320 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	applyUsage = "usage: shp apply [--dry-run] [--profile name[,name]]... -f <file|dir>..."
+
+	// profilesEnv lists the active profiles of apply without --profile
+	profilesEnv = "SHP_PROFILES"
+
+	// appliedLabel marks the containers that shp apply manages, the only
+	// ones it removes
+	appliedLabel = "shp.apply"
+)
+
+// applyAction is what apply does to bring a container in line with its
+// definition.
+type applyAction struct {
+	entry  autostartEntry
+	args   []string
+	change string
+}
+
+func apply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var paths, profiles []string
+	fs.Func("f", "container definition file, or directory of *.json files; later ones override earlier ones (repeatable)", func(v string) error {
+		paths = append(paths, v)
+		return nil
+	})
+	fs.Func("profile", "comma-separated profiles whose definitions to enable (repeatable)", func(v string) error {
+		profiles = append(profiles, splitList(v)...)
+		return nil
+	})
+	dryRun := fs.Bool("dry-run", false, "print the changes without making them")
+	if err := fs.Parse(args); err != nil || len(paths) == 0 || fs.NArg() != 0 {
+		fmt.Println(applyUsage)
+		os.Exit(1)
+	}
+	if profiles == nil {
+		profiles = splitList(os.Getenv(profilesEnv))
+	}
+	handle(applyDefinitions(paths, profiles, *dryRun))
+}
+
+// containerDefinition is a definition of shp apply: an autostart entry that
+// may belong to profiles.
+type containerDefinition struct {
+	autostartEntry
+	// Profiles enable the definition only while one of them is active;
+	// definitions without profiles are always enabled
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+// readDefinitions reads the container definitions of a file, or of the
+// *.json files of a directory, with variables substituted.
+func readDefinitions(path string) ([]containerDefinition, error) {
+	paths := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return nil, err
+		}
+	}
+	var defs []containerDefinition
+	names := make(map[string]string)
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", p, err)
+		}
+		var d containerDefinition
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %w", p, err)
+		}
+		if err := d.expand(os.LookupEnv); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if err := validateName(d.Name); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if other, ok := names[d.Name]; ok {
+			return nil, fmt.Errorf("container %s is defined in both %s and %s", d.Name, other, p)
+		}
+		names[d.Name] = p
+		defs = append(defs, d)
+	}
+	return defs, nil
+}
+
+// loadDefinitions reads container definitions, which use the format of
+// autostart entries: a name, the containers to start first and the run
+// arguments without --name. The definitions of each path override those
+// of the same containers in earlier paths, and only the definitions
+// enabled by the active profiles are returned.
+func loadDefinitions(paths, profiles []string) ([]autostartEntry, error) {
+	var order []string
+	byName := make(map[string]*containerDefinition)
+	for _, path := range paths {
+		defs, err := readDefinitions(path)
+		if err != nil {
+			return nil, err
+		}
+		for i := range defs {
+			d := &defs[i]
+			base, ok := byName[d.Name]
+			if !ok {
+				byName[d.Name] = d
+				order = append(order, d.Name)
+				continue
+			}
+			if err := base.merge(*d); err != nil {
+				return nil, fmt.Errorf("cannot override %s with %s: %w", d.Name, path, err)
+			}
+		}
+	}
+
+	active := make(map[string]bool, len(profiles))
+	for _, p := range profiles {
+		active[p] = true
+	}
+	var entries []autostartEntry
+	for _, name := range order {
+		if d := byName[name]; d.enabled(active) {
+			entries = append(entries, d.autostartEntry)
+		}
+	}
+	// A dependency in an inactive profile would otherwise be reported as
+	// not defined
+	for _, e := range entries {
+		for _, dep := range e.After {
+			if d, ok := byName[dep]; ok && !d.enabled(active) {
+				return nil, fmt.Errorf("%s needs %s, which is only enabled by profile %s", e.Name, dep, strings.Join(d.Profiles, ", "))
+			}
+		}
+	}
+	return entries, nil
+}
+
+// enabled reports whether the definition applies with the given profiles
+// active.
+func (d *containerDefinition) enabled(active map[string]bool) bool {
+	if len(d.Profiles) == 0 {
+		return true
+	}
+	for _, p := range d.Profiles {
+		if active[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// merge applies an override of the definition, like a compose override
+// file: after and profiles replace those of d when they are set, and so do
+// args that name a rootfs. Args of flags only are added after the flags of
+// d, so they take precedence over its single-valued flags and add to its
+// repeatable ones.
+func (d *containerDefinition) merge(o containerDefinition) error {
+	if o.After != nil {
+		d.After = o.After
+	}
+	if o.Profiles != nil {
+		d.Profiles = o.Profiles
+	}
+	if o.Args == nil {
+		return nil
+	}
+	_, pargs, err := parseRunOptions("run", o.Args)
+	if err != nil {
+		return fmt.Errorf("invalid run arguments %v: %w", o.Args, err)
+	}
+	if len(pargs) > 0 {
+		d.Args = o.Args
+		return nil
+	}
+	_, pargs, err = parseRunOptions("run", d.Args)
+	if err != nil {
+		return fmt.Errorf("invalid run arguments %v: %w", d.Args, err)
+	}
+	flags := d.Args[:len(d.Args)-len(pargs)]
+	args := append([]string{}, flags...)
+	if n := len(flags); n > 0 && flags[n-1] == "--" {
+		args = append(args[:n-1], o.Args...)
+		args = append(args, "--")
+	} else {
+		args = append(args, o.Args...)
+	}
+	d.Args = append(args, pargs...)
+	return nil
+}
+
+// expand substitutes variables in the strings of a definition, so one
+// definition serves several environments. Substitution applies to the
+// decoded strings rather than the JSON text, so values cannot break it.
+func (e *autostartEntry) expand(lookup func(string) (string, bool)) error {
+	fields := []*string{&e.Name}
+	for i := range e.After {
+		fields = append(fields, &e.After[i])
+	}
+	for i := range e.Args {
+		fields = append(fields, &e.Args[i])
+	}
+	for _, f := range fields {
+		v, err := expandVars(*f, lookup)
+		if err != nil {
+			return err
+		}
+		*f = v
+	}
+	return nil
+}
+
+// applyDefinitions makes the running containers match the enabled
+// definitions at paths: containers that are missing or run another
+// definition are started with run --idempotent, and managed containers
+// without an enabled definition are stopped. Every definition is checked
+// before anything changes.
+func applyDefinitions(paths, profiles []string, dryRun bool) error {
+	entries, err := loadDefinitions(paths, profiles)
+	if err != nil {
+		return err
+	}
+	order, err := startOrder(entries)
+	if err != nil {
+		return err
+	}
+	states, err := listStates()
+	if err != nil {
+		return err
+	}
+	running := make(map[string]*containerState)
+	for _, st := range states {
+		if st.Name != "" {
+			running[st.Name] = st
+		}
+	}
+
+	var actions []applyAction
+	for _, e := range order {
+		args := append([]string{"--detach", "--idempotent", "--name", e.Name, "--label", appliedLabel + "=true"}, e.Args...)
+		opts, pargs, err := parseRunOptions("run", args)
+		if err != nil || len(pargs) < 2 {
+			return fmt.Errorf("invalid run arguments for %s: %v", e.Name, e.Args)
+		}
+		if opts.name != e.Name || opts.id != "" || opts.autostart {
+			return fmt.Errorf("definition of %s must not set --name, --id or --autostart", e.Name)
+		}
+		digest, err := definitionDigest(args, pargs)
+		if err != nil {
+			return err
+		}
+		a := applyAction{entry: e, args: args, change: "created"}
+		if st := running[e.Name]; st != nil {
+			a.change = "updated"
+			if st.Definition == digest {
+				a.change = "unchanged"
+			}
+		}
+		actions = append(actions, a)
+	}
+	desired := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		desired[e.Name] = true
+	}
+	var removals []*containerState
+	for _, st := range states {
+		if st.Labels[appliedLabel] == "true" && !desired[st.Name] {
+			removals = append(removals, st)
+		}
+	}
+
+	// Removals come first, so they free resources and quota for the rest
+	for _, st := range removals {
+		if dryRun {
+			fmt.Printf("%s: would be removed\n", st.Name)
+			continue
+		}
+		if err := removeContainer(st, false); err != nil {
+			return err
+		}
+		fmt.Printf("%s: removed\n", st.Name)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot resolve shp executable: %w", err)
+	}
+	for _, a := range actions {
+		switch {
+		case a.change == "unchanged":
+			fmt.Printf("%s: unchanged\n", a.entry.Name)
+		case dryRun:
+			fmt.Printf("%s: would be %s\n", a.entry.Name, a.change)
+		default:
+			out, err := exec.Command(self, append([]string{"run"}, a.args...)...).CombinedOutput()
+			if err != nil {
+				os.Stderr.Write(out)
+				return fmt.Errorf("cannot apply %s: %w", a.entry.Name, err)
+			}
+			// A detached run prints the container ID last
+			out = bytes.TrimSpace(out)
+			fmt.Printf("%s: %s (%s)\n", a.entry.Name, a.change, out[bytes.LastIndexByte(out, '\n')+1:])
+		}
+	}
+	return nil
+}
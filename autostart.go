@@ -0,0 +1,265 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stateDir     = "/var/lib/shp"
+	autostartDir = "autostart"
+	systemUsage  = "usage: shp system start-all | disable <name>..."
+
+	// autostartTimeout bounds the wait for a container others depend on
+	autostartTimeout = 30 * time.Second
+)
+
+// autostartEntry is the persisted definition of a container flagged with
+// --autostart.
+type autostartEntry struct {
+	Name  string   `json:"name"`
+	After []string `json:"after,omitempty"`
+	Args  []string `json:"args"`
+}
+
+func autostartPath(name string) string {
+	return filepath.Join(stateDir, autostartDir, name+".json")
+}
+
+// validateName rejects container names that are unsafe to use as file names.
+func validateName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return fmt.Errorf("invalid container name: %q", name)
+	}
+	return nil
+}
+
+// saveAutostart records the run arguments of a named container so that
+// `shp system start-all` can bring it up again at boot.
+func saveAutostart(opts *runOptions, args, pargs []string) error {
+	if err := validateName(opts.name); err != nil {
+		return fmt.Errorf("--autostart requires --name: %w", err)
+	}
+	args, err := absRunArgs(args, pargs)
+	if err != nil {
+		return err
+	}
+	entry := autostartEntry{Name: opts.name, After: opts.after, Args: args}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := autostartPath(opts.name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return nil
+}
+
+func loadAutostart() ([]autostartEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(stateDir, autostartDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []autostartEntry
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", path, err)
+		}
+		var e autostartEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// startOrder sorts entries so that every container comes after the
+// containers it depends on. Unknown dependencies and cycles are errors.
+// shp apply orders its definitions the same way.
+func startOrder(entries []autostartEntry) ([]autostartEntry, error) {
+	byName := make(map[string]autostartEntry, len(entries))
+	for _, e := range entries {
+		byName[e.Name] = e
+	}
+	names := make([]string, 0, len(entries))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(entries))
+	var order []autostartEntry
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle involving %s", name)
+		case done:
+			return nil
+		}
+		e, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("dependency %s is not defined", name)
+		}
+		state[name] = visiting
+		for _, dep := range e.After {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		order = append(order, e)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func system(args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "start-all":
+		handle(startAll())
+	case len(args) > 1 && args[0] == "disable":
+		for _, name := range args[1:] {
+			handle(removeAutostart(name))
+		}
+	default:
+		fmt.Println(systemUsage)
+		os.Exit(1)
+	}
+}
+
+// removeAutostart deletes the autostart entry of a container, unless other
+// entries depend on it. A running container keeps running.
+func removeAutostart(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	entries, err := loadAutostart()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		for _, dep := range e.After {
+			if dep == name && e.Name != name {
+				return fmt.Errorf("autostart entry %s depends on %s", e.Name, name)
+			}
+		}
+	}
+	if err := os.Remove(autostartPath(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no autostart entry for %s", name)
+		}
+		return err
+	}
+	return nil
+}
+
+// startAll launches every autostart container in dependency order and waits
+// for all of them, so a single service unit can supervise the whole set. A
+// container others depend on is waited for until it runs; those depending
+// on one that does not are skipped.
+func startAll() error {
+	entries, err := loadAutostart()
+	if err != nil {
+		return err
+	}
+	order, err := startOrder(entries)
+	if err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot resolve shp executable: %w", err)
+	}
+
+	needed := make(map[string]bool)
+	for _, e := range order {
+		for _, dep := range e.After {
+			needed[dep] = true
+		}
+	}
+	failed := make(map[string]bool)
+	var wg sync.WaitGroup
+next:
+	for _, e := range order {
+		for _, dep := range e.After {
+			if failed[dep] {
+				fmt.Printf("Warning: not starting %s: %s is not running\n", e.Name, dep)
+				failed[e.Name] = true
+				continue next
+			}
+		}
+		cmd := exec.Command(self, append([]string{"run"}, e.Args...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			fmt.Printf("Warning: starting %s failed: %v\n", e.Name, err)
+			failed[e.Name] = true
+			continue
+		}
+		fmt.Printf("Started %s (pid %d)\n", e.Name, cmd.Process.Pid)
+
+		exited := make(chan struct{})
+		wg.Add(1)
+		go func(name string, cmd *exec.Cmd) {
+			defer wg.Done()
+			if err := cmd.Wait(); err != nil {
+				fmt.Printf("Warning: %s exited: %v\n", name, err)
+			}
+			close(exited)
+		}(e.Name, cmd)
+		if needed[e.Name] {
+			if err := awaitRunning(e.Name, exited); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				failed[e.Name] = true
+			}
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// awaitRunning waits until the container name is recorded as running. It
+// fails if its run exits first or takes longer than autostartTimeout.
+func awaitRunning(name string, exited <-chan struct{}) error {
+	deadline := time.Now().Add(autostartTimeout)
+	for {
+		if st, err := findContainer(name); err == nil && processAlive(st.PID) {
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("%s exited before it was running", name)
+		default:
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s to run", name)
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const benchUsage = "usage: shp bench start [--iterations N] [run flags] <rootfs_path> <cmd> [options]"
+
+// benchPhases are reported in order; each phase spans from its start event
+// to the next one.
+var benchPhases = []string{"spawn", phaseValidate, phaseIsolate, phaseMount, phaseStarted, "total"}
+
+func bench(args []string) {
+	if len(args) < 1 || args[0] != "start" {
+		fmt.Println(benchUsage)
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	iterations := fs.Int("iterations", 10, "number of containers to start")
+	if err := fs.Parse(args[1:]); err != nil || *iterations < 1 || fs.NArg() < 2 {
+		fmt.Println(benchUsage)
+		os.Exit(1)
+	}
+	handle(benchStart(*iterations, fs.Args()))
+}
+
+// benchStart runs a container iterations times and prints latency
+// percentiles per phase, using the timestamps of the JSON progress events.
+func benchStart(iterations int, runArgs []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot resolve shp executable: %w", err)
+	}
+
+	samples := make(map[string][]time.Duration)
+	for i := 0; i < iterations; i++ {
+		timings, err := benchOnce(self, runArgs)
+		if err != nil {
+			return fmt.Errorf("iteration %d: %w", i+1, err)
+		}
+		for phase, d := range timings {
+			samples[phase] = append(samples[phase], d)
+		}
+	}
+
+	fmt.Printf("%-10s %10s %10s %10s %10s\n", "PHASE", "P50", "P90", "P99", "MAX")
+	for _, phase := range benchPhases {
+		ds := samples[phase]
+		if len(ds) == 0 {
+			continue
+		}
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		fmt.Printf("%-10s %10s %10s %10s %10s\n", phase,
+			percentile(ds, 50), percentile(ds, 90), percentile(ds, 99), ds[len(ds)-1])
+	}
+	return nil
+}
+
+func benchOnce(self string, runArgs []string) (map[string]time.Duration, error) {
+	cmd := exec.Command(self, append([]string{"run", "--progress", progressJSON}, runArgs...)...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	events := map[string]time.Time{"spawn": start}
+	s := bufio.NewScanner(stderr)
+	for s.Scan() {
+		var ev progressEvent
+		if line := s.Text(); strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &ev) == nil {
+			events[ev.Phase] = ev.Time
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	end := time.Now()
+
+	timings := map[string]time.Duration{"total": end.Sub(start)}
+	for i, phase := range benchPhases[:len(benchPhases)-1] {
+		from, ok := events[phase]
+		if !ok {
+			continue
+		}
+		to := end
+		if next := benchPhases[i+1]; next != "total" {
+			if t, ok := events[next]; ok {
+				to = t
+			}
+		}
+		timings[phase] = to.Sub(from)
+	}
+	return timings, nil
+}
+
+// percentile returns the p-th percentile of sorted durations (nearest rank).
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,150 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const blobsDir = "blobs"
+
+// blobStore is a content-addressable store for image content, keyed by
+// sha256 digest. It is safe for concurrent use by multiple goroutines and
+// multiple shp processes: fetches of the same digest are serialized with a
+// per-digest file lock, so only the first caller downloads and every waiter
+// shares the verified result.
+type blobStore struct {
+	root  string
+	slots string
+
+	limits  pullLimits
+	limiter *rateLimiter
+}
+
+func newBlobStore(root string) *blobStore {
+	return &blobStore{root: filepath.Join(root, blobsDir), slots: filepath.Join(root, pullSlotsDir)}
+}
+
+// limit throttles the downloads of the store from now on.
+func (s *blobStore) limit(limits pullLimits) {
+	s.limits, s.limiter = limits, nil
+	if limits.Bandwidth <= 0 {
+		return
+	}
+	rate := limits.Bandwidth
+	if limits.Concurrent > 0 {
+		rate /= int64(limits.Concurrent)
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	s.limiter = newRateLimiter(rate)
+}
+
+// path returns the location of a blob given a digest like "sha256:<hex>".
+func (s *blobStore) path(digest string) (string, error) {
+	algo, hexsum, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" || len(hexsum) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest: %q", digest)
+	}
+	if _, err := hex.DecodeString(hexsum); err != nil {
+		return "", fmt.Errorf("invalid digest: %q", digest)
+	}
+	return filepath.Join(s.root, algo, hexsum), nil
+}
+
+// has reports whether the blob for digest is already stored.
+func (s *blobStore) has(digest string) bool {
+	path, err := s.path(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// ensure returns the path of the blob for digest, calling fetch to download
+// it if it is not stored yet. The content written by fetch is verified
+// against the digest before it becomes visible, so a failed or corrupt
+// download never poisons the store.
+func (s *blobStore) ensure(digest string, fetch func(w io.Writer) error) (string, error) {
+	path, err := s.path(digest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("cannot create blob directory: %w", err)
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Another caller may have completed the fetch while we waited
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if s.limits.Concurrent > 0 {
+		release, err := acquirePullSlot(s.slots, s.limits.Concurrent)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temporary blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	var w io.Writer = io.MultiWriter(tmp, h)
+	if s.limiter != nil {
+		w = s.limiter.writer(w)
+	}
+	if err := fetch(w); err != nil {
+		return "", fmt.Errorf("fetching %s failed: %w", digest, err)
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		return "", fmt.Errorf("digest mismatch: expected %s, got %s", digest, got)
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", fmt.Errorf("cannot sync blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("cannot commit blob: %w", err)
+	}
+	return path, nil
+}
+
+// lockFile takes an exclusive flock on path, blocking until it is
+// available, and returns a function releasing it.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock %s: %w", path, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
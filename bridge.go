@@ -0,0 +1,275 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	networkIsolatedEgress = "isolated-egress"
+	networkBridge         = "bridge"
+
+	bridgeName   = "shp0"
+	bridgeSubnet = "10.88.0.0/16"
+	ipFile       = "ip"
+	ipamLock     = "ipam.lock"
+	ipForward    = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// netAttachment is a container's connection to a network: the host end of
+// its veth pair on bridge networks, an address leased by the network's IPAM
+// driver and the firewall rules programmed for it.
+type netAttachment struct {
+	id       string
+	hostVeth string
+	ip       net.IP
+	lease    *ipLease
+	rules    [][]string
+}
+
+// runIP runs a sequence of ip commands.
+func runIP(cmds [][]string) error {
+	for _, args := range cmds {
+		if err := runTool("ip", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTool runs a host tool such as ip, iptables or btrfs.
+func runTool(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), msg)
+	}
+	return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+}
+
+func nextIP(ip net.IP) net.IP {
+	v := binary.BigEndian.Uint32(ip.To4())
+	out := make(net.IP, 4)
+	binary.BigEndian.PutUint32(out, v+1)
+	return out
+}
+
+// ensureBridge creates and configures the host bridge of a bridge network
+// and the NAT rule for its subnet if they do not exist yet.
+func ensureBridge(n *networkConfig, addr *netAddressing) error {
+	if _, err := net.InterfaceByName(n.Name); err != nil {
+		if err := runTool("ip", "link", "add", n.Name, "type", "bridge"); err != nil {
+			return err
+		}
+	}
+	if err := runTool("ip", "addr", "replace", fmt.Sprintf("%s/%d", addr.gateway, addr.prefixLen()), "dev", n.Name); err != nil {
+		return err
+	}
+	if err := runTool("ip", "link", "set", n.Name, "up"); err != nil {
+		return err
+	}
+	if err := os.WriteFile(ipForward, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("cannot enable IP forwarding: %w", err)
+	}
+	masquerade := masqueradeRule(n)
+	if runTool("iptables", ruleArgs("-C", masquerade)...) == nil {
+		return nil
+	}
+	return runTool("iptables", ruleArgs("-A", masquerade)...)
+}
+
+func masqueradeRule(n *networkConfig) []string {
+	return []string{"-t", "nat", "POSTROUTING", "-s", n.Subnet, "!", "-o", n.Name, "-j", "MASQUERADE"}
+}
+
+// ruleArgs places an iptables command such as -A before the chain of rule,
+// after an optional leading "-t table".
+func ruleArgs(op string, rule []string) []string {
+	if len(rule) > 2 && rule[0] == "-t" {
+		return append([]string{rule[0], rule[1], op}, rule[2:]...)
+	}
+	return append([]string{op}, rule...)
+}
+
+// attachNetwork connects the network namespace of pid to the network that
+// mode (a --network value) refers to. In isolated-egress mode the container
+// may open outbound connections through NAT, but nothing can connect to it:
+// its bridge port is isolated from the other containers' and new inbound
+// connections are rejected. On bridged networks, connections to the
+// published ports are forwarded to the container.
+func attachNetwork(id string, pid int, mode string, publish []portMapping) (*netAttachment, error) {
+	n, err := lookupNetwork(mode)
+	if err != nil {
+		return nil, err
+	}
+	ipam, err := newIPAM(n)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureNetwork(n); err != nil {
+		return nil, err
+	}
+
+	a := &netAttachment{id: id}
+	if err := a.setup(pid, n, ipam, mode == networkIsolatedEgress); err != nil {
+		a.detach()
+		return nil, err
+	}
+	if n.bridged() {
+		if err := a.publish(publish); err != nil {
+			a.detach()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// ensureNetwork sets up the host side of a network shared by its containers.
+func ensureNetwork(n *networkConfig) error {
+	unlock, err := lockFile(filepath.Join(runtimeDir, ipamLock))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !n.bridged() {
+		if _, err := ensureParent(n.Parent); err != nil {
+			return fmt.Errorf("cannot set up parent interface %s: %w", n.Parent, err)
+		}
+		return nil
+	}
+	addr, err := n.addressing()
+	if err != nil {
+		return err
+	}
+	if err := ensureBridge(n, addr); err != nil {
+		return fmt.Errorf("cannot set up bridge %s: %w", n.Name, err)
+	}
+	if n.Driver == driverWireGuard {
+		if err := ensureWireGuard(n); err != nil {
+			return fmt.Errorf("cannot set up wireguard mesh %s: %w", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// createLink creates the container's interface on the host side, named
+// link, and returns the name of the host end of a veth pair if there is one.
+func createLink(n *networkConfig, id, link string) (string, error) {
+	switch n.Driver {
+	case driverMacvlan:
+		// Bridge mode lets containers on the same parent reach each other
+		return "", runTool("ip", "link", "add", link, "link", n.Parent, "type", "macvlan", "mode", "bridge")
+	case driverIPvlan:
+		return "", runTool("ip", "link", "add", link, "link", n.Parent, "type", "ipvlan", "mode", "l2")
+	}
+	hostVeth := "shp" + id[:8]
+	if err := runTool("ip", "link", "add", hostVeth, "type", "veth", "peer", "name", link); err != nil {
+		return "", err
+	}
+	return hostVeth, runTool("ip", "link", "set", hostVeth, "master", n.Name, "up")
+}
+
+// setup moves the container's interface into its network namespace as eth0,
+// and addresses it once it is up, so that DHCP can run on it.
+func (a *netAttachment) setup(pid int, n *networkConfig, ipam ipamDriver, isolated bool) error {
+	link := "shpc" + a.id[:8]
+	hostVeth, err := createLink(n, a.id, link)
+	a.hostVeth = hostVeth
+	if err != nil {
+		if hostVeth == "" {
+			runTool("ip", "link", "del", link)
+		}
+		return err
+	}
+	if err := runTool("ip", "link", "set", link, "netns", fmt.Sprint(pid)); err != nil {
+		if hostVeth == "" {
+			runTool("ip", "link", "del", link)
+		}
+		return err
+	}
+
+	err = inNetns(pid, func() error {
+		return runIP([][]string{
+			{"link", "set", "lo", "up"},
+			{"link", "set", link, "name", "eth0"},
+			{"link", "set", "eth0", "up"},
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("cannot configure container network: %w", err)
+	}
+
+	lease, err := ipam.allocate(a.id, pid)
+	if err != nil {
+		return err
+	}
+	a.lease, a.ip = lease, lease.ip
+	cmds := [][]string{{"addr", "add", fmt.Sprintf("%s/%d", lease.ip, lease.prefixLen), "dev", "eth0"}}
+	if lease.gateway != nil {
+		cmds = append(cmds, []string{"route", "add", "default", "via", lease.gateway.String()})
+	}
+	if err := inNetns(pid, func() error { return runIP(cmds) }); err != nil {
+		return fmt.Errorf("cannot configure container network: %w", err)
+	}
+
+	if !isolated {
+		return nil
+	}
+	if err := runTool("bridge", "link", "set", "dev", a.hostVeth, "isolated", "on"); err != nil {
+		return err
+	}
+	// Replies to the container's own connections are ESTABLISHED, anything
+	// else addressed to it is inbound, whether routed or from the host
+	inbound := []string{"-d", a.ip.String(), "-m", "conntrack", "!", "--ctstate", "ESTABLISHED,RELATED",
+		"-m", "comment", "--comment", "shp:" + a.id, "-j", "REJECT"}
+	for _, chain := range []string{"FORWARD", "OUTPUT"} {
+		rule := append([]string{chain}, inbound...)
+		if err := runTool("iptables", ruleArgs("-I", rule)...); err != nil {
+			return err
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return nil
+}
+
+// detach releases the address lease and removes the host side of the
+// attachment. Macvlan and ipvlan links go away with the container's network
+// namespace.
+func (a *netAttachment) detach() {
+	if a.lease != nil && a.lease.release != nil {
+		a.lease.release()
+	}
+	for _, rule := range a.rules {
+		if err := runTool("iptables", ruleArgs("-D", rule)...); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+	// Deleting one end removes the pair; it is already gone if the
+	// container's network namespace was destroyed first
+	if a.hostVeth == "" {
+		return
+	}
+	if _, err := net.InterfaceByName(a.hostVeth); err == nil {
+		runTool("ip", "link", "del", a.hostVeth)
+	}
+}
+
+// waitNetwork blocks the child until run has attached its network namespace.
+// run closes the sync pipe without writing if the attachment failed.
+func waitNetwork(sync *os.File) error {
+	defer sync.Close()
+	if _, err := sync.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("network setup failed")
+	}
+	return nil
+}
@@ -0,0 +1,529 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	bundleUsage = `usage: shp bundle export [--sign-key keyref] [--volumes] <image|container> <bundle.shp>
+       shp bundle import [--verify-key keyref] [--volumes-root dir] <bundle.shp>
+       shp bundle keygen <name>`
+
+	bundleVersion        = 1
+	bundleManifestEntry  = "bundle.json"
+	bundleSignatureEntry = "bundle.sig"
+	bundleBlobsDir       = "blobs/"
+	bundleVolumesDir     = "volumes/"
+)
+
+// bundleManifest is the first entry of a bundle. It lists the digest of
+// every other entry, so a signature over it covers the whole bundle.
+type bundleManifest struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	Image   storedImage    `json:"image"`
+	Blobs   []string       `json:"blobs"`
+	Volumes []bundleVolume `json:"volumes,omitempty"`
+}
+
+// bundleVolume is a volume of an exported container, stored as a
+// gzip-compressed tarball.
+type bundleVolume struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Digest string `json:"digest"`
+}
+
+func bundle(args []string) {
+	if len(args) < 1 {
+		fmt.Println(bundleUsage)
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	switch args[0] {
+	case "export":
+		signKey := fs.String("sign-key", "", "key reference of the Ed25519 private key to sign the bundle with")
+		volumes := fs.Bool("volumes", false, "include the volumes of a container")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 2 {
+			fmt.Println(bundleUsage)
+			os.Exit(1)
+		}
+		var signer ed25519.PrivateKey
+		if *signKey != "" {
+			seed, err := loadLayerKey(*signKey)
+			handle(err)
+			signer = ed25519.NewKeyFromSeed(seed)
+		}
+		handle(exportBundle(fs.Arg(0), fs.Arg(1), signer, *volumes))
+	case "import":
+		verifyKey := fs.String("verify-key", "", "key reference of the Ed25519 public key the bundle must be signed with")
+		volumesRoot := fs.String("volumes-root", "", "restore volumes below this directory instead of their original paths")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+			fmt.Println(bundleUsage)
+			os.Exit(1)
+		}
+		var key ed25519.PublicKey
+		if *verifyKey != "" {
+			k, err := loadLayerKey(*verifyKey)
+			handle(err)
+			key = ed25519.PublicKey(k)
+		}
+		handle(importBundle(fs.Arg(0), key, *volumesRoot))
+	case "keygen":
+		if len(args) != 2 {
+			fmt.Println(bundleUsage)
+			os.Exit(1)
+		}
+		handle(bundleKeygen(args[1]))
+	default:
+		fmt.Println(bundleUsage)
+		os.Exit(1)
+	}
+}
+
+// exportBundle writes a pulled image, or the image of a running container,
+// to the new file out. A container started from a directory is exported as
+// a single-layer image of its rootfs.
+func exportBundle(src, out string, signer ed25519.PrivateKey, withVolumes bool) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(out), ".shp-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	store := newBlobStore(imagesRoot())
+	// files maps the digest of every blob and volume to its content
+	files := make(map[string]string)
+	b := &bundleManifest{Version: bundleVersion, Created: time.Now()}
+	img, err := lookupImage(src)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		st, err := findContainer(src)
+		if err != nil {
+			return fmt.Errorf("no such image or container: %s", src)
+		}
+		if st.Image != "" {
+			if img, err = lookupImage(st.Image); err != nil {
+				return err
+			} else if img == nil {
+				return fmt.Errorf("image %s of container %s is no longer pulled", st.Image, st.ID)
+			}
+		} else if img, err = squashContainer(st, tmp, files); err != nil {
+			return err
+		}
+		if withVolumes {
+			for i, v := range st.Volumes {
+				path := filepath.Join(tmp, "volume-"+strconv.Itoa(i))
+				if _, err := exportLayer(v.Source, path, "", nil); err != nil {
+					return fmt.Errorf("cannot export volume %s: %w", v.Source, err)
+				}
+				digest, err := fileDigest(path)
+				if err != nil {
+					return err
+				}
+				files[digest] = path
+				b.Volumes = append(b.Volumes, bundleVolume{Source: v.Source, Target: v.Target, Digest: digest})
+			}
+		}
+	} else if withVolumes {
+		return fmt.Errorf("--volumes requires a container")
+	}
+	b.Image = *img
+
+	if _, ok := files[img.Digest]; !ok {
+		path, err := store.path(img.Digest)
+		if err != nil {
+			return err
+		}
+		files[img.Digest] = path
+	}
+	m, err := readManifestBlob(files[img.Digest])
+	if err != nil {
+		return err
+	}
+	b.Blobs = []string{img.Digest, m.Config.Digest}
+	for _, l := range m.Layers {
+		b.Blobs = append(b.Blobs, l.Digest)
+	}
+	for _, d := range b.Blobs[1:] {
+		if _, ok := files[d]; ok {
+			continue
+		}
+		if files[d], err = store.path(d); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = createFile(out, func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		if err := writeBundleEntry(tw, bundleManifestEntry, data); err != nil {
+			return err
+		}
+		if signer != nil {
+			if err := writeBundleEntry(tw, bundleSignatureEntry, ed25519.Sign(signer, data)); err != nil {
+				return err
+			}
+		}
+		for _, d := range b.Blobs {
+			if err := writeBundleFile(tw, bundleBlobsDir+strings.TrimPrefix(d, "sha256:"), files[d]); err != nil {
+				return err
+			}
+		}
+		for i, v := range b.Volumes {
+			if err := writeBundleFile(tw, bundleVolumesDir+strconv.Itoa(i), files[v.Digest]); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %s to %s\n", img.Ref, out)
+	return nil
+}
+
+// squashContainer exports the rootfs of a container as the single layer of
+// an image named localhost/shp/<container>, leaving its blobs in dir.
+func squashContainer(st *containerState, dir string, files map[string]string) (*storedImage, error) {
+	layer := filepath.Join(dir, "layer")
+	if _, err := exportLayer(st.Rootfs, layer, "", nil); err != nil {
+		return nil, err
+	}
+	layerDigest, err := fileDigest(layer)
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := uncompressedDigest(layer)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(layer)
+	if err != nil {
+		return nil, err
+	}
+	files[layerDigest] = layer
+
+	config := map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           runtime.GOOS,
+		"created":      time.Now().UTC(),
+		"config":       map[string]interface{}{},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}},
+	}
+	configDesc, err := writeBlobJSON(dir, "config", config, files)
+	if err != nil {
+		return nil, err
+	}
+	configDesc.MediaType = "application/vnd.oci.image.config.v1+json"
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIManifest,
+		"config":        configDesc,
+		"layers":        []ociDescriptor{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layerDigest, Size: fi.Size()}},
+	}
+	manifestDesc, err := writeBlobJSON(dir, "manifest", manifest, files)
+	if err != nil {
+		return nil, err
+	}
+	name := st.Name
+	if name == "" {
+		name = st.ID
+	}
+	r, err := parseImageRef("localhost/shp/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return &storedImage{
+		Ref:    r.String(),
+		Digest: manifestDesc.Digest,
+		Pulled: time.Now(),
+		Blobs:  []string{manifestDesc.Digest, configDesc.Digest, layerDigest},
+	}, nil
+}
+
+func writeBlobJSON(dir, name string, v interface{}, files map[string]string) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return ociDescriptor{}, err
+	}
+	sum := sha256.Sum256(data)
+	d := ociDescriptor{Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	files[d.Digest] = path
+	return d, nil
+}
+
+func readManifestBlob(path string) (*ociManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	m := &ociManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %w", err)
+	}
+	return m, nil
+}
+
+// uncompressedDigest returns the digest of a gzip-compressed layer's tar,
+// its diff ID.
+func uncompressedDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, gz); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeBundleEntry(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeBundleFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// importBundle adds the image of a bundle to the image store and restores
+// its volumes. With a key, the bundle must carry a valid signature by it.
+// Every blob and volume is verified against the digest in the manifest.
+func importBundle(path string, key ed25519.PublicKey, volumesRoot string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != bundleManifestEntry {
+		return fmt.Errorf("%s is not a bundle", path)
+	}
+	data, err := io.ReadAll(io.LimitReader(tr, maxManifestSize))
+	if err != nil {
+		return err
+	}
+	hdr, err = tr.Next()
+	var sig []byte
+	if err == nil && hdr.Name == bundleSignatureEntry {
+		if sig, err = io.ReadAll(io.LimitReader(tr, ed25519.SignatureSize)); err != nil {
+			return err
+		}
+		hdr, err = tr.Next()
+	}
+	switch {
+	case key == nil:
+		fmt.Printf("Warning: the signature of %s is not verified, pass --verify-key\n", path)
+	case sig == nil:
+		return fmt.Errorf("bundle %s is not signed", path)
+	case len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, data, sig):
+		return fmt.Errorf("bundle %s has an invalid signature", path)
+	}
+
+	b := &bundleManifest{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return fmt.Errorf("cannot parse bundle manifest: %w", err)
+	}
+	if b.Version != bundleVersion {
+		return fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	r, err := parseImageRef(b.Image.Ref)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Images.checkRef(r); err != nil {
+		return err
+	}
+	if err := cfg.Images.checkDigests(r, b.Blobs...); err != nil {
+		return err
+	}
+	if len(b.Blobs) == 0 || b.Blobs[0] != b.Image.Digest {
+		return fmt.Errorf("bundle manifest does not list the image manifest first")
+	}
+	blobs := make(map[string]string, len(b.Blobs))
+	for _, d := range b.Blobs {
+		blobs[bundleBlobsDir+strings.TrimPrefix(d, "sha256:")] = d
+	}
+
+	store := newBlobStore(imagesRoot())
+	for ; err == nil; hdr, err = tr.Next() {
+		if d, ok := blobs[hdr.Name]; ok {
+			if _, err := store.ensure(d, func(w io.Writer) error {
+				_, err := io.Copy(w, tr)
+				return err
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		i, perr := strconv.Atoi(strings.TrimPrefix(hdr.Name, bundleVolumesDir))
+		if !strings.HasPrefix(hdr.Name, bundleVolumesDir) || perr != nil || i < 0 || i >= len(b.Volumes) {
+			return fmt.Errorf("unexpected bundle entry %s", hdr.Name)
+		}
+		if err := restoreVolume(b.Volumes[i], tr, volumesRoot); err != nil {
+			return err
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	for _, d := range b.Blobs {
+		if !store.has(d) {
+			return fmt.Errorf("bundle lacks blob %s", d)
+		}
+	}
+
+	manifestPath, err := store.path(b.Image.Digest)
+	if err != nil {
+		return err
+	}
+	m, err := readManifestBlob(manifestPath)
+	if err != nil {
+		return err
+	}
+	img := b.Image
+	img.Ref, img.Pulled, img.Blobs = r.String(), time.Now(), b.Blobs
+	if err := ensureRootfs(store, &img, m.Layers, nil); err != nil {
+		return err
+	}
+	if err := updateImageIndex(func(index map[string]*storedImage) error {
+		index[img.Ref] = &img
+		return nil
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %s (%s)\n", img.Ref, img.Digest)
+	return nil
+}
+
+// restoreVolume extracts a volume to its source path, below root if set.
+// It refuses to replace a directory that is not empty.
+func restoreVolume(v bundleVolume, r io.Reader, root string) error {
+	dest := v.Source
+	if root != "" {
+		dest = filepath.Join(root, v.Source)
+	}
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+		return fmt.Errorf("cannot restore volume %s: %s is not empty", v.Source, dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dest), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+	gz, err := gzip.NewReader(tee)
+	if err != nil {
+		return fmt.Errorf("cannot restore volume %s: %w", v.Source, err)
+	}
+	if err := applyLayer(tmp, gz); err != nil {
+		return fmt.Errorf("cannot restore volume %s: %w", v.Source, err)
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != v.Digest {
+		return fmt.Errorf("volume %s: digest mismatch: expected %s, got %s", v.Source, v.Digest, got)
+	}
+	os.Remove(dest)
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("cannot restore volume %s: %w", v.Source, err)
+	}
+	fmt.Printf("Restored volume %s, mount it with -v %s:%s\n", v.Source, dest, v.Target)
+	return nil
+}
+
+// bundleKeygen writes a new Ed25519 key pair for signing bundles to
+// <name>.key and <name>.pub, hex-encoded for use with file: references.
+func bundleKeygen(name string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	err = createFile(name+".key", func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, hex.EncodeToString(priv.Seed()))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = createFile(name+".pub", func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, hex.EncodeToString(pub))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(name+".pub", 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s.key and %s.pub\n", name, name)
+	return nil
+}
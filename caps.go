@@ -0,0 +1,154 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	capLastCapPath = "/proc/sys/kernel/cap_last_cap"
+	prCapbsetDrop  = 24 // PR_CAPBSET_DROP
+)
+
+// capabilities maps capability names (without the CAP_ prefix) to their
+// numbers, see capabilities(7).
+var capabilities = map[string]int{
+	"CHOWN":              0,
+	"DAC_OVERRIDE":       1,
+	"DAC_READ_SEARCH":    2,
+	"FOWNER":             3,
+	"FSETID":             4,
+	"KILL":               5,
+	"SETGID":             6,
+	"SETUID":             7,
+	"SETPCAP":            8,
+	"LINUX_IMMUTABLE":    9,
+	"NET_BIND_SERVICE":   10,
+	"NET_BROADCAST":      11,
+	"NET_ADMIN":          12,
+	"NET_RAW":            13,
+	"IPC_LOCK":           14,
+	"IPC_OWNER":          15,
+	"SYS_MODULE":         16,
+	"SYS_RAWIO":          17,
+	"SYS_CHROOT":         18,
+	"SYS_PTRACE":         19,
+	"SYS_PACCT":          20,
+	"SYS_ADMIN":          21,
+	"SYS_BOOT":           22,
+	"SYS_NICE":           23,
+	"SYS_RESOURCE":       24,
+	"SYS_TIME":           25,
+	"SYS_TTY_CONFIG":     26,
+	"MKNOD":              27,
+	"LEASE":              28,
+	"AUDIT_WRITE":        29,
+	"AUDIT_CONTROL":      30,
+	"SETFCAP":            31,
+	"MAC_OVERRIDE":       32,
+	"MAC_ADMIN":          33,
+	"SYSLOG":             34,
+	"WAKE_ALARM":         35,
+	"BLOCK_SUSPEND":      36,
+	"AUDIT_READ":         37,
+	"PERFMON":            38,
+	"BPF":                39,
+	"CHECKPOINT_RESTORE": 40,
+}
+
+// defaultCapabilities is the set the workload keeps once setup is done,
+// matching Docker's defaults.
+var defaultCapabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD", "NET_RAW",
+	"SETGID", "SETUID", "SETFCAP", "SETPCAP", "NET_BIND_SERVICE",
+	"SYS_CHROOT", "KILL", "AUDIT_WRITE",
+}
+
+// parseCapabilities parses a comma-separated list of capability names,
+// with or without the CAP_ prefix, in which ALL stands for every one.
+func parseCapabilities(v string) ([]string, error) {
+	var caps []string
+	for _, name := range splitList(v) {
+		name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+		if _, ok := capabilities[name]; !ok && name != capAll {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, name)
+	}
+	return caps, nil
+}
+
+// adjustCapabilities returns the bounding set set without drop and with
+// add, applied in that order like Docker's --cap-drop and --cap-add.
+func adjustCapabilities(set, add, drop []string) []string {
+	dropped := make(map[string]bool, len(drop))
+	for _, name := range drop {
+		if name == capAll {
+			set = nil
+		}
+		dropped[name] = true
+	}
+	out := []string{}
+	seen := make(map[string]bool)
+	keep := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	for _, name := range set {
+		if !dropped[name] {
+			keep(name)
+		}
+	}
+	for _, name := range add {
+		if name == capAll {
+			for c := range capabilities {
+				keep(c)
+			}
+			continue
+		}
+		keep(name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// lastCap returns the highest capability number known to the kernel.
+func lastCap() (int, error) {
+	data, err := os.ReadFile(capLastCapPath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %w", capLastCapPath, err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// pruneBoundingSet drops every capability not in keep from the bounding set
+// of the calling thread. It runs after all privileged setup, so the command
+// forked from this thread never inherits setup-era privileges such as
+// CAP_SYS_ADMIN.
+func pruneBoundingSet(keep []string) error {
+	last, err := lastCap()
+	if err != nil {
+		return err
+	}
+	kept := make(map[int]bool, len(keep))
+	for _, name := range keep {
+		kept[capabilities[name]] = true
+	}
+	for c := 0; c <= last; c++ {
+		if kept[c] {
+			continue
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(c), 0); errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("cannot drop capability %d from bounding set: %w", c, errno)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	captureUsage = "usage: shp capture [-o <dir>] <container>"
+
+	captureRecordFile   = "capture.json"
+	captureManifestFile = "rootfs.manifest"
+	captureRootfsFile   = "rootfs.tar.gz"
+	captureSumsFile     = "SHA256SUMS"
+)
+
+// captureProcFiles are the files of /proc/<pid> kept for every process of
+// a captured container: the memory map listing, and what the process is.
+var captureProcFiles = []string{"cmdline", "status", "maps", "mountinfo"}
+
+// captureNetFiles are the socket tables of the container's network
+// namespace; the inodes in them match the socket:[inode] targets of the
+// processes' fds.
+var captureNetFiles = []string{"tcp", "tcp6", "udp", "udp6", "unix", "packet"}
+
+// captureRecord describes an evidence bundle and when its contents were
+// taken.
+type captureRecord struct {
+	Container string    `json:"container"`
+	Name      string    `json:"name,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Rootfs    string    `json:"rootfs"`
+	PID       int       `json:"pid"`
+	Processes []int     `json:"processes"`
+	Host      string    `json:"host"`
+	Frozen    time.Time `json:"frozen_at"`
+	// Thawed is unset if the container was paused before and stays so
+	Thawed *time.Time `json:"thawed_at,omitempty"`
+}
+
+func capture(args []string) {
+	fs := flag.NewFlagSet("capture", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var out string
+	fs.StringVar(&out, "o", "", "directory of the evidence bundle, which must not exist")
+	fs.StringVar(&out, "output", "", "directory of the evidence bundle, which must not exist")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Println(captureUsage)
+		os.Exit(1)
+	}
+	st, err := findContainer(fs.Arg(0))
+	handle(err)
+	if out == "" {
+		out = fmt.Sprintf("shp-capture-%s-%s", st.ID, time.Now().UTC().Format("20060102T150405Z"))
+	}
+	sum, err := captureContainer(st, out)
+	handle(err)
+	fmt.Printf("%s sha256:%s\n", out, sum)
+}
+
+// captureContainer freezes a container and writes an evidence bundle of it
+// to the new directory out: its processes' memory maps, open fds and
+// sockets, and its filesystem as the container sees it, with a manifest of
+// file digests. The container is thawed again unless it was paused before.
+// Every file of the bundle is listed in a SHA256SUMS file, whose digest is
+// returned to be recorded in the chain of custody.
+func captureContainer(st *containerState, out string) (string, error) {
+	if err := os.Mkdir(out, 0700); err != nil {
+		return "", fmt.Errorf("cannot create evidence bundle: %w", err)
+	}
+	host, _ := os.Hostname()
+	rec := captureRecord{Container: st.ID, Name: st.Name, Image: st.Image, Rootfs: st.Rootfs, PID: st.PID, Host: host}
+	paused := st.Status == statusPaused
+	if !paused {
+		if err := freezeContainer(st, true); err != nil {
+			return "", err
+		}
+	}
+	rec.Frozen = time.Now().UTC()
+	err := captureContents(st, out, &rec)
+	if !paused {
+		thawed := time.Now().UTC()
+		rec.Thawed = &thawed
+		if thawErr := freezeContainer(st, false); err == nil {
+			err = thawErr
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return sealCapture(out, rec)
+}
+
+// captureContents writes the processes and the filesystem of a frozen
+// container to the bundle out.
+func captureContents(st *containerState, out string, rec *captureRecord) error {
+	var err error
+	if rec.Processes, err = namespacePIDs(st.PID); err != nil {
+		return fmt.Errorf("cannot list processes of container %s: %w", st.ID, err)
+	}
+	for _, pid := range rec.Processes {
+		if err := captureProcess(filepath.Join(out, "processes", strconv.Itoa(pid)), pid); err != nil {
+			return err
+		}
+	}
+	netDir := filepath.Join(out, "net")
+	if err := os.Mkdir(netDir, 0700); err != nil {
+		return err
+	}
+	for _, name := range captureNetFiles {
+		if err := copyProcFile(filepath.Join(netDir, name), fmt.Sprintf("/proc/%d/net/%s", st.PID, name)); err != nil {
+			return err
+		}
+	}
+	return captureFilesystem(out, fmt.Sprintf("/proc/%d/root/", st.PID))
+}
+
+// captureProcess keeps the /proc files of a process in dir, and its
+// executable and open fds as "<fd> <target>" lines. A process that exited
+// since it was listed leaves what was read until then.
+func captureProcess(dir string, pid int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	proc := fmt.Sprintf("/proc/%d", pid)
+	for _, name := range captureProcFiles {
+		if err := copyProcFile(filepath.Join(dir, name), filepath.Join(proc, name)); err != nil {
+			return err
+		}
+	}
+	var b strings.Builder
+	if exe, err := os.Readlink(proc + "/exe"); err == nil {
+		fmt.Fprintf(&b, "exe %s\n", exe)
+	}
+	entries, _ := os.ReadDir(proc + "/fd")
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := strconv.Atoi(entries[i].Name())
+		b, _ := strconv.Atoi(entries[j].Name())
+		return a < b
+	})
+	for _, e := range entries {
+		if target, err := os.Readlink(filepath.Join(proc, "fd", e.Name())); err == nil {
+			fmt.Fprintf(&b, "%s %s\n", e.Name(), target)
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "fds"), []byte(b.String()), 0600)
+}
+
+// copyProcFile copies a /proc file, which has no size to copy by. A file
+// that does not exist is skipped.
+func copyProcFile(dst, src string) error {
+	data, err := os.ReadFile(src)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ESRCH) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot read %s: %w", src, err)
+	}
+	return os.WriteFile(dst, data, 0600)
+}
+
+// captureFilesystem archives the filesystem at root into the bundle,
+// together with its manifest. Sockets are listed in the manifest but
+// cannot be archived.
+func captureFilesystem(out, root string) error {
+	entries, err := buildManifest(root)
+	if err != nil {
+		return err
+	}
+	manifest := strings.Join(entries, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(out, captureManifestFile), []byte(manifest), 0600); err != nil {
+		return err
+	}
+	return createFile(filepath.Join(out, captureRootfsFile), func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, entry := range entries {
+			if strings.HasPrefix(entry, "special ") {
+				if info, err := os.Lstat(filepath.Join(root, manifestPath(entry))); err != nil || info.Mode()&os.ModeSocket != 0 {
+					continue
+				}
+			}
+			if err := writeTarEntry(tw, root, manifestPath(entry), nil); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+// sealCapture writes the record of a bundle and the digests of all its
+// files in the format of sha256sum, so `sha256sum -c SHA256SUMS` verifies
+// the bundle. It returns the hex digest of SHA256SUMS.
+func sealCapture(out string, rec captureRecord) (string, error) {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(out, captureRecordFile), append(data, '\n'), 0600); err != nil {
+		return "", err
+	}
+	var sums strings.Builder
+	err = filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(out, path)
+		if err != nil || rel == captureSumsFile {
+			return err
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", strings.TrimPrefix(digest, "sha256:"), filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(out, captureSumsFile), []byte(sums.String()), 0400); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(sums.String()))
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,191 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupParent        = "shp"
+	cgroupCPUPeriod     = 100000
+	cgroupRemoveTimeout = 5 * time.Second
+	// cgroupInit is the leaf below the container cgroup its processes run
+	// in. cgroup v2 only lets controllers be enabled for the children of a
+	// cgroup without processes, and exec sessions need that to have limits
+	// of their own.
+	cgroupInit = "init"
+)
+
+// cgroupControllers are the controllers enabled for container cgroups.
+var cgroupControllers = []string{"memory", "cpu", "pids"}
+
+// containerCgroup is the cgroup v2 group of a container below
+// /sys/fs/cgroup/shp, holding its resource limits. The container's init is
+// cloned directly into its init leaf, dir, so no container process ever
+// runs outside. Exec sessions with limits get temporary cgroups next to
+// the leaf, which the container's limits apply to as well.
+type containerCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// cgroupV2Available reports whether a cgroup v2 hierarchy is mounted at
+// /sys/fs/cgroup.
+func cgroupV2Available() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// createCgroup creates the cgroup of a container and applies its limits.
+// Without cgroup v2 it returns nil, or an error if limits were requested.
+func createCgroup(id string, limits resourceLimits, pidsLimit int64) (*containerCgroup, error) {
+	if !cgroupV2Available() {
+		if limits.memoryBytes > 0 || limits.cpus > 0 || pidsLimit > 0 {
+			return nil, fmt.Errorf("resource limits require cgroup v2 mounted at %s", cgroupRoot)
+		}
+		return nil, nil
+	}
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if err := os.Mkdir(parent, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("cannot create cgroup %s: %w", parent, err)
+	}
+	// Controllers must be enabled on every level above the container
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := enableControllers(dir); err != nil {
+			return nil, err
+		}
+	}
+	cg, err := newCgroup(filepath.Join(parent, id), limits, pidsLimit)
+	if err != nil {
+		return nil, err
+	}
+	if err := enableControllers(cg.path); err != nil {
+		cg.remove()
+		return nil, err
+	}
+	leaf := filepath.Join(cg.path, cgroupInit)
+	if err := os.Mkdir(leaf, 0755); err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("cannot create cgroup %s: %w", leaf, err)
+	}
+	dir, err := os.Open(leaf)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	cg.dir = dir
+	return cg, nil
+}
+
+// createSessionCgroup creates the temporary cgroup of an exec session in
+// the cgroup of a container, with limits of its own.
+func createSessionCgroup(container, session string, limits resourceLimits, pidsLimit int64) (*containerCgroup, error) {
+	return newCgroup(filepath.Join(container, "exec-"+session), limits, pidsLimit)
+}
+
+// newCgroup creates the cgroup at path and applies limits to it.
+func newCgroup(path string, limits resourceLimits, pidsLimit int64) (*containerCgroup, error) {
+	cg := &containerCgroup{path: path}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cgroup %s: %w", cg.path, err)
+	}
+	var settings [][2]string
+	if limits.memoryBytes > 0 {
+		settings = append(settings, [2]string{"memory.max", strconv.FormatInt(limits.memoryBytes, 10)})
+	}
+	if limits.cpus > 0 {
+		quota := int64(limits.cpus * cgroupCPUPeriod)
+		settings = append(settings, [2]string{"cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)})
+	}
+	if pidsLimit > 0 {
+		settings = append(settings, [2]string{"pids.max", strconv.FormatInt(pidsLimit, 10)})
+	}
+	for _, s := range settings {
+		if err := writeCgroupFile(cg.path, s[0], s[1]); err != nil {
+			cg.remove()
+			if errors.Is(err, os.ErrNotExist) {
+				controller, _, _ := strings.Cut(s[0], ".")
+				return nil, fmt.Errorf("the cgroup %s controller is not available", controller)
+			}
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// enableControllers enables the container controllers that dir offers for
+// its children.
+func enableControllers(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("cannot read controllers of %s: %w", dir, err)
+	}
+	available := strings.Fields(string(data))
+	for _, c := range cgroupControllers {
+		for _, a := range available {
+			if a != c {
+				continue
+			}
+			if err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_TRUNC, 0)
+	if err == nil {
+		_, err = f.WriteString(value)
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot set %s of %s: %w", name, dir, err)
+	}
+	return nil
+}
+
+// remove deletes the cgroup and those below it, killing processes that
+// are still in them. The kernel frees the processes of an exited container
+// asynchronously, so removal is retried for a while.
+func (cg *containerCgroup) remove() {
+	if cg.dir != nil {
+		cg.dir.Close()
+	}
+	// cgroup.kill exists since Linux 5.14
+	writeCgroupFile(cg.path, "cgroup.kill", "1")
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := removeCgroupTree(cg.path)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if err != syscall.EBUSY || time.Now().After(deadline) {
+			fmt.Printf("Warning: cannot remove cgroup %s: %v\n", cg.path, err)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// removeCgroupTree removes the cgroup at path, children first.
+func removeCgroupTree(path string) error {
+	entries, _ := os.ReadDir(path)
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := removeCgroupTree(filepath.Join(path, e.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return syscall.Rmdir(path)
+}
@@ -0,0 +1,224 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	commitUsage = `usage: shp commit [--reproducible] [--provenance file [--sign-key keyref]] --squash <rootfs_path> <out.tar.gz>
+       shp commit [--reproducible] [--provenance file [--sign-key keyref]] --diff-tar <base.manifest> <rootfs_path> <out.tar.gz>`
+
+	whiteoutPrefix = ".wh."
+)
+
+func commit(args []string) {
+	fs := flag.NewFlagSet("commit", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	squash := fs.Bool("squash", false, "export the whole rootfs as a single layer")
+	base := fs.String("diff-tar", "", "export only the changes against this base manifest")
+	reproducible := fs.Bool("reproducible", false, "make the layer byte-identical for identical rootfs contents and print its digest")
+	provenance := fs.String("provenance", "", "write an in-toto SLSA provenance statement of the layer to this file")
+	signKey := fs.String("sign-key", "", "key reference of the Ed25519 private key to sign the provenance with")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 || *squash == (*base != "") || *signKey != "" && *provenance == "" {
+		fmt.Println(commitUsage)
+		os.Exit(1)
+	}
+	var signer ed25519.PrivateKey
+	if *signKey != "" {
+		seed, err := loadLayerKey(*signKey)
+		handle(err)
+		signer = ed25519.NewKeyFromSeed(seed)
+	}
+	var mtime *time.Time
+	params := commitParameters{Reproducible: *reproducible}
+	if *reproducible {
+		epoch, err := sourceDateEpoch()
+		handle(err)
+		mtime = &epoch
+		sec := epoch.Unix()
+		params.SourceDateEpoch = &sec
+	}
+	started := time.Now()
+	manifest, err := exportLayer(fs.Arg(0), fs.Arg(1), *base, mtime)
+	handle(err)
+	if *reproducible {
+		sum, err := fileDigest(fs.Arg(1))
+		handle(err)
+		fmt.Println(sum)
+	}
+	if *provenance != "" {
+		params.Rootfs, err = filepath.Abs(fs.Arg(0))
+		handle(err)
+		if *base != "" {
+			params.BaseManifest, err = filepath.Abs(*base)
+			handle(err)
+		}
+		st, err := commitProvenance(fs.Arg(1), params, manifest, started, time.Now())
+		handle(err)
+		handle(writeProvenance(*provenance, st, signer))
+	}
+}
+
+// sourceDateEpoch returns the modification time of every entry of a
+// reproducible layer: $SOURCE_DATE_EPOCH, as is the convention of
+// reproducible builds, or the Unix epoch.
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Unix(0, 0), nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, fmt.Errorf("invalid $SOURCE_DATE_EPOCH: %q", v)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// exportLayer writes rootfs as a gzip-compressed OCI layer to out. With a
+// base manifest only added and modified entries are included, and removed
+// entries are recorded as ".wh.<name>" whiteouts, so the layer can be
+// applied on top of the base image. Entries are written in path order; a
+// non-nil mtime replaces their times and drops other host metadata, which
+// makes the layer depend on the rootfs contents only. The manifest of
+// rootfs is returned.
+func exportLayer(rootfs, out, baseManifest string, mtime *time.Time) ([]string, error) {
+	current, err := buildManifest(rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	var base map[string]string
+	if baseManifest != "" {
+		if base, err = readManifest(baseManifest); err != nil {
+			return nil, err
+		}
+	}
+
+	var changed, removed []string
+	seen := make(map[string]bool, len(current))
+	for _, line := range current {
+		p := manifestPath(line)
+		seen[p] = true
+		if base == nil || base[p] != line {
+			changed = append(changed, p)
+		}
+	}
+	for p := range base {
+		if !seen[p] {
+			removed = append(removed, p)
+		}
+	}
+	sort.Strings(removed)
+
+	err = createFile(out, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+
+		whited := make(map[string]bool)
+		for _, p := range removed {
+			// Whiting out a directory already hides everything below it
+			if whited[path.Dir(p)] || hasWhitedAncestor(whited, p) {
+				whited[p] = true
+				continue
+			}
+			whited[p] = true
+			hdr := &tar.Header{
+				Name:     strings.TrimPrefix(path.Join(path.Dir(p), whiteoutPrefix+path.Base(p)), "/"),
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+			}
+			if mtime != nil {
+				hdr.ModTime = *mtime
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		for _, p := range changed {
+			if err := writeTarEntry(tw, rootfs, p, mtime); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return current, nil
+}
+
+func hasWhitedAncestor(whited map[string]bool, p string) bool {
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		if whited[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTarEntry adds the rootfs entry at p (a "/"-rooted path) to tw,
+// preserving type, mode, ownership and, unless mtime is set, modification
+// time.
+func writeTarEntry(tw *tar.Writer, rootfs, p string, mtime *time.Time) error {
+	full := filepath.Join(rootfs, p)
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(full); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("cannot archive %s: %w", p, err)
+	}
+	hdr.Name = strings.TrimPrefix(p, "/")
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	if mtime != nil {
+		hdr.ModTime = *mtime
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.PAXRecords = nil
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
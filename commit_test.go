@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExportLayerReproducible(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc", "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("shp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "conf.d", "a"), []byte("a=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hostname", filepath.Join(rootfs, "etc", "name")); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	mtime := time.Unix(1700000000, 0)
+	first := filepath.Join(out, "first.tar.gz")
+	if _, err := exportLayer(rootfs, first, "", &mtime); err != nil {
+		t.Fatal(err)
+	}
+	// Host times must not leak into the layer
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(rootfs, "etc", "hostname"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	second := filepath.Join(out, "second.tar.gz")
+	if _, err := exportLayer(rootfs, second, "", &mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatalf("exports of the same rootfs differ: %d and %d bytes", len(a), len(b))
+	}
+}
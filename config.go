@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const defaultConfigPath = "/etc/shp/config.json"
+
+// config is the host-wide shp configuration. A missing file is equivalent
+// to an empty configuration.
+type config struct {
+	Images   imagePolicy                 `json:"images"`
+	DNS      dnsConfig                   `json:"dns"`
+	Profiles map[string]containerProfile `json:"profiles"`
+	Exec     execConfig                  `json:"exec"`
+	Quotas   quotaConfig                 `json:"quotas"`
+	// StateBackend stores state in files (the default) or in the kv backend
+	StateBackend string `json:"state_backend"`
+	// StorageDriver keeps image and container rootfs, see storageDriver
+	StorageDriver string `json:"storage_driver"`
+	// ZFSDataset is the parent dataset of the zfs storage driver
+	ZFSDataset string `json:"zfs_dataset"`
+	// ImagesDir replaces /var/lib/shp/images, see imagesRoot
+	ImagesDir string `json:"images_dir"`
+	// LayersDir holds the writable layers of overlay and vfs containers
+	// instead of their runtime directory
+	LayersDir string `json:"layers_dir"`
+}
+
+// loadConfig reads the configuration from $SHP_CONFIG or the default path.
+func loadConfig() (*config, error) {
+	path := os.Getenv("SHP_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+	cfg := &config{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse config %s: %w", path, err)
+	}
+	for _, dir := range []string{cfg.ImagesDir, cfg.LayersDir} {
+		if dir != "" && !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("config %s: directory %s must be absolute", path, dir)
+		}
+	}
+	return cfg, nil
+}
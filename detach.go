@@ -0,0 +1,169 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	detachedOutput    = "output.log"
+	readyPollInterval = 250 * time.Millisecond
+	readyDialTimeout  = time.Second
+
+	readyStarted = "started"
+	readyReady   = "ready"
+)
+
+// readyCheck is a --wait-ready condition: a TCP port the workload accepts
+// connections on, or a file it creates inside the container.
+type readyCheck struct {
+	tcp  string
+	file string
+}
+
+// parseReadyCheck parses tcp://[host]:port or file:///path. The host of a
+// TCP check defaults to the container's loopback address.
+func parseReadyCheck(v string) (*readyCheck, error) {
+	if addr, ok := strings.CutPrefix(v, "tcp://"); ok {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || port == "" {
+			return nil, fmt.Errorf("invalid readiness address %q", v)
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		return &readyCheck{tcp: net.JoinHostPort(host, port)}, nil
+	}
+	if path, ok := strings.CutPrefix(v, "file://"); ok && strings.HasPrefix(path, "/") {
+		return &readyCheck{file: path}, nil
+	}
+	return nil, fmt.Errorf("invalid readiness check %q, expected tcp://[host]:port or file:///path", v)
+}
+
+// ready probes the container whose init is pid. TCP checks connect from
+// inside the container's network namespace if it has its own.
+func (c *readyCheck) ready(pid int, ownNetns bool) bool {
+	if c.file != "" {
+		// Until the init has pivoted, its root is still the host's
+		root := fmt.Sprintf("/proc/%d/root", pid)
+		rootInfo, err := os.Stat(root)
+		hostInfo, herr := os.Stat("/")
+		if err != nil || herr != nil || os.SameFile(rootInfo, hostInfo) {
+			return false
+		}
+		_, err = os.Stat(root + c.file)
+		return err == nil
+	}
+	dial := func() error {
+		conn, err := net.DialTimeout("tcp", c.tcp, readyDialTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if ownNetns {
+		return inNetns(pid, dial) == nil
+	}
+	return dial() == nil
+}
+
+// reportReady tells a detaching run that the container started and, once
+// check passes, that it is ready. Closing w without a ready line means the
+// container exited first.
+func reportReady(w *os.File, check *readyCheck, pid int, ownNetns bool, exited <-chan struct{}) {
+	defer w.Close()
+	fmt.Fprintln(w, readyStarted)
+	if check == nil {
+		return
+	}
+	for !check.ready(pid, ownNetns) {
+		select {
+		case <-exited:
+			return
+		case <-time.After(readyPollInterval):
+		}
+	}
+	fmt.Fprintln(w, readyReady)
+}
+
+// runDetached starts the container in a background run and returns once it
+// started, or with --wait-ready once it is ready, printing its ID. Output of
+// the background run and the container goes to output.log in the runtime
+// directory unless --log-file is set.
+func runDetached(args []string, opts *runOptions) error {
+	id, err := newContainerID(opts.id)
+	if err != nil {
+		return err
+	}
+	if _, err := createRuntimeDir(id); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(scratchPath(id, detachedOutput), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		removeState(id)
+		return fmt.Errorf("cannot create output log: %w", err)
+	}
+	defer out.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		removeState(id)
+		return err
+	}
+	defer devNull.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		removeState(id)
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command("/proc/self/exe", append([]string{"run", "--container-id", id, "--ready-fd", "3"}, args...)...)
+	cmd.Stdin = devNull
+	cmd.Stdout, cmd.Stderr = out, out
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		removeState(id)
+		return err
+	}
+	cmd.Process.Release()
+
+	// The background run removes the runtime directory if it fails, but
+	// its output stays readable through out
+	failed := func(msg string) error {
+		out.Seek(0, io.SeekStart)
+		io.Copy(os.Stderr, out)
+		return fmt.Errorf("container %s %s", id, msg)
+	}
+	lines := bufio.NewReader(r)
+	if line, _ := lines.ReadString('\n'); strings.TrimSpace(line) != readyStarted {
+		removeState(id)
+		return failed("failed to start")
+	}
+	if opts.waitReady != nil {
+		r.SetReadDeadline(time.Now().Add(opts.readyTimeout))
+		line, err := lines.ReadString('\n')
+		if os.IsTimeout(err) {
+			if st, err := loadState(id); err == nil {
+				stopProcess(st.PID, st.StopTimeout)
+			}
+			return fmt.Errorf("container %s was not ready within %v and has been stopped", id, opts.readyTimeout)
+		}
+		if strings.TrimSpace(line) != readyReady {
+			return failed("exited before it became ready")
+		}
+	}
+	fmt.Println(id)
+	return nil
+}
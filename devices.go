@@ -0,0 +1,126 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// containerDevice is a character device created in the /dev of every
+// container.
+type containerDevice struct {
+	name         string
+	major, minor int64
+}
+
+// defaultDevices are the devices of Docker and runc containers. None of
+// them gives access to host hardware; /dev/tty is the controlling terminal
+// of the process opening it.
+var defaultDevices = []containerDevice{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// devSymlinks are the symlinks in /dev, by name.
+var devSymlinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"ptmx", "pts/ptmx"},
+}
+
+// setupDev mounts a tmpfs over /dev of rootfs and populates it, so
+// containers get the devices workloads expect whatever the rootfs holds.
+// It runs before volumes are mounted, which may add devices of their own.
+func setupDev(rootfs string, rootless bool) error {
+	dev, err := securePath(rootfs, "/dev")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return fmt.Errorf("cannot create /dev: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return fmt.Errorf("cannot mount /dev: %w", err)
+	}
+	for _, d := range defaultDevices {
+		if err := createDevice(dev, d); err != nil {
+			return fmt.Errorf("cannot create /dev/%s: %w", d.name, err)
+		}
+	}
+
+	// A private devpts instance, so the container cannot reach the
+	// terminals of the host. The tty group only exists for root.
+	pts := filepath.Join(dev, "pts")
+	ptsData := "newinstance,ptmxmode=0666,mode=0620"
+	if !rootless {
+		ptsData += ",gid=5"
+	}
+	if err := os.Mkdir(pts, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, ptsData); err != nil {
+		return fmt.Errorf("cannot mount /dev/pts: %w", err)
+	}
+	shm := filepath.Join(dev, "shm")
+	if err := os.Mkdir(shm, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777,size=65536k"); err != nil {
+		return fmt.Errorf("cannot mount /dev/shm: %w", err)
+	}
+	for _, l := range devSymlinks {
+		if err := os.Symlink(l[1], filepath.Join(dev, l[0])); err != nil {
+			return err
+		}
+	}
+	return bindConsole(dev)
+}
+
+// createDevice creates a device node in dev. In a user namespace device
+// nodes cannot be created, so the host's node is bind-mounted instead.
+func createDevice(dev string, d containerDevice) error {
+	path := filepath.Join(dev, d.name)
+	err := syscall.Mknod(path, syscall.S_IFCHR|0666, mkdev(d.major, d.minor))
+	if err == syscall.EPERM {
+		if err := os.WriteFile(path, nil, 0666); err != nil {
+			return err
+		}
+		return syscall.Mount(filepath.Join("/dev", d.name), path, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return err
+	}
+	// Mknod applies the umask
+	return os.Chmod(path, 0666)
+}
+
+// bindConsole makes the terminal the container was started on its
+// /dev/console, like runc. Without a terminal there is no console, as a
+// node for the host's console would let the container write to it.
+func bindConsole(dev string) error {
+	if !isTerminal(os.Stdin) {
+		return nil
+	}
+	tty, err := os.Readlink("/proc/self/fd/0")
+	if err != nil || !strings.HasPrefix(tty, "/dev/pts/") && !strings.HasPrefix(tty, "/dev/tty") {
+		return nil
+	}
+	console := filepath.Join(dev, "console")
+	if err := os.WriteFile(console, nil, 0600); err != nil {
+		return err
+	}
+	if err := syscall.Mount(tty, console, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("cannot bind %s to /dev/console: %w", tty, err)
+	}
+	return nil
+}
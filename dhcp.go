@@ -0,0 +1,287 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+	dhcpAttempts   = 3
+	dhcpWait       = 4 * time.Second
+	dhcpRetry      = time.Minute
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+
+	dhcpOptPad         = 0
+	dhcpOptSubnetMask  = 1
+	dhcpOptRouter      = 3
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMsgType     = 53
+	dhcpOptServerID    = 54
+	dhcpOptParamList   = 55
+	dhcpOptRenewalTime = 58
+	dhcpOptClientID    = 61
+	dhcpOptEnd         = 255
+
+	containerIf = "eth0"
+)
+
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+// dhcpIPAM obtains container addresses from the DHCP server on the LAN of
+// a macvlan network, so network admins keep control over addressing. The
+// client runs in the container's network namespace on behalf of the
+// container, renews the lease while the container runs and releases it
+// when it exits.
+type dhcpIPAM struct{}
+
+// dhcpReply holds the fields of a server message the client uses.
+type dhcpReply struct {
+	msgType   byte
+	yiaddr    net.IP
+	mask      net.IPMask
+	router    net.IP
+	server    net.IP
+	leaseTime time.Duration
+	renewTime time.Duration
+}
+
+// dhcpClient speaks DHCP through a socket bound to the container's eth0.
+// The socket also keeps the network namespace, and with it the interface,
+// alive after the container exited, so the lease can still be released.
+type dhcpClient struct {
+	conn *net.UDPConn
+	mac  net.HardwareAddr
+	xid  uint32
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (d *dhcpIPAM) allocate(id string, pid int) (*ipLease, error) {
+	c := &dhcpClient{stop: make(chan struct{}), done: make(chan struct{})}
+	err := inNetns(pid, func() error {
+		ifc, err := net.InterfaceByName(containerIf)
+		if err != nil {
+			return err
+		}
+		c.mac = ifc.HardwareAddr
+		c.conn, err = listenDHCP(containerIf)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot start DHCP client: %w", err)
+	}
+	xid := make([]byte, 4)
+	rand.Read(xid)
+	c.xid = binary.BigEndian.Uint32(xid)
+
+	offer, err := c.transact(dhcpDiscover, nil, nil, nil, dhcpOffer)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	ack, err := c.transact(dhcpRequest, nil, offer.yiaddr, offer.server, dhcpAck)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if err := recordLease(id, ack.yiaddr); err != nil {
+		c.release(ack)
+		return nil, err
+	}
+
+	prefix, bits := ack.mask.Size()
+	if bits == 0 {
+		prefix = 24
+	}
+	go c.renew(ack)
+	return &ipLease{
+		ip:        ack.yiaddr,
+		prefixLen: prefix,
+		gateway:   ack.router,
+		release: func() {
+			close(c.stop)
+			<-c.done
+			c.release(ack)
+		},
+	}, nil
+}
+
+// listenDHCP opens the client port on ifname. The socket must be created
+// on a thread inside the container's network namespace.
+func listenDHCP(ifname string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); serr != nil {
+				return
+			}
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifname)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", dhcpClientPort))
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// packet builds a client message. ciaddr is set once the client owns an
+// address; before that replies are requested as broadcasts, since the
+// client cannot receive unicast to an address it does not have yet.
+func (c *dhcpClient) packet(msgType byte, ciaddr, requested, server net.IP) []byte {
+	p := make([]byte, 236, 300)
+	p[0], p[1], p[2] = 1, 1, 6 // BOOTREQUEST, Ethernet, 6 byte MAC
+	binary.BigEndian.PutUint32(p[4:], c.xid)
+	if ciaddr == nil {
+		binary.BigEndian.PutUint16(p[10:], 0x8000)
+	} else {
+		copy(p[12:16], ciaddr.To4())
+	}
+	copy(p[28:], c.mac)
+	p = append(p, dhcpMagic...)
+	p = append(p, dhcpOptMsgType, 1, msgType)
+	p = append(p, dhcpOptClientID, byte(1+len(c.mac)), 1)
+	p = append(p, c.mac...)
+	if requested != nil {
+		p = append(p, dhcpOptRequestedIP, 4)
+		p = append(p, requested.To4()...)
+	}
+	if server != nil {
+		p = append(p, dhcpOptServerID, 4)
+		p = append(p, server.To4()...)
+	}
+	if msgType != dhcpRelease {
+		p = append(p, dhcpOptParamList, 4, dhcpOptSubnetMask, dhcpOptRouter, dhcpOptLeaseTime, dhcpOptRenewalTime)
+	}
+	return append(p, dhcpOptEnd)
+}
+
+// transact broadcasts a message and waits for a reply of type want,
+// retransmitting a few times.
+func (c *dhcpClient) transact(msgType byte, ciaddr, requested, server net.IP, want byte) (*dhcpReply, error) {
+	to := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}
+	msg := c.packet(msgType, ciaddr, requested, server)
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < dhcpAttempts; attempt++ {
+		if _, err := c.conn.WriteToUDP(msg, to); err != nil {
+			return nil, fmt.Errorf("cannot send DHCP message: %w", err)
+		}
+		c.conn.SetReadDeadline(time.Now().Add(dhcpWait))
+		for {
+			n, _, err := c.conn.ReadFromUDP(buf)
+			if err != nil {
+				break // timeout, retransmit
+			}
+			r, ok := c.parse(buf[:n])
+			if !ok {
+				continue
+			}
+			if r.msgType == dhcpNak {
+				return nil, fmt.Errorf("DHCP server %s declined the request", r.server)
+			}
+			if r.msgType == want {
+				return r, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no answer from a DHCP server")
+}
+
+// parse decodes a server reply to this client's transaction.
+func (c *dhcpClient) parse(p []byte) (*dhcpReply, bool) {
+	if len(p) < 240 || p[0] != 2 || binary.BigEndian.Uint32(p[4:]) != c.xid ||
+		!bytes.Equal(p[28:28+len(c.mac)], c.mac) || !bytes.Equal(p[236:240], dhcpMagic) {
+		return nil, false
+	}
+	r := &dhcpReply{yiaddr: net.IP(append([]byte(nil), p[16:20]...)), leaseTime: time.Hour}
+	for opts := p[240:]; len(opts) > 0; {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, false
+		}
+		val := opts[2 : 2+int(opts[1])]
+		opts = opts[2+int(opts[1]):]
+		switch {
+		case code == dhcpOptMsgType && len(val) == 1:
+			r.msgType = val[0]
+		case code == dhcpOptSubnetMask && len(val) == 4:
+			r.mask = net.IPMask(append([]byte(nil), val...))
+		case code == dhcpOptRouter && len(val) >= 4:
+			r.router = net.IP(append([]byte(nil), val[:4]...))
+		case code == dhcpOptServerID && len(val) == 4:
+			r.server = net.IP(append([]byte(nil), val...))
+		case code == dhcpOptLeaseTime && len(val) == 4:
+			r.leaseTime = time.Duration(binary.BigEndian.Uint32(val)) * time.Second
+		case code == dhcpOptRenewalTime && len(val) == 4:
+			r.renewTime = time.Duration(binary.BigEndian.Uint32(val)) * time.Second
+		}
+	}
+	return r, r.msgType != 0
+}
+
+// renew extends the lease at the renewal time (T1, half the lease time by
+// default) until the client is stopped.
+func (c *dhcpClient) renew(lease *dhcpReply) {
+	defer close(c.done)
+	wait := lease.renewTime
+	if wait == 0 {
+		wait = lease.leaseTime / 2
+	}
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(wait):
+		}
+		ack, err := c.transact(dhcpRequest, lease.yiaddr, nil, nil, dhcpAck)
+		if err != nil {
+			fmt.Printf("Warning: cannot renew DHCP lease of %s: %v\n", lease.yiaddr, err)
+			wait = dhcpRetry
+			continue
+		}
+		wait = ack.renewTime
+		if wait == 0 {
+			wait = ack.leaseTime / 2
+		}
+	}
+}
+
+// release gives the address back to the server and closes the client.
+func (c *dhcpClient) release(lease *dhcpReply) {
+	defer c.conn.Close()
+	if lease.server == nil {
+		return
+	}
+	msg := c.packet(dhcpRelease, lease.yiaddr, nil, lease.server)
+	if _, err := c.conn.WriteToUDP(msg, &net.UDPAddr{IP: lease.server, Port: dhcpServerPort}); err != nil {
+		fmt.Printf("Warning: cannot release DHCP lease of %s: %v\n", lease.yiaddr, err)
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// freeSpace returns the bytes unprivileged writers may still use on the
+// file system of path, which need not exist yet.
+func freeSpace(path string) (int64, error) {
+	for {
+		var st syscall.Statfs_t
+		err := syscall.Statfs(path, &st)
+		if err == nil {
+			return int64(st.Bavail) * int64(st.Bsize), nil
+		}
+		parent := filepath.Dir(path)
+		if err != syscall.ENOENT || parent == path {
+			return 0, fmt.Errorf("statfs %s: %w", path, err)
+		}
+		path = parent
+	}
+}
+
+// checkSpace fails unless need bytes are free at path, so that an operation
+// which would run out of space fails before it starts rather than halfway.
+func checkSpace(path string, need int64, what string) error {
+	have, err := freeSpace(path)
+	if err != nil {
+		return err
+	}
+	if need > have {
+		return fmt.Errorf("not enough space in %s to %s: need %s, have %s", path, what, formatSize(need), formatSize(have))
+	}
+	return nil
+}
+
+// missingBlobsSize is the size of the blobs of descs the store does not
+// have yet.
+func missingBlobsSize(store *blobStore, descs ...ociDescriptor) int64 {
+	var size int64
+	for _, d := range descs {
+		if !store.has(d.Digest) {
+			size += d.Size
+		}
+	}
+	return size
+}
+
+// unpackedSize estimates the space a layer takes once unpacked: the size
+// gzip records in its trailer, which is exact for layers of less than 4G,
+// or the size of the blob for uncompressed and encrypted layers.
+func unpackedSize(store *blobStore, l ociDescriptor) (int64, error) {
+	path, err := store.path(l.Digest)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if !strings.HasSuffix(l.MediaType, "gzip") || size < 4 {
+		return size, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var trailer [4]byte
+	if _, err := f.ReadAt(trailer[:], size-4); err != nil {
+		return 0, err
+	}
+	// The trailer holds the size modulo 4G. Gzip grows incompressible data
+	// by a fraction of a percent only, so a size well below that of the
+	// blob has wrapped.
+	isize := int64(binary.LittleEndian.Uint32(trailer[:]))
+	if isize < size-size/16 {
+		for isize < size {
+			isize += 1 << 32
+		}
+	}
+	if isize < size {
+		isize = size
+	}
+	return isize, nil
+}
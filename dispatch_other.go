@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// dispatch is unavailable off Linux: containers need Linux namespaces, so
+// other platforms can only drive a remote host.
+func dispatch(args []string) {
+	fmt.Println("shp can only run containers on Linux; use --host ssh://[user@]host or $SHP_HOST to drive a remote host")
+	os.Exit(1)
+}
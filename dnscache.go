@@ -0,0 +1,510 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	dnsUsage = "usage: shp dns serve [--listen addr:port]... [--upstream ip[:port]]..."
+
+	dnsCacheMode     = "cache"
+	resolvConfFile   = "resolv.conf"
+	hostResolvConf   = "/etc/resolv.conf"
+	dnsTimeout       = 2 * time.Second
+	upstreamHoldDown = 30 * time.Second
+	maxCacheEntries  = 10000
+	maxNegativeTTL   = 5 * time.Minute
+	defaultNegTTL    = time.Minute
+	maxStale         = time.Hour
+	staleTTL         = 30 // RFC 8767 recommends 30 seconds for stale answers
+
+	dnsTypeOPT       = 41
+	dnsRcodeNXDomain = 3
+	dnsRcodeServFail = 2
+)
+
+// dnsConfig is the "dns" section of the config file, used by
+// `shp dns serve` when no flags are given.
+type dnsConfig struct {
+	Listen    []string `json:"listen,omitempty"`
+	Upstreams []string `json:"upstreams,omitempty"`
+}
+
+// dnsCacheEntry is a cached upstream response. ttlOffsets locate the TTL
+// fields, so that hits can be served with the remaining lifetime.
+type dnsCacheEntry struct {
+	msg        []byte
+	ttlOffsets []int
+	stored     time.Time
+	ttl        time.Duration
+}
+
+// dnsResolver is a caching stub resolver forwarding to a list of upstream
+// servers. Upstreams are tried in order; one that fails is skipped for a
+// while, and if all of them fail expired answers are served stale rather
+// than failing lookups while the site's resolvers flap.
+type dnsResolver struct {
+	upstreams []string
+
+	mu    sync.Mutex
+	cache map[string]*dnsCacheEntry
+	down  map[string]time.Time
+}
+
+func newDNSResolver(upstreams []string) *dnsResolver {
+	return &dnsResolver{
+		upstreams: upstreams,
+		cache:     make(map[string]*dnsCacheEntry),
+		down:      make(map[string]time.Time),
+	}
+}
+
+func dnsServe(args []string) {
+	if len(args) < 1 || args[0] != "serve" {
+		fmt.Println(dnsUsage)
+		os.Exit(1)
+	}
+	var listen, upstreams []string
+	fs := flag.NewFlagSet("dns serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Func("listen", "address to serve DNS on (repeatable)", func(v string) error {
+		listen = append(listen, v)
+		return nil
+	})
+	fs.Func("upstream", "upstream DNS server, tried in order (repeatable)", func(v string) error {
+		upstreams = append(upstreams, v)
+		return nil
+	})
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+		fmt.Println(dnsUsage)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig()
+	handle(err)
+	if len(listen) == 0 {
+		listen = cfg.DNS.Listen
+	}
+	if len(upstreams) == 0 {
+		upstreams = cfg.DNS.Upstreams
+	}
+	if len(listen) == 0 {
+		listen, err = gatewayListenAddrs()
+		handle(err)
+	}
+	if len(upstreams) == 0 {
+		upstreams, err = nameservers(hostResolvConf)
+		handle(err)
+	}
+	if len(upstreams) == 0 {
+		handle(fmt.Errorf("no upstream DNS servers configured"))
+	}
+	for i, u := range upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			upstreams[i] = net.JoinHostPort(u, "53")
+		}
+	}
+	handle(newDNSResolver(upstreams).serve(listen))
+}
+
+// gatewayListenAddrs returns port 53 on the gateway of every bridge network,
+// the address containers are given as nameserver by --dns cache.
+func gatewayListenAddrs() ([]string, error) {
+	networks, err := listNetworks()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, n := range networks {
+		if n.bridged() && n.Gateway != "" {
+			addrs = append(addrs, net.JoinHostPort(n.Gateway, "53"))
+		}
+	}
+	return addrs, nil
+}
+
+// freebind lets the resolver bind gateway addresses of bridges that are
+// only created when the first container joins their network.
+func freebind(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// serve answers DNS over UDP and TCP on every listen address until a
+// listener fails.
+func (r *dnsResolver) serve(listen []string) error {
+	lc := net.ListenConfig{Control: freebind}
+	errc := make(chan error, 2*len(listen))
+	for _, addr := range listen {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s: %w", addr, err)
+		}
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s: %w", addr, err)
+		}
+		go func() { errc <- r.serveUDP(pc) }()
+		go func() { errc <- r.serveTCP(ln) }()
+		fmt.Printf("Serving DNS on %s\n", addr)
+	}
+	fmt.Printf("Upstreams: %s\n", strings.Join(r.upstreams, ", "))
+	return <-errc
+}
+
+func (r *dnsResolver) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := r.resolve(query); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (r *dnsResolver) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := r.resolve(query)
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+	_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// questionKey returns the cache key of a query's single question.
+func questionKey(msg []byte) string {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return ""
+	}
+	name, next, err := decodeDNSName(msg, 12)
+	if err != nil || next+4 > len(msg) {
+		return ""
+	}
+	return fmt.Sprintf("%s/%x", strings.ToLower(name), msg[next:next+4])
+}
+
+// resolve answers a query from the cache or the upstreams. It returns nil
+// for messages that are not answerable queries.
+func (r *dnsResolver) resolve(query []byte) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	key := questionKey(query)
+	now := time.Now()
+
+	r.mu.Lock()
+	entry := r.cache[key]
+	r.mu.Unlock()
+	if entry != nil && now.Sub(entry.stored) < entry.ttl {
+		return entry.render(query, now, false)
+	}
+
+	resp, err := r.exchange(query)
+	if err == nil {
+		if key != "" {
+			r.store(key, resp, now)
+		}
+		return resp
+	}
+	if entry != nil && now.Sub(entry.stored) < entry.ttl+maxStale {
+		return entry.render(query, now, true)
+	}
+	fmt.Fprintf(os.Stderr, "dns: %v\n", err)
+	return servFail(query)
+}
+
+// exchange forwards a query to the first upstream that answers it. Upstreams
+// that recently failed are only tried once all others have failed too.
+func (r *dnsResolver) exchange(query []byte) ([]byte, error) {
+	r.mu.Lock()
+	var healthy, failed []string
+	for _, u := range r.upstreams {
+		if time.Now().Before(r.down[u]) {
+			failed = append(failed, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	r.mu.Unlock()
+
+	var lastErr error
+	for _, u := range append(healthy, failed...) {
+		resp, err := exchangeWith(u, query)
+		if err == nil && len(resp) >= 4 && resp[3]&0x0f == dnsRcodeServFail {
+			err = fmt.Errorf("upstream %s answered SERVFAIL", u)
+		}
+		r.mu.Lock()
+		if err != nil {
+			r.down[u] = time.Now().Add(upstreamHoldDown)
+		} else {
+			delete(r.down, u)
+		}
+		r.mu.Unlock()
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// exchangeWith sends query to upstream over UDP, retrying over TCP if the
+// answer was truncated.
+func exchangeWith(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", upstream, err)
+		}
+		// Ignore stray datagrams not answering this query
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+		break
+	}
+
+	tcp, err := net.DialTimeout("tcp", upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := writeTCPMessage(tcp, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(tcp)
+}
+
+// store caches a response for the lifetime of its shortest TTL. Negative
+// answers are cached for the TTL of the authority records (the SOA), but
+// not longer than maxNegativeTTL.
+func (r *dnsResolver) store(key string, resp []byte, now time.Time) {
+	rcode := resp[3] & 0x0f
+	if resp[2]&0x02 != 0 || (rcode != 0 && rcode != dnsRcodeNXDomain) {
+		return
+	}
+	offsets, minTTL, ok := ttlOffsets(resp)
+	if !ok {
+		return
+	}
+	ttl := time.Duration(minTTL) * time.Second
+	negative := rcode == dnsRcodeNXDomain || binary.BigEndian.Uint16(resp[6:]) == 0
+	if negative {
+		if len(offsets) == 0 {
+			ttl = defaultNegTTL
+		}
+		if ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= maxCacheEntries {
+		for k, e := range r.cache {
+			if now.Sub(e.stored) >= e.ttl+maxStale {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache {
+			if len(r.cache) < maxCacheEntries {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = &dnsCacheEntry{msg: resp, ttlOffsets: offsets, stored: now, ttl: ttl}
+}
+
+// ttlOffsets locates the TTL field of every resource record except EDNS
+// OPT pseudo-records, and returns the smallest TTL.
+func ttlOffsets(msg []byte) ([]int, uint32, bool) {
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rrs := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, err := decodeDNSName(msg, off)
+		if err != nil {
+			return nil, 0, false
+		}
+		off = next + 4
+	}
+	var offsets []int
+	var minTTL uint32
+	for i := 0; i < rrs; i++ {
+		_, next, err := decodeDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, 0, false
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		ttl := binary.BigEndian.Uint32(msg[next+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		if rtype != dnsTypeOPT {
+			if len(offsets) == 0 || ttl < minTTL {
+				minTTL = ttl
+			}
+			offsets = append(offsets, next+4)
+		}
+		off = next + 10 + rdlen
+		if off > len(msg) {
+			return nil, 0, false
+		}
+	}
+	return offsets, minTTL, true
+}
+
+// render returns the cached response for query, with the query's ID and
+// TTLs reduced by the time the answer spent in the cache.
+func (e *dnsCacheEntry) render(query []byte, now time.Time, stale bool) []byte {
+	msg := append([]byte(nil), e.msg...)
+	copy(msg, query[:2])
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, off := range e.ttlOffsets {
+		ttl := uint32(staleTTL)
+		if orig := binary.BigEndian.Uint32(msg[off:]); !stale && orig > age {
+			ttl = orig - age
+		} else if !stale {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[off:], ttl)
+	}
+	return msg
+}
+
+// servFail builds a SERVFAIL response echoing the question of query.
+func servFail(query []byte) []byte {
+	end := 12
+	if questionKey(query) != "" {
+		_, next, _ := decodeDNSName(query, 12)
+		end = next + 4
+	}
+	msg := append([]byte(nil), query[:end]...)
+	msg[2] = 0x80 | msg[2]&0x79 // response, keep opcode and RD
+	msg[3] = 0x80 | dnsRcodeServFail
+	var qd uint16
+	if end > 12 {
+		qd = 1
+	}
+	binary.BigEndian.PutUint16(msg[4:], qd)
+	binary.BigEndian.PutUint16(msg[6:], 0)
+	binary.BigEndian.PutUint16(msg[8:], 0)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	return msg
+}
+
+// dnsServers returns the nameservers of a container started with --dns.
+// "cache" stands for the host's caching resolver (`shp dns serve`) on the
+// gateway of the container's bridge network, or of shp0 on the host network.
+func dnsServers(opts *runOptions) ([]string, error) {
+	var servers []string
+	for _, s := range opts.dns {
+		if s != dnsCacheMode {
+			if net.ParseIP(s) == nil {
+				return nil, fmt.Errorf("invalid DNS server: %s", s)
+			}
+			servers = append(servers, s)
+			continue
+		}
+		n := &defaultNetwork
+		if opts.network != hostNetwork {
+			var err error
+			if n, err = lookupNetwork(opts.network); err != nil {
+				return nil, err
+			}
+		}
+		if !n.bridged() || n.Gateway == "" {
+			return nil, fmt.Errorf("--dns cache requires host or bridge networking")
+		}
+		servers = append(servers, n.Gateway)
+	}
+	return servers, nil
+}
+
+// writeResolvConf generates the resolv.conf of a container in its runtime
+// directory, from where the child mounts it over /etc/resolv.conf.
+func writeResolvConf(id string, servers []string) error {
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	return os.WriteFile(scratchPath(id, resolvConfFile), []byte(b.String()), 0644)
+}
+
+// mountResolvConf mounts the generated resolv.conf read-only into rootfs.
+func mountResolvConf(rootfs, id string) error {
+	v := volume{
+		source: scratchPath(id, resolvConfFile),
+		target: hostResolvConf,
+		flags:  defaultVolumeFlags | syscall.MS_RDONLY,
+	}
+	return v.mount(rootfs)
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	drainUsage        = "usage: shp drain [--cancel]"
+	drainMarker       = "draining"
+	priorityLabel     = "shp.priority"
+	drainPollInterval = 100 * time.Millisecond
+)
+
+func drainMarkerPath() string {
+	return filepath.Join(runtimeDir, drainMarker)
+}
+
+// checkNotDraining refuses new container starts while the node is drained.
+func checkNotDraining() error {
+	if _, err := os.Stat(drainMarkerPath()); err == nil {
+		return fmt.Errorf("node is draining, not starting new containers (run `shp drain --cancel` to resume)")
+	}
+	return nil
+}
+
+func drain(args []string) {
+	switch {
+	case len(args) == 0:
+		handle(drainNode())
+	case len(args) == 1 && (args[0] == "--cancel" || args[0] == "-cancel"):
+		if err := os.Remove(drainMarkerPath()); err != nil && !os.IsNotExist(err) {
+			handle(fmt.Errorf("cannot remove drain marker: %w", err))
+		}
+		fmt.Println("Node accepts new containers again")
+	default:
+		fmt.Println(drainUsage)
+		os.Exit(1)
+	}
+}
+
+// drainNode blocks new starts and stops every running container. Containers
+// are stopped in groups of ascending shp.priority label (default 0), so
+// higher priority containers outlive the ones depending on them.
+func drainNode() error {
+	if err := os.MkdirAll(runtimeDir, 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %w", runtimeDir, err)
+	}
+	if err := os.WriteFile(drainMarkerPath(), nil, 0600); err != nil {
+		return fmt.Errorf("cannot write drain marker: %w", err)
+	}
+
+	states, err := listStates()
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[int][]*containerState)
+	for _, st := range states {
+		prio, _ := strconv.Atoi(st.Labels[priorityLabel])
+		groups[prio] = append(groups[prio], st)
+	}
+	prios := make([]int, 0, len(groups))
+	for prio := range groups {
+		prios = append(prios, prio)
+	}
+	sort.Ints(prios)
+
+	for _, prio := range prios {
+		var wg sync.WaitGroup
+		for _, st := range groups[prio] {
+			wg.Add(1)
+			go func(st *containerState) {
+				defer wg.Done()
+				if err := stopProcess(st.PID, st.StopTimeout); err != nil {
+					fmt.Printf("Warning: stopping %s failed: %v\n", st.ID, err)
+					return
+				}
+				fmt.Printf("Stopped %s\n", st.ID)
+			}(st)
+		}
+		wg.Wait()
+	}
+
+	fmt.Println("Node is empty")
+	return nil
+}
+
+// stopProcess sends SIGTERM to pid and SIGKILL once timeout has passed,
+// returning when the process is gone.
+func stopProcess(pid int, timeout time.Duration) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		if err == syscall.ESRCH {
+			return nil
+		}
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return err
+			}
+			deadline = time.Now().Add(timeout)
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+//go:build linux && (amd64 || 386 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	bpfMapCreate          = 0  // BPF_MAP_CREATE
+	bpfProgLoad           = 5  // BPF_PROG_LOAD
+	bpfMapTypeRingbuf     = 27 // BPF_MAP_TYPE_RINGBUF
+	bpfProgTypeTracepoint = 5  // BPF_PROG_TYPE_TRACEPOINT
+	bpfPseudoMapFD        = 1  // BPF_PSEUDO_MAP_FD
+
+	// The kernel helpers the probes call
+	bpfKtimeGetNs                 = 5
+	bpfGetCurrentPidTgid          = 14
+	bpfGetCurrentComm             = 16
+	bpfGetCurrentAncestorCgroupID = 123
+	bpfRingbufOutput              = 130
+
+	// The header of a ring buffer record: its length and flags, and the
+	// page offset of the buffer
+	ringbufBusy      = 1 << 31
+	ringbufDiscard   = 1 << 30
+	ringbufHeaderLen = 8
+
+	perfTypeTracepoint = 2          // PERF_TYPE_TRACEPOINT
+	perfSampleRaw      = 1 << 10    // PERF_SAMPLE_RAW
+	perfFlagFDCloexec  = 8          // PERF_FLAG_FD_CLOEXEC
+	perfEventSetBPF    = 0x40042408 // PERF_EVENT_IOC_SET_BPF
+	perfAttrSize       = 64         // PERF_ATTR_SIZE_VER0
+
+	traceRingSize = 4 << 20
+	bpfLogSize    = 1 << 16
+	onlineCPUs    = "/sys/devices/system/cpu/online"
+)
+
+// The opcodes of the eBPF instructions the probes are assembled from.
+const (
+	ebpfMov64Imm = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K
+	ebpfMov64Reg = 0xbf // BPF_ALU64 | BPF_MOV | BPF_X
+	ebpfAdd64Imm = 0x07 // BPF_ALU64 | BPF_ADD | BPF_K
+	ebpfLoadImm  = 0x18 // BPF_LD | BPF_IMM | BPF_DW
+	ebpfLoadMem  = 0x79 // BPF_LDX | BPF_MEM | BPF_DW
+	ebpfStoreReg = 0x7b // BPF_STX | BPF_MEM | BPF_DW
+	ebpfStoreImm = 0x7a // BPF_ST | BPF_MEM | BPF_DW
+	ebpfJneReg   = 0x5d // BPF_JMP | BPF_JNE | BPF_X
+	ebpfCall     = 0x85 // BPF_JMP | BPF_CALL
+	ebpfExit     = 0x95 // BPF_JMP | BPF_EXIT
+
+	// Registers: r0 returns, r1-r5 pass arguments, r6 is kept across calls
+	// and r10 is the frame pointer
+	ebpfR0, ebpfR1, ebpfR2, ebpfR3, ebpfR4, ebpfR6, ebpfR10 = 0, 1, 2, 3, 4, 6, 10
+)
+
+// ebpfInsn is struct bpf_insn.
+type ebpfInsn struct {
+	code uint8
+	regs uint8 // dst_reg in the low nibble, src_reg in the high one
+	off  int16
+	imm  int32
+}
+
+func ebpfOp(code, dst, src uint8, off int16, imm int32) ebpfInsn {
+	return ebpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// ebpfLoad64 loads a 64-bit immediate, which takes two instructions; with
+// src bpfPseudoMapFD, v is the fd of a map.
+func ebpfLoad64(dst, src uint8, v uint64) []ebpfInsn {
+	return []ebpfInsn{ebpfOp(ebpfLoadImm, dst, src, 0, int32(uint32(v))), {imm: int32(uint32(v >> 32))}}
+}
+
+// bpfMapCreateAttr is the head of union bpf_attr for BPF_MAP_CREATE.
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+}
+
+// bpfProgLoadAttr is the head of union bpf_attr for BPF_PROG_LOAD.
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	progName    [16]byte
+}
+
+// perfEventAttr is struct perf_event_attr in its first version.
+type perfEventAttr struct {
+	typ          uint32
+	size         uint32
+	config       uint64
+	samplePeriod uint64
+	sampleType   uint64
+	readFormat   uint64
+	flags        uint64
+	wakeupEvents uint32
+	bpType       uint32
+	config1      uint64
+}
+
+// traceSession is a set of eBPF programs attached to tracepoints on every
+// CPU, which report the events of a cgroup to a ring buffer shp reads.
+type traceSession struct {
+	ring     int
+	epoll    int
+	fds      []int
+	consumer []byte
+	data     []byte
+}
+
+var (
+	syscallNamesOnce sync.Once
+	syscallNames     map[uint32]string
+)
+
+// syscallName returns the name of the system call nr, or "" if it is not
+// known.
+func syscallName(nr uint32) string {
+	syscallNamesOnce.Do(func() {
+		syscallNames = make(map[uint32]string, len(syscallNumbers))
+		for name, n := range syscallNumbers {
+			syscallNames[n] = name
+		}
+	})
+	return syscallNames[nr]
+}
+
+// openTraceSession attaches the probes for the cgroup with the ID cgroupID
+// at level in the hierarchy. The programs run in the kernel on every hit
+// of the tracepoints and pass on only the events of tasks in the cgroup
+// or below it, so nothing stops the traced processes.
+func openTraceSession(cgroupID uint64, level int, probes []*traceProbe) (*traceSession, error) {
+	cpus, err := readCPUList(onlineCPUs)
+	if err != nil {
+		return nil, err
+	}
+	s := &traceSession{ring: -1, epoll: -1}
+	attr := bpfMapCreateAttr{mapType: bpfMapTypeRingbuf, maxEntries: traceRingSize}
+	if s.ring, err = bpfCall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return nil, fmt.Errorf("cannot create ring buffer: %w", err)
+	}
+	if err := s.attach(cgroupID, level, probes, cpus); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *traceSession) attach(cgroupID uint64, level int, probes []*traceProbe, cpus []int) error {
+	// The consumer position is written by shp; the producer position and
+	// the data, mapped twice in a row so records never wrap, are read-only
+	page := os.Getpagesize()
+	var err error
+	if s.consumer, err = syscall.Mmap(s.ring, 0, page, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+		return fmt.Errorf("cannot map ring buffer: %w", err)
+	}
+	if s.data, err = syscall.Mmap(s.ring, int64(page), page+2*traceRingSize, syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		return fmt.Errorf("cannot map ring buffer: %w", err)
+	}
+	if s.epoll, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return err
+	}
+	if err := syscall.EpollCtl(s.epoll, syscall.EPOLL_CTL_ADD, s.ring, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(s.ring)}); err != nil {
+		return err
+	}
+	for kind, p := range probes {
+		prog, err := loadTraceProgram(p, traceProgram(s.ring, kind, p.size, cgroupID, level))
+		if err != nil {
+			return err
+		}
+		s.fds = append(s.fds, prog)
+		for _, cpu := range cpus {
+			fd, err := attachTracepoint(p.id, cpu, prog)
+			if err != nil {
+				return fmt.Errorf("cannot attach the %s probe: %w", p.name, err)
+			}
+			s.fds = append(s.fds, fd)
+		}
+	}
+	return nil
+}
+
+// traceProgram assembles the probe of the kind-th tracepoint, whose
+// records are size bytes long. It builds the event on the stack and
+// copies it to the ring buffer.
+func traceProgram(ring, kind, size int, cgroupID uint64, level int) []ebpfInsn {
+	words := (size + 7) / 8
+	frame := traceHeaderLen + 8*words
+	ev := int16(-frame)
+	prog := []ebpfInsn{
+		ebpfOp(ebpfMov64Reg, ebpfR6, ebpfR1, 0, 0),
+		ebpfOp(ebpfMov64Imm, ebpfR1, 0, 0, int32(level)),
+		ebpfOp(ebpfCall, 0, 0, 0, bpfGetCurrentAncestorCgroupID),
+	}
+	prog = append(prog, ebpfLoad64(ebpfR1, 0, cgroupID)...)
+	skip := len(prog)
+	prog = append(prog,
+		ebpfInsn{}, // if r0 != r1 goto out, set below
+		ebpfOp(ebpfStoreImm, ebpfR10, 0, ev+traceKindOffset, int32(kind)),
+		ebpfOp(ebpfCall, 0, 0, 0, bpfGetCurrentPidTgid),
+		ebpfOp(ebpfStoreReg, ebpfR10, ebpfR0, ev+tracePIDOffset, 0),
+		ebpfOp(ebpfCall, 0, 0, 0, bpfKtimeGetNs),
+		ebpfOp(ebpfStoreReg, ebpfR10, ebpfR0, ev+traceTimeOffset, 0),
+		ebpfOp(ebpfMov64Reg, ebpfR1, ebpfR10, 0, 0),
+		ebpfOp(ebpfAdd64Imm, ebpfR1, 0, 0, int32(ev+traceCommOffset)),
+		ebpfOp(ebpfMov64Imm, ebpfR2, 0, 0, traceCommLen),
+		ebpfOp(ebpfCall, 0, 0, 0, bpfGetCurrentComm),
+	)
+	// The common fields that start every record cannot be read, and no
+	// probe needs them
+	prog = append(prog, ebpfOp(ebpfStoreImm, ebpfR10, 0, ev+traceHeaderLen, 0))
+	for i := 1; i < words; i++ {
+		prog = append(prog,
+			ebpfOp(ebpfLoadMem, ebpfR0, ebpfR6, int16(8*i), 0),
+			ebpfOp(ebpfStoreReg, ebpfR10, ebpfR0, ev+traceHeaderLen+int16(8*i), 0))
+	}
+	prog = append(prog, ebpfLoad64(ebpfR1, bpfPseudoMapFD, uint64(ring))...)
+	prog = append(prog,
+		ebpfOp(ebpfMov64Reg, ebpfR2, ebpfR10, 0, 0),
+		ebpfOp(ebpfAdd64Imm, ebpfR2, 0, 0, int32(ev)),
+		ebpfOp(ebpfMov64Imm, ebpfR3, 0, 0, int32(frame)),
+		ebpfOp(ebpfMov64Imm, ebpfR4, 0, 0, 0),
+		ebpfOp(ebpfCall, 0, 0, 0, bpfRingbufOutput),
+	)
+	prog[skip] = ebpfOp(ebpfJneReg, ebpfR0, ebpfR1, int16(len(prog)-skip-1), 0)
+	return append(prog,
+		ebpfOp(ebpfMov64Imm, ebpfR0, 0, 0, 0),
+		ebpfOp(ebpfExit, 0, 0, 0, 0))
+}
+
+// loadTraceProgram loads the program of a probe. If the verifier rejects
+// it, loading is repeated with its log for the error.
+func loadTraceProgram(p *traceProbe, insns []ebpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	attr := bpfProgLoadAttr{
+		progType: bpfProgTypeTracepoint,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	copy(attr.progName[:15], "shp_"+p.name)
+	fd, err := bpfCall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return fd, nil
+	}
+	if err == syscall.EPERM {
+		return -1, fmt.Errorf("cannot load the %s probe: %w; tracing requires root", p.name, err)
+	}
+	log := make([]byte, bpfLogSize)
+	attr.logLevel, attr.logSize, attr.logBuf = 1, uint32(len(log)), uint64(uintptr(unsafe.Pointer(&log[0])))
+	if fd, retry := bpfCall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); retry == nil {
+		return fd, nil
+	}
+	if i := strings.IndexByte(string(log), 0); i >= 0 {
+		log = log[:i]
+	}
+	return -1, fmt.Errorf("cannot load the %s probe: %w\n%s", p.name, err, strings.TrimSpace(string(log)))
+}
+
+// attachTracepoint opens the tracepoint id on cpu and runs prog on its
+// hits.
+func attachTracepoint(id, cpu, prog int) (int, error) {
+	attr := perfEventAttr{
+		typ:          perfTypeTracepoint,
+		size:         perfAttrSize,
+		config:       uint64(id),
+		samplePeriod: 1,
+		sampleType:   perfSampleRaw,
+		wakeupEvents: 1,
+	}
+	pid := -1
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)),
+		uintptr(pid), uintptr(cpu), ^uintptr(0), perfFlagFDCloexec, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventSetBPF, uintptr(prog)); errno != 0 {
+		syscall.Close(int(fd))
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// read waits up to timeout for events and passes each to fn, which must
+// not keep it.
+func (s *traceSession) read(timeout time.Duration, fn func([]byte)) error {
+	events := make([]syscall.EpollEvent, 1)
+	if _, err := syscall.EpollWait(s.epoll, events, int(timeout/time.Millisecond)); err != nil && err != syscall.EINTR {
+		return err
+	}
+	page := uint64(os.Getpagesize())
+	consumer := (*uint64)(unsafe.Pointer(&s.consumer[0]))
+	producer := (*uint64)(unsafe.Pointer(&s.data[0]))
+	cons := atomic.LoadUint64(consumer)
+	for prod := atomic.LoadUint64(producer); cons < prod; {
+		rec := s.data[page+cons&(traceRingSize-1):]
+		n := atomic.LoadUint32((*uint32)(unsafe.Pointer(&rec[0])))
+		if n&ringbufBusy != 0 {
+			break
+		}
+		size := n &^ (ringbufBusy | ringbufDiscard)
+		if n&ringbufDiscard == 0 {
+			fn(rec[ringbufHeaderLen : ringbufHeaderLen+size])
+		}
+		cons += (uint64(size) + ringbufHeaderLen + 7) &^ 7
+		atomic.StoreUint64(consumer, cons)
+	}
+	return nil
+}
+
+// close detaches the probes; the kernel unloads them with their last fd.
+func (s *traceSession) close() {
+	for _, fd := range s.fds {
+		syscall.Close(fd)
+	}
+	if s.epoll >= 0 {
+		syscall.Close(s.epoll)
+	}
+	if s.data != nil {
+		syscall.Munmap(s.data)
+	}
+	if s.consumer != nil {
+		syscall.Munmap(s.consumer)
+	}
+	syscall.Close(s.ring)
+}
+
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// readCPUList parses a CPU list such as "0-3,6".
+func readCPUList(path string) ([]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		first, last, ranged := strings.Cut(r, "-")
+		lo, err := strconv.Atoi(first)
+		hi := lo
+		if err == nil && ranged {
+			hi, err = strconv.Atoi(last)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad CPU list %q in %s", data, path)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,204 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultEnvPassthrough lists the host variables a container receives when
+// --env-passthrough is not given.
+var defaultEnvPassthrough = []string{"PATH", "HOME", "TERM", "LANG"}
+
+// setEnv returns env with key set to value, replacing any existing entry.
+func setEnv(env []string, key, value string) []string {
+	prefix := key + "="
+	out := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			out = append(out, kv)
+		}
+	}
+	return append(out, prefix+value)
+}
+
+// hasEnv reports whether env has an entry for key.
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// passthroughEnv returns the entries of host whose names match one of
+// allowed. A pattern ending in "*" matches by prefix, so "LC_*" selects all
+// locale variables and "*" the whole host environment.
+func passthroughEnv(host, allowed []string) []string {
+	var out []string
+	for _, kv := range host {
+		name, _, _ := strings.Cut(kv, "=")
+		for _, pattern := range allowed {
+			if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(name, prefix) || name == pattern {
+				out = append(out, kv)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// parseEnvVar parses a --env value: KEY=VALUE, or KEY alone for the value
+// of KEY on the host, which is skipped if the host has no such variable.
+func parseEnvVar(v string) ([]string, error) {
+	name, _, ok := strings.Cut(v, "=")
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return nil, fmt.Errorf("invalid environment variable %q", v)
+	}
+	if ok {
+		return []string{v}, nil
+	}
+	if value, found := os.LookupEnv(name); found {
+		return []string{name + "=" + value}, nil
+	}
+	return nil, nil
+}
+
+// readEnvFile reads an --env-file: one --env value per line, with blank
+// lines and lines starting with # ignored. Values may contain substitutions
+// (see expandVars) of host variables and of those set by earlier lines,
+// and are otherwise taken literally, quotes included.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read env file: %w", err)
+	}
+	defer f.Close()
+	var env []string
+	defined := make(map[string]string)
+	lookup := func(name string) (string, bool) {
+		if v, ok := defined[name]; ok {
+			return v, true
+		}
+		return os.LookupEnv(name)
+	}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimLeft(s.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, value, ok := strings.Cut(line, "="); ok {
+			if value, err = expandVars(value, lookup); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			line = name + "=" + value
+		}
+		vars, err := parseEnvVar(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		for _, kv := range vars {
+			name, value, _ := strings.Cut(kv, "=")
+			defined[name] = value
+		}
+		env = append(env, vars...)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read env file: %w", err)
+	}
+	return env, nil
+}
+
+// expandVars substitutes variables in s like a compose file: ${VAR} is the
+// value of VAR, or empty if it is unset; ${VAR:-default} and ${VAR-default}
+// fall back to default if VAR is unset or empty, or only if it is unset;
+// ${VAR:?message} and ${VAR?message} fail with message instead. Defaults
+// and messages may contain substitutions themselves, and $$ is a literal $.
+func expandVars(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] != '$':
+			b.WriteByte(s[i])
+		case strings.HasPrefix(s[i:], "$$"):
+			b.WriteByte('$')
+			i++
+		case strings.HasPrefix(s[i:], "${"):
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated substitution in %q", s)
+			}
+			v, err := expandVar(s[i+2:end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i = end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// closingBrace returns the index of the } closing the substitution whose
+// expression starts at start, skipping nested substitutions, or -1.
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case s[i] == '}' && depth == 0:
+			return i
+		case s[i] == '}':
+			depth--
+		}
+	}
+	return -1
+}
+
+// expandVar evaluates the expression of a ${...} substitution.
+func expandVar(expr string, lookup func(string) (string, bool)) (string, error) {
+	n := 0
+	for n < len(expr) && (expr[n] == '_' || 'a' <= expr[n] && expr[n] <= 'z' || 'A' <= expr[n] && expr[n] <= 'Z' || n > 0 && '0' <= expr[n] && expr[n] <= '9') {
+		n++
+	}
+	name, op := expr[:n], expr[n:]
+	if name == "" {
+		return "", fmt.Errorf("invalid substitution ${%s}", expr)
+	}
+	value, set := lookup(name)
+	var arg string
+	switch {
+	case op == "":
+		return value, nil
+	case strings.HasPrefix(op, ":-"), strings.HasPrefix(op, ":?"):
+		arg, set = op[2:], set && value != ""
+		op = op[1:2]
+	case strings.HasPrefix(op, "-"), strings.HasPrefix(op, "?"):
+		arg, op = op[1:], op[:1]
+	default:
+		return "", fmt.Errorf("invalid substitution ${%s}", expr)
+	}
+	if set {
+		return value, nil
+	}
+	arg, err := expandVars(arg, lookup)
+	if err != nil {
+		return "", err
+	}
+	if op == "-" {
+		return arg, nil
+	}
+	if arg == "" {
+		return "", fmt.Errorf("variable %s is required", name)
+	}
+	return "", fmt.Errorf("variable %s is required: %s", name, arg)
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupRoot     = "/sys/fs/cgroup"
+	procSelfCgroup = "/proc/self/cgroup"
+)
+
+// resourceLimits describes the effective cgroup limits of a process.
+// A zero value means "unlimited".
+type resourceLimits struct {
+	memoryBytes int64
+	cpus        float64
+}
+
+// envHints returns environment variables that let common runtimes size
+// themselves to the cgroup limits. Variables already present in env are
+// left untouched so users can always override a hint.
+func envHints(limits resourceLimits, env []string) []string {
+	set := make(map[string]bool, len(env))
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			set[kv[:i]] = true
+		}
+	}
+
+	var hints []string
+	add := func(key, value string) {
+		if !set[key] {
+			hints = append(hints, key+"="+value)
+		}
+	}
+
+	if limits.memoryBytes > 0 {
+		// Leave headroom for non-heap memory (stacks, code, buffers)
+		add("GOMEMLIMIT", strconv.FormatInt(limits.memoryBytes*9/10, 10))
+		add("JAVA_TOOL_OPTIONS", fmt.Sprintf("-Xmx%dm", limits.memoryBytes*3/4/(1<<20)))
+	}
+	if limits.cpus > 0 {
+		n := strconv.Itoa(int(math.Ceil(limits.cpus)))
+		add("NPROC", n)
+		add("GOMAXPROCS", n)
+	}
+	return hints
+}
+
+// currentLimits reads the effective cgroup v2 limits of the calling process,
+// taking the tightest limit found along the path to the cgroup root.
+func currentLimits() (resourceLimits, error) {
+	var limits resourceLimits
+
+	rel, err := currentCgroup()
+	if err != nil {
+		return limits, err
+	}
+
+	for dir := filepath.Join(cgroupRoot, rel); strings.HasPrefix(dir, cgroupRoot); dir = filepath.Dir(dir) {
+		if mem, ok := readMemoryMax(dir); ok && (limits.memoryBytes == 0 || mem < limits.memoryBytes) {
+			limits.memoryBytes = mem
+		}
+		if cpus, ok := readCPUMax(dir); ok && (limits.cpus == 0 || cpus < limits.cpus) {
+			limits.cpus = cpus
+		}
+		if dir == cgroupRoot {
+			break
+		}
+	}
+	return limits, nil
+}
+
+// currentCgroup returns the cgroup v2 path of the calling process relative
+// to the cgroup mount.
+func currentCgroup() (string, error) {
+	return readCgroup(procSelfCgroup)
+}
+
+// readCgroup returns the cgroup v2 path listed in a /proc/<pid>/cgroup file.
+func readCgroup(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry in %s", path)
+}
+
+func readMemoryMax(dir string) (int64, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "memory.max"))
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+func readCPUMax(dir string) (float64, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "cpu.max"))
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+	quota, err1 := strconv.ParseFloat(fields[0], 64)
+	period, err2 := strconv.ParseFloat(fields[1], 64)
+	if err1 != nil || err2 != nil || period == 0 {
+		return 0, false
+	}
+	return quota / period, true
+}
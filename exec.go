@@ -0,0 +1,510 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"shp/pkg/container"
+)
+
+const (
+	execUsage = "usage: shp exec [-t] [--read-only] [--record <file>] [--session-timeout <d>] [--idle-timeout <d>] [--memory <size>] [--cpus <n>] [--pids-limit <n>] <container> <cmd> [args]"
+
+	auditDir     = "audit"
+	execAuditLog = "exec.log"
+
+	auditStart = "start"
+	auditEnd   = "end"
+
+	timeoutSession = "session"
+	timeoutIdle    = "idle"
+	// sessionHangupGrace is how long a timed out session may take to end
+	// after SIGHUP before it is killed
+	sessionHangupGrace  = 5 * time.Second
+	sessionPollInterval = time.Second
+)
+
+// execConfig is the "exec" section of the config file. With RecordDir set,
+// every exec session is recorded to a file below it. SessionTimeout and
+// IdleTimeout, durations such as "1h", apply to every session; the flags
+// of exec can only shorten them.
+type execConfig struct {
+	RecordDir      string `json:"record_dir,omitempty"`
+	SessionTimeout string `json:"session_timeout,omitempty"`
+	IdleTimeout    string `json:"idle_timeout,omitempty"`
+}
+
+// execAuditEntry is a line of the exec audit log. Every session logs a
+// start entry before the command runs and an end entry with its exit code,
+// so sessions that never ended still leave a trace.
+type execAuditEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Session   string    `json:"session"`
+	Container string    `json:"container"`
+	Name      string    `json:"name,omitempty"`
+	Command   []string  `json:"command"`
+	UID       int       `json:"uid"`
+	User      string    `json:"user,omitempty"`
+	SudoUser  string    `json:"sudo_user,omitempty"`
+	LoginUID  string    `json:"login_uid,omitempty"`
+	Recording string    `json:"recording,omitempty"`
+	ReadOnly  bool      `json:"read_only,omitempty"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	// Timeout is session or idle for sessions shp ended
+	Timeout string `json:"timeout,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// execContainer runs a command inside a running container, with the
+// container's namespaces, cgroup, rlimits and security profile, and records
+// the session in the audit log. With limits of its own, the session runs
+// in a temporary cgroup inside the container's, so it cannot take the
+// container's memory or CPU from its workload.
+func execContainer(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var tty bool
+	fs.BoolVar(&tty, "tty", false, "allocate a pseudo-terminal for the command")
+	fs.BoolVar(&tty, "t", false, "shorthand for --tty")
+	record := fs.String("record", "", "record the session's input and output to this file")
+	readOnly := fs.Bool("read-only", false, "inspect the container through a read-only view of its mounts and without capabilities that could alter it")
+	sessionTimeout := fs.Duration("session-timeout", 0, "end the session after this long")
+	idleTimeout := fs.Duration("idle-timeout", 0, "end the session after this long without input or output")
+	var limits resourceLimits
+	var pidsLimit int64
+	fs.Func("memory", "memory limit of the session, e.g. 256m", func(v string) error {
+		n, err := parseSize(v)
+		limits.memoryBytes = n
+		return err
+	})
+	fs.Float64Var(&limits.cpus, "cpus", 0, "number of CPUs of the session")
+	fs.Func("pids-limit", "maximum number of processes in the session", func(v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid pids limit: %s", v)
+		}
+		pidsLimit = n
+		return nil
+	})
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 {
+		fmt.Println(execUsage)
+		os.Exit(1)
+	}
+	st, err := findContainer(fs.Arg(0))
+	handle(err)
+	if st.Status == statusPaused {
+		handle(fmt.Errorf("container %s is paused; unpause it first", st.ID))
+	}
+	if st.NoExec {
+		handle(fmt.Errorf("container %s does not allow exec (profile %s)", st.ID, st.Profile))
+	}
+	profile, err := lookupProfile(st.Profile)
+	handle(err)
+	if st.Security != "" {
+		sp, err := loadSecurityProfile(st.Security)
+		handle(err)
+		profile.securityProfile = *sp
+	}
+	if st.Capabilities != nil {
+		profile.Capabilities = st.Capabilities
+	}
+	if st.Seccomp != "" {
+		profile.Seccomp = st.Seccomp
+	}
+	if *readOnly {
+		profile.restrictReadOnly()
+	}
+	handle(profile.securityProfile.validate())
+	cfg, err := loadConfig()
+	handle(err)
+	limit, err := sessionLimit("session_timeout", cfg.Exec.SessionTimeout, *sessionTimeout)
+	handle(err)
+	idle, err := sessionLimit("idle_timeout", cfg.Exec.IdleTimeout, *idleTimeout)
+	handle(err)
+
+	entry, err := newExecAuditEntry(st, fs.Args()[1:])
+	handle(err)
+	entry.Recording = *record
+	entry.ReadOnly = *readOnly
+	if entry.Recording == "" && cfg.Exec.RecordDir != "" {
+		entry.Recording = filepath.Join(cfg.Exec.RecordDir, fmt.Sprintf("%s-%s.rec", st.ID, entry.Session))
+	}
+	var rec *sessionRecorder
+	if entry.Recording != "" {
+		rec, err = newSessionRecorder(entry.Recording)
+		handle(err)
+	}
+	var cgroup string
+	var session *containerCgroup
+	if st.Cgroup != "" {
+		cgroup = filepath.Join(st.Cgroup, cgroupInit)
+	} else if st.Freezer != "" {
+		cgroup = st.Freezer
+	}
+	if limits.memoryBytes > 0 || limits.cpus > 0 || pidsLimit > 0 {
+		if st.Cgroup == "" {
+			handle(fmt.Errorf("exec limits require container %s to have a cgroup, which needs cgroup v2", st.ID))
+		}
+		session, err = createSessionCgroup(st.Cgroup, entry.Session, limits, pidsLimit)
+		handle(err)
+		cgroup = session.path
+	}
+	handle(appendExecAudit(entry))
+
+	proc, err := startInContainer(st, profile, fs.Args()[1:], rec, *readOnly, tty)
+	if err == nil && cgroup != "" {
+		// clone3, which could start the command in the cgroup, is denied by
+		// seccomp filters, so the command joins it right after starting.
+		// Without its own limits, failing to join only loses accounting.
+		if err = writeCgroupFile(cgroup, "cgroup.procs", strconv.Itoa(proc.Pid())); err != nil && session == nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			err = nil
+		}
+		if err != nil {
+			proc.Signal(os.Kill)
+			proc.Wait()
+		}
+	}
+	var term *execTerminal
+	if err == nil && tty {
+		if term, err = proxyExecTerminal(proc, rec); err != nil {
+			proc.Signal(os.Kill)
+			proc.Wait()
+		}
+	}
+	if err != nil {
+		entry.Event, entry.Time, entry.Error = auditEnd, time.Now(), err.Error()
+		appendExecAudit(entry)
+		if session != nil {
+			session.remove()
+		}
+		handle(err)
+	}
+	stop := forwardSignals(proc)
+	var watch *sessionWatch
+	if limit > 0 || idle > 0 {
+		watch = watchSession(proc, limit, idle)
+	}
+	if term != nil {
+		term.drain()
+	}
+	ps, err := proc.Wait()
+	if term != nil {
+		term.close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	stop()
+	if watch != nil {
+		entry.Timeout = watch.stop()
+	}
+	if session != nil {
+		// Processes the session left behind go with its cgroup
+		session.remove()
+	}
+	code := exitStatus(ps)
+	entry.Event, entry.Time, entry.ExitCode = auditEnd, time.Now(), &code
+	if err := appendExecAudit(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if rec != nil {
+		rec.close()
+	}
+	os.Exit(code)
+}
+
+func newExecAuditEntry(st *containerState, command []string) (*execAuditEntry, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	e := &execAuditEntry{
+		Time:      time.Now(),
+		Event:     auditStart,
+		Session:   hex.EncodeToString(b),
+		Container: st.ID,
+		Name:      st.Name,
+		Command:   command,
+		UID:       os.Getuid(),
+		SudoUser:  os.Getenv("SUDO_USER"),
+	}
+	if u, err := user.LookupId(strconv.Itoa(e.UID)); err == nil {
+		e.User = u.Username
+	}
+	// The login UID survives sudo and su; 4294967295 means unset
+	if data, err := os.ReadFile("/proc/self/loginuid"); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "4294967295" {
+			e.LoginUID = id
+		}
+	}
+	return e, nil
+}
+
+// appendExecAudit appends an entry to the audit log, which only root can
+// read or write.
+func appendExecAudit(e *execAuditEntry) error {
+	dir := filepath.Join(stateDir, auditDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create audit log directory: %w", err)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, execAuditLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer f.Close()
+	// A single write keeps concurrent sessions' lines whole
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("cannot write audit log: %w", err)
+	}
+	return nil
+}
+
+// startInContainer starts command in the namespaces of the container,
+// confined by its profile, and with readOnly in a read-only view of its
+// mounts. With tty, the command runs on a terminal of the container, which
+// the caller proxies.
+func startInContainer(st *containerState, profile *containerProfile, command []string, rec *sessionRecorder, readOnly, tty bool) (*container.Process, error) {
+	cfg := container.ExecConfig{
+		Args:     command,
+		Env:      execEnv(),
+		TTY:      tty,
+		Restrict: profile.restrictThread,
+	}
+	if !tty {
+		cfg.Stdin, cfg.Stdout, cfg.Stderr = os.Stdin, os.Stdout, os.Stderr
+	}
+	if readOnly {
+		cfg.Enter = enterReadOnly
+	}
+	if rec != nil && !tty {
+		rec.attach(&cfg)
+	}
+	proc, err := container.New(*st).Exec(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil && !tty {
+		go rec.feed(proc.Stdin)
+	}
+	return proc, nil
+}
+
+// sessionLimit returns the timeout of a session: the one of the flag, or
+// the one of the configuration if the flag is not given. The flag may not
+// exceed the configured one.
+func sessionLimit(name, configured string, flag time.Duration) (time.Duration, error) {
+	if flag < 0 {
+		return 0, fmt.Errorf("invalid %s: %v", strings.ReplaceAll(name, "_", "-"), flag)
+	}
+	if configured == "" {
+		return flag, nil
+	}
+	limit, err := time.ParseDuration(configured)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid exec.%s in the configuration: %q", name, configured)
+	}
+	if flag == 0 {
+		return limit, nil
+	}
+	if limit > 0 && flag > limit {
+		return 0, fmt.Errorf("--%s %v exceeds the limit of %v in the configuration", strings.ReplaceAll(name, "_", "-"), flag, limit)
+	}
+	return flag, nil
+}
+
+// sessionWatch ends an exec session once it ran for its time limit, or saw
+// neither input nor output for its idle timeout, so forgotten debug shells
+// do not stay in long-lived containers.
+type sessionWatch struct {
+	proc   signaler
+	limit  time.Duration
+	idle   time.Duration
+	start  time.Time
+	quit   chan struct{}
+	done   chan struct{}
+	reason string
+}
+
+func watchSession(proc signaler, limit, idle time.Duration) *sessionWatch {
+	w := &sessionWatch{
+		proc:  proc,
+		limit: limit,
+		idle:  idle,
+		start: time.Now(),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *sessionWatch) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(sessionPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case now := <-ticker.C:
+			switch {
+			case w.limit > 0 && now.Sub(w.start) >= w.limit:
+				w.reason = timeoutSession
+				fmt.Fprintf(os.Stderr, "\r\nshp: session reached its time limit of %v, ending it\r\n", w.limit)
+			case w.idle > 0 && now.Sub(lastActivity(w.start)) >= w.idle:
+				w.reason = timeoutIdle
+				fmt.Fprintf(os.Stderr, "\r\nshp: session was idle for %v, ending it\r\n", w.idle)
+			default:
+				continue
+			}
+			w.hangup()
+			return
+		}
+	}
+}
+
+// hangup ends the session like a closed terminal would, with SIGHUP, which
+// shells pass on to their jobs, and SIGKILL if it is still there after a
+// grace period.
+func (w *sessionWatch) hangup() {
+	w.proc.Signal(syscall.SIGHUP)
+	select {
+	case <-w.quit:
+	case <-time.After(sessionHangupGrace):
+		w.proc.Signal(os.Kill)
+	}
+}
+
+// stop ends watching once the session exited, and returns the timeout that
+// ended it, if any.
+func (w *sessionWatch) stop() string {
+	close(w.quit)
+	<-w.done
+	return w.reason
+}
+
+// lastActivity returns when the session's terminal or streams were last
+// read or written, going by the access and modification times the kernel
+// keeps for them, like w(1) does, but no earlier than start.
+func lastActivity(start time.Time) time.Time {
+	last := start
+	for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+			continue
+		}
+		for _, t := range []syscall.Timespec{st.Atim, st.Mtim} {
+			if at := time.Unix(t.Unix()); at.After(last) {
+				last = at
+			}
+		}
+	}
+	return last
+}
+
+// execEnv returns the environment of exec sessions: a standard PATH plus
+// the terminal type and locale of the caller.
+func execEnv() []string {
+	env := []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"}
+	for _, name := range []string{"TERM", "LANG"} {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// sessionRecorder writes the input and output of an exec session to a file
+// as JSON lines with the time since the session started, the stream (i, o
+// or e) and the data, so sessions can be reviewed or replayed.
+type sessionRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	started time.Time
+}
+
+type sessionEvent struct {
+	Time   float64 `json:"t"`
+	Stream string  `json:"s"`
+	Data   string  `json:"d"`
+}
+
+func newSessionRecorder(path string) (*sessionRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("cannot create recording directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create session recording: %w", err)
+	}
+	return &sessionRecorder{f: f, enc: json.NewEncoder(f), started: time.Now()}, nil
+}
+
+func (r *sessionRecorder) record(stream string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(sessionEvent{Time: time.Since(r.started).Seconds(), Stream: stream, Data: string(data)})
+}
+
+// attach routes the output of a session without a terminal through the
+// recorder and leaves its input to a pipe fed by feed.
+func (r *sessionRecorder) attach(cfg *container.ExecConfig) {
+	cfg.Stdin = nil
+	cfg.Stdout = &recordedStream{r, "o", os.Stdout}
+	cfg.Stderr = &recordedStream{r, "e", os.Stderr}
+}
+
+// feed copies and records input to the session's stdin until the session
+// exits; the goroutine may stay blocked reading the terminal after that.
+// The recorder needs the data, so it cannot be spliced.
+func (r *sessionRecorder) feed(stdin io.WriteCloser) {
+	io.Copy(stdin, &recordedStream{r, "i", os.Stdin})
+	stdin.Close()
+}
+
+func (r *sessionRecorder) close() {
+	r.f.Close()
+}
+
+// recordedStream records data passing through it. Readers record what
+// they read, writers what they write.
+type recordedStream struct {
+	rec    *sessionRecorder
+	stream string
+	f      *os.File
+}
+
+func (s *recordedStream) Read(p []byte) (int, error) {
+	n, err := s.f.Read(p)
+	if n > 0 {
+		s.rec.record(s.stream, p[:n])
+	}
+	return n, err
+}
+
+func (s *recordedStream) Write(p []byte) (int, error) {
+	s.rec.record(s.stream, p)
+	return s.f.Write(p)
+}
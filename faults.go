@@ -0,0 +1,110 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// faultInjectEnv sets --fault-inject for every run and pull that has none,
+// e.g. those started by shp apply or autostart.
+const faultInjectEnv = "SHP_FAULT_INJECT"
+
+// faultInjection is the set of runtime failures --fault-inject simulates, so
+// that systems built on shp can be tested against them deterministically.
+// It is meant for tests only.
+type faultInjection struct {
+	spec string
+	// pullFail fails pulls, and runs of images, as if the registry was
+	// unreachable
+	pullFail bool
+	// startDelay holds the command back once the container is set up
+	startDelay time.Duration
+	// oomAfter kills the container like the OOM killer once it has run
+	// this long
+	oomAfter time.Duration
+}
+
+// parseFaults parses a comma-separated list of faults, e.g.
+// pull-fail,start-delay=2s,oom-after=10s.
+func parseFaults(v string) (faultInjection, error) {
+	f := faultInjection{spec: v}
+	for _, item := range splitList(v) {
+		name, value, hasValue := strings.Cut(item, "=")
+		var d *time.Duration
+		switch name {
+		case "pull-fail":
+			if hasValue {
+				return f, fmt.Errorf("fault pull-fail takes no value")
+			}
+			f.pullFail = true
+			continue
+		case "start-delay":
+			d = &f.startDelay
+		case "oom-after":
+			d = &f.oomAfter
+		default:
+			return f, fmt.Errorf("unknown fault %q: must be pull-fail, start-delay=<duration> or oom-after=<duration>", name)
+		}
+		n, err := time.ParseDuration(value)
+		if err != nil || n <= 0 {
+			return f, fmt.Errorf("invalid duration for fault %s: %q", name, value)
+		}
+		*d = n
+	}
+	return f, nil
+}
+
+// defaultFaults returns the faults of $SHP_FAULT_INJECT.
+func defaultFaults() (faultInjection, error) {
+	v := os.Getenv(faultInjectEnv)
+	if v == "" {
+		return faultInjection{}, nil
+	}
+	f, err := parseFaults(v)
+	if err != nil {
+		return f, fmt.Errorf("$%s: %w", faultInjectEnv, err)
+	}
+	return f, nil
+}
+
+func (f faultInjection) active() bool {
+	return f.pullFail || f.startDelay > 0 || f.oomAfter > 0
+}
+
+// pull fails with the injected pull failure of ref, if any.
+func (f faultInjection) pull(ref string) error {
+	if f.pullFail {
+		return fmt.Errorf("cannot pull %s: injected fault pull-fail", ref)
+	}
+	return nil
+}
+
+// delayStart waits out the injected start delay in the child.
+func (f faultInjection) delayStart() {
+	if f.startDelay > 0 {
+		time.Sleep(f.startDelay)
+	}
+}
+
+// injectOOM kills the container after the injected delay as the OOM
+// killer would, with SIGKILL and the on-oom hook, and returns a function
+// cancelling it. Killing the child, the init of the container's PID
+// namespace, kills every process of the container.
+func (f faultInjection) injectOOM(st *containerState, onOOM string) func() {
+	if f.oomAfter <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(f.oomAfter, func() {
+		fmt.Fprintf(os.Stderr, "fault injection: killing container %s as out of memory\n", st.ID)
+		if err := syscall.Kill(st.PID, syscall.SIGKILL); err != nil {
+			return
+		}
+		runHook(hookOOM, onOOM, st, "SHP_OOM_KILLS=1")
+	})
+	return func() { t.Stop() }
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"shp/pkg/container"
+)
+
+const (
+	pauseUsage   = "usage: shp pause <container>..."
+	unpauseUsage = "usage: shp unpause <container>..."
+
+	statusPaused = "paused"
+
+	// freezerRoot is the cgroup v1 freezer hierarchy of hosts that do not
+	// use cgroup v2 alone
+	freezerRoot = "/sys/fs/cgroup/freezer"
+)
+
+func pause(args []string) {
+	freezeCommand("pause", pauseUsage, args, true)
+}
+
+func unpause(args []string) {
+	freezeCommand("unpause", unpauseUsage, args, false)
+}
+
+func freezeCommand(name, usage string, args []string, frozen bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	for _, ref := range fs.Args() {
+		st, err := findContainer(ref)
+		handle(err)
+		handle(freezeContainer(st, frozen))
+		fmt.Println(st.ID)
+	}
+}
+
+// freezeContainer suspends every process of a container with the cgroup
+// freezer, or resumes them, and records the container as paused meanwhile.
+func freezeContainer(st *containerState, frozen bool) error {
+	if frozen && st.Status == statusStopping {
+		return fmt.Errorf("container %s is stopping", st.ID)
+	}
+	c := container.New(*st)
+	status, freeze := "", c.Resume
+	if frozen {
+		status, freeze = statusPaused, c.Pause
+	}
+	if err := freeze(context.Background()); err != nil {
+		return err
+	}
+	return setStatus(st.ID, status)
+}
+
+// createFreezer creates the group of a container in the v1 freezer
+// hierarchy and moves run into it, so the container's init is forked
+// inside and every process it starts inherits the group; leave moves run
+// back once the container started. It returns an empty path if the host
+// does not mount the hierarchy.
+func createFreezer(id string) (dir string, leave func(), err error) {
+	own, err := freezerGroup()
+	if err != nil {
+		return "", nil, nil
+	}
+	dir = filepath.Join(freezerRoot, cgroupParent, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("cannot create freezer cgroup %s: %w", dir, err)
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := writeCgroupFile(dir, "cgroup.procs", pid); err != nil {
+		syscall.Rmdir(dir)
+		return "", nil, err
+	}
+	return dir, func() { writeCgroupFile(filepath.Join(freezerRoot, own), "cgroup.procs", pid) }, nil
+}
+
+// freezerGroup returns the group of the calling process in the v1 freezer
+// hierarchy.
+func freezerGroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(freezerRoot, "cgroup.procs")); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// hierarchy-ID:controller-list:path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) == 3 && fields[1] == "freezer" {
+			return fields[2], nil
+		}
+	}
+	return "", fmt.Errorf("no freezer group in %s", procSelfCgroup)
+}
+
+// removeFreezer removes the freezer group of a container that exited,
+// thawing processes a frozen container left behind so they can end.
+func removeFreezer(dir string) {
+	writeCgroupFile(dir, "freezer.state", "THAWED")
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := syscall.Rmdir(dir)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if err != syscall.EBUSY || time.Now().After(deadline) {
+			fmt.Printf("Warning: cannot remove cgroup %s: %v\n", dir, err)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,184 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+	phaseHealth     = "health"
+)
+
+// healthProbe checks a single aspect of a running container. Probes run in
+// the child after isolation, so they see the container's filesystem and
+// network namespace rather than the host's.
+type healthProbe interface {
+	probe(ctx context.Context) error
+}
+
+// execProbe runs a command inside the container; exit status 0 is healthy.
+// It runs with the environment, working directory and user of the main
+// command.
+type execProbe struct {
+	args []string
+	env  []string
+	dir  string
+	user *syscall.Credential
+}
+
+func (p *execProbe) probe(ctx context.Context) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, getCmdPath(p.args[0]), p.args[1:]...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	cmd.Env = p.env
+	cmd.Dir = p.dir
+	if p.user != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: p.user}
+	}
+	err := reaper.start(cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// tcpProbe succeeds when a TCP connection to addr can be established.
+type tcpProbe struct {
+	addr string
+}
+
+func (p tcpProbe) probe(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// httpProbe succeeds when a GET on url returns a 2xx or 3xx status.
+type httpProbe struct {
+	url string
+}
+
+func (p httpProbe) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// healthCheck periodically runs a probe and tracks the container's health.
+type healthCheck struct {
+	probe    healthProbe
+	interval time.Duration
+	timeout  time.Duration
+	retries  int
+}
+
+// newHealthCheck builds the health check configured by opts, or returns nil
+// if no probe was requested.
+func newHealthCheck(opts *runOptions) (*healthCheck, error) {
+	var probes []healthProbe
+	if opts.healthCmd != "" {
+		args := strings.Fields(opts.healthCmd)
+		probes = append(probes, &execProbe{args: args})
+	}
+	if opts.healthTCP != "" {
+		probes = append(probes, tcpProbe{addr: opts.healthTCP})
+	}
+	if opts.healthHTTP != "" {
+		probes = append(probes, httpProbe{url: opts.healthHTTP})
+	}
+
+	switch len(probes) {
+	case 0:
+		return nil, nil
+	case 1:
+		if opts.healthInterval <= 0 || opts.healthTimeout <= 0 {
+			return nil, fmt.Errorf("health interval and timeout must be positive")
+		}
+		return &healthCheck{
+			probe:    probes[0],
+			interval: opts.healthInterval,
+			timeout:  opts.healthTimeout,
+			retries:  opts.healthRetries,
+		}, nil
+	}
+	return nil, fmt.Errorf("only one of --health-cmd, --health-tcp and --health-http may be set")
+}
+
+// configure gives an exec probe the environment, working directory and user
+// of the main command, which are known only once the container is set up.
+func (h *healthCheck) configure(env []string, dir string, user *syscall.Credential) {
+	if p, ok := h.probe.(*execProbe); ok {
+		p.env, p.dir, p.user = env, dir, user
+	}
+}
+
+// run probes until stop is closed, calling report whenever the health
+// status changes. The container turns unhealthy after retries consecutive
+// failures and healthy again on the first success.
+func (h *healthCheck) run(stop <-chan struct{}, profile *containerProfile, report func(status string, err error)) {
+	// The bounding set is per thread: exec probes are forked from this
+	// one, so it drops setup-era privileges like the main command's
+	runtime.LockOSThread()
+	if err := profile.restrictThread(); err != nil {
+		fmt.Fprintf(os.Stderr, "health: %v\n", err)
+		return
+	}
+	status := healthStarting
+	failures := 0
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		err := h.probe.probe(ctx)
+		cancel()
+
+		next := status
+		if err == nil {
+			failures = 0
+			next = healthHealthy
+		} else if failures++; failures >= h.retries || status == healthUnhealthy {
+			next = healthUnhealthy
+		}
+		if next != status {
+			status = next
+			report(status, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"shp/pkg/container"
+)
+
+const (
+	hookStart = "start"
+	hookExit  = "exit"
+	hookOOM   = "oom"
+
+	hookTimeout     = time.Minute
+	oomPollInterval = time.Second
+)
+
+// lifecycleHooks are host commands run by run on container lifecycle
+// events, with the container's metadata in SHP_* variables and its state
+// record as JSON on stdin.
+type lifecycleHooks struct {
+	onStart   string
+	onExit    string
+	onOOM     string
+	onAnomaly string
+}
+
+// register adds the start and exit commands to the in-process hooks of
+// run, so they run at the same phases as those of embedders.
+func (h lifecycleHooks) register(hooks *container.Hooks) {
+	hooks.Register(container.PhaseStarted, func(ctx context.Context, st containerState) error {
+		runHook(hookStart, h.onStart, &st)
+		return nil
+	})
+	hooks.Register(container.PhaseExited, func(ctx context.Context, st containerState) error {
+		runHook(hookExit, h.onExit, &st, fmt.Sprintf("SHP_EXIT_CODE=%d", *st.ExitCode))
+		return nil
+	})
+}
+
+// runHook runs a hook command through the host shell and waits for it, at
+// most hookTimeout. Failures are reported but do not affect the container.
+func runHook(event, command string, st *containerState, extra ...string) {
+	if command == "" {
+		return
+	}
+	stdin, err := json.Marshal(st)
+	if err != nil {
+		fmt.Printf("Warning: %s hook: %v\n", event, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"SHP_EVENT="+event,
+		"SHP_CONTAINER_ID="+st.ID,
+		"SHP_CONTAINER_NAME="+st.Name,
+		"SHP_CONTAINER_PID="+strconv.Itoa(st.PID),
+		"SHP_ROOTFS="+st.Rootfs,
+		"SHP_NETWORK="+st.Network,
+		"SHP_IP="+st.IP,
+	)
+	cmd.Env = append(cmd.Env, extra...)
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Warning: %s hook failed: %v\n", event, err)
+	}
+}
+
+// exitStatus returns the exit code of a finished process, using the shell
+// convention of 128 plus the signal number for processes killed by a signal.
+func exitStatus(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
+
+// oomWatcher runs the on-oom hook whenever the OOM killer kills a process
+// in the container's cgroup, as counted by oom_kill in its memory.events.
+type oomWatcher struct {
+	st      *containerState
+	command string
+	events  string
+	last    int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func watchOOM(st *containerState, command string) (*oomWatcher, error) {
+	rel, err := readCgroup(fmt.Sprintf("/proc/%d/cgroup", st.PID))
+	if err != nil {
+		return nil, err
+	}
+	w := &oomWatcher{
+		st:      st,
+		command: command,
+		events:  filepath.Join(cgroupRoot, rel, "memory.events"),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if w.last, err = w.oomKills(); err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(oomPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.check()
+			}
+		}
+	}()
+	return w, nil
+}
+
+func (w *oomWatcher) check() {
+	n, err := w.oomKills()
+	if err != nil || n <= w.last {
+		return
+	}
+	runHook(hookOOM, w.command, w.st, fmt.Sprintf("SHP_OOM_KILLS=%d", n-w.last))
+	w.last = n
+}
+
+func (w *oomWatcher) oomKills() (int64, error) {
+	f, err := os.Open(w.events)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "oom_kill "); ok {
+			return strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no oom_kill counter in %s", w.events)
+}
+
+// close stops watching after a last check for kills, since an OOM kill
+// often is what ended the container.
+func (w *oomWatcher) close() {
+	close(w.stop)
+	<-w.done
+	w.check()
+}
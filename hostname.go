@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+const (
+	hostnameFile = "hostname"
+	hostsFile    = "hosts"
+
+	// maxHostnameLen is HOST_NAME_MAX, the longest name sethostname accepts
+	maxHostnameLen = 64
+)
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// validateHostname checks that name is an RFC 1123 host name that fits the
+// UTS namespace.
+func validateHostname(name string) error {
+	if name == "" || len(name) > maxHostnameLen {
+		return fmt.Errorf("invalid hostname %q: must be 1 to %d characters", name, maxHostnameLen)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > 63 || !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q: labels must be letters, digits and inner hyphens", name)
+		}
+	}
+	return nil
+}
+
+// containerIP returns the first IPv4 address of the container's network
+// namespace outside loopback, or nil if it has none.
+func containerIP() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return n.IP
+		}
+	}
+	return nil
+}
+
+// setupHostname sets the host name of the container's UTS namespace and
+// mounts matching /etc/hostname and /etc/hosts over those of the rootfs.
+// The files are generated in the runtime directory, like resolv.conf, so
+// the rootfs itself is never written. Without an address of its own, the
+// container resolves its name to 127.0.1.1 as Debian does.
+func setupHostname(rootfs, id, hostname string, ip net.IP) error {
+	if err := syscall.Sethostname([]byte(hostname)); err != nil {
+		return fmt.Errorf("cannot set hostname: %w", err)
+	}
+	if ip == nil {
+		ip = net.IPv4(127, 0, 1, 1)
+	}
+	files := []struct{ name, content string }{
+		{hostnameFile, hostname + "\n"},
+		{hostsFile, fmt.Sprintf("127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n%s\t%s\n", ip, hostname)},
+	}
+	for _, f := range files {
+		source := scratchPath(id, f.name)
+		if err := os.WriteFile(source, []byte(f.content), 0644); err != nil {
+			return err
+		}
+		v := volume{source: source, target: "/etc/" + f.name, flags: defaultVolumeFlags}
+		if err := v.mount(rootfs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
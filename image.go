@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const imageUsage = `usage: shp image ls
+       shp image rm <ref>
+       shp image check <ref> [digest...]
+       shp image sbom [--json] <ref|rootfs_path>
+       shp image scan <trivy|grype> <severity> <rootfs_path>`
+
+func image(args []string) {
+	if len(args) < 1 {
+		fmt.Println(imageUsage)
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "ls":
+		handle(imageList())
+	case "rm":
+		if len(args) != 2 {
+			fmt.Println(imageUsage)
+			os.Exit(1)
+		}
+		handle(imageRemove(args[1]))
+	case "check":
+		if len(args) < 2 {
+			fmt.Println(imageUsage)
+			os.Exit(1)
+		}
+		handle(imageCheck(args[1], args[2:]))
+	case "sbom":
+		asJSON := len(args) == 3 && (args[1] == "--json" || args[1] == "-json")
+		if len(args) != 2 && !asJSON {
+			fmt.Println(imageUsage)
+			os.Exit(1)
+		}
+		handle(imageSBOM(args[len(args)-1], asJSON))
+	case "scan":
+		if len(args) != 4 {
+			fmt.Println(imageUsage)
+			os.Exit(1)
+		}
+		s, err := newScanner(args[1])
+		handle(err)
+		handle(scanRootfs(s, args[3], args[2]))
+	default:
+		fmt.Println(imageUsage)
+		os.Exit(1)
+	}
+}
+
+// imageCheck evaluates the configured image policy for ref, so operators
+// can test their allow and deny lists before relying on them.
+func imageCheck(ref string, digests []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	r, err := parseImageRef(ref)
+	if err != nil {
+		return err
+	}
+	if r.Digest != "" {
+		digests = append(digests, r.Digest)
+	}
+	if err := cfg.Images.checkRef(r); err != nil {
+		return err
+	}
+	if err := cfg.Images.checkDigests(r, digests...); err != nil {
+		return err
+	}
+	fmt.Printf("image %s allowed\n", r)
+	return nil
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// imagePolicy restricts which images may be pulled and run, and how fast
+// they are pulled. Empty allow lists allow everything; blocked digests
+// always win.
+type imagePolicy struct {
+	// AllowedRegistries lists registry hosts, e.g. "registry.example.com".
+	AllowedRegistries []string `json:"allowed_registries"`
+	// AllowedRepositories lists qualified repositories, e.g.
+	// "docker.io/library/alpine"; a trailing "/*" allows a whole namespace.
+	AllowedRepositories []string `json:"allowed_repositories"`
+	// BlockedDigests lists manifest or layer digests that are never used.
+	BlockedDigests []string `json:"blocked_digests"`
+
+	// MaxConcurrentPulls limits the blobs downloaded at once on the host.
+	MaxConcurrentPulls int `json:"max_concurrent_pulls,omitempty"`
+	// PullBandwidth caps the total download rate per second, e.g. "2m".
+	PullBandwidth string `json:"pull_bandwidth,omitempty"`
+}
+
+// pullLimits returns the download limits of the policy.
+func (p imagePolicy) pullLimits() (pullLimits, error) {
+	limits := pullLimits{Concurrent: p.MaxConcurrentPulls}
+	if limits.Concurrent < 0 {
+		return limits, fmt.Errorf("invalid max_concurrent_pulls: %d", p.MaxConcurrentPulls)
+	}
+	if p.PullBandwidth != "" {
+		n, err := parseSize(p.PullBandwidth)
+		if err != nil || n <= 0 {
+			return limits, fmt.Errorf("invalid pull_bandwidth: %q", p.PullBandwidth)
+		}
+		limits.Bandwidth = n
+	}
+	return limits, nil
+}
+
+// checkRef enforces the registry and repository allow lists.
+func (p imagePolicy) checkRef(ref imageRef) error {
+	if len(p.AllowedRegistries) > 0 && !contains(p.AllowedRegistries, ref.Registry) {
+		return fmt.Errorf("image %s denied: registry %s is not allowed", ref, ref.Registry)
+	}
+	if len(p.AllowedRepositories) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedRepositories {
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(ref.Name(), prefix+"/") || ref.Name() == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s denied: repository %s is not allowed", ref, ref.Name())
+}
+
+// checkDigests rejects any blocked digest among digests.
+func (p imagePolicy) checkDigests(ref imageRef, digests ...string) error {
+	for _, d := range digests {
+		if contains(p.BlockedDigests, d) {
+			return fmt.Errorf("image %s denied: digest %s is blocked", ref, d)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
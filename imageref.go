@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultRegistry = "docker.io"
+	defaultTag      = "latest"
+)
+
+// imageRef is a parsed image reference such as
+// "registry.example.com:5000/team/app:1.2@sha256:...".
+type imageRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageRef parses ref following the Docker conventions: a first path
+// component containing "." or ":" (or "localhost") is a registry, Docker Hub
+// official images live under "library/", and the tag defaults to "latest".
+func parseImageRef(ref string) (imageRef, error) {
+	var r imageRef
+	if ref == "" || strings.ContainsAny(ref, " \t\n") {
+		return r, fmt.Errorf("invalid image reference: %q", ref)
+	}
+
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		r.Digest = name[i+1:]
+		name = name[:i]
+		if !strings.HasPrefix(r.Digest, "sha256:") {
+			return r, fmt.Errorf("unsupported digest in image reference: %q", ref)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		r.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		r.Registry = first
+		name = rest
+	} else {
+		r.Registry = defaultRegistry
+	}
+	if r.Registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" {
+		return r, fmt.Errorf("invalid image reference: %q", ref)
+	}
+	r.Repository = name
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = defaultTag
+	}
+	return r, nil
+}
+
+// Name returns the registry-qualified repository.
+func (r imageRef) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+func (r imageRef) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,447 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	pullUsage = "usage: shp pull [--key keyref] [--max-concurrent n] [--limit-rate size] [--fault-inject faults] <image>"
+
+	imagesDir      = "images"
+	imageIndexFile = "index.json"
+	imageRootfsDir = "rootfs"
+
+	// Scratch directories of a container running an image
+	imageUpperDir  = "upper"
+	imageWorkDir   = "work"
+	imageMergedDir = "rootfs"
+)
+
+// storedImage is a pulled image: the manifest a reference resolved to and
+// the environment of its config. Its layers are unpacked into a read-only
+// rootfs shared by all containers of the image, each of which writes to an
+// overlay of its own.
+type storedImage struct {
+	Ref    string    `json:"ref"`
+	Digest string    `json:"digest"`
+	Env    []string  `json:"env,omitempty"`
+	Pulled time.Time `json:"pulled"`
+	// Blobs are the digests of the index, manifest, config and layers the
+	// image is made of, which image policies are checked against at run
+	// time. Images pulled by older versions only have Digest.
+	Blobs []string `json:"blobs,omitempty"`
+}
+
+// ociImageConfig holds the parts of an image config that shp uses.
+type ociImageConfig struct {
+	Config struct {
+		Env []string `json:"Env"`
+	} `json:"config"`
+}
+
+// imagesRoot holds the blobs and rootfs of pulled images, and the rootfs
+// of containers of the btrfs and zfs drivers: images_dir from the config
+// file, so images can live on a disk of their own, or below the state
+// directory. An unreadable config is reported by the callers loading it.
+func imagesRoot() string {
+	if cfg, err := loadConfig(); err == nil && cfg.ImagesDir != "" {
+		return cfg.ImagesDir
+	}
+	return filepath.Join(stateDir, imagesDir)
+}
+
+// rootfs returns the unpacked rootfs of the image.
+func (img *storedImage) rootfs() string {
+	return filepath.Join(imagesRoot(), imageRootfsDir, strings.TrimPrefix(img.Digest, "sha256:"))
+}
+
+func pull(args []string) {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	keyRef := fs.String("key", "", "key reference to decrypt encrypted layers with")
+	concurrent := fs.Int("max-concurrent", -1, "blobs downloaded at once on the host, overriding the config")
+	var rate int64 = -1
+	fs.Func("limit-rate", "download bandwidth per second, e.g. 2m, overriding the config", func(v string) error {
+		n, err := parseSize(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid rate: %s", v)
+		}
+		rate = n
+		return nil
+	})
+	faults, err := defaultFaults()
+	handle(err)
+	fs.Func("fault-inject", "test only: comma-separated faults to simulate, e.g. pull-fail", func(v string) error {
+		f, err := parseFaults(v)
+		faults = f
+		return err
+	})
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Println(pullUsage)
+		os.Exit(1)
+	}
+	handle(faults.pull(fs.Arg(0)))
+	var key []byte
+	if *keyRef != "" {
+		key, err = loadLayerKey(*keyRef)
+		handle(err)
+	}
+	cfg, err := loadConfig()
+	handle(err)
+	limits, err := cfg.Images.pullLimits()
+	handle(err)
+	if *concurrent >= 0 {
+		limits.Concurrent = *concurrent
+	}
+	if rate > 0 {
+		limits.Bandwidth = rate
+	}
+	img, err := pullImage(fs.Arg(0), cfg.Images, limits, key)
+	handle(err)
+	fmt.Printf("Pulled %s (%s)\n", img.Ref, img.Digest)
+}
+
+// pullImage downloads an image into the blob store, unpacks its rootfs and
+// records the reference in the image index.
+func pullImage(ref string, policy imagePolicy, limits pullLimits, key []byte) (*storedImage, error) {
+	r, err := parseImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.checkRef(r); err != nil {
+		return nil, err
+	}
+	client := newRegistryClient(r)
+	reference := r.Digest
+	if reference == "" {
+		reference = r.Tag
+	}
+	m, data, digest, err := client.manifest(reference)
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{digest}
+	if m.isIndex() {
+		platform, err := platformManifest(m)
+		if err != nil {
+			return nil, fmt.Errorf("image %s: %w", r, err)
+		}
+		if m, data, digest, err = client.manifest(platform); err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	digests = append(digests, m.Config.Digest)
+	for _, l := range m.Layers {
+		digests = append(digests, l.Digest)
+	}
+	if err := policy.checkDigests(r, digests...); err != nil {
+		return nil, err
+	}
+
+	store := newBlobStore(imagesRoot())
+	store.limit(limits)
+	need := missingBlobsSize(store, append([]ociDescriptor{m.Config}, m.Layers...)...)
+	if err := checkSpace(store.root, need, "download "+r.String()); err != nil {
+		return nil, err
+	}
+	fromBytes := func(b []byte) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		}
+	}
+	if _, err := store.ensure(digest, fromBytes(data)); err != nil {
+		return nil, err
+	}
+	configPath, err := store.ensure(m.Config.Digest, func(w io.Writer) error { return client.blob(m.Config.Digest, w) })
+	if err != nil {
+		return nil, err
+	}
+	var fetches []func() error
+	for _, l := range m.Layers {
+		l := l
+		fetches = append(fetches, func() error {
+			if store.has(l.Digest) {
+				fmt.Printf("%s: already exists\n", shortDigest(l.Digest))
+				return nil
+			}
+			if _, err := store.ensure(l.Digest, func(w io.Writer) error { return client.blob(l.Digest, w) }); err != nil {
+				return err
+			}
+			fmt.Printf("%s: downloaded\n", shortDigest(l.Digest))
+			return nil
+		})
+	}
+	if err := runParallel(fetches...); err != nil {
+		return nil, err
+	}
+
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var config ociImageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("cannot parse image config: %w", err)
+	}
+	img := &storedImage{Ref: r.String(), Digest: digest, Env: config.Config.Env, Pulled: time.Now(), Blobs: digests}
+	if err := ensureRootfs(store, img, m.Layers, key); err != nil {
+		return nil, err
+	}
+	for _, l := range m.Layers {
+		if strings.HasSuffix(l.MediaType, mediaTypeEncryptedSuffix) {
+			fmt.Printf("Warning: encrypted layers of %s are stored unencrypted in %s\n", r, img.rootfs())
+			break
+		}
+	}
+	return img, updateImageIndex(func(index map[string]*storedImage) error {
+		index[img.Ref] = img
+		return nil
+	})
+}
+
+// ensureRootfs unpacks the rootfs of an image unless it already exists.
+func ensureRootfs(store *blobStore, img *storedImage, layers []ociDescriptor, key []byte) error {
+	dest := img.rootfs()
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	unlock, err := lockFile(dest + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	return unpackLayers(store, layers, key, dest)
+}
+
+func shortDigest(digest string) string {
+	d := strings.TrimPrefix(digest, "sha256:")
+	if len(d) > 12 {
+		d = d[:12]
+	}
+	return d
+}
+
+// loadImageIndex returns the pulled images by reference. A host without
+// any pulled images, or a user who may not read them, has an empty index.
+func loadImageIndex() (map[string]*storedImage, error) {
+	store, err := openStore(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	var index map[string]*storedImage
+	err = store.view(func(tx storeTx) error {
+		index, err = readImageIndex(tx)
+		return err
+	})
+	if errors.Is(err, fs.ErrPermission) {
+		return make(map[string]*storedImage), nil
+	}
+	return index, err
+}
+
+func readImageIndex(tx storeTx) (map[string]*storedImage, error) {
+	records, err := tx.list(bucketImages)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]*storedImage, len(records))
+	for ref, data := range records {
+		img := &storedImage{}
+		if err := json.Unmarshal(data, img); err != nil {
+			return nil, fmt.Errorf("cannot parse image %s: %w", ref, err)
+		}
+		index[ref] = img
+	}
+	return index, nil
+}
+
+// updateImageIndex changes the image index in a transaction.
+func updateImageIndex(fn func(map[string]*storedImage) error) error {
+	store, err := openStore(stateDir)
+	if err != nil {
+		return err
+	}
+	return store.update(func(tx storeTx) error {
+		index, err := readImageIndex(tx)
+		if err != nil {
+			return err
+		}
+		refs := make([]string, 0, len(index))
+		for ref := range index {
+			refs = append(refs, ref)
+		}
+		if err := fn(index); err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if index[ref] == nil {
+				if err := tx.delete(bucketImages, ref); err != nil {
+					return err
+				}
+			}
+		}
+		for ref, img := range index {
+			if err := putRecord(tx, bucketImages, ref, img); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// lookupImage returns the pulled image ref refers to, or nil.
+func lookupImage(ref string) (*storedImage, error) {
+	r, err := parseImageRef(ref)
+	if err != nil {
+		return nil, nil
+	}
+	index, err := loadImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	return index[r.String()], nil
+}
+
+// imageForRootfs returns the pulled image the rootfs argument of run refers
+// to, or nil if it is a directory. Images are subject to the image policy
+// when they run as well as when they are pulled.
+func imageForRootfs(arg string) (*storedImage, error) {
+	if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+		return nil, nil
+	}
+	img, err := lookupImage(arg)
+	if err != nil || img == nil {
+		return nil, err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseImageRef(img.Ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Images.checkRef(r); err != nil {
+		return nil, err
+	}
+	// Digests blocked after the pull apply too
+	if err := cfg.Images.checkDigests(r, append([]string{img.Digest}, img.Blobs...)...); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// mountImage gives a container a writable rootfs of the image with the
+// storage driver, in the container's mount namespace, and returns its path.
+// Writes are discarded with the container.
+func mountImage(img *storedImage, id string, quota int64) (string, error) {
+	driver, err := openStorageDriver()
+	if err != nil {
+		return "", err
+	}
+	merged, err := driver.mount(img.rootfs(), id, quota)
+	if err != nil {
+		return "", fmt.Errorf("cannot mount image %s: %w", img.Ref, err)
+	}
+	// Squashed images, like those of bundles, lack the run-time mount points
+	for dir := range manifestSkip {
+		p, err := securePath(merged, dir)
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return "", err
+		}
+	}
+	return merged, nil
+}
+
+// imageList prints the pulled images.
+func imageList() error {
+	index, err := loadImageIndex()
+	if err != nil {
+		return err
+	}
+	refs := make([]string, 0, len(index))
+	for ref := range index {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tDIGEST\tPULLED")
+	for _, ref := range refs {
+		img := index[ref]
+		fmt.Fprintf(w, "%s\t%s\t%s\n", ref, shortDigest(img.Digest), img.Pulled.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// imageRemove forgets a pulled image and deletes its rootfs unless another
+// reference or a running container still uses it. Blobs stay in the store,
+// so pulling the image again needs no downloads.
+func imageRemove(ref string) error {
+	r, err := parseImageRef(ref)
+	if err != nil {
+		return err
+	}
+	var removed *storedImage
+	var inUse bool
+	err = updateImageIndex(func(index map[string]*storedImage) error {
+		removed = index[r.String()]
+		if removed == nil {
+			return fmt.Errorf("no such image: %s", ref)
+		}
+		states, err := listStates()
+		if err != nil {
+			return err
+		}
+		for _, st := range states {
+			if st.Rootfs == removed.rootfs() {
+				return fmt.Errorf("image %s is used by container %s", ref, st.ID)
+			}
+		}
+		delete(index, r.String())
+		for _, img := range index {
+			inUse = inUse || img.Digest == removed.Digest
+		}
+		return nil
+	})
+	if err != nil || inUse {
+		return err
+	}
+	driver, err := openStorageDriver()
+	if err != nil {
+		return err
+	}
+	os.Remove(removed.rootfs() + ".lock")
+	return driver.removeImage(removed.rootfs())
+}
+
+// imageEnv returns env with the variables of an image set. The image's
+// variables win over those passed through from the host, whose PATH, for
+// one, rarely fits the image.
+func imageEnv(img *storedImage, env []string) []string {
+	for _, kv := range img.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		env = setEnv(env, name, value)
+	}
+	return env
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// parseInitScript checks an --init-script value and makes it absolute, so
+// that it still resolves when the run is replayed from another directory.
+func parseInitScript(v string) (string, error) {
+	path, err := filepath.Abs(v)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("init script: %w", err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("init script %s is not an executable file", path)
+	}
+	return path, nil
+}
+
+// openInitScript opens the host file of an init script while the host
+// filesystem is still reachable.
+func openInitScript(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open init script: %w", err)
+	}
+	return f, nil
+}
+
+// runInitScript executes the opened init script inside the container and
+// waits for it. The script is not copied into the rootfs: it is executed
+// through its file descriptor, which the command inherits as fd 3, so that
+// interpreters named by a #! line can open it as /proc/self/fd/3 as well.
+func runInitScript(script *os.File, env []string) error {
+	defer script.Close()
+	cmd := exec.Command("/proc/self/fd/3")
+	cmd.Args = []string{filepath.Base(script.Name())}
+	cmd.ExtraFiles = []*os.File{script}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("init script %s failed: %w", script.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const inspectUsage = "usage: shp inspect <container>..."
+
+// containerInspect is the configuration and runtime state of a container
+// as shp inspect prints it: the state record, completed with what the
+// kernel reports about the container's processes.
+type containerInspect struct {
+	*containerState
+	Status string `json:"status"`
+	// WorkloadPID is the process running the container's command, a child
+	// of the container's init at PID
+	WorkloadPID int               `json:"workload_pid,omitempty"`
+	Env         []string          `json:"env"`
+	Namespaces  map[string]string `json:"namespaces"`
+	// Cgroups maps the controllers of each hierarchy the init belongs to,
+	// or "unified" for cgroup v2, to its group
+	Cgroups map[string]string `json:"cgroups"`
+	Mounts  []mountEntry      `json:"mounts"`
+}
+
+// mountEntry is a mount of the container, with the target relative to its
+// root.
+type mountEntry struct {
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	Type    string `json:"type"`
+	Options string `json:"options"`
+}
+
+func inspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Println(inspectUsage)
+		os.Exit(1)
+	}
+	var all []*containerInspect
+	for _, ref := range fs.Args() {
+		st, err := findContainer(ref)
+		handle(err)
+		c, err := inspectContainer(st)
+		handle(err)
+		all = append(all, c)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	handle(enc.Encode(all))
+}
+
+// inspectContainer reads the runtime state of a container from /proc.
+func inspectContainer(st *containerState) (*containerInspect, error) {
+	c := &containerInspect{containerState: st, Status: st.Status, Env: []string{}, Namespaces: make(map[string]string), Cgroups: make(map[string]string)}
+	if c.Status == "" {
+		c.Status = statusRunning
+	}
+	proc := fmt.Sprintf("/proc/%d", st.PID)
+	links, err := filepath.Glob(proc + "/ns/*")
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if ns, err := os.Readlink(link); err == nil {
+			c.Namespaces[filepath.Base(link)] = ns
+		}
+	}
+	if len(c.Namespaces) == 0 {
+		return nil, fmt.Errorf("container %s exited", st.ID)
+	}
+	if data, err := os.ReadFile(proc + "/cgroup"); err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			// hierarchy-ID:controller-list:path
+			fields := strings.SplitN(line, ":", 3)
+			if len(fields) != 3 {
+				continue
+			}
+			if fields[1] == "" {
+				fields[1] = "unified"
+			}
+			c.Cgroups[fields[1]] = fields[2]
+		}
+	}
+	if c.Mounts, err = readMounts(st.PID); err != nil {
+		return nil, err
+	}
+	c.WorkloadPID = workloadPID(st.PID)
+	if c.WorkloadPID != 0 {
+		if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", c.WorkloadPID)); err == nil {
+			for _, kv := range bytes.Split(data, []byte{0}) {
+				if len(kv) > 0 {
+					c.Env = append(c.Env, string(kv))
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+// readMounts parses the mountinfo of a process.
+func readMounts(pid int) ([]mountEntry, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	if err != nil {
+		return nil, err
+	}
+	mounts := []mountEntry{}
+	for _, line := range strings.Split(string(data), "\n") {
+		// ID parent major:minor root target options [optional...] - type source super-options
+		mount, super, ok := strings.Cut(line, " - ")
+		fields, superFields := strings.Fields(mount), strings.Fields(super)
+		if !ok || len(fields) < 6 || len(superFields) < 2 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			Source:  unescapeMountinfo(superFields[1]),
+			Target:  unescapeMountinfo(fields[4]),
+			Type:    superFields[0],
+			Options: fields[5],
+		})
+	}
+	return mounts, nil
+}
+
+// unescapeMountinfo decodes the octal escapes of spaces, tabs, newlines
+// and backslashes in mountinfo paths.
+func unescapeMountinfo(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// workloadPID returns the oldest child of the container's init, which runs
+// its command, or 0 if there is none.
+func workloadPID(init int) int {
+	pids, err := namespacePIDs(init)
+	if err != nil {
+		return 0
+	}
+	oldest, started := 0, uint64(0)
+	for _, pid := range pids {
+		if st, err := readProcStat(pid); err == nil && st.ppid == init && (oldest == 0 || st.startTime < started) {
+			oldest, started = pid, st.startTime
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,251 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	hookAnomaly = "anomaly"
+
+	canaryFile  = "canary"
+	canaryMount = "canary.mnt"
+)
+
+// integrityMonitor periodically verifies from the host that a container is
+// still confined: that it cannot see host paths, that its maskings and
+// read-only mounts persist, and that no process with capabilities beyond
+// the container's joined it. Canaries planted in the host's runtime
+// directory expose host paths or mounts leaking into the container.
+type integrityMonitor struct {
+	st       *containerState
+	profile  *containerProfile
+	command  string
+	interval time.Duration
+
+	canary    os.FileInfo
+	mountPath string
+	mountTag  string
+
+	allowedCaps uint64
+	// protected records, per masked or read-only path, whether its
+	// protection was seen in place; only protections seen once are
+	// expected to persist, since setup may still be running
+	protected map[string]bool
+	reported  map[string]bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// startIntegrityChecks plants the canaries of a started container and
+// checks it every interval until close.
+func startIntegrityChecks(st *containerState, profile *containerProfile, interval time.Duration, command string) (*integrityMonitor, error) {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	m := &integrityMonitor{
+		st:        st,
+		profile:   profile,
+		command:   command,
+		interval:  interval,
+		mountPath: scratchPath(st.ID, canaryMount),
+		mountTag:  "shp-canary-" + hex.EncodeToString(token),
+		protected: make(map[string]bool),
+		reported:  make(map[string]bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	path := scratchPath(st.ID, canaryFile)
+	if err := os.WriteFile(path, []byte(m.mountTag+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("cannot plant canary: %w", err)
+	}
+	var err error
+	if m.canary, err = os.Stat(path); err != nil {
+		return nil, err
+	}
+	// Mounted after the container started, the canary mount must never
+	// propagate into it
+	if err := os.Mkdir(m.mountPath, 0700); err != nil {
+		return nil, fmt.Errorf("cannot plant canary mount: %w", err)
+	}
+	if err := syscall.Mount(m.mountTag, m.mountPath, "tmpfs", syscall.MS_RDONLY, "size=0"); err != nil {
+		return nil, fmt.Errorf("cannot plant canary mount: %w", err)
+	}
+	for _, name := range profile.boundingSet() {
+		m.allowedCaps |= 1 << uint(capabilities[name])
+	}
+	go m.run()
+	return m, nil
+}
+
+func (m *integrityMonitor) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		anomalies := m.check()
+		found := make(map[string]bool, len(anomalies))
+		for _, a := range anomalies {
+			found[a] = true
+			if !m.reported[a] {
+				fmt.Fprintf(os.Stderr, "integrity: %s %s\n", m.st.ID, a)
+				runHook(hookAnomaly, m.command, m.st, "SHP_ANOMALY="+a)
+			}
+		}
+		// A lasting anomaly is reported once, until it cleared
+		m.reported = found
+	}
+}
+
+// check returns a description of every anomaly found. A container that
+// exited between checks yields none.
+func (m *integrityMonitor) check() []string {
+	var anomalies []string
+	root := fmt.Sprintf("/proc/%d/root", m.st.PID)
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return nil
+	}
+	if hostInfo, err := os.Stat("/"); err == nil && os.SameFile(rootInfo, hostInfo) {
+		anomalies = append(anomalies, "container root is the host root")
+	} else if fi, err := os.Stat(root + scratchPath(m.st.ID, canaryFile)); err == nil && os.SameFile(fi, m.canary) {
+		anomalies = append(anomalies, "host path "+filepath.Dir(scratchPath(m.st.ID, canaryFile))+" is visible")
+	}
+
+	mounts, mountinfo, err := readMountinfo(fmt.Sprintf("/proc/%d/mountinfo", m.st.PID))
+	if err != nil {
+		return anomalies
+	}
+	if strings.Contains(mountinfo, m.mountTag) {
+		anomalies = append(anomalies, "host mount propagated into the container")
+	}
+	// Masked files are bind mounts of a writable /dev/null, so only
+	// read-only paths and the rootfs must stay read-only
+	type protection struct {
+		path     string
+		readonly bool
+	}
+	var expected []protection
+	if m.profile.ReadOnlyRootfs {
+		expected = append(expected, protection{"/", true})
+	}
+	for _, path := range m.profile.MaskedPaths {
+		expected = append(expected, protection{path, false})
+	}
+	for _, path := range m.profile.ReadOnlyPaths {
+		expected = append(expected, protection{path, true})
+	}
+	for _, p := range expected {
+		readonly, mounted := mounts[p.path]
+		ok := mounted && (readonly || !p.readonly)
+		if m.protected[p.path] && !ok {
+			anomalies = append(anomalies, "protection of "+p.path+" was removed")
+		}
+		m.protected[p.path] = m.protected[p.path] || ok
+	}
+
+	pids, err := namespacePIDs(m.st.PID)
+	if err != nil {
+		return anomalies
+	}
+	for _, pid := range pids {
+		// The init keeps its setup privileges but runs no workload code
+		if pid == m.st.PID {
+			continue
+		}
+		if caps, err := effectiveCaps(pid); err == nil && caps&^m.allowedCaps != 0 {
+			anomalies = append(anomalies, fmt.Sprintf("process %d has capabilities %#x outside the container's set", pid, caps&^m.allowedCaps))
+		}
+	}
+	return append(anomalies, m.outsiders(pids)...)
+}
+
+// outsiders returns anomalies for processes in the container's cgroup that
+// are not in its PID namespace. It only applies when the container has a
+// cgroup of its own rather than sharing that of shp.
+func (m *integrityMonitor) outsiders(pids []int) []string {
+	rel, err := readCgroup(fmt.Sprintf("/proc/%d/cgroup", m.st.PID))
+	if err != nil {
+		return nil
+	}
+	if own, err := currentCgroup(); err != nil || own == rel {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, rel, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	inside := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		inside[pid] = true
+	}
+	var anomalies []string
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil && !inside[pid] {
+			anomalies = append(anomalies, fmt.Sprintf("process %d joined the container's cgroup from outside", pid))
+		}
+	}
+	return anomalies
+}
+
+// readMountinfo returns the mount points in the mountinfo file of a
+// process, relative to its root, with whether the last mount on each is
+// read-only, and the raw mountinfo.
+func readMountinfo(path string) (map[string]bool, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	mounts := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		readonly := false
+		for _, opt := range strings.Split(fields[5], ",") {
+			readonly = readonly || opt == "ro"
+		}
+		mounts[fields[4]] = readonly
+	}
+	return mounts, string(data), nil
+}
+
+// effectiveCaps returns the effective capability set of a process.
+func effectiveCaps(pid int) (uint64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "CapEff:"); ok {
+			return strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("no CapEff in status of %d", pid)
+}
+
+// close stops the checks and removes the canary mount.
+func (m *integrityMonitor) close() {
+	close(m.stop)
+	<-m.done
+	syscall.Unmount(m.mountPath, syscall.MNT_DETACH)
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ipamHostLocal = "host-local"
+	ipamDHCP      = "dhcp"
+)
+
+// ipamDriver hands out container addresses on a network.
+type ipamDriver interface {
+	// allocate leases an address to the container whose eth0 is up, but not
+	// yet addressed, in the network namespace of pid.
+	allocate(id string, pid int) (*ipLease, error)
+}
+
+// ipLease is an address leased to a container, with the prefix length and
+// gateway it is configured with.
+type ipLease struct {
+	ip        net.IP
+	prefixLen int
+	gateway   net.IP
+
+	// release gives the address back before the container's runtime
+	// directory is removed; nil if nothing has to be done
+	release func()
+}
+
+// newIPAM returns the IPAM driver configured for a network.
+func newIPAM(n *networkConfig) (ipamDriver, error) {
+	switch n.IPAM {
+	case "", ipamHostLocal:
+		addr, err := n.addressing()
+		if err != nil {
+			return nil, err
+		}
+		return &hostLocalIPAM{network: n.Name, addr: addr}, nil
+	case ipamDHCP:
+		return &dhcpIPAM{}, nil
+	}
+	return nil, fmt.Errorf("unknown IPAM driver: %s", n.IPAM)
+}
+
+// hostLocalIPAM allocates the lowest free address of the network's pool.
+// Leases are files in the container runtime directories, so they are
+// released together with the rest of the container's runtime state.
+type hostLocalIPAM struct {
+	network string
+	addr    *netAddressing
+}
+
+func (h *hostLocalIPAM) allocate(id string, pid int) (*ipLease, error) {
+	unlock, err := lockFile(filepath.Join(runtimeDir, ipamLock))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Drops the runtime directories, and so the leases, of dead containers
+	if _, err := listStates(); err != nil {
+		return nil, err
+	}
+	leases, err := filepath.Glob(filepath.Join(runtimeDir, "*", ipFile))
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, lease := range leases {
+		if data, err := os.ReadFile(lease); err == nil {
+			used[strings.TrimSpace(string(data))] = true
+		}
+	}
+	addr := h.addr
+	if addr.gateway != nil {
+		used[addr.gateway.String()] = true
+	}
+
+	for ip := addr.pool.IP.To4(); addr.pool.Contains(ip); ip = nextIP(ip) {
+		// Skip the network and broadcast addresses of the subnet
+		if ip.Equal(addr.subnet.IP) || !addr.subnet.Contains(nextIP(ip)) || used[ip.String()] {
+			continue
+		}
+		if err := recordLease(id, ip); err != nil {
+			return nil, err
+		}
+		return &ipLease{ip: ip, prefixLen: addr.prefixLen(), gateway: addr.gateway}, nil
+	}
+	return nil, fmt.Errorf("no free address left in network %s", h.network)
+}
+
+// recordLease notes the container's address in its runtime directory.
+func recordLease(id string, ip net.IP) error {
+	if err := os.WriteFile(scratchPath(id, ipFile), []byte(ip.String()), 0600); err != nil {
+		return fmt.Errorf("cannot record address lease: %w", err)
+	}
+	return nil
+}
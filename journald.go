@@ -0,0 +1,143 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	logDriverJournald = "journald"
+
+	journalSocket = "/run/systemd/journal/socket"
+	// journalMaxLine splits longer lines into several entries, like Docker,
+	// so every entry fits a datagram
+	journalMaxLine = 16 << 10
+
+	journalPriorityErr  = 3
+	journalPriorityInfo = 6
+)
+
+var journalNamespacePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// journalLogger sends the output of a container to journald, an entry per
+// line, over its native protocol. Every entry carries the fields that
+// identify the container, so `journalctl -t <name>` or
+// `journalctl CONTAINER_ID=<id>` shows the output of one container only.
+type journalLogger struct {
+	conn   *net.UnixConn
+	fields []byte
+	wg     sync.WaitGroup
+
+	warnOnce sync.Once
+}
+
+// journalFields are the fields identifying a container in the journal,
+// named like those of Docker's journald driver.
+func journalFields(id, name, image string) [][2]string {
+	tag := name
+	if tag == "" {
+		tag = id
+	}
+	fields := [][2]string{{"SYSLOG_IDENTIFIER", tag}, {"CONTAINER_ID", id}}
+	if name != "" {
+		fields = append(fields, [2]string{"CONTAINER_NAME", name})
+	}
+	if image != "" {
+		fields = append(fields, [2]string{"IMAGE_NAME", image})
+	}
+	return fields
+}
+
+// journalSocketPath returns the socket of the journal namespace, or of the
+// default journal if namespace is empty.
+func journalSocketPath(namespace string) string {
+	if namespace == "" {
+		return journalSocket
+	}
+	return "/run/systemd/journal." + namespace + "/socket"
+}
+
+// ensureJournalNamespace starts the journald instance of namespace unless
+// it runs already. systemd creates the namespace on first use.
+func ensureJournalNamespace(namespace string) error {
+	if _, err := os.Stat(journalSocketPath(namespace)); err == nil {
+		return nil
+	}
+	if err := runTool("systemctl", "start", "systemd-journald@"+namespace+".socket"); err != nil {
+		return fmt.Errorf("cannot start journal namespace %s: %w", namespace, err)
+	}
+	return nil
+}
+
+// newJournalLogger connects to the journal of namespace, tagging entries
+// with fields, in order.
+func newJournalLogger(namespace string, fields [][2]string) (*journalLogger, error) {
+	if namespace != "" {
+		if err := ensureJournalNamespace(namespace); err != nil {
+			return nil, err
+		}
+	}
+	path := journalSocketPath(namespace)
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to journald at %s: %w", path, err)
+	}
+	j := &journalLogger{conn: conn}
+	for _, f := range fields {
+		j.fields = appendJournalField(j.fields, f[0], f[1])
+	}
+	return j, nil
+}
+
+// appendJournalField encodes a field of the native journal protocol; values
+// with newlines need the length-prefixed form.
+func appendJournalField(b []byte, key, value string) []byte {
+	if !strings.ContainsRune(value, '\n') {
+		return append(append(append(b, key...), '='), value+"\n"...)
+	}
+	b = append(append(b, key...), '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	return append(b, value+"\n"...)
+}
+
+// stream sends the lines read from r as entries until EOF, those of stderr
+// at error priority.
+func (j *journalLogger) stream(r *os.File, stderr bool) {
+	priority := journalPriorityInfo
+	if stderr {
+		priority = journalPriorityErr
+	}
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		readLines(r, journalMaxLine, func(line []byte) {
+			j.send(bytes.TrimSuffix(line, []byte("\n")), priority)
+		})
+	}()
+}
+
+func (j *journalLogger) send(msg []byte, priority int) {
+	entry := append([]byte{}, j.fields...)
+	entry = appendJournalField(entry, "PRIORITY", strconv.Itoa(priority))
+	entry = appendJournalField(entry, "MESSAGE", string(msg))
+	if _, err := j.conn.Write(entry); err != nil {
+		j.warnOnce.Do(func() {
+			fmt.Printf("Warning: cannot send container output to journald: %v\n", err)
+		})
+	}
+}
+
+// wait blocks until all output has been sent, and disconnects.
+func (j *journalLogger) wait() {
+	j.wg.Wait()
+	j.conn.Close()
+}
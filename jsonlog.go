@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	logDriverJSONFile = "json-file"
+
+	jsonLogFile = "output.json"
+	// jsonLogMaxLine splits longer lines into several entries, like Docker;
+	// only the last one ends in a newline
+	jsonLogMaxLine = 16 << 10
+)
+
+// lineDriver is a log driver that takes stdout and stderr of a container
+// apart and records them line by line.
+type lineDriver interface {
+	stream(r *os.File, stderr bool)
+	// wait blocks until all output has been recorded, and releases the
+	// destination
+	wait()
+}
+
+// openLogDriver opens the driver opts select for the container. For the
+// json-file driver, it also returns the path of the log.
+func openLogDriver(opts *runOptions, id, image string) (lineDriver, string, error) {
+	if opts.logDriver == logDriverJournald {
+		j, err := newJournalLogger(opts.journalNamespace, journalFields(id, opts.name, image))
+		if err != nil {
+			return nil, "", err
+		}
+		return j, "", nil
+	}
+	path := scratchPath(id, jsonLogFile)
+	if opts.logFile != "" {
+		var err error
+		if path, err = filepath.Abs(opts.logFile); err != nil {
+			return nil, "", err
+		}
+	}
+	sink, err := openLogSink(path)
+	if err != nil {
+		return nil, "", err
+	}
+	j, err := newJSONLogger(sink, scratchPath(id, logIndexFile))
+	if err != nil {
+		sink.Close()
+		return nil, "", err
+	}
+	return j, path, nil
+}
+
+// readLines calls emit with every line read from r until EOF, including
+// the newline. Lines longer than max are passed on in pieces.
+func readLines(r *os.File, max int, emit func(line []byte)) {
+	defer r.Close()
+	br := bufio.NewReaderSize(r, max)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			emit(line)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// jsonLogEntry is a line of output in a json-file log, in the format of
+// Docker's json-file driver.
+type jsonLogEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// jsonLogger writes the output of a container to a file as JSON lines
+// stamped with the time and the stream each line came from. Like the raw
+// log, the file has an index, whose first record is the offset the output
+// of the container starts at; shp logs needs no other marks, as every
+// entry carries its time.
+type jsonLogger struct {
+	sink  *os.File
+	index *logIndex
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+
+	warnOnce sync.Once
+}
+
+func newJSONLogger(sink *os.File, indexPath string) (*jsonLogger, error) {
+	index, err := openLogIndex(indexPath, sink)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLogger{sink: sink, index: index}, nil
+}
+
+func (j *jsonLogger) stream(r *os.File, stderr bool) {
+	name := "stdout"
+	if stderr {
+		name = "stderr"
+	}
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		readLines(r, jsonLogMaxLine, func(line []byte) {
+			j.write(jsonLogEntry{Log: string(line), Stream: name, Time: time.Now().UTC()})
+		})
+	}()
+}
+
+func (j *jsonLogger) write(e jsonLogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.sink.Write(append(b, '\n')); err != nil {
+		j.warnOnce.Do(func() {
+			fmt.Printf("Warning: cannot write container output to %s: %v\n", j.sink.Name(), err)
+		})
+	}
+}
+
+func (j *jsonLogger) wait() {
+	j.wg.Wait()
+	j.index.close()
+	j.sink.Close()
+}
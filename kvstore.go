@@ -0,0 +1,267 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	kvStoreFile = "state.db"
+
+	// kvBatchHeader is the length and CRC-32 of a batch's payload
+	kvBatchHeader = 8
+	// kvCompactSize is the file size from which superseded records are
+	// dropped, once they make up more than half of the file
+	kvCompactSize = 1 << 20
+)
+
+// kvOp is a write of a batch. A missing value deletes the record.
+type kvOp struct {
+	Bucket string          `json:"b"`
+	Key    string          `json:"k"`
+	Value  json.RawMessage `json:"v,omitempty"`
+}
+
+// kvStore is the embedded key-value backend: all records of a root live in
+// one append-only file, so listing thousands of records is a single read.
+// Every transaction is appended as one checksummed batch of writes, which
+// is applied entirely or, if shp died while writing it, not at all. Readers
+// take no lock: they ignore an incomplete last batch, and compaction
+// replaces the file by renaming a new one over it.
+type kvStore struct {
+	path string
+}
+
+// kvData holds the records of a kvStore by bucket and key.
+type kvData map[string]map[string][]byte
+
+// load replays the batches of the file and returns the records with the
+// length of the file's valid prefix.
+func (s *kvStore) load() (kvData, int64, error) {
+	data := make(kvData)
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return data, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("cannot read %s: %w", s.path, err)
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read %s: %w", s.path, err)
+	}
+	var valid int64
+	for len(buf) >= kvBatchHeader {
+		n := binary.BigEndian.Uint32(buf)
+		sum := binary.BigEndian.Uint32(buf[4:])
+		if uint64(len(buf)-kvBatchHeader) < uint64(n) {
+			break
+		}
+		payload := buf[kvBatchHeader : kvBatchHeader+int(n)]
+		var ops []kvOp
+		if crc32.ChecksumIEEE(payload) != sum || json.Unmarshal(payload, &ops) != nil {
+			break
+		}
+		data.apply(ops)
+		buf = buf[kvBatchHeader+int(n):]
+		valid += kvBatchHeader + int64(n)
+	}
+	return data, valid, nil
+}
+
+func (d kvData) apply(ops []kvOp) {
+	for _, op := range ops {
+		if op.Value == nil {
+			delete(d[op.Bucket], op.Key)
+			continue
+		}
+		if d[op.Bucket] == nil {
+			d[op.Bucket] = make(map[string][]byte)
+		}
+		d[op.Bucket][op.Key] = op.Value
+	}
+}
+
+// size is the length of the data written as a single batch.
+func (d kvData) size() int64 {
+	n := int64(kvBatchHeader)
+	for bucket, records := range d {
+		for key, value := range records {
+			n += int64(len(bucket) + len(key) + len(value) + 20)
+		}
+	}
+	return n
+}
+
+// ops returns the writes that recreate d, in a stable order.
+func (d kvData) ops() []kvOp {
+	var ops []kvOp
+	for bucket, records := range d {
+		for key, value := range records {
+			ops = append(ops, kvOp{Bucket: bucket, Key: key, Value: value})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Bucket != ops[j].Bucket {
+			return ops[i].Bucket < ops[j].Bucket
+		}
+		return ops[i].Key < ops[j].Key
+	})
+	return ops
+}
+
+func encodeBatch(ops []kvOp) ([]byte, error) {
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	batch := make([]byte, kvBatchHeader, kvBatchHeader+len(payload))
+	binary.BigEndian.PutUint32(batch, uint32(len(payload)))
+	binary.BigEndian.PutUint32(batch[4:], crc32.ChecksumIEEE(payload))
+	return append(batch, payload...), nil
+}
+
+func (s *kvStore) view(fn func(tx storeTx) error) error {
+	data, _, err := s.load()
+	if err != nil {
+		return err
+	}
+	return fn(&kvTx{data: data})
+}
+
+func (s *kvStore) update(fn func(tx storeTx) error) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %w", filepath.Dir(s.path), err)
+	}
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, valid, err := s.load()
+	if err != nil {
+		return err
+	}
+	tx := &kvTx{data: data, writable: true}
+	if err := fn(tx); err != nil || len(tx.ops) == 0 {
+		return err
+	}
+	data.apply(tx.ops)
+	if size := data.size(); valid > kvCompactSize && valid > 2*size {
+		return s.compact(data)
+	}
+	return s.append(tx.ops, valid)
+}
+
+// append writes a batch after the valid prefix of the file, dropping an
+// incomplete batch a crash left behind.
+func (s *kvStore) append(ops []kvOp, valid int64) error {
+	batch, err := encodeBatch(ops)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", s.path, err)
+	}
+	defer f.Close()
+	if err := f.Truncate(valid); err != nil {
+		return fmt.Errorf("cannot write %s: %w", s.path, err)
+	}
+	if _, err := f.WriteAt(batch, valid); err != nil {
+		return fmt.Errorf("cannot write %s: %w", s.path, err)
+	}
+	return f.Sync()
+}
+
+// compact replaces the file with a single batch of the current records.
+func (s *kvStore) compact(data kvData) error {
+	batch, err := encodeBatch(data.ops())
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", tmp, err)
+	}
+	_, err = f.Write(batch)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot compact %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// kvTx reads from a snapshot and collects the writes of a transaction.
+type kvTx struct {
+	data     kvData
+	writable bool
+	ops      []kvOp
+}
+
+func (tx *kvTx) get(bucket, key string) ([]byte, error) {
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if op := tx.ops[i]; op.Bucket == bucket && op.Key == key {
+			return op.Value, nil
+		}
+	}
+	return tx.data[bucket][key], nil
+}
+
+func (tx *kvTx) list(bucket string) (map[string][]byte, error) {
+	records := make(map[string][]byte, len(tx.data[bucket]))
+	for key, value := range tx.data[bucket] {
+		records[key] = value
+	}
+	for _, op := range tx.ops {
+		if op.Bucket != bucket {
+			continue
+		}
+		if op.Value == nil {
+			delete(records, op.Key)
+		} else {
+			records[op.Key] = op.Value
+		}
+	}
+	return records, nil
+}
+
+func (tx *kvTx) put(bucket, key string, data []byte) error {
+	if !tx.writable {
+		return fmt.Errorf("store is read-only")
+	}
+	// Records are stored compactly, as the payload of a batch is JSON
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return fmt.Errorf("invalid %s record %s: %w", bucket, key, err)
+	}
+	tx.ops = append(tx.ops, kvOp{Bucket: bucket, Key: key, Value: buf.Bytes()})
+	return nil
+}
+
+func (tx *kvTx) delete(bucket, key string) error {
+	if !tx.writable {
+		return fmt.Errorf("store is read-only")
+	}
+	tx.ops = append(tx.ops, kvOp{Bucket: bucket, Key: key})
+	return nil
+}
@@ -0,0 +1,300 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	layerUsage = "usage: shp layer encrypt|decrypt --key <keyref> <in> <out>"
+
+	// mediaTypeEncryptedSuffix marks layers encrypted by shp in image
+	// manifests. The format is not that of ocicrypt, whose layers end in
+	// mediaTypeOCICryptSuffix and which shp cannot decrypt.
+	mediaTypeEncryptedSuffix = "+shp-encrypted"
+	mediaTypeOCICryptSuffix  = "+encrypted"
+
+	layerCryptMagic = "SHPENC1\n"
+	layerChunkSize  = 64 << 10
+	layerKeySize    = 32
+	layerNoncePre   = 8
+)
+
+// loadLayerKey resolves a key reference to a 256-bit key. Supported forms
+// are "file:<path>" (32 raw bytes or 64 hex characters), "env:<NAME>" (hex)
+// and "cmd:<program> [args]" which runs a helper, such as a KMS client, that
+// prints the hex key on stdout.
+func loadLayerKey(ref string) ([]byte, error) {
+	kind, value, ok := strings.Cut(ref, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("invalid key reference %q, expected file:, env: or cmd:", ref)
+	}
+
+	var raw []byte
+	switch kind {
+	case "file":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+		raw = data
+	case "env":
+		raw = []byte(os.Getenv(value))
+	case "cmd":
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid key reference %q, expected a command after cmd:", ref)
+		}
+		out, err := exec.Command(fields[0], fields[1:]...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("key helper %s failed: %w", fields[0], err)
+		}
+		raw = out
+	default:
+		return nil, fmt.Errorf("unknown key reference type %q", kind)
+	}
+
+	if len(raw) == layerKeySize {
+		return raw, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != layerKeySize {
+		return nil, fmt.Errorf("key from %s is not a 256-bit key", kind)
+	}
+	return key, nil
+}
+
+// Encrypted layers are a magic header and a random nonce prefix followed by
+// AES-256-GCM sealed chunks, each preceded by its big-endian uint32 length.
+// Chunk nonces are the prefix plus a chunk counter, and the last chunk is
+// authenticated as final so truncation is detected.
+
+type layerEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newLayerEncrypter returns a writer encrypting into w. Close must be
+// called to write the final chunk.
+func newLayerEncrypter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newLayerAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, layerNoncePre)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, layerCryptMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &layerEncrypter{w: w, aead: aead, prefix: prefix}, nil
+}
+
+func (e *layerEncrypter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := layerChunkSize - len(e.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		e.buf = append(e.buf, p[:take]...)
+		p = p[take:]
+		if len(e.buf) == layerChunkSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *layerEncrypter) Close() error {
+	return e.seal(true)
+}
+
+func (e *layerEncrypter) seal(final bool) error {
+	ct := e.aead.Seal(nil, layerNonce(e.prefix, e.counter), e.buf, finalAD(final))
+	e.counter++
+	e.buf = e.buf[:0]
+
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(ct)))
+	if _, err := e.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(ct)
+	return err
+}
+
+type layerDecrypter struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	final   bool
+}
+
+// newLayerDecrypter returns a reader yielding the plaintext of an encrypted
+// layer read from r. Tampering or truncation surfaces as a read error.
+func newLayerDecrypter(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newLayerAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(layerCryptMagic)+layerNoncePre)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("cannot read encrypted layer header: %w", err)
+	}
+	if !bytes.Equal(hdr[:len(layerCryptMagic)], []byte(layerCryptMagic)) {
+		return nil, errors.New("not an encrypted layer")
+	}
+	return &layerDecrypter{r: br, aead: aead, prefix: hdr[len(layerCryptMagic):]}, nil
+}
+
+func (d *layerDecrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *layerDecrypter) open() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+		return fmt.Errorf("truncated encrypted layer: %w", err)
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > layerChunkSize+uint32(d.aead.Overhead()) {
+		return errors.New("corrupt encrypted layer: oversized chunk")
+	}
+	ct := make([]byte, size)
+	if _, err := io.ReadFull(d.r, ct); err != nil {
+		return fmt.Errorf("truncated encrypted layer: %w", err)
+	}
+
+	nonce := layerNonce(d.prefix, d.counter)
+	d.counter++
+	pt, err := d.aead.Open(nil, nonce, ct, finalAD(false))
+	if err != nil {
+		if pt, err = d.aead.Open(nil, nonce, ct, finalAD(true)); err != nil {
+			return errors.New("encrypted layer failed authentication (wrong key or tampered data)")
+		}
+		d.final = true
+		if _, err := d.r.ReadByte(); err != io.EOF {
+			return errors.New("corrupt encrypted layer: data after final chunk")
+		}
+	}
+	d.buf = pt
+	return nil
+}
+
+func newLayerAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func layerNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, layerNoncePre+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[layerNoncePre:], counter)
+	return nonce
+}
+
+func finalAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func layer(args []string) {
+	if len(args) != 5 || (args[1] != "--key" && args[1] != "-key") {
+		fmt.Println(layerUsage)
+		os.Exit(1)
+	}
+	key, err := loadLayerKey(args[2])
+	handle(err)
+
+	switch args[0] {
+	case "encrypt":
+		handle(transformFile(args[3], args[4], func(in io.Reader, out io.Writer) error {
+			enc, err := newLayerEncrypter(out, key)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(enc, in); err != nil {
+				return err
+			}
+			return enc.Close()
+		}))
+	case "decrypt":
+		handle(transformFile(args[3], args[4], func(in io.Reader, out io.Writer) error {
+			dec, err := newLayerDecrypter(in, key)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, dec)
+			return err
+		}))
+	default:
+		fmt.Println(layerUsage)
+		os.Exit(1)
+	}
+}
+
+// transformFile streams src through fn into dst, removing dst on failure.
+func transformFile(src, dst string, fn func(io.Reader, io.Writer) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createFile(dst, func(out io.Writer) error { return fn(in, out) })
+}
+
+// createFile creates the new file dst and fills it with fn, removing it
+// again if fn fails.
+func createFile(dst string, fn func(io.Writer) error) error {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := fn(out); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,258 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	logPolicyBlock = "block"
+	logPolicyDrop  = "drop"
+
+	logChunkSize     = 64 << 10
+	iovMax           = 1024 // IOV_MAX, the most buffers writev takes
+	logStatsFile     = "log-stats.json"
+	logStatsInterval = time.Second
+	spliceMove       = 0x1 // SPLICE_F_MOVE
+	spliceMore       = 0x4 // SPLICE_F_MORE
+)
+
+// logStats are the per-container log metrics published in the runtime dir.
+type logStats struct {
+	Bytes       int64   `json:"bytes"`
+	Dropped     int64   `json:"dropped_bytes"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+// logPipeline moves container output from a pipe to a sink with bounded
+// memory. In block mode data is spliced from the pipe to the sink without
+// copying through userspace, and a slow sink backpressures the container
+// through the full pipe. In drop mode output is read into a queue of at
+// most limit bytes and written out with writev; when the queue is full new
+// output is dropped so a chatty container cannot stall or balloon memory.
+type logPipeline struct {
+	src     *os.File
+	sink    *os.File
+	policy  string
+	limit   int64
+	bytes   atomic.Int64
+	dropped atomic.Int64
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	queued int64
+	eof    bool
+
+	// index, if set, records when output reached the sink
+	index *logIndex
+	done  chan struct{}
+	// warned is set once a failed write to the sink was reported
+	warned bool
+}
+
+func newLogPipeline(src, sink *os.File, policy string, limit int64) *logPipeline {
+	p := &logPipeline{src: src, sink: sink, policy: policy, limit: limit, done: make(chan struct{})}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// start runs the pipeline until src reaches EOF. statsPath, if set, is
+// rewritten periodically with the current metrics, and indexPath, if set,
+// is the log index of the sink.
+func (p *logPipeline) start(statsPath, indexPath string) {
+	if indexPath != "" {
+		index, err := openLogIndex(indexPath, p.sink)
+		if err != nil {
+			fmt.Printf("Warning: cannot index log: %v\n", err)
+		}
+		p.index = index
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	if p.policy == logPolicyDrop {
+		go p.readQueue()
+		go func() {
+			defer wg.Done()
+			p.writeQueue()
+		}()
+	} else {
+		go func() {
+			defer wg.Done()
+			p.splice()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		p.index.close()
+		close(p.done)
+	}()
+	if statsPath != "" {
+		go p.publishStats(statsPath)
+	}
+}
+
+// wait blocks until all output has been written to the sink.
+func (p *logPipeline) wait() {
+	<-p.done
+}
+
+func (p *logPipeline) splice() {
+	spliceCopy(p.sink, p.src, func(n int64) {
+		p.bytes.Add(n)
+		p.index.mark()
+	})
+}
+
+func (p *logPipeline) readQueue() {
+	buf := make([]byte, logChunkSize)
+	for {
+		n, err := p.src.Read(buf)
+		if n > 0 {
+			p.mu.Lock()
+			if p.queued+int64(n) > p.limit {
+				p.dropped.Add(int64(n))
+			} else {
+				// Queue a copy of what was read, so the limit counts all
+				// the memory the queue holds
+				p.queue = append(p.queue, append([]byte(nil), buf[:n]...))
+				p.queued += int64(n)
+				p.cond.Signal()
+			}
+			p.mu.Unlock()
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.eof = true
+			p.cond.Signal()
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (p *logPipeline) writeQueue() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.eof {
+			p.cond.Wait()
+		}
+		batch := p.queue
+		p.queue = nil
+		p.queued = 0
+		eof := p.eof
+		p.mu.Unlock()
+
+		if len(batch) > 0 {
+			var size int64
+			for _, b := range batch {
+				size += int64(len(b))
+			}
+			n, err := writev(p.sink, batch)
+			p.bytes.Add(n)
+			p.index.mark()
+			if err != nil {
+				p.dropped.Add(size - n)
+				if !p.warned {
+					fmt.Printf("Warning: cannot write log: %v\n", err)
+					p.warned = true
+				}
+			}
+		}
+		if eof && len(batch) == 0 {
+			return
+		}
+	}
+}
+
+// writev writes all buffers with as few system calls as possible, each
+// taking at most iovMax buffers.
+func writev(f *os.File, bufs [][]byte) (int64, error) {
+	var total int64
+	for len(bufs) > 0 {
+		iov := make([]syscall.Iovec, 0, len(bufs))
+		for _, b := range bufs {
+			if len(iov) == iovMax {
+				break
+			}
+			if len(b) > 0 {
+				v := syscall.Iovec{Base: &b[0]}
+				v.SetLen(len(b))
+				iov = append(iov, v)
+			}
+		}
+		if len(iov) == 0 {
+			return total, nil
+		}
+		n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, f.Fd(), uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+		if errno == syscall.EINTR || errno == syscall.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return total, errno
+		}
+		total += int64(n)
+
+		// Skip what was written, keeping any partially written buffer
+		for w := int(n); w > 0 && len(bufs) > 0; {
+			if w >= len(bufs[0]) {
+				w -= len(bufs[0])
+				bufs = bufs[1:]
+			} else {
+				bufs[0] = bufs[0][w:]
+				w = 0
+			}
+		}
+	}
+	return total, nil
+}
+
+func (p *logPipeline) stats(elapsed time.Duration, lastBytes int64) logStats {
+	st := logStats{Bytes: p.bytes.Load(), Dropped: p.dropped.Load()}
+	if elapsed > 0 {
+		st.BytesPerSec = float64(st.Bytes-lastBytes) / elapsed.Seconds()
+	}
+	return st
+}
+
+func (p *logPipeline) publishStats(path string) {
+	ticker := time.NewTicker(logStatsInterval)
+	defer ticker.Stop()
+	last, lastBytes := time.Now(), int64(0)
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			st := p.stats(now.Sub(last), lastBytes)
+			last, lastBytes = now, st.Bytes
+			if data, err := json.Marshal(st); err == nil {
+				os.WriteFile(path, data, 0600)
+			}
+		}
+	}
+}
+
+// openLogSink opens a log file for appending. O_APPEND is avoided because
+// splice refuses append-only files; the offset is moved to the end instead.
+func openLogSink(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open log file %s: %w", path, err)
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
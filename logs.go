@@ -0,0 +1,389 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	logsUsage = "usage: shp logs [-f] [-t] [--tail N] [--no-color] --all | <container>..."
+
+	logIndexFile     = "log-index"
+	logIndexRecord   = 16
+	logsPollInterval = 200 * time.Millisecond
+	logsTimeFormat   = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// logIndex records when the output of a container reached its log: after
+// every chunk written, the offset of the log file and the time. Logs are
+// the raw output, which the index gives timestamps to without copying it.
+// The index ends with a record at offset -1 once the output is complete.
+type logIndex struct {
+	f    *os.File
+	sink *os.File
+}
+
+// openLogIndex creates the index of the log sink. Its first record is the
+// offset the output of the container starts at, as a log file may already
+// hold the output of earlier containers.
+func openLogIndex(path string, sink *os.File) (*logIndex, error) {
+	start, err := sink.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	x := &logIndex{f: f, sink: sink}
+	x.record(start)
+	return x, nil
+}
+
+func (x *logIndex) record(off int64) {
+	var rec [logIndexRecord]byte
+	binary.LittleEndian.PutUint64(rec[:8], uint64(off))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(time.Now().UnixNano()))
+	x.f.Write(rec[:])
+}
+
+// mark records the offset the sink has been written up to.
+func (x *logIndex) mark() {
+	if x == nil {
+		return
+	}
+	if off, err := x.sink.Seek(0, io.SeekCurrent); err == nil {
+		x.record(off)
+	}
+}
+
+func (x *logIndex) close() {
+	if x == nil {
+		return
+	}
+	x.record(-1)
+	x.f.Close()
+}
+
+// logMark is a record of a log index.
+type logMark struct {
+	off int64
+	t   time.Time
+}
+
+// logSource is the log of one container as shp logs reads it.
+type logSource struct {
+	name  string
+	pid   int
+	color int
+	log   *os.File
+	index *os.File
+	// json is set for logs of the json-file driver, whose entries carry
+	// their time and stream; partial holds the pieces of a split line per
+	// stream
+	json    bool
+	partial [2][]byte
+	// indexBuf holds a partially read index record
+	indexBuf []byte
+	marks    []logMark
+	started  bool
+	complete bool
+	// pending is the unread output from offset pos on
+	pending []byte
+	pos     int64
+	last    time.Time
+}
+
+// logLine is a line of output with the time it reached the log.
+type logLine struct {
+	t      time.Time
+	src    *logSource
+	stderr bool
+	text   []byte
+}
+
+func logs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	follow := fs.Bool("f", false, "follow the output until the containers exit")
+	fs.BoolVar(follow, "follow", false, "follow the output until the containers exit")
+	timestamps := fs.Bool("t", false, "show the time each line was written")
+	fs.BoolVar(timestamps, "timestamps", false, "show the time each line was written")
+	all := fs.Bool("all", false, "merge the output of every container that captures it")
+	noColor := fs.Bool("no-color", false, "do not color the container prefixes")
+	tail := fs.Int("tail", -1, "show only the last N lines of every container's output so far")
+	if err := fs.Parse(args); err != nil || *all == (fs.NArg() > 0) {
+		fmt.Println(logsUsage)
+		os.Exit(1)
+	}
+
+	var states []*containerState
+	if *all {
+		running, err := listStates()
+		handle(err)
+		for _, st := range running {
+			if st.LogFile != "" {
+				states = append(states, st)
+			}
+		}
+	}
+	for _, ref := range fs.Args() {
+		st, err := findContainer(ref)
+		handle(err)
+		if st.LogDriver == logDriverJournald {
+			handle(fmt.Errorf("container %s logs to journald; read its output with journalctl CONTAINER_ID=%s", ref, st.ID))
+		}
+		if st.LogFile == "" {
+			handle(fmt.Errorf("container %s does not capture its output; run it with --detach or --log-file", ref))
+		}
+		states = append(states, st)
+	}
+
+	var sources []*logSource
+	for i, st := range states {
+		src, err := openLogSource(st)
+		handle(err)
+		defer src.close()
+		src.color = 31 + i%6
+		sources = append(sources, src)
+	}
+	p := logPrinter{
+		prefix:     *all || len(sources) > 1,
+		timestamps: *timestamps,
+		tail:       *tail,
+		color:      !*noColor && isTTY(os.Stdout),
+	}
+	for _, src := range sources {
+		if len(src.name) > p.width {
+			p.width = len(src.name)
+		}
+	}
+	handle(p.run(sources, *follow))
+}
+
+func openLogSource(st *containerState) (*logSource, error) {
+	name := st.Name
+	if name == "" {
+		name = st.ID
+	}
+	log, err := os.Open(st.LogFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open log of %s: %w", name, err)
+	}
+	index, err := os.Open(scratchPath(st.ID, logIndexFile))
+	if err != nil {
+		log.Close()
+		return nil, fmt.Errorf("cannot open log index of %s: %w", name, err)
+	}
+	return &logSource{name: name, pid: st.PID, log: log, index: index, json: st.LogDriver == logDriverJSONFile}, nil
+}
+
+func (s *logSource) close() {
+	s.log.Close()
+	s.index.Close()
+}
+
+// readIndex reads the records added to the index since the last call.
+func (s *logSource) readIndex() error {
+	data, err := io.ReadAll(s.index)
+	if err != nil {
+		return err
+	}
+	s.indexBuf = append(s.indexBuf, data...)
+	for len(s.indexBuf) >= logIndexRecord {
+		off := int64(binary.LittleEndian.Uint64(s.indexBuf[:8]))
+		t := time.Unix(0, int64(binary.LittleEndian.Uint64(s.indexBuf[8:logIndexRecord])))
+		s.indexBuf = s.indexBuf[logIndexRecord:]
+		switch {
+		case off < 0:
+			s.complete = true
+		case !s.started:
+			s.started, s.pos, s.last = true, off, t
+		default:
+			s.marks = append(s.marks, logMark{off: off, t: t})
+		}
+	}
+	return nil
+}
+
+// timeAt returns the time the output up to offset end was written, or
+// false if the index has no record of it yet.
+func (s *logSource) timeAt(end int64) (time.Time, bool) {
+	i := sort.Search(len(s.marks), func(i int) bool { return s.marks[i].off >= end })
+	if i == len(s.marks) {
+		return time.Time{}, false
+	}
+	s.marks = s.marks[i:]
+	s.last = s.marks[0].t
+	return s.last, true
+}
+
+// poll returns the complete lines written since the last call. Once the
+// output is complete, or final is set, it also returns an unterminated last
+// line, and lines the index has no record of get the time of the last one.
+func (s *logSource) poll(final bool) ([]logLine, error) {
+	if err := s.readIndex(); err != nil {
+		return nil, err
+	}
+	if !s.started {
+		return nil, nil
+	}
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := s.log.ReadAt(buf, s.pos+int64(len(s.pending)))
+		s.pending = append(s.pending, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	final = final || s.complete
+	if s.json {
+		return s.pollJSON(final)
+	}
+	var lines []logLine
+	for len(s.pending) > 0 {
+		n := bytes.IndexByte(s.pending, '\n') + 1
+		if n == 0 {
+			if !final {
+				break
+			}
+			n = len(s.pending)
+		}
+		t, ok := s.timeAt(s.pos + int64(n))
+		if !ok {
+			if !final {
+				break
+			}
+			t = s.last
+		}
+		lines = append(lines, logLine{t: t, src: s, text: bytes.TrimSuffix(s.pending[:n], []byte("\n"))})
+		s.pending = s.pending[n:]
+		s.pos += int64(n)
+	}
+	return lines, nil
+}
+
+// pollJSON returns the entries of a json-file log written since the last
+// call, joining lines the driver split into several entries. Once final is
+// set, it also returns a line still missing its end.
+func (s *logSource) pollJSON(final bool) ([]logLine, error) {
+	var lines []logLine
+	for {
+		n := bytes.IndexByte(s.pending, '\n') + 1
+		if n == 0 {
+			break
+		}
+		var e jsonLogEntry
+		if err := json.Unmarshal(s.pending[:n], &e); err != nil {
+			return nil, fmt.Errorf("invalid entry at offset %d: %w", s.pos, err)
+		}
+		s.pending = s.pending[n:]
+		s.pos += int64(n)
+		s.last = e.Time
+		stream := 0
+		if e.Stream == "stderr" {
+			stream = 1
+		}
+		s.partial[stream] = append(s.partial[stream], e.Log...)
+		if strings.HasSuffix(e.Log, "\n") {
+			lines = append(lines, s.flush(stream))
+		}
+	}
+	for stream := range s.partial {
+		if final && len(s.partial[stream]) > 0 {
+			lines = append(lines, s.flush(stream))
+		}
+	}
+	return lines, nil
+}
+
+func (s *logSource) flush(stream int) logLine {
+	text := bytes.TrimSuffix(s.partial[stream], []byte("\n"))
+	s.partial[stream] = nil
+	return logLine{t: s.last, src: s, stderr: stream == 1, text: text}
+}
+
+// logPrinter prints the lines of several logs in the order they were
+// written.
+type logPrinter struct {
+	prefix     bool
+	timestamps bool
+	color      bool
+	width      int
+	// tail limits the lines printed of the output so far, unless negative
+	tail int
+}
+
+// run prints the logs of sources up to now or, with follow, until every
+// container exited. Lines are merged by time in every round of polling;
+// tail applies to the first round, before following.
+func (p logPrinter) run(sources []*logSource, follow bool) error {
+	done := make(map[*logSource]bool)
+	first := true
+	for {
+		var lines []logLine
+		for _, s := range sources {
+			if done[s] {
+				continue
+			}
+			// A container that exited without completing its index, e.g.
+			// because run was killed, is done once nothing new arrives
+			exited := !processAlive(s.pid)
+			n := len(lines)
+			more, err := s.poll(!follow || exited)
+			if err != nil {
+				return fmt.Errorf("cannot read log of %s: %w", s.name, err)
+			}
+			if first && p.tail >= 0 && len(more) > p.tail {
+				more = more[len(more)-p.tail:]
+			}
+			lines = append(lines, more...)
+			if !follow || s.complete && len(s.pending) == 0 || exited && len(lines) == n {
+				done[s] = true
+			}
+		}
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].t.Before(lines[j].t) })
+		for _, l := range lines {
+			p.print(l)
+		}
+		if len(done) == len(sources) {
+			return nil
+		}
+		first = false
+		time.Sleep(logsPollInterval)
+	}
+}
+
+func (p logPrinter) print(l logLine) {
+	var b bytes.Buffer
+	if p.prefix {
+		name := fmt.Sprintf("%-*s |", p.width, l.src.name)
+		if p.color {
+			name = fmt.Sprintf("\x1b[%dm%s\x1b[0m", l.src.color, name)
+		}
+		b.WriteString(name + " ")
+	}
+	if p.timestamps {
+		b.WriteString(l.t.Format(logsTimeFormat) + " ")
+	}
+	b.Write(l.text)
+	b.WriteByte('\n')
+	if l.stderr {
+		os.Stderr.Write(b.Bytes())
+		return
+	}
+	os.Stdout.Write(b.Bytes())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	args := os.Args[1:]
+	host := os.Getenv("SHP_HOST")
+
+	if len(args) > 0 {
+		switch {
+		case args[0] == "--host" || args[0] == "-H":
+			if len(args) < 2 {
+				fmt.Println("usage: shp --host ssh://[user@]host[:port] <command> ...")
+				os.Exit(1)
+			}
+			host, args = args[1], args[2:]
+		case strings.HasPrefix(args[0], "--host="):
+			host, args = strings.TrimPrefix(args[0], "--host="), args[1:]
+		}
+	}
+
+	if host != "" {
+		handle(runRemote(host, args))
+		return
+	}
+	dispatch(args)
+}
+
+func handle(err error) {
+	if err != nil {
+		fmt.Printf("\n%s\n", err.Error())
+		os.Exit(1)
+	}
+}
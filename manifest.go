@@ -0,0 +1,180 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const manifestUsage = "usage: shp manifest <rootfs_path>"
+
+// manifestSkip lists rootfs directories whose contents are provided at run
+// time and therefore not part of the recorded image.
+var manifestSkip = map[string]bool{
+	"proc": true,
+	"sys":  true,
+	"dev":  true,
+}
+
+func manifest(args []string) {
+	if len(args) != 1 {
+		fmt.Println(manifestUsage)
+		os.Exit(1)
+	}
+	entries, err := buildManifest(args[0])
+	handle(err)
+	for _, e := range entries {
+		fmt.Println(e)
+	}
+}
+
+// buildManifest returns one line per filesystem object in rootfs, sorted
+// by path, in the form "<kind> <mode> <uid>:<gid> <path>" where kind is
+// "sha256:<hex>" for regular files, "link:<escaped target>" for symlinks and "dir"
+// for directories. Paths are last so they may contain spaces.
+func buildManifest(rootfs string) ([]string, error) {
+	var entries []string
+	err := filepath.WalkDir(rootfs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if d.IsDir() && manifestSkip[rel] {
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var kind string
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			kind = "link:" + url.PathEscape(target)
+		case d.IsDir():
+			kind = "dir"
+		case d.Type().IsRegular():
+			sum, err := fileDigest(path)
+			if err != nil {
+				return err
+			}
+			kind = sum
+		default:
+			kind = "special"
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot stat %s", path)
+		}
+		entries = append(entries, fmt.Sprintf("%s %04o %d:%d /%s", kind, st.Mode&07777, st.Uid, st.Gid, filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot build manifest of %s: %w", rootfs, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return manifestPath(entries[i]) < manifestPath(entries[j]) })
+	return entries, nil
+}
+
+func manifestPath(entry string) string {
+	parts := strings.SplitN(entry, " ", 4)
+	return parts[len(parts)-1]
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyManifest refuses rootfs unless it matches the manifest file exactly.
+// If manifestDigest is set, the manifest file itself must have that digest,
+// so a manifest stored next to the rootfs cannot be swapped undetected.
+func verifyManifest(rootfs, manifestFile, manifestDigest string) error {
+	if manifestDigest != "" {
+		sum, err := fileDigest(manifestFile)
+		if err != nil {
+			return fmt.Errorf("cannot read manifest: %w", err)
+		}
+		if sum != manifestDigest {
+			return fmt.Errorf("manifest %s has digest %s, expected %s", manifestFile, sum, manifestDigest)
+		}
+	}
+
+	want, err := readManifest(manifestFile)
+	if err != nil {
+		return err
+	}
+
+	got, err := buildManifest(rootfs)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, line := range got {
+		path := manifestPath(line)
+		expected, ok := want[path]
+		delete(want, path)
+		switch {
+		case !ok:
+			problems = append(problems, "unexpected "+path)
+		case expected != line:
+			problems = append(problems, "modified "+path)
+		}
+	}
+	for path := range want {
+		problems = append(problems, "missing "+path)
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("rootfs %s does not match manifest:\n  %s", rootfs, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// readManifest loads a manifest file into a map from path to entry.
+func readManifest(manifestFile string) (map[string]string, error) {
+	f, err := os.Open(manifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := s.Text(); line != "" {
+			entries[manifestPath(line)] = line
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	return entries, nil
+}
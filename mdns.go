@@ -0,0 +1,323 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mdnsAddr = "224.0.0.251:5353"
+	mdnsPort = 5353
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN     = 1
+	mdnsCacheFlush = 0x8000
+	mdnsUnicast    = 0x8000
+
+	// RFC 6762 recommends 120s for records naming a host and 75 minutes
+	// for the others
+	mdnsHostTTL  = 120
+	mdnsOtherTTL = 4500
+
+	dnsSDServices = "_services._dns-sd._udp.local."
+)
+
+// mdnsService is a service advertised with --mdns, e.g. _http._tcp on
+// port 8080.
+type mdnsService struct {
+	Type string
+	Port int
+}
+
+// parseMDNSService parses a --mdns value "<service type>:<port>".
+func parseMDNSService(v string) (mdnsService, error) {
+	typ, port, ok := strings.Cut(v, ":")
+	p, err := strconv.Atoi(port)
+	if !ok || err != nil || p < 1 || p > 65535 {
+		return mdnsService{}, fmt.Errorf("invalid mdns service %q, expected e.g. _http._tcp:8080", v)
+	}
+	labels := strings.Split(typ, ".")
+	if len(labels) != 2 || !strings.HasPrefix(labels[0], "_") || (labels[1] != "_tcp" && labels[1] != "_udp") {
+		return mdnsService{}, fmt.Errorf("invalid mdns service type %q, expected e.g. _http._tcp", typ)
+	}
+	return mdnsService{Type: typ, Port: p}, nil
+}
+
+// mdnsRecord is a resource record answered by the responder.
+type mdnsRecord struct {
+	name   string
+	rtype  uint16
+	ttl    uint32
+	unique bool
+	rdata  []byte
+}
+
+// mdnsResponder answers multicast DNS queries for a container's host name
+// <name>.local and its DNS-SD service records.
+type mdnsResponder struct {
+	conn    *net.UDPConn
+	group   *net.UDPAddr
+	records []mdnsRecord
+	done    chan struct{}
+}
+
+// newMDNSResponder joins the mDNS group on ifi, or the system default
+// multicast interface if ifi is nil.
+func newMDNSResponder(name string, ips []net.IP, services []mdnsService, ifi *net.Interface) (*mdnsResponder, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return nil, fmt.Errorf("cannot join mdns group: %w", err)
+	}
+
+	host := name + ".local."
+	r := &mdnsResponder{conn: conn, group: group, done: make(chan struct{})}
+	for _, ip := range ips {
+		r.records = append(r.records, mdnsRecord{host, dnsTypeA, mdnsHostTTL, true, ip.To4()})
+	}
+	for _, s := range services {
+		svc := s.Type + ".local."
+		instance := name + "." + svc
+		srv := make([]byte, 6)
+		binary.BigEndian.PutUint16(srv[4:], uint16(s.Port))
+		r.records = append(r.records,
+			mdnsRecord{dnsSDServices, dnsTypePTR, mdnsOtherTTL, false, encodeDNSName(svc)},
+			mdnsRecord{svc, dnsTypePTR, mdnsOtherTTL, false, encodeDNSName(instance)},
+			mdnsRecord{instance, dnsTypeSRV, mdnsHostTTL, true, append(srv, encodeDNSName(host)...)},
+			mdnsRecord{instance, dnsTypeTXT, mdnsOtherTTL, true, []byte{0}},
+		)
+	}
+	return r, nil
+}
+
+// serve announces the records and answers queries until shutdown.
+func (r *mdnsResponder) serve() {
+	// RFC 6762 section 8.3: announce at least twice, one second apart
+	for i := 0; i < 2; i++ {
+		r.send(r.records, -1, r.group)
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		id, answers, unicast := r.answer(buf[:n])
+		if len(answers) == 0 {
+			continue
+		}
+		switch {
+		case from.Port != mdnsPort:
+			// Legacy one-shot resolvers expect a unicast reply carrying
+			// their query ID
+			r.sendID(id, answers, -1, from)
+		case unicast:
+			r.send(answers, -1, from)
+		default:
+			r.send(answers, -1, r.group)
+		}
+	}
+}
+
+// shutdown sends goodbye packets, so that caches drop the records right
+// away, and stops serving.
+func (r *mdnsResponder) shutdown() {
+	close(r.done)
+	r.send(r.records, 0, r.group)
+	r.conn.Close()
+}
+
+// answer returns the records matching the questions of a query.
+func (r *mdnsResponder) answer(msg []byte) (uint16, []mdnsRecord, bool) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return 0, nil, false // not a query
+	}
+	id := binary.BigEndian.Uint16(msg)
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	var answers []mdnsRecord
+	unicast := true
+	for i := 0; i < qdcount; i++ {
+		name, next, err := decodeDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return id, answers, false
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		qclass := binary.BigEndian.Uint16(msg[next+2:])
+		off = next + 4
+		unicast = unicast && qclass&mdnsUnicast != 0
+		for _, rr := range r.records {
+			if strings.EqualFold(rr.name, name) && (qtype == rr.rtype || qtype == dnsTypeANY) {
+				answers = append(answers, rr)
+			}
+		}
+	}
+	return id, answers, unicast
+}
+
+func (r *mdnsResponder) send(records []mdnsRecord, ttl int64, to *net.UDPAddr) {
+	r.sendID(0, records, ttl, to)
+}
+
+// sendID sends records as an authoritative response. A ttl of -1 keeps
+// each record's own TTL.
+func (r *mdnsResponder) sendID(id uint16, records []mdnsRecord, ttl int64, to *net.UDPAddr) {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(records)))
+	for _, rr := range records {
+		class := uint16(dnsClassIN)
+		if rr.unique && to.Port == mdnsPort {
+			class |= mdnsCacheFlush
+		}
+		rttl := rr.ttl
+		if ttl >= 0 {
+			rttl = uint32(ttl)
+		}
+		msg = append(msg, encodeDNSName(rr.name)...)
+		msg = binary.BigEndian.AppendUint16(msg, rr.rtype)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, rttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.rdata)))
+		msg = append(msg, rr.rdata...)
+	}
+	if _, err := r.conn.WriteToUDP(msg, to); err != nil {
+		fmt.Fprintf(os.Stderr, "mdns: %v\n", err)
+	}
+}
+
+// encodeDNSName encodes a fully qualified name in DNS wire format.
+func encodeDNSName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+// decodeDNSName decodes the possibly compressed name at off and returns it
+// with a trailing dot, along with the offset following it.
+func decodeDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("truncated name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, fmt.Errorf("invalid name compression")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, fmt.Errorf("truncated name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// hostAddresses returns the IPv4 addresses other machines on the LAN can
+// reach the host on: those of up, non-loopback interfaces that are not
+// bridges, which only lead to containers.
+func hostAddresses() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sysClassNet, ifc.Name, "bridge")); err == nil {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				ips = append(ips, ipn.IP.To4())
+			}
+		}
+	}
+	return ips, nil
+}
+
+// checkMDNS verifies that the services of a container can be advertised:
+// the name is its host name, and the advertised address must be reachable
+// from the LAN, which rules out bridge networks.
+func checkMDNS(opts *runOptions) error {
+	if err := validateName(opts.name); err != nil || strings.Contains(opts.name, ".") {
+		return fmt.Errorf("--mdns requires a --name usable as host name")
+	}
+	if opts.network == hostNetwork {
+		return nil
+	}
+	n, err := lookupNetwork(opts.network)
+	if err != nil {
+		return err
+	}
+	if n.bridged() {
+		return fmt.Errorf("--mdns requires host, macvlan or ipvlan networking")
+	}
+	return nil
+}
+
+// newContainerResponder advertises the services of a container: on the host
+// network with the host's addresses, on macvlan and ipvlan networks with the
+// container's own address on the parent interface's LAN.
+func newContainerResponder(opts *runOptions, ip net.IP) (*mdnsResponder, error) {
+	if opts.network == hostNetwork {
+		ips, err := hostAddresses()
+		if err != nil {
+			return nil, err
+		}
+		return newMDNSResponder(opts.name, ips, opts.mdns, nil)
+	}
+	n, err := lookupNetwork(opts.network)
+	if err != nil {
+		return nil, err
+	}
+	ifi, err := net.InterfaceByName(n.Parent)
+	if err != nil {
+		return nil, err
+	}
+	return newMDNSResponder(opts.name, []net.IP{ip}, opts.mdns, ifi)
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// lockedMountFlags are the statfs flags that, in a user namespace, a
+// remount must keep if they were set on the mount, as MS_ mount flags.
+var lockedMountFlags = map[int64]uintptr{
+	0x2:    syscall.MS_NOSUID,     // ST_NOSUID
+	0x4:    syscall.MS_NODEV,      // ST_NODEV
+	0x8:    syscall.MS_NOEXEC,     // ST_NOEXEC
+	0x400:  syscall.MS_NOATIME,    // ST_NOATIME
+	0x800:  syscall.MS_NODIRATIME, // ST_NODIRATIME
+	0x1000: syscall.MS_RELATIME,   // ST_RELATIME
+}
+
+// remountFlags adds flags to the bind mount at path, keeping the flags it
+// already has. Rootless containers cannot clear flags locked by the host.
+func remountFlags(path string, flags uintptr) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return err
+	}
+	for bit, flag := range lockedMountFlags {
+		if int64(st.Flags)&bit != 0 {
+			flags |= flag
+		}
+	}
+	return syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, "")
+}
+
+// maxSymlinks bounds symlink resolution in securePath, like the kernel's
+// ELOOP limit.
+const maxSymlinks = 40
+
+// securePath resolves path inside rootfs the way it would be resolved after
+// pivot_root: absolute symlinks are interpreted relative to rootfs and ".."
+// never climbs above it. The returned host path is always within rootfs.
+// Components that do not exist yet are appended verbatim.
+func securePath(rootfs, path string) (string, error) {
+	rootfs = filepath.Clean(rootfs)
+	resolved := "/"
+	pending := strings.Split(filepath.Clean("/"+path), "/")
+	links := 0
+
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many symlinks resolving %s", path)
+		}
+		dest, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", fmt.Errorf("cannot read symlink %s: %w", next, err)
+		}
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(dest, "/"), pending...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// ensureMountTarget creates an empty directory or file at target, matching
+// the type of the mount source.
+func ensureMountTarget(target string, dir bool) error {
+	if dir {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,245 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	networksDir = "networks"
+
+	driverBridge  = "bridge"
+	driverMacvlan = "macvlan"
+	driverIPvlan  = "ipvlan"
+
+	// Linux interface names are limited to 15 bytes
+	maxIfNameLen = 15
+)
+
+// networkConfig is the definition of a named network, persisted in the
+// state store of /var/lib/shp. Bridge networks get a host bridge named after
+// the network; macvlan and ipvlan networks give containers addresses
+// directly on the LAN of the parent interface, which may be a bond or a
+// VLAN subinterface such as eth0.100. Wireguard networks are bridge networks
+// whose subnet is one of several routed between shp hosts over a WireGuard
+// mesh.
+type networkConfig struct {
+	Name    string `json:"name"`
+	Driver  string `json:"driver"`
+	Parent  string `json:"parent,omitempty"`
+	Subnet  string `json:"subnet,omitempty"`
+	IPRange string `json:"ip_range,omitempty"`
+	Gateway string `json:"gateway,omitempty"`
+
+	// IPAM is the address allocation driver, host-local if empty
+	IPAM string `json:"ipam,omitempty"`
+
+	// WireGuard mesh settings of wireguard networks
+	ListenPort int      `json:"listen_port,omitempty"`
+	Peers      []wgPeer `json:"peers,omitempty"`
+
+	// ManagedParent is set when shp created the VLAN subinterface Parent
+	// and removes it together with the last network using it
+	ManagedParent bool `json:"managed_parent,omitempty"`
+}
+
+// defaultNetwork is the built-in bridge used by --network bridge and
+// --network isolated-egress.
+var defaultNetwork = networkConfig{
+	Name:    bridgeName,
+	Driver:  driverBridge,
+	Subnet:  bridgeSubnet,
+	Gateway: "10.88.0.1",
+}
+
+// networkName maps a --network value to the name of the network it attaches
+// to, or "" for the host network.
+func networkName(mode string) string {
+	switch mode {
+	case "", hostNetwork:
+		return ""
+	case networkBridge, networkIsolatedEgress:
+		return bridgeName
+	}
+	return mode
+}
+
+// lookupNetwork returns the network a --network value attaches to.
+func lookupNetwork(mode string) (*networkConfig, error) {
+	name := networkName(mode)
+	if name == bridgeName {
+		n := defaultNetwork
+		return &n, nil
+	}
+	if err := validateName(name); err != nil {
+		return nil, fmt.Errorf("no such network: %s", mode)
+	}
+	store, err := openStore(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	n := &networkConfig{}
+	var found bool
+	err = store.view(func(tx storeTx) error {
+		found, err = getRecord(tx, bucketNetworks, name, n)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read network %s: %w", name, err)
+	} else if !found {
+		return nil, fmt.Errorf("no such network: %s", mode)
+	}
+	return n, nil
+}
+
+// listNetworks returns the built-in bridge followed by the configured
+// networks.
+func listNetworks() ([]*networkConfig, error) {
+	store, err := openStore(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	var records map[string][]byte
+	err = store.view(func(tx storeTx) error {
+		records, err = tx.list(bucketNetworks)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	n := defaultNetwork
+	networks := []*networkConfig{&n}
+	for _, name := range names {
+		c := &networkConfig{}
+		if err := json.Unmarshal(records[name], c); err != nil {
+			return nil, fmt.Errorf("cannot parse network %s: %w", name, err)
+		}
+		networks = append(networks, c)
+	}
+	return networks, nil
+}
+
+// saveNetwork records a new network.
+func saveNetwork(n *networkConfig) error {
+	store, err := openStore(stateDir)
+	if err != nil {
+		return err
+	}
+	return store.update(func(tx storeTx) error {
+		if data, err := tx.get(bucketNetworks, n.Name); err != nil {
+			return err
+		} else if data != nil {
+			return fmt.Errorf("network %s already exists", n.Name)
+		}
+		return putRecord(tx, bucketNetworks, n.Name, n)
+	})
+}
+
+func deleteNetwork(name string) error {
+	store, err := openStore(stateDir)
+	if err != nil {
+		return err
+	}
+	return store.update(func(tx storeTx) error { return tx.delete(bucketNetworks, name) })
+}
+
+// validate checks a network definition before it is saved.
+func (n *networkConfig) validate() error {
+	if err := validateName(n.Name); err != nil {
+		return err
+	}
+	switch n.Name {
+	case hostNetwork, networkBridge, networkIsolatedEgress, bridgeName:
+		return fmt.Errorf("network name %s is reserved", n.Name)
+	}
+	switch n.Driver {
+	case driverBridge, driverWireGuard:
+		if n.Parent != "" {
+			return fmt.Errorf("the %s driver does not take a parent interface", n.Driver)
+		}
+		if len(n.Name) > maxIfNameLen {
+			return fmt.Errorf("bridge network names are limited to %d characters", maxIfNameLen)
+		}
+		if n.Driver == driverWireGuard {
+			if err := validateWireGuard(n); err != nil {
+				return err
+			}
+		}
+	case driverMacvlan, driverIPvlan:
+		if n.Parent == "" {
+			return fmt.Errorf("the %s driver requires --parent", n.Driver)
+		}
+		if err := checkParent(n.Parent); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown network driver: %s", n.Driver)
+	}
+	switch n.IPAM {
+	case "", ipamHostLocal:
+	case ipamDHCP:
+		// ipvlan links share the parent's MAC address, which DHCP servers
+		// identify clients by
+		if n.Driver != driverMacvlan {
+			return fmt.Errorf("the dhcp IPAM driver requires a macvlan network")
+		}
+		if n.Subnet != "" || n.IPRange != "" || n.Gateway != "" {
+			return fmt.Errorf("dhcp networks take their addressing from the DHCP server")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown IPAM driver: %s", n.IPAM)
+	}
+	_, err := n.addressing()
+	return err
+}
+
+// bridged reports whether containers attach to a host bridge named after
+// the network.
+func (n *networkConfig) bridged() bool {
+	return n.Driver == driverBridge || n.Driver == driverWireGuard
+}
+
+// netAddressing is the parsed address plan of a network.
+type netAddressing struct {
+	subnet  *net.IPNet
+	pool    *net.IPNet
+	gateway net.IP
+}
+
+func (n *networkConfig) addressing() (*netAddressing, error) {
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 subnet: %q", n.Subnet)
+	}
+	a := &netAddressing{subnet: subnet, pool: subnet}
+	if n.IPRange != "" {
+		_, pool, err := net.ParseCIDR(n.IPRange)
+		if err != nil || !subnet.Contains(pool.IP) {
+			return nil, fmt.Errorf("invalid IP range %q for subnet %s", n.IPRange, n.Subnet)
+		}
+		a.pool = pool
+	}
+	if n.Gateway != "" {
+		a.gateway = net.ParseIP(n.Gateway).To4()
+		if a.gateway == nil || !subnet.Contains(a.gateway) {
+			return nil, fmt.Errorf("invalid gateway %q for subnet %s", n.Gateway, n.Subnet)
+		}
+	}
+	return a, nil
+}
+
+// prefixLen returns the subnet prefix length, e.g. 16 for a /16.
+func (a *netAddressing) prefixLen() int {
+	ones, _ := a.subnet.Mask.Size()
+	return ones
+}
@@ -0,0 +1,262 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	netUsageDir           = "netusage"
+	netAccountingInterval = time.Minute
+	monthLayout           = "2006-01"
+)
+
+// netCounters are the traffic counters of a network namespace, summed over
+// all its interfaces except loopback.
+type netCounters struct {
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+func (c netCounters) add(o netCounters) netCounters {
+	return netCounters{c.RxBytes + o.RxBytes, c.RxPackets + o.RxPackets, c.TxBytes + o.TxBytes, c.TxPackets + o.TxPackets}
+}
+
+func (c netCounters) sub(o netCounters) netCounters {
+	return netCounters{c.RxBytes - o.RxBytes, c.RxPackets - o.RxPackets, c.TxBytes - o.TxBytes, c.TxPackets - o.TxPackets}
+}
+
+// readNetCounters parses a /proc/net/dev table.
+func readNetCounters(path string) (netCounters, error) {
+	var c netCounters
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		ifname, stats, ok := strings.Cut(s.Text(), ":")
+		if !ok || strings.TrimSpace(ifname) == "lo" {
+			continue
+		}
+		// rx: bytes packets errs drop fifo frame compressed multicast, then tx
+		fields := strings.Fields(stats)
+		if len(fields) < 10 {
+			continue
+		}
+		v := make([]uint64, 10)
+		for i := range v {
+			v[i], _ = strconv.ParseUint(fields[i], 10, 64)
+		}
+		c = c.add(netCounters{RxBytes: v[0], RxPackets: v[1], TxBytes: v[8], TxPackets: v[9]})
+	}
+	return c, s.Err()
+}
+
+func netUsagePath(month string) string {
+	return filepath.Join(stateDir, netUsageDir, month+".json")
+}
+
+// loadNetUsage returns the persisted traffic of a month by container name.
+func loadNetUsage(month string) (map[string]netCounters, error) {
+	usage := make(map[string]netCounters)
+	data, err := os.ReadFile(netUsagePath(month))
+	if os.IsNotExist(err) {
+		return usage, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", netUsagePath(month), err)
+	}
+	return usage, nil
+}
+
+// recordNetUsage adds traffic of the named container to the counters of
+// the month of t.
+func recordNetUsage(name string, delta netCounters, t time.Time) error {
+	month := t.Format(monthLayout)
+	path := netUsagePath(month)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %w", filepath.Dir(path), err)
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	usage, err := loadNetUsage(month)
+	if err != nil {
+		return err
+	}
+	usage[name] = usage[name].add(delta)
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// netAccountant persists the traffic of a container into monthly counters
+// keyed by container name, so they add up across restarts. It holds the
+// container's network namespace open, which keeps the interfaces and their
+// counters alive for a final reading after the container exited.
+type netAccountant struct {
+	name string
+	ns   *os.File
+	last netCounters
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startNetAccounting(name string, pid int) (*netAccountant, error) {
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, err
+	}
+	a := &netAccountant{name: name, ns: ns, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(netAccountingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				a.flush()
+			}
+		}
+	}()
+	return a, nil
+}
+
+func (a *netAccountant) flush() {
+	var c netCounters
+	err := inNetnsPath(fmt.Sprintf("/proc/self/fd/%d", a.ns.Fd()), func() error {
+		var err error
+		c, err = readNetCounters("/proc/thread-self/net/dev")
+		return err
+	})
+	if err == nil {
+		err = recordNetUsage(a.name, c.sub(a.last), time.Now())
+	}
+	if err != nil {
+		fmt.Printf("Warning: cannot record network usage: %v\n", err)
+		return
+	}
+	a.last = c
+}
+
+// finish records the traffic since the last reading and releases the
+// network namespace.
+func (a *netAccountant) finish() {
+	close(a.stop)
+	<-a.done
+	a.flush()
+	a.ns.Close()
+}
+
+// collectStats reads the traffic of every running container with its own
+// network namespace.
+func collectStats() ([]containerStats, error) {
+	states, err := listStates()
+	if err != nil {
+		return nil, err
+	}
+	var out []containerStats
+	for _, st := range states {
+		if s, ok := netStats(st); ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// netStats reads the traffic of a container, or returns false if it exited
+// meanwhile. /proc/<pid>/net shows the namespace of the process, so nothing
+// has to be entered.
+func netStats(st *containerState) (containerStats, bool) {
+	s := containerStats{ID: st.ID, Name: st.Name, Network: networkName(st.Network)}
+	if s.Network == "" {
+		s.Network = hostNetwork
+		return s, true
+	}
+	var err error
+	s.netCounters, err = readNetCounters(fmt.Sprintf("/proc/%d/net/dev", st.PID))
+	return s, err == nil
+}
+
+// printNetStats prints the traffic of the running containers followed by
+// the totals of every network.
+func printNetStats(asJSON bool) error {
+	all, err := collectStats()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(all)
+	}
+
+	totals := make(map[string]netCounters)
+	fmt.Printf("%-12s %-16s %-12s %14s %10s %14s %10s\n", "ID", "NAME", "NETWORK", "RX BYTES", "RX PKTS", "TX BYTES", "TX PKTS")
+	for _, s := range all {
+		if s.Network == hostNetwork {
+			// Host network traffic cannot be attributed to a container
+			fmt.Printf("%-12s %-16s %-12s %14s %10s %14s %10s\n", s.ID, s.Name, s.Network, "-", "-", "-", "-")
+			continue
+		}
+		totals[s.Network] = totals[s.Network].add(s.netCounters)
+		fmt.Printf("%-12s %-16s %-12s %14d %10d %14d %10d\n", s.ID, s.Name, s.Network, s.RxBytes, s.RxPackets, s.TxBytes, s.TxPackets)
+	}
+	networks := make([]string, 0, len(totals))
+	for n := range totals {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	for _, n := range networks {
+		t := totals[n]
+		fmt.Printf("%-12s %-16s %-12s %14d %10d %14d %10d\n", "total", "", n, t.RxBytes, t.RxPackets, t.TxBytes, t.TxPackets)
+	}
+	return nil
+}
+
+func printNetUsage(month string) error {
+	if _, err := time.Parse(monthLayout, month); err != nil {
+		return fmt.Errorf("invalid month %q, expected YYYY-MM", month)
+	}
+	usage, err := loadNetUsage(month)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-16s %14s %10s %14s %10s\n", "NAME", "RX BYTES", "RX PKTS", "TX BYTES", "TX PKTS")
+	for _, name := range names {
+		u := usage[name]
+		fmt.Printf("%-16s %14d %10d %14d %10d\n", name, u.RxBytes, u.RxPackets, u.TxBytes, u.TxPackets)
+	}
+	return nil
+}
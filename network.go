@@ -0,0 +1,512 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	networkUsage = `usage: shp network create -d <bridge|macvlan|ipvlan|wireguard> [--parent if] [--ipam host-local|dhcp]
+                           [--subnet cidr] [--ip-range cidr] [--gateway ip] [--listen-port port] [--peer key,host:port,cidr]... <name>
+       shp network ls
+       shp network rm <name>
+       shp network inspect [--check] [--check-name host] <name>`
+	hostNetwork  = "host"
+	checkTimeout = 2 * time.Second
+)
+
+// networkInfo describes a network and the containers attached to it.
+type networkInfo struct {
+	Name       string              `json:"name"`
+	Driver     string              `json:"driver"`
+	Forwarding bool                `json:"ipForwarding"`
+	PublicKey  string              `json:"publicKey,omitempty"`
+	Containers []attachedContainer `json:"containers"`
+}
+
+// attachedContainer is the view of a network from inside one container's
+// network namespace.
+type attachedContainer struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name,omitempty"`
+	PID         int             `json:"pid"`
+	Netns       string          `json:"netns"`
+	Mode        string          `json:"mode,omitempty"`
+	Interfaces  []interfaceInfo `json:"interfaces"`
+	Gateway     string          `json:"gateway,omitempty"`
+	Nameservers []string        `json:"nameservers,omitempty"`
+	Ports       []string        `json:"ports,omitempty"`
+}
+
+type interfaceInfo struct {
+	Name  string   `json:"name"`
+	Up    bool     `json:"up"`
+	MAC   string   `json:"mac,omitempty"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// networkCheck is the outcome of one reachability test.
+type networkCheck struct {
+	Container string
+	Name      string
+	Err       error
+}
+
+func network(args []string) {
+	if len(args) < 1 {
+		fmt.Println(networkUsage)
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "create":
+		networkCreate(args[1:])
+	case "ls":
+		handle(networkList())
+	case "rm":
+		if len(args) != 2 {
+			fmt.Println(networkUsage)
+			os.Exit(1)
+		}
+		handle(networkRemove(args[1]))
+	case "inspect":
+		networkInspect(args[1:])
+	default:
+		fmt.Println(networkUsage)
+		os.Exit(1)
+	}
+}
+
+func networkCreate(args []string) {
+	n := &networkConfig{}
+	fs := flag.NewFlagSet("network create", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&n.Driver, "d", driverBridge, "network driver: bridge, macvlan, ipvlan or wireguard")
+	fs.StringVar(&n.Parent, "parent", "", "host interface macvlan and ipvlan networks attach to")
+	fs.StringVar(&n.IPAM, "ipam", ipamHostLocal, "address allocation: host-local, or dhcp on macvlan networks")
+	fs.StringVar(&n.Subnet, "subnet", "", "IPv4 subnet of the network, e.g. 192.168.1.0/24")
+	fs.StringVar(&n.IPRange, "ip-range", "", "part of the subnet containers get addresses from")
+	fs.StringVar(&n.Gateway, "gateway", "", "default gateway of the containers")
+	fs.IntVar(&n.ListenPort, "listen-port", defaultWireGuardPort, "UDP port of the wireguard mesh")
+	fs.Func("peer", "wireguard mesh peer <public key>,<host:port>,<container subnet> (repeatable)", func(v string) error {
+		p, err := parseWireGuardPeer(v)
+		n.Peers = append(n.Peers, p)
+		return err
+	})
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || (n.Subnet == "" && n.IPAM != ipamDHCP) {
+		fmt.Println(networkUsage)
+		os.Exit(1)
+	}
+	n.Name = fs.Arg(0)
+	if n.Driver != driverWireGuard {
+		n.ListenPort = 0
+	}
+	if n.bridged() && n.Gateway == "" {
+		// The host bridge needs an address to route and NAT for containers
+		if addr, err := n.addressing(); err == nil {
+			n.Gateway = nextIP(addr.subnet.IP).String()
+		}
+	}
+	handle(n.validate())
+	if n.Parent != "" {
+		created, err := ensureParent(n.Parent)
+		handle(err)
+		n.ManagedParent = created
+	}
+	if err := saveNetwork(n); err != nil {
+		if n.ManagedParent {
+			runTool("ip", "link", "del", n.Parent)
+		}
+		handle(err)
+	}
+	fmt.Println(n.Name)
+	if n.Driver == driverWireGuard {
+		pub, err := createWireGuardKey(n)
+		if err != nil {
+			deleteNetwork(n.Name)
+			handle(err)
+		}
+		fmt.Printf("public key: %s\n", pub)
+	}
+}
+
+func networkList() error {
+	networks, err := listNetworks()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-16s %-10s %-18s %s\n", "NAME", "DRIVER", "SUBNET", "PARENT")
+	fmt.Printf("%-16s %-10s %-18s %s\n", hostNetwork, hostNetwork, "", "")
+	for _, n := range networks {
+		subnet := n.Subnet
+		if n.IPAM == ipamDHCP {
+			subnet = ipamDHCP
+		}
+		fmt.Printf("%-16s %-10s %-18s %s\n", n.Name, n.Driver, subnet, n.Parent)
+	}
+	return nil
+}
+
+// networkRemove deletes a network definition that no running container is
+// attached to, together with the host bridge of bridge networks.
+func networkRemove(name string) error {
+	if name == hostNetwork || name == networkBridge || name == bridgeName {
+		return fmt.Errorf("network %s is built in", name)
+	}
+	n, err := lookupNetwork(name)
+	if err != nil {
+		return err
+	}
+	states, err := listStates()
+	if err != nil {
+		return err
+	}
+	for _, st := range states {
+		if networkName(st.Network) == n.Name {
+			return fmt.Errorf("network %s is in use by container %s", n.Name, st.ID)
+		}
+	}
+	if n.Driver == driverWireGuard {
+		if err := removeWireGuard(n); err != nil {
+			return err
+		}
+	}
+	if n.bridged() {
+		if _, err := net.InterfaceByName(n.Name); err == nil {
+			if err := runTool("ip", "link", "del", n.Name); err != nil {
+				return err
+			}
+		}
+		runTool("iptables", ruleArgs("-D", masqueradeRule(n))...)
+	}
+	if n.ManagedParent {
+		if err := removeManagedParent(n); err != nil {
+			return err
+		}
+	}
+	if err := deleteNetwork(n.Name); err != nil {
+		return fmt.Errorf("cannot remove network %s: %w", n.Name, err)
+	}
+	return nil
+}
+
+// removeManagedParent deletes the VLAN subinterface shp created for n unless
+// another network still uses it.
+func removeManagedParent(n *networkConfig) error {
+	networks, err := listNetworks()
+	if err != nil {
+		return err
+	}
+	for _, other := range networks {
+		if other.Name != n.Name && other.Parent == n.Parent {
+			return nil
+		}
+	}
+	if _, err := net.InterfaceByName(n.Parent); err != nil {
+		return nil
+	}
+	return runTool("ip", "link", "del", n.Parent)
+}
+
+func networkInspect(args []string) {
+	fs := flag.NewFlagSet("network inspect", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	check := fs.Bool("check", false, "run reachability tests from each attached container")
+	checkName := fs.String("check-name", "example.com", "name resolved by the DNS check")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Println(networkUsage)
+		os.Exit(1)
+	}
+
+	info, err := inspectNetwork(fs.Arg(0))
+	handle(err)
+	if !*check {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		handle(enc.Encode(info))
+		return
+	}
+	handle(checkNetwork(info, *checkName))
+}
+
+// inspectNetwork collects the state of the named network: host, shared by
+// containers started with --network host, the shp0 bridge or a network
+// created with `shp network create`.
+func inspectNetwork(name string) (*networkInfo, error) {
+	driver, pub := hostNetwork, ""
+	if name != hostNetwork {
+		n, err := lookupNetwork(name)
+		if err != nil || n.Name != name {
+			return nil, fmt.Errorf("no such network: %s", name)
+		}
+		driver = n.Driver
+		if n.Driver == driverWireGuard {
+			if pub, err = wireGuardPublicKey(n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	states, err := listStates()
+	if err != nil {
+		return nil, err
+	}
+	fwd, _ := os.ReadFile(ipForward)
+	info := &networkInfo{
+		Name:       name,
+		Driver:     driver,
+		Forwarding: strings.TrimSpace(string(fwd)) == "1",
+		PublicKey:  pub,
+		Containers: []attachedContainer{},
+	}
+	for _, st := range states {
+		if on := networkName(st.Network); on != name && (on != "" || name != hostNetwork) {
+			continue
+		}
+		c, err := inspectAttached(st)
+		if err != nil {
+			return nil, fmt.Errorf("cannot inspect container %s: %w", st.ID, err)
+		}
+		info.Containers = append(info.Containers, *c)
+	}
+	return info, nil
+}
+
+func inspectAttached(st *containerState) (*attachedContainer, error) {
+	proc := filepath.Join("/proc", strconv.Itoa(st.PID))
+	netns, err := os.Readlink(filepath.Join(proc, "ns", "net"))
+	if err != nil {
+		return nil, err
+	}
+	c := &attachedContainer{ID: st.ID, Name: st.Name, PID: st.PID, Netns: netns, Mode: st.Network, Ports: st.Ports}
+
+	err = inNetns(st.PID, func() error {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, ifc := range ifaces {
+			info := interfaceInfo{Name: ifc.Name, Up: ifc.Flags&net.FlagUp != 0, MAC: ifc.HardwareAddr.String()}
+			addrs, _ := ifc.Addrs()
+			for _, a := range addrs {
+				info.Addrs = append(info.Addrs, a.String())
+			}
+			c.Interfaces = append(c.Interfaces, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// /proc/<pid>/net and /proc/<pid>/root show the container's view
+	// without having to enter its namespaces.
+	if gw, err := defaultGateway(filepath.Join(proc, "net", "route")); err == nil && gw != nil {
+		c.Gateway = gw.String()
+	}
+	c.Nameservers, _ = nameservers(filepath.Join(proc, "root", "etc", "resolv.conf"))
+	return c, nil
+}
+
+// defaultGateway returns the IPv4 default route's gateway from a
+// /proc/net/route table, or nil if there is none.
+func defaultGateway(path string) (net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+		return ip, nil
+	}
+	return nil, s.Err()
+}
+
+func nameservers(resolvConf string) ([]string, error) {
+	data, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers, nil
+}
+
+// hasNeighbour reports whether the ARP table at path has a complete entry
+// for ip.
+func hasNeighbour(path string, ip net.IP) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		// IP address, HW type, Flags, HW address, Mask, Device; flag 0x2 is ATF_COM
+		if len(fields) >= 4 && fields[0] == ip.String() {
+			flags, _ := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+			return flags&0x2 != 0, nil
+		}
+	}
+	return false, nil
+}
+
+// checkNetwork runs reachability tests from every attached container and
+// prints one line per test. It fails if any test failed.
+func checkNetwork(info *networkInfo, name string) error {
+	var checks []networkCheck
+	for _, c := range info.Containers {
+		checks = append(checks, checkContainer(c, name)...)
+	}
+	failed := 0
+	for _, ch := range checks {
+		if ch.Err != nil {
+			failed++
+			fmt.Printf("FAIL  %-12s %-10s %v\n", ch.Container, ch.Name, ch.Err)
+		} else {
+			fmt.Printf("ok    %-12s %s\n", ch.Container, ch.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d network checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+func checkContainer(c attachedContainer, name string) []networkCheck {
+	result := func(check string, err error) networkCheck {
+		return networkCheck{Container: c.ID, Name: check, Err: err}
+	}
+	proc := filepath.Join("/proc", strconv.Itoa(c.PID))
+
+	var loErr error = fmt.Errorf("loopback interface is down")
+	for _, ifc := range c.Interfaces {
+		if ifc.Name == "lo" && ifc.Up {
+			loErr = nil
+		}
+	}
+	checks := []networkCheck{result("loopback", loErr)}
+
+	if c.Gateway == "" {
+		checks = append(checks, result("gateway", fmt.Errorf("no default route")))
+	} else {
+		gw := net.ParseIP(c.Gateway)
+		pingErr := inNetns(c.PID, func() error { return ping(gw) })
+		checks = append(checks, result("ping", pingErr))
+
+		// The ping above resolves the gateway if it was not cached yet
+		arpErr := fmt.Errorf("no ARP entry for gateway %s", gw)
+		if ok, err := hasNeighbour(filepath.Join(proc, "net", "arp"), gw); err != nil {
+			arpErr = err
+		} else if ok {
+			arpErr = nil
+		}
+		checks = append(checks, result("arp", arpErr))
+	}
+
+	if len(c.Nameservers) == 0 {
+		checks = append(checks, result("dns", fmt.Errorf("no nameserver in /etc/resolv.conf")))
+	} else {
+		checks = append(checks, result("dns", resolveIn(c.PID, c.Nameservers, name)))
+	}
+	return checks
+}
+
+// ping sends one ICMP echo request to ip and waits for the reply. It must
+// run on a thread inside the network namespace to test from.
+func ping(ip net.IP) error {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	msg := []byte{8, 0, 0, 0, 0, 0, 0, 1} // echo request, sequence 1
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(checkTimeout))
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("no echo reply from %s: %w", ip, err)
+		}
+		if n >= 8 && buf[0] == 0 && binary.BigEndian.Uint16(buf[4:]) == id && from.(*net.IPAddr).IP.Equal(ip) {
+			return nil
+		}
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// resolveIn looks up name using the container's nameservers, dialing them
+// from inside its network namespace.
+func resolveIn(pid int, servers []string, name string) error {
+	var lastErr error
+	for _, server := range servers {
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var conn net.Conn
+				err := inNetns(pid, func() error {
+					var err error
+					d := net.Dialer{Timeout: checkTimeout}
+					conn, err = d.DialContext(ctx, network, net.JoinHostPort(server, "53"))
+					return err
+				})
+				return conn, err
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		_, err := r.LookupHost(ctx, name)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		lastErr = fmt.Errorf("cannot resolve %s via %s: %w", name, server, err)
+	}
+	return lastErr
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// setns moves the calling thread into the namespace referred to by path,
+// e.g. /proc/<pid>/ns/net. nstype is the matching CLONE_NEW* flag or 0.
+func setns(path string, nstype int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open namespace %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), uintptr(nstype), 0); errno != 0 {
+		return fmt.Errorf("setns %s failed: %w", path, errno)
+	}
+	return nil
+}
+
+// inNetns runs fn on a thread that has joined the network namespace of pid.
+// Sockets created by fn stay in that namespace after it returns. The thread
+// is never handed back to the scheduler: returning while still locked makes
+// the Go runtime discard it instead of reusing a thread in the wrong
+// namespace.
+func inNetns(pid int, fn func() error) error {
+	return inNetnsPath(fmt.Sprintf("/proc/%d/ns/net", pid), fn)
+}
+
+// inNetnsPath is like inNetns for the network namespace at path, which may
+// also be a /proc/self/fd link to a namespace kept open after its last
+// process exited.
+func inNetnsPath(path string, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := setns(path, syscall.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
+}
@@ -0,0 +1,541 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const runUsage = "usage: shp run [flags] <rootfs_path> <cmd> [options]"
+
+// runOptions holds the flags accepted by run. The child re-parses the same
+// arguments, so every flag must be safe to evaluate on both sides.
+type runOptions struct {
+	envHints  bool
+	tz        string
+	name      string
+	autostart bool
+	// id replaces the generated container ID
+	id         string
+	idempotent bool
+	after      []string
+
+	limits           resourceLimits
+	pidsLimit        int64
+	storageQuota     int64
+	admission        string
+	admissionTimeout time.Duration
+
+	progress string
+
+	healthCmd      string
+	healthTCP      string
+	healthHTTP     string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	healthRetries  int
+
+	labels      map[string]string
+	stopTimeout time.Duration
+
+	envPassthrough []string
+
+	initScript string
+	sidecars   [][]string
+	supervise  restartPolicy
+
+	profile         *containerProfile
+	securityProfile *securityProfile
+	// seccomp replaces the seccomp filter of the profiles
+	seccomp    string
+	capAdd     []string
+	capDrop    []string
+	privileged bool
+	// maskPaths, readOnlyPaths and unmaskPaths adjust the protected paths
+	// of the profiles, or of the bundle if it lists any
+	maskPaths     []string
+	readOnlyPaths []string
+	unmaskPaths   []string
+
+	hooks  lifecycleHooks
+	alerts []resourceAlert
+
+	integrityChecks   bool
+	integrityInterval time.Duration
+	// activity records process executions and file opens for shp activity
+	activity bool
+
+	detach       bool
+	tty          bool
+	waitReady    *readyCheck
+	readyTimeout time.Duration
+
+	volumes []volume
+	// env are set in the container after the variables passed through
+	// from the host, in order; workdir is the directory of the command
+	env     []string
+	workdir string
+	// userSpec is --user, resolved in the rootfs into user
+	userSpec string
+
+	// hostname defaults to the container ID
+	hostname string
+
+	// bundle is the OCI bundle directory whose config.json the fields
+	// below, and defaults of env, workdir and hostname, come from;
+	// readOnlyRootfs and mounts are also set by --read-only and --tmpfs
+	bundle         string
+	bundleRootfs   string
+	bundleCommand  []string
+	readOnlyRootfs bool
+	user           *syscall.Credential
+	rlimits        []ociRlimit
+	mounts         []specMount
+	cloneFlags     uintptr
+	// bundleMaskedPaths and bundleReadOnlyPaths replace the protected
+	// paths of the profiles if either is set
+	bundleMaskedPaths   []string
+	bundleReadOnlyPaths []string
+
+	logFile   string
+	logPolicy string
+	logBuffer int64
+	// logDriver journald sends output to the journal instead of a file;
+	// json-file records it as JSON lines
+	logDriver        string
+	journalNamespace string
+
+	watch       string
+	watchSignal syscall.Signal
+
+	verifyManifest string
+	manifestDigest string
+	noPrepCache    bool
+
+	scanner      string
+	scanSeverity string
+
+	faults faultInjection
+
+	network       string
+	publish       []portMapping
+	mdns          []mdnsService
+	netAccounting bool
+	dns           []string
+	rootless      bool
+
+	// containerID is passed from run to the child to locate the runtime
+	// directory; it is not meant to be set by users
+	containerID string
+	// readyFD is the pipe a detaching run waits on in the background run
+	readyFD int
+	// idMapFD is the pipe a rootless child waits on for its ID maps
+	idMapFD int
+}
+
+// parseRunOptions parses the leading flags of args and returns the remaining
+// positional arguments (rootfs path, command and its options).
+func parseRunOptions(name string, args []string) (*runOptions, []string, error) {
+	opts := &runOptions{
+		admission: admissionOff,
+		progress:  progressNone,
+		labels:    make(map[string]string),
+
+		envPassthrough: defaultEnvPassthrough,
+		logPolicy:      logPolicyBlock,
+		logBuffer:      1 << 20,
+		network:        hostNetwork,
+		supervise:      restartPolicy{mode: restartNo},
+		profile:        &containerProfile{},
+	}
+	faults, err := defaultFaults()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.faults = faults
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&opts.envHints, "env-hints", false, "inject runtime sizing env vars derived from cgroup limits")
+	fs.StringVar(&opts.tz, "tz", "", "time zone for the container, e.g. Europe/Berlin")
+	fs.StringVar(&opts.name, "name", "", "container name")
+	fs.Func("id", "container ID instead of a generated one", func(v string) error {
+		opts.id = v
+		return validateContainerID(v)
+	})
+	fs.BoolVar(&opts.idempotent, "idempotent", false, "with --id or --name, do nothing if the container runs with the same definition and replace it otherwise")
+	fs.BoolVar(&opts.autostart, "autostart", false, "start the container from `shp system start-all`")
+	fs.Func("after", "comma-separated autostart containers to start first", func(v string) error {
+		opts.after = append(opts.after, splitList(v)...)
+		return nil
+	})
+	fs.Func("memory", "memory limit, e.g. 512m", func(v string) error {
+		n, err := parseSize(v)
+		opts.limits.memoryBytes = n
+		return err
+	})
+	fs.Float64Var(&opts.limits.cpus, "cpus", 0, "number of CPUs")
+	fs.Func("pids-limit", "maximum number of processes in the container", func(v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid pids limit: %s", v)
+		}
+		opts.pidsLimit = n
+		return nil
+	})
+	fs.Func("storage-quota", "limit on the data an image container writes, with the btrfs or zfs storage driver, e.g. 10g", func(v string) error {
+		n, err := parseSize(v)
+		opts.storageQuota = n
+		return err
+	})
+	fs.Func("admission", "admission control against host capacity: off, reject or queue", func(v string) error {
+		switch v {
+		case admissionOff, admissionReject, admissionQueue:
+			opts.admission = v
+			return nil
+		}
+		return fmt.Errorf("invalid admission mode: %s", v)
+	})
+	fs.DurationVar(&opts.admissionTimeout, "admission-timeout", time.Minute, "how long a queued start waits for capacity")
+	fs.Func("progress", "report creation progress on stderr: none, plain or json", func(v string) error {
+		switch v {
+		case progressNone, progressPlain, progressJSON:
+			opts.progress = v
+			return nil
+		}
+		return fmt.Errorf("invalid progress mode: %s", v)
+	})
+	fs.StringVar(&opts.healthCmd, "health-cmd", "", "command run inside the container to check its health")
+	fs.StringVar(&opts.healthTCP, "health-tcp", "", "address the container must accept TCP connections on, e.g. 127.0.0.1:8080")
+	fs.StringVar(&opts.healthHTTP, "health-http", "", "URL the container must answer a GET for with 2xx/3xx")
+	fs.DurationVar(&opts.healthInterval, "health-interval", 30*time.Second, "time between health probes")
+	fs.DurationVar(&opts.healthTimeout, "health-timeout", 5*time.Second, "timeout of a single health probe")
+	fs.IntVar(&opts.healthRetries, "health-retries", 3, "consecutive failures before the container is unhealthy")
+	fs.Func("label", "container label key=value (repeatable)", func(v string) error {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid label: %s", v)
+		}
+		opts.labels[key] = value
+		return nil
+	})
+	fs.DurationVar(&opts.stopTimeout, "stop-timeout", 10*time.Second, "grace period between SIGTERM and SIGKILL when stopping")
+	fs.Func("env-passthrough", "comma-separated host variables to copy into the container (LC_* style prefixes allowed, * for all)", func(v string) error {
+		opts.envPassthrough = splitList(v)
+		return nil
+	})
+	addEnv := func(v string) error {
+		vars, err := parseEnvVar(v)
+		opts.env = append(opts.env, vars...)
+		return err
+	}
+	fs.Func("env", "environment variable KEY=VALUE, or KEY for its host value (repeatable)", addEnv)
+	fs.Func("e", "shorthand for --env", addEnv)
+	fs.Func("env-file", "file of KEY=VALUE lines to set in the container (repeatable)", func(v string) error {
+		vars, err := readEnvFile(v)
+		opts.env = append(opts.env, vars...)
+		return err
+	})
+	setWorkdir := func(v string) error {
+		if !filepath.IsAbs(v) {
+			return fmt.Errorf("workdir must be absolute: %s", v)
+		}
+		opts.workdir = filepath.Clean(v)
+		return nil
+	}
+	fs.Func("workdir", "absolute directory inside the container to run the command in, created if missing", setWorkdir)
+	fs.Func("w", "shorthand for --workdir", setWorkdir)
+	setUser := func(v string) error {
+		opts.userSpec = v
+		return validateUserSpec(v)
+	}
+	fs.Func("user", "user[:group] to run the command as, by name in the rootfs or numeric ID", setUser)
+	fs.Func("u", "shorthand for --user", setUser)
+	fs.Func("hostname", "host name of the container, default the container ID", func(v string) error {
+		opts.hostname = v
+		return validateHostname(v)
+	})
+	fs.Func("init-script", "host script executed inside the container before the command", func(v string) error {
+		path, err := parseInitScript(v)
+		opts.initScript = path
+		return err
+	})
+	fs.Func("sidecar", "additional command run and supervised next to the main command (repeatable)", func(v string) error {
+		args, err := parseSidecar(v)
+		opts.sidecars = append(opts.sidecars, args)
+		return err
+	})
+	fs.Func("supervise", "restart the command inside the container: no, on-failure[:max] or always[:max]", func(v string) error {
+		p, err := parseRestartPolicy(v)
+		opts.supervise = p
+		return err
+	})
+	fs.Func("v", "bind volume host:container[:options] (repeatable)", func(v string) error {
+		vol, err := parseVolume(v)
+		opts.volumes = append(opts.volumes, vol)
+		return err
+	})
+	fs.Func("tmpfs", "tmpfs mounted at container[:size=64m,mode=1777,...] (repeatable)", func(v string) error {
+		m, err := parseTmpfs(v)
+		opts.mounts = append(opts.mounts, m)
+		return err
+	})
+	fs.BoolVar(&opts.readOnlyRootfs, "read-only", false, "remount the rootfs read-only after setup; volumes and tmpfs mounts keep their own mode")
+	fs.Func("bundle", "OCI bundle directory to take the rootfs, command, mounts and namespaces from its config.json", func(v string) error {
+		abs, err := filepath.Abs(v)
+		opts.bundle = abs
+		return err
+	})
+	fs.StringVar(&opts.verifyManifest, "verify-manifest", "", "refuse to run unless the rootfs matches this manifest")
+	fs.StringVar(&opts.manifestDigest, "manifest-digest", "", "expected sha256 digest of the --verify-manifest file")
+	fs.BoolVar(&opts.noPrepCache, "no-prep-cache", false, "always redo rootfs preparation steps instead of using cached results")
+	fs.StringVar(&opts.scanner, "scan", "", "scan the rootfs with trivy or grype before starting")
+	fs.StringVar(&opts.scanSeverity, "scan-severity", "high", "refuse to start with vulnerabilities at or above this severity")
+	fs.StringVar(&opts.logFile, "log-file", "", "write container output to this file instead of the terminal")
+	fs.Func("log-mode", "what to do when the log sink falls behind: block or drop", func(v string) error {
+		switch v {
+		case logPolicyBlock, logPolicyDrop:
+			opts.logPolicy = v
+			return nil
+		}
+		return fmt.Errorf("invalid log mode: %s", v)
+	})
+	fs.Func("log-driver", "how container output is recorded: journald, or json-file for JSON lines with times and streams", func(v string) error {
+		switch v {
+		case logDriverJournald, logDriverJSONFile:
+			opts.logDriver = v
+			return nil
+		}
+		return fmt.Errorf("invalid log driver: %s", v)
+	})
+	fs.Func("journal-namespace", "with --log-driver journald, journal namespace to log to, started if needed", func(v string) error {
+		if !journalNamespacePattern.MatchString(v) {
+			return fmt.Errorf("invalid journal namespace: %q", v)
+		}
+		opts.journalNamespace = v
+		return nil
+	})
+	fs.Func("log-buffer", "maximum buffered log output in drop mode, e.g. 4m", func(v string) error {
+		n, err := parseSize(v)
+		opts.logBuffer = n
+		return err
+	})
+	fs.StringVar(&opts.watch, "watch", "", "restart the command when files below this container path change")
+	fs.Func("watch-signal", "signal the command on changes instead of restarting it, e.g. SIGHUP", func(v string) error {
+		sig, err := parseSignal(v)
+		opts.watchSignal = sig
+		return err
+	})
+	fs.Func("network", "network mode: host, bridge, isolated-egress or the name of a network", func(v string) error {
+		if v != hostNetwork && v != networkBridge && v != networkIsolatedEgress && validateName(v) != nil {
+			return fmt.Errorf("invalid network: %s", v)
+		}
+		opts.network = v
+		return nil
+	})
+	publish := func(v string) error {
+		m, err := parsePublish(v)
+		opts.publish = append(opts.publish, m)
+		return err
+	}
+	fs.Func("publish", "publish a container port on the host as [addr:]hostPort:containerPort[/tcp] (repeatable)", publish)
+	fs.Func("p", "shorthand for --publish", publish)
+	fs.BoolVar(&opts.netAccounting, "net-accounting", false, "add the container's traffic to monthly counters kept across restarts")
+	fs.Func("dns", "comma-separated nameservers for the container, \"cache\" for the host's caching resolver", func(v string) error {
+		opts.dns = append(opts.dns, splitList(v)...)
+		return nil
+	})
+	fs.Func("fault-inject", "test only: comma-separated faults to simulate: pull-fail, start-delay=<duration>, oom-after=<duration>", func(v string) error {
+		f, err := parseFaults(v)
+		opts.faults = f
+		return err
+	})
+	fs.StringVar(&opts.containerID, "container-id", "", "internal: runtime directory of the container")
+	fs.IntVar(&opts.readyFD, "ready-fd", 0, "internal: pipe to report readiness of a detached container on")
+	fs.BoolVar(&opts.rootless, "rootless", false, "run without root privileges in a user namespace")
+	fs.IntVar(&opts.idMapFD, "id-map-fd", 0, "internal: pipe to wait on for the ID maps of a rootless container")
+	fs.Func("profile", "hardening profile, e.g. appliance, or one defined in the config file", func(v string) error {
+		p, err := lookupProfile(v)
+		opts.profile = p
+		return err
+	})
+	fs.Func("security-profile", "seccomp, capability, masking and AppArmor settings: default, restricted, privileged or a JSON file", func(v string) error {
+		p, err := loadSecurityProfile(v)
+		opts.securityProfile = p
+		return err
+	})
+	fs.Func("seccomp-profile", "OCI seccomp profile JSON file to filter system calls with", func(v string) error {
+		abs, err := filepath.Abs(v)
+		opts.seccomp = abs
+		return err
+	})
+	fs.Func("security-opt", "security option: seccomp=unconfined|<profile.json>, mask=<paths>, readonly=<paths>, unmask=<paths>|ALL or systempaths=unconfined", func(v string) error {
+		key, value, _ := strings.Cut(v, "=")
+		if value == "" {
+			return fmt.Errorf("unsupported security option %q", v)
+		}
+		switch key {
+		case "seccomp":
+			if value == seccompUnconfined {
+				opts.seccomp = value
+				return nil
+			}
+			abs, err := filepath.Abs(value)
+			opts.seccomp = abs
+			return err
+		case "mask":
+			opts.maskPaths = append(opts.maskPaths, strings.Split(value, ":")...)
+		case "readonly":
+			opts.readOnlyPaths = append(opts.readOnlyPaths, strings.Split(value, ":")...)
+		case "unmask":
+			opts.unmaskPaths = append(opts.unmaskPaths, strings.Split(value, ":")...)
+		case "systempaths":
+			// Docker's name for unmasking everything
+			if value != seccompUnconfined {
+				return fmt.Errorf("unsupported security option %q", v)
+			}
+			opts.unmaskPaths = append(opts.unmaskPaths, unmaskAll)
+		default:
+			return fmt.Errorf("unsupported security option %q", v)
+		}
+		return nil
+	})
+	fs.Func("cap-add", "comma-separated capabilities to add to the bounding set, or ALL (repeatable)", func(v string) error {
+		caps, err := parseCapabilities(v)
+		opts.capAdd = append(opts.capAdd, caps...)
+		return err
+	})
+	fs.Func("cap-drop", "comma-separated capabilities to drop from the bounding set, or ALL (repeatable)", func(v string) error {
+		caps, err := parseCapabilities(v)
+		opts.capDrop = append(opts.capDrop, caps...)
+		return err
+	})
+	fs.BoolVar(&opts.privileged, "privileged", false, "keep every capability, without seccomp filter or masking; same as --security-profile privileged")
+	fs.StringVar(&opts.hooks.onStart, "on-start", "", "host shell command run once the container started")
+	fs.StringVar(&opts.hooks.onExit, "on-exit", "", "host shell command run after the container exited")
+	fs.StringVar(&opts.hooks.onOOM, "on-oom", "", "host shell command run when the OOM killer kills a container process")
+	fs.BoolVar(&opts.integrityChecks, "integrity-checks", false, "plant canaries and periodically verify from the host that the container is still confined")
+	fs.DurationVar(&opts.integrityInterval, "integrity-interval", 30*time.Second, "time between integrity checks")
+	fs.StringVar(&opts.hooks.onAnomaly, "on-anomaly", "", "host shell command run when an integrity check finds an anomaly")
+	fs.BoolVar(&opts.activity, "activity", false, "record the programs the container executes and the files it opens, shown by shp activity")
+	fs.Func("alert", "resource threshold and action, e.g. memory>90%:cmd or cpu>150%:https://hook (repeatable)", func(v string) error {
+		a, err := parseAlert(v)
+		opts.alerts = append(opts.alerts, a)
+		return err
+	})
+	fs.BoolVar(&opts.detach, "detach", false, "run the container in the background and print its ID")
+	fs.BoolVar(&opts.detach, "d", false, "shorthand for --detach")
+	fs.BoolVar(&opts.tty, "tty", false, "allocate a pseudo-terminal for the command")
+	fs.BoolVar(&opts.tty, "t", false, "shorthand for --tty")
+	// stdin is always attached; -i only exists for Docker compatibility
+	fs.Bool("interactive", true, "keep stdin attached")
+	fs.Bool("i", true, "shorthand for --interactive")
+	fs.Var(boolFlagFunc(func() { opts.tty = true }), "it", "shorthand for --interactive --tty")
+	fs.Func("wait-ready", "with --detach, return once tcp://[host]:port accepts connections or file:///path exists", func(v string) error {
+		c, err := parseReadyCheck(v)
+		opts.waitReady = c
+		return err
+	})
+	fs.DurationVar(&opts.readyTimeout, "ready-timeout", 30*time.Second, "how long --wait-ready waits before stopping the container")
+	fs.Func("mdns", "advertise a service via mDNS as <name>.local, e.g. _http._tcp:8080 (repeatable)", func(v string) error {
+		s, err := parseMDNSService(v)
+		opts.mdns = append(opts.mdns, s)
+		return err
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if opts.bundle != "" {
+		if err := opts.applyBundle(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.privileged {
+		if opts.securityProfile != nil {
+			return nil, nil, fmt.Errorf("--privileged and --security-profile are mutually exclusive")
+		}
+		sp, err := loadSecurityProfile(securityPrivileged)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.securityProfile = sp
+	}
+	// --security-profile replaces the security settings of --profile
+	p := *opts.profile
+	if opts.securityProfile != nil {
+		p.securityProfile = *opts.securityProfile
+	}
+	if opts.readOnlyRootfs {
+		p.ReadOnlyRootfs = true
+	}
+	// Containers run without any profile get the default seccomp filter
+	// and path protections
+	switch {
+	case opts.seccomp != "":
+		p.Seccomp = opts.seccomp
+	case opts.profile.name == "" && opts.securityProfile == nil:
+		p.Seccomp = seccompDefault
+	}
+	if opts.profile.name == "" && opts.securityProfile == nil {
+		p.MaskedPaths, p.ReadOnlyPaths = defaultMaskedPaths, defaultReadOnlyPaths
+	}
+	if opts.bundleMaskedPaths != nil || opts.bundleReadOnlyPaths != nil {
+		p.MaskedPaths, p.ReadOnlyPaths = opts.bundleMaskedPaths, opts.bundleReadOnlyPaths
+	}
+	p.adjustPaths(opts.maskPaths, opts.readOnlyPaths, opts.unmaskPaths)
+	if opts.capAdd != nil || opts.capDrop != nil {
+		p.Capabilities = adjustCapabilities(p.boundingSet(), opts.capAdd, opts.capDrop)
+	}
+	// Seccomp profiles may depend on the capabilities
+	if err := p.securityProfile.validate(); err != nil {
+		return nil, nil, err
+	}
+	opts.profile = &p
+	return opts, fs.Args(), nil
+}
+
+// boolFlagFunc is a boolean flag calling a function when set to true.
+type boolFlagFunc func()
+
+func (f boolFlagFunc) String() string   { return "" }
+func (f boolFlagFunc) IsBoolFlag() bool { return true }
+
+func (f boolFlagFunc) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if on {
+		f()
+	}
+	return err
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// absRunArgs returns a copy of the run arguments with the rootfs path made
+// absolute, for commands that are replayed later from another directory.
+// pargs must be the positional arguments returned by parseRunOptions.
+func absRunArgs(args, pargs []string) ([]string, error) {
+	idx := len(args) - len(pargs)
+	abs, err := filepath.Abs(args[idx])
+	if err != nil {
+		return nil, fmt.Errorf("cannot get absolute path for %s: %w", args[idx], err)
+	}
+	out := append([]string(nil), args...)
+	out[idx] = abs
+	return out, nil
+}
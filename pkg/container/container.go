@@ -0,0 +1,145 @@
+//go:build linux
+
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	freezeTimeout      = 5 * time.Second
+	freezePollInterval = 100 * time.Millisecond
+)
+
+// Container is a running container as its state record describes it. It
+// does not track changes other programs make, such as the shp command
+// stopping the container.
+type Container struct {
+	State State
+	// Hooks run at the phases the operations on the container pass, and
+	// may be shared by several containers
+	Hooks *Hooks
+}
+
+// New returns the container of a state record, such as one read from the
+// state store or printed by shp inspect, with no hooks.
+func New(st State) *Container {
+	return &Container{State: st, Hooks: &Hooks{}}
+}
+
+// ID returns the container's ID.
+func (c *Container) ID() string {
+	return c.State.ID
+}
+
+// Running reports whether the main process of the container still exists.
+func (c *Container) Running() bool {
+	return c.State.PID > 0 && syscall.Kill(c.State.PID, 0) == nil
+}
+
+// Signal sends sig to the main process of the container.
+func (c *Container) Signal(sig syscall.Signal) error {
+	if err := syscall.Kill(c.State.PID, sig); err != nil {
+		return fmt.Errorf("cannot signal container %s: %w", c.State.ID, err)
+	}
+	return nil
+}
+
+// Pause suspends every process of the container with the cgroup freezer.
+// The processes keep their memory and open files, and do not notice
+// anything but the time that passed. The hooks of PhasePaused run once
+// the processes stopped.
+func (c *Container) Pause(ctx context.Context) error {
+	return c.freeze(ctx, true)
+}
+
+// Resume thaws the processes of a paused container, then runs the hooks
+// of PhaseResumed.
+func (c *Container) Resume(ctx context.Context) error {
+	return c.freeze(ctx, false)
+}
+
+func (c *Container) freeze(ctx context.Context, frozen bool) error {
+	verb, phase := "unpause", PhaseResumed
+	if frozen {
+		verb, phase = "pause", PhasePaused
+	}
+	var err error
+	switch {
+	case c.State.Cgroup != "":
+		err = freezeCgroup(c.State.Cgroup, frozen)
+	case c.State.Freezer != "":
+		err = freezeV1(c.State.Freezer, frozen)
+	default:
+		return fmt.Errorf("container %s has no cgroup to freeze", c.State.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot %s container %s: %w", verb, c.State.ID, err)
+	}
+	return c.Hooks.Run(ctx, phase, c.State)
+}
+
+// freezeCgroup freezes or thaws a cgroup v2 group. The kernel reports the
+// new state in cgroup.events once every process has stopped or resumed.
+func freezeCgroup(dir string, frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	if err := writeFile(filepath.Join(dir, "cgroup.freeze"), value); err != nil {
+		return err
+	}
+	return awaitCgroupState(filepath.Join(dir, "cgroup.events"), "frozen "+value)
+}
+
+// freezeV1 freezes or thaws a group of the v1 freezer, whose state reads
+// FREEZING until every process has stopped.
+func freezeV1(dir string, frozen bool) error {
+	state := "THAWED"
+	if frozen {
+		state = "FROZEN"
+	}
+	if err := writeFile(filepath.Join(dir, "freezer.state"), state); err != nil {
+		return err
+	}
+	return awaitCgroupState(filepath.Join(dir, "freezer.state"), state)
+}
+
+// awaitCgroupState waits until a line of the cgroup file at path is want.
+func awaitCgroupState(path, want string) error {
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == want {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", want)
+		}
+		time.Sleep(freezePollInterval)
+	}
+}
+
+// writeFile writes value to an existing kernel file such as a cgroup's.
+func writeFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err == nil {
+		_, err = f.WriteString(value)
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+// Package container holds the parts of shp that other programs can embed:
+// the description and runtime record of a container, the hooks and events
+// of its lifecycle, the strategies that isolate its filesystem, and the
+// operations on a running container. Its functions return errors and
+// never exit or print; the shp command is built on top of it.
+//
+// Starting a container is not part of the package: there is no Start or
+// Wait. shp run prepares the rootfs, network, cgroups and security profile
+// in the command itself, and embedders start containers by running it
+// detached and load the state shp inspect prints.
+package container
@@ -0,0 +1,324 @@
+//go:build linux
+
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// rlimitCount is RLIM_NLIMITS, the number of resources with rlimits.
+const rlimitCount = 16
+
+// execNamespaces are the namespaces of a container an exec session joins,
+// in order; the mount namespace comes last since joining it changes the
+// root the other paths are resolved against.
+var execNamespaces = []struct {
+	name   string
+	nstype int
+}{
+	{"uts", syscall.CLONE_NEWUTS},
+	{"net", syscall.CLONE_NEWNET},
+	{"pid", syscall.CLONE_NEWPID},
+	{"mnt", syscall.CLONE_NEWNS},
+}
+
+// ExecConfig describes a process to start in a running container.
+type ExecConfig struct {
+	// Args is the command and its arguments. Commands without a slash are
+	// resolved in /bin, like the container's main command.
+	Args []string
+	// Env is the whole environment of the process, which does not inherit
+	// that of the caller
+	Env []string
+	// TTY starts the process on a new terminal of the container's devpts
+	// instance, as the leader of a new session.
+	TTY bool
+	// Stdin, Stdout and Stderr are the streams of a process without a
+	// terminal. Streams left nil are connected to pipes whose other ends
+	// are those of the Process.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Enter makes the container's root, opened before its namespaces are
+	// joined, the root of the calling thread, e.g. through a read-only
+	// view of its mounts. If nil, the thread changes its root to it.
+	Enter func(root *os.File) error
+	// Restrict confines the thread that joined the container and forks the
+	// process, e.g. with the capabilities and seccomp filter of the
+	// container. If nil, the process has the privileges of the caller.
+	Restrict func() error
+}
+
+// Process is a process started in a container by Exec.
+type Process struct {
+	// Stdin, Stdout and Stderr are the caller's ends of the streams the
+	// ExecConfig left to pipes. With a terminal, Stdin and Stdout are both
+	// its master side and Stderr is nil.
+	Stdin  io.WriteCloser
+	Stdout io.ReadCloser
+	Stderr io.ReadCloser
+
+	cmd  *exec.Cmd
+	tty  *os.File
+	ends []*os.File
+	done chan struct{}
+	once sync.Once
+}
+
+// Exec starts a process in the namespaces of the container, with its
+// rlimits, once the hooks of PhaseExec accepted it. The process is forked
+// from a thread that joined the container and is never handed back to the
+// scheduler. It is killed if ctx is done before it exits. A terminal and
+// streams connected to pipes are closed by Wait, so they should be read
+// to their end first.
+func (c *Container) Exec(ctx context.Context, cfg ExecConfig) (*Process, error) {
+	if len(cfg.Args) == 0 {
+		return nil, fmt.Errorf("no command to run in container %s", c.State.ID)
+	}
+	if err := c.Hooks.Run(ctx, PhaseExec, c.State); err != nil {
+		return nil, err
+	}
+	path := cfg.Args[0]
+	if !strings.Contains(path, "/") {
+		path = filepath.Join("/bin", path)
+	}
+	p := &Process{
+		cmd:  &exec.Cmd{Path: path, Args: cfg.Args, Env: append([]string{}, cfg.Env...)},
+		done: make(chan struct{}),
+	}
+	// The process's ends of the pipes are closed once it started
+	var child []*os.File
+	defer func() {
+		for _, f := range child {
+			f.Close()
+		}
+	}()
+	if !cfg.TTY {
+		p.cmd.Stdin, p.cmd.Stdout, p.cmd.Stderr = cfg.Stdin, cfg.Stdout, cfg.Stderr
+		if cfg.Stdin == nil {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return nil, err
+			}
+			p.cmd.Stdin, p.Stdin = r, w
+			child, p.ends = append(child, r), append(p.ends, w)
+		}
+		for _, s := range []struct {
+			cfg    io.Writer
+			cmd    *io.Writer
+			caller *io.ReadCloser
+		}{{cfg.Stdout, &p.cmd.Stdout, &p.Stdout}, {cfg.Stderr, &p.cmd.Stderr, &p.Stderr}} {
+			if s.cfg != nil {
+				continue
+			}
+			r, w, err := os.Pipe()
+			if err != nil {
+				p.closeEnds()
+				return nil, err
+			}
+			*s.cmd, *s.caller = w, r
+			child, p.ends = append(child, w), append(p.ends, r)
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errc <- c.enterAndStart(p, cfg)
+	}()
+	if err := <-errc; err != nil {
+		p.closeEnds()
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.cmd.Process.Kill()
+		case <-p.done:
+		}
+	}()
+	return p, nil
+}
+
+// enterAndStart joins the container on the calling thread, which must be
+// locked to it and is discarded afterwards, and starts the process.
+func (c *Container) enterAndStart(p *Process, cfg ExecConfig) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	open := func(path string) (*os.File, error) {
+		f, err := os.Open(path)
+		if err == nil {
+			files = append(files, f)
+		}
+		return f, err
+	}
+	if err := inheritRlimits(c.State.PID); err != nil {
+		return err
+	}
+	// Everything is opened before joining, while host paths still resolve
+	root, err := open(fmt.Sprintf("/proc/%d/root", c.State.PID))
+	if err != nil {
+		return fmt.Errorf("cannot open root of container %s: %w", c.State.ID, err)
+	}
+	var namespaces []*os.File
+	for _, ns := range execNamespaces {
+		f, err := open(fmt.Sprintf("/proc/%d/ns/%s", c.State.PID, ns.name))
+		if err != nil {
+			return fmt.Errorf("cannot open namespace of container %s: %w", c.State.ID, err)
+		}
+		namespaces = append(namespaces, f)
+	}
+
+	// Joining a mount namespace requires a thread with its own root and
+	// working directory
+	if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+		return fmt.Errorf("cannot unshare file system attributes: %w", err)
+	}
+	for i, ns := range execNamespaces {
+		if _, _, errno := syscall.RawSyscall(sysSetns, namespaces[i].Fd(), uintptr(ns.nstype), 0); errno != 0 {
+			return fmt.Errorf("cannot join %s namespace of container %s: %w", ns.name, c.State.ID, errno)
+		}
+	}
+	// The namespace's root is the host's for containers isolated by chroot
+	if cfg.Enter != nil {
+		if err := cfg.Enter(root); err != nil {
+			return err
+		}
+	} else {
+		if err := syscall.Fchdir(int(root.Fd())); err != nil {
+			return err
+		}
+		if err := syscall.Chroot("."); err != nil {
+			return fmt.Errorf("cannot enter root of container %s: %w", c.State.ID, err)
+		}
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if cfg.TTY {
+		// Inside the root, /dev/ptmx is the container's devpts instance
+		master, slave, err := OpenPTY()
+		if err != nil {
+			return err
+		}
+		files = append(files, slave)
+		p.tty, p.Stdin, p.Stdout = master, master, master
+		p.ends = append(p.ends, master)
+		p.cmd.Stdin, p.cmd.Stdout, p.cmd.Stderr = slave, slave, slave
+		p.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	}
+	if cfg.Restrict != nil {
+		if err := cfg.Restrict(); err != nil {
+			return err
+		}
+	}
+	return p.cmd.Start()
+}
+
+// Pid returns the process ID of the process in the host's PID namespace.
+func (p *Process) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+// Signal sends sig to the process.
+func (p *Process) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+// Resize sets the window size of the process's terminal, whose kernel
+// then signals SIGWINCH to its foreground process group.
+func (p *Process) Resize(cols, rows uint16) error {
+	if p.tty == nil {
+		return errors.New("process has no terminal")
+	}
+	ws := struct{ row, col, xpixel, ypixel uint16 }{row: rows, col: cols}
+	return ioctl(p.tty.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// Wait waits for the process to exit and for the copying of streams that
+// are not files, then closes the caller's ends of its streams. The error
+// reports failures to wait, not unsuccessful exits, which the state shows.
+func (p *Process) Wait() (*os.ProcessState, error) {
+	err := p.cmd.Wait()
+	p.once.Do(func() { close(p.done) })
+	p.closeEnds()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		err = nil
+	}
+	return p.cmd.ProcessState, err
+}
+
+func (p *Process) closeEnds() {
+	for _, f := range p.ends {
+		f.Close()
+	}
+	p.ends = nil
+}
+
+// inheritRlimits applies the rlimits of the container's init to the
+// calling thread, whose processes inherit them. This happens before the
+// thread drops the privileges that raising a hard limit needs.
+func inheritRlimits(pid int) error {
+	for resource := 0; resource < rlimitCount; resource++ {
+		var l syscall.Rlimit
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), 0, uintptr(unsafe.Pointer(&l)), 0, 0); errno != 0 {
+			return fmt.Errorf("cannot read rlimit %d of the container: %w", resource, errno)
+		}
+		if err := syscall.Setrlimit(resource, &l); err != nil {
+			return fmt.Errorf("cannot set rlimit %d: %w", resource, err)
+		}
+	}
+	return nil
+}
+
+// OpenPTY allocates a pseudo-terminal from /dev/ptmx and returns its
+// master and slave sides. Called after isolation, or by a thread that
+// entered a container, it allocates from the container's devpts instance.
+func OpenPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot allocate a terminal: %w", err)
+	}
+	var unlock int32
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("cannot unlock terminal: %w", err)
+	}
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("cannot get terminal number: %w", err)
+	}
+	path := filepath.Join("/dev/pts", strconv.FormatUint(uint64(n), 10))
+	slave, err = os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	return master, slave, nil
+}
+
+// ioctl issues a terminal ioctl whose argument is a pointer.
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package container
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Phase is a point of a container's lifecycle at which hooks run and
+// subscribers are told about the container.
+type Phase string
+
+const (
+	// PhaseStarted follows the start of the container's command and the
+	// recording of its state
+	PhaseStarted Phase = "started"
+	// PhasePaused and PhaseResumed follow freezing and thawing the
+	// container's processes
+	PhasePaused  Phase = "paused"
+	PhaseResumed Phase = "resumed"
+	// PhaseExec precedes the start of a process in the container; an error
+	// of its hooks refuses the process
+	PhaseExec Phase = "exec"
+	// PhaseExited follows the exit of the container's command, with its
+	// exit code in the state, and precedes the removal of the state
+	PhaseExited Phase = "exited"
+)
+
+// Hook is a function run in-process at a phase of a container's lifecycle.
+type Hook func(ctx context.Context, st State) error
+
+// Event tells subscribers that a container passed a phase.
+type Event struct {
+	Phase Phase
+	Time  time.Time
+	State State
+	// Err is the error of the hook that failed, if one did
+	Err error
+}
+
+// Hooks holds the hooks registered for the phases of a container and the
+// subscribers to its events. The zero value has neither and is ready to
+// use; a nil *Hooks does nothing.
+type Hooks struct {
+	mu    sync.Mutex
+	hooks map[Phase][]Hook
+	subs  map[chan Event]struct{}
+}
+
+// Register adds fn to the hooks run at phase, after those registered
+// before it.
+func (h *Hooks) Register(phase Phase, fn Hook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hooks == nil {
+		h.hooks = make(map[Phase][]Hook)
+	}
+	h.hooks[phase] = append(h.hooks[phase], fn)
+}
+
+// Subscribe returns a channel receiving an event for every phase the
+// container passes, and a function ending the subscription, which closes
+// the channel. Events are not waited for: a subscriber whose buffer is
+// full misses them.
+func (h *Hooks) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan Event]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Run runs the hooks of phase in order until one fails, then sends the
+// event to the subscribers. It returns the error of the failed hook.
+func (h *Hooks) Run(ctx context.Context, phase Phase, st State) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	hooks := append([]Hook(nil), h.hooks[phase]...)
+	h.mu.Unlock()
+	var err error
+	for _, fn := range hooks {
+		if err = fn(ctx, st); err != nil {
+			err = fmt.Errorf("%s hook of container %s: %w", phase, st.ID, err)
+			break
+		}
+	}
+	ev := Event{Phase: phase, Time: time.Now(), State: st, Err: err}
+	h.mu.Lock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	h.mu.Unlock()
+	return err
+}
@@ -0,0 +1,150 @@
+//go:build linux
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	prCapbsetDrop = 24 // PR_CAPBSET_DROP
+	capSysChroot  = 18 // CAP_SYS_CHROOT
+	procSelfFd    = "/proc/self/fd"
+)
+
+// Isolator defines filesystem isolation strategies
+type Isolator interface {
+	Isolate(rootfs string) error
+}
+
+// PivotRootIsolator uses pivot_root for filesystem isolation
+type PivotRootIsolator struct{}
+
+func (p *PivotRootIsolator) Isolate(rootfs string) error {
+	absNewRoot, err := filepath.Abs(rootfs)
+	if err != nil {
+		return fmt.Errorf("cannot get absolute path for %s: %w", rootfs, err)
+	}
+	err = syscall.Mount(absNewRoot, absNewRoot, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind mount new root: %w", err)
+	}
+	if err := MakeMountsPrivate(); err != nil {
+		return err
+	}
+
+	// pivot_root(".", ".") stacks the old root on top of the new one, so it
+	// can be detached without creating an old_root directory in the rootfs
+	if err := syscall.Chdir(absNewRoot); err != nil {
+		return fmt.Errorf("chdir to new root failed: %w", err)
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root failed: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting old root failed: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir to / failed after pivot_root: %w", err)
+	}
+	return nil
+}
+
+// ChrootIsolator uses chroot for filesystem isolation (fallback)
+type ChrootIsolator struct{}
+
+func (c *ChrootIsolator) Isolate(rootfs string) error {
+	if err := closeDirFds(); err != nil {
+		return err
+	}
+	if err := syscall.Chroot(rootfs); err != nil {
+		return fmt.Errorf("chroot failed: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir to / failed after chroot: %w", err)
+	}
+	if err := verifyChrootJail(); err != nil {
+		return fmt.Errorf("chroot verification failed: %w", err)
+	}
+	if err := dropChrootCapability(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MakeMountsPrivate stops mounts created in the mount namespace of a
+// container
+// from propagating back to the host. It must run before any host-side
+// mount is set up inside the rootfs.
+func MakeMountsPrivate() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to set mount propagation to private: %w", err)
+	}
+	return nil
+}
+
+// closeDirFds closes every open directory file descriptor. A directory fd
+// that survives chroot is a handle outside the new root, and fchdir on it
+// is the classic way to escape the jail.
+func closeDirFds() error {
+	entries, err := os.ReadDir(procSelfFd)
+	if err != nil {
+		return fmt.Errorf("cannot list open fds: %w", err)
+	}
+	for _, e := range entries {
+		fd, err := strconv.Atoi(e.Name())
+		if err != nil || fd <= 2 {
+			continue
+		}
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			// The fd used by ReadDir itself is already closed
+			continue
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err := syscall.Close(fd); err != nil {
+				return fmt.Errorf("cannot close directory fd %d: %w", fd, err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyChrootJail checks that the working directory is the new root and
+// that ".." of the root is the root itself, i.e. there is no path left to
+// walk out of the jail.
+func verifyChrootJail() error {
+	var root, cwd, parent syscall.Stat_t
+	if err := syscall.Stat("/", &root); err != nil {
+		return err
+	}
+	if err := syscall.Stat(".", &cwd); err != nil {
+		return err
+	}
+	// The literal path, as filepath.Join would clean it to "/"
+	if err := syscall.Stat("/..", &parent); err != nil {
+		return err
+	}
+	if cwd.Dev != root.Dev || cwd.Ino != root.Ino {
+		return fmt.Errorf("working directory is outside the chroot")
+	}
+	if parent.Dev != root.Dev || parent.Ino != root.Ino {
+		return fmt.Errorf("parent of / escapes the chroot")
+	}
+	return nil
+}
+
+// dropChrootCapability removes CAP_SYS_CHROOT from the bounding set of the
+// calling thread, so the containerized process can never chroot again to
+// stage an escape. Capability sets are per thread, so callers must keep
+// the goroutine locked to its OS thread until the command is started.
+func dropChrootCapability() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, capSysChroot, 0); errno != 0 {
+		return fmt.Errorf("cannot drop CAP_SYS_CHROOT: %w", errno)
+	}
+	return nil
+}
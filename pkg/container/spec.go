@@ -0,0 +1,93 @@
+//go:build linux
+
+package container
+
+import "time"
+
+// Spec is the fully resolved description of a container, as admission
+// policies see it.
+type Spec struct {
+	Name     string            `json:"name,omitempty"`
+	Rootfs   string            `json:"rootfs"`
+	Image    string            `json:"image,omitempty"`
+	Command  []string          `json:"command"`
+	Env      []string          `json:"env_passthrough"`
+	Volumes  []VolumeSpec      `json:"volumes,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Memory   int64             `json:"memory,omitempty"`
+	CPUs     float64           `json:"cpus,omitempty"`
+	Pids     int64             `json:"pids_limit,omitempty"`
+	Timezone string            `json:"timezone,omitempty"`
+	// Network is the network mode, host or the name of a network
+	Network  string `json:"network"`
+	User     string `json:"user,omitempty"`
+	Rootless bool   `json:"rootless"`
+	// Profile and SecurityProfile name the profiles in effect; Seccomp is
+	// the filter they resolve to, empty for none
+	Profile         string `json:"profile,omitempty"`
+	SecurityProfile string `json:"security_profile,omitempty"`
+	Seccomp         string `json:"seccomp"`
+	// Privileged is set by --privileged and --security-profile privileged
+	Privileged bool `json:"privileged"`
+	// Capabilities is the bounding set of the workload, sorted, after
+	// --cap-add and --cap-drop
+	Capabilities []string `json:"capabilities"`
+}
+
+// VolumeSpec is a volume of a container in -v syntax.
+type VolumeSpec struct {
+	Source  string   `json:"source"`
+	Target  string   `json:"target"`
+	Options []string `json:"options"`
+}
+
+// State is the runtime record of a running container, kept in the state
+// store of the runtime directory for as long as the container runs.
+type State struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	PID         int               `json:"pid"`
+	Rootfs      string            `json:"rootfs"`
+	Image       string            `json:"image,omitempty"`
+	Command     []string          `json:"command"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	StopTimeout time.Duration     `json:"stop_timeout"`
+	Network     string            `json:"network,omitempty"`
+	IP          string            `json:"ip,omitempty"`
+	Ports       []string          `json:"ports,omitempty"`
+	Cgroup      string            `json:"cgroup,omitempty"`
+	// Freezer is the cgroup v1 freezer group of a container without a
+	// cgroup v2 group of its own
+	Freezer  string `json:"freezer,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Security string `json:"security_profile,omitempty"`
+	Seccomp  string `json:"seccomp,omitempty"`
+	// Capabilities is the bounding set of the workload, null for the
+	// default set and empty if every capability was dropped
+	Capabilities []string `json:"capabilities"`
+	NoExec       bool     `json:"no_exec,omitempty"`
+	// Definition is the digest of the run arguments, by which idempotent
+	// runs recognize an unchanged container
+	Definition string `json:"definition,omitempty"`
+	// Args are the run arguments of the container, with its rootfs path
+	// made absolute, from which shp generate systemd writes a unit
+	Args    []string     `json:"args,omitempty"`
+	Volumes []VolumeSpec `json:"volumes,omitempty"`
+	// LogFile is where the output of the container is captured, if it is,
+	// and LogDriver is journald for output sent to the journal or
+	// json-file for JSON lines
+	LogFile   string `json:"log_file,omitempty"`
+	LogDriver string `json:"log_driver,omitempty"`
+	// Status is empty while the container runs, paused while shp pause has
+	// frozen it and stopping once shp stop or kill is ending it
+	Status string `json:"status,omitempty"`
+	// UID is the user the container was started for, with the limits
+	// counted against the user's quota
+	UID     int       `json:"uid"`
+	Memory  int64     `json:"memory,omitempty"`
+	CPUs    float64   `json:"cpus,omitempty"`
+	Created time.Time `json:"created"`
+	// ExitCode is set once the command exited, for the hooks of
+	// PhaseExited
+	ExitCode *int `json:"exit_code,omitempty"`
+}
@@ -0,0 +1,6 @@
+//go:build linux
+
+package container
+
+// The syscall package does not define SYS_SETNS on 386.
+const sysSetns = 346
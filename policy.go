@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// policyDir holds admission policy hooks. Every executable in it receives
+// the resolved container spec as JSON on stdin and denies the start by
+// exiting non-zero; its output is reported as the reason.
+const policyDir = "/etc/shp/policy.d"
+
+// checkPolicy runs all policy hooks in lexical order against spec.
+func checkPolicy(spec *containerSpec) error {
+	hooks, err := policyHooks(policyDir)
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		var out bytes.Buffer
+		cmd := exec.Command(hook)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			reason := strings.TrimSpace(out.String())
+			if reason == "" {
+				reason = err.Error()
+			}
+			return fmt.Errorf("denied by policy %s: %s", filepath.Base(hook), reason)
+		}
+	}
+	return nil
+}
+
+func policyHooks(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", dir, err)
+	}
+	var hooks []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			continue
+		}
+		hooks = append(hooks, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(hooks)
+	return hooks, nil
+}
@@ -0,0 +1,134 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	portForwardUsage = "usage: shp port-forward <container> [addr:]hostPort:containerPort ..."
+	aliveInterval    = time.Second
+)
+
+// portMapping forwards a host listen address to a port in the container.
+type portMapping struct {
+	listen        string
+	containerPort int
+}
+
+// parsePortMapping parses "[addr:]hostPort:containerPort"; the listen
+// address defaults to defaultAddr.
+func parsePortMapping(spec, defaultAddr string) (portMapping, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return portMapping{}, fmt.Errorf("invalid port mapping %q, expected [addr:]hostPort:containerPort", spec)
+	}
+	cport, err := strconv.Atoi(spec[i+1:])
+	if err != nil || cport < 1 || cport > 65535 {
+		return portMapping{}, fmt.Errorf("invalid container port in %q", spec)
+	}
+	listen := spec[:i]
+	if !strings.Contains(listen, ":") {
+		listen = net.JoinHostPort(defaultAddr, listen)
+	}
+	return portMapping{listen: listen, containerPort: cport}, nil
+}
+
+func portForward(args []string) {
+	if len(args) < 2 {
+		fmt.Println(portForwardUsage)
+		os.Exit(1)
+	}
+	st, err := findContainer(args[0])
+	handle(err)
+
+	var mappings []portMapping
+	for _, spec := range args[1:] {
+		m, err := parsePortMapping(spec, "127.0.0.1")
+		handle(err)
+		mappings = append(mappings, m)
+	}
+	handle(forwardPorts(st.PID, mappings))
+}
+
+// forwardPorts proxies connections accepted on the host to the container
+// until interrupted or until the container exits. Upstream connections
+// are dialed from inside the container's network namespace, so no rules
+// have to be programmed and the container does not need to be restarted.
+func forwardPorts(pid int, mappings []portMapping) error {
+	for _, m := range mappings {
+		ln, err := net.Listen("tcp", m.listen)
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s: %w", m.listen, err)
+		}
+		defer ln.Close()
+		fmt.Printf("Forwarding %s -> %d\n", ln.Addr(), m.containerPort)
+		go acceptForward(ln, pid, m.containerPort)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(aliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigs:
+			return nil
+		case <-ticker.C:
+			if !processAlive(pid) {
+				return fmt.Errorf("container exited")
+			}
+		}
+	}
+}
+
+func acceptForward(ln net.Listener, pid, port int) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var upstream net.Conn
+			err := inNetns(pid, func() error {
+				var err error
+				upstream, err = net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 5*time.Second)
+				return err
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "port-forward: %v\n", err)
+				return
+			}
+			defer upstream.Close()
+			proxy(conn, upstream)
+		}()
+	}
+}
+
+// proxy copies in both directions until either side is done, half-closing
+// the other so protocols relying on EOF keep working. Between two TCP
+// connections io.Copy already splices in the kernel.
+func proxy(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if c, ok := dst.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+}
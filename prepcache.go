@@ -0,0 +1,108 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const prepCacheDir = "cache/prep"
+
+// rootfsFingerprint summarizes the metadata of every entry in rootfs
+// (inode, mode, size, mtime and ctime). Any modification changes ctime, which
+// unprivileged users cannot set back, so an unchanged fingerprint means the
+// results of expensive preparation steps are still valid without rereading
+// file contents.
+func rootfsFingerprint(rootfs string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(rootfs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && manifestSkip[rel] {
+			return fs.SkipDir
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d %d %o %d:%d %d %d.%d %d.%d\n", rel, st.Dev, st.Ino, st.Mode, st.Uid, st.Gid,
+			st.Size, st.Mtim.Sec, st.Mtim.Nsec, st.Ctim.Sec, st.Ctim.Nsec)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot fingerprint %s: %w", rootfs, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// prepCachePath returns the cache entry for a preparation step on rootfs,
+// keyed by the step name and its inputs.
+func prepCachePath(rootfs string, key ...string) (string, error) {
+	abs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprint(h, abs)
+	for _, k := range key {
+		fmt.Fprint(h, "\x00", k)
+	}
+	return filepath.Join(stateDir, prepCacheDir, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// memoize runs step unless a previous successful run on the same rootfs
+// with the same key recorded the current fingerprint. Only successes are
+// cached; cache failures simply fall back to running the step.
+func memoize(rootfs string, key []string, step func() error) error {
+	path, err := prepCachePath(rootfs, key...)
+	if err != nil {
+		return step()
+	}
+	before, err := rootfsFingerprint(rootfs)
+	if err != nil {
+		return step()
+	}
+	if cached, err := os.ReadFile(path); err == nil && string(cached) == before {
+		return nil
+	}
+
+	if err := step(); err != nil {
+		return err
+	}
+
+	// Do not record a fingerprint if the rootfs changed while the step ran
+	if after, err := rootfsFingerprint(rootfs); err == nil && after == before {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			os.WriteFile(path, []byte(before), 0600)
+		}
+	}
+	return nil
+}
+
+// verifyManifestCached is verifyManifest memoized on the manifest digest,
+// turning repeated verification of an unchanged rootfs into a metadata walk.
+// The pinned digest of the manifest is checked on every run, as a cached
+// verification says nothing about a pin set since.
+func verifyManifestCached(rootfs, manifestFile, manifestDigest string) error {
+	sum, err := fileDigest(manifestFile)
+	if err != nil {
+		return fmt.Errorf("cannot read manifest: %w", err)
+	}
+	if manifestDigest != "" && sum != manifestDigest {
+		return fmt.Errorf("manifest %s has digest %s, expected %s", manifestFile, sum, manifestDigest)
+	}
+	return memoize(rootfs, []string{"verify-manifest", sum}, func() error {
+		return verifyManifest(rootfs, manifestFile, manifestDigest)
+	})
+}
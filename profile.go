@@ -0,0 +1,86 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const profileAppliance = "appliance"
+
+// containerProfile is a set of hardening options selected with --profile.
+// Profiles may also be defined under "profiles" in the config file, which
+// take precedence over built-in profiles of the same name.
+type containerProfile struct {
+	name string
+
+	securityProfile
+
+	// ReadOnlyRootfs remounts the rootfs read-only once setup, including
+	// the init script, is done. Volumes keep their own mode.
+	ReadOnlyRootfs bool `json:"readonly_rootfs"`
+	PrivateTmp     bool `json:"private_tmp"`
+	// NoExec marks the container so that nothing may enter it after start.
+	NoExec bool `json:"no_exec"`
+}
+
+// builtinProfiles are the profiles available without configuration.
+// appliance is meant for single-purpose kiosk and edge deployments, where
+// the workload never changes its image and needs no privileges.
+var builtinProfiles = map[string]containerProfile{
+	profileAppliance: {
+		securityProfile: securityProfile{
+			Capabilities:    []string{"NET_BIND_SERVICE"},
+			Seccomp:         seccompStrict,
+			NoNewPrivileges: true,
+			MaskedPaths:     defaultMaskedPaths,
+			ReadOnlyPaths:   defaultReadOnlyPaths,
+		},
+		ReadOnlyRootfs: true,
+		PrivateTmp:     true,
+		NoExec:         true,
+	},
+}
+
+// lookupProfile returns the profile called name, or the default profile,
+// which changes nothing, if name is empty.
+func lookupProfile(name string) (*containerProfile, error) {
+	if name == "" {
+		return &containerProfile{}, nil
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		if p, ok = builtinProfiles[name]; !ok {
+			return nil, fmt.Errorf("unknown profile: %s", name)
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %w", name, err)
+	}
+	p.name = name
+	return &p, nil
+}
+
+// mountProtections applies the profile's path protections and mounts a
+// private /tmp. It runs after pivot_root and the /proc mount; null is the
+// mount returned by openNullMount.
+func (p *containerProfile) mountProtections(null *os.File) error {
+	if err := p.protectPaths(null); err != nil {
+		return err
+	}
+	if p.PrivateTmp {
+		if err := os.MkdirAll("/tmp", 0755); err != nil {
+			return fmt.Errorf("cannot create /tmp: %w", err)
+		}
+		if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("cannot mount private /tmp: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressNone  = "none"
+	progressPlain = "plain"
+	progressJSON  = "json"
+
+	progressBarWidth = 30
+)
+
+// Phases reported while creating a container.
+const (
+	phaseDownload = "download"
+	phaseExtract  = "extract"
+	phaseValidate = "validate"
+	phaseNetwork  = "network"
+	phaseIsolate  = "isolate"
+	phaseMount    = "mount"
+	phaseInit     = "init"
+	phaseStarted  = "started"
+)
+
+// progressEvent is a single machine-readable progress update.
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase"`
+	ID      string    `json:"id,omitempty"`
+	Current int64     `json:"current,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// progressReporter receives progress events. Implementations must be safe
+// for concurrent use.
+type progressReporter interface {
+	report(ev progressEvent)
+}
+
+// newProgressReporter returns the reporter for a --progress mode.
+func newProgressReporter(mode string, w io.Writer) progressReporter {
+	switch mode {
+	case progressJSON:
+		return &jsonProgress{enc: json.NewEncoder(w)}
+	case progressPlain:
+		return &plainProgress{w: w}
+	}
+	return noProgress{}
+}
+
+type noProgress struct{}
+
+func (noProgress) report(progressEvent) {}
+
+// jsonProgress writes one JSON object per event.
+type jsonProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (p *jsonProgress) report(ev progressEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(ev)
+}
+
+// plainProgress renders events for humans, drawing a progress bar for
+// events that carry a total.
+type plainProgress struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *plainProgress) report(ev progressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	label := ev.Phase
+	if ev.ID != "" {
+		label += " " + ev.ID
+	}
+	if ev.Total <= 0 {
+		msg := ev.Message
+		if msg == "" {
+			msg = "..."
+		}
+		fmt.Fprintf(p.w, "%s: %s\n", label, msg)
+		return
+	}
+
+	filled := int(ev.Current * progressBarWidth / ev.Total)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	end := ""
+	if ev.Current >= ev.Total {
+		end = "\n"
+	}
+	fmt.Fprintf(p.w, "\r%s [%s] %3d%%%s", label, bar, ev.Current*100/ev.Total, end)
+}
+
+// progressWriter reports the bytes written through it, at most once per
+// percent of total, so it can be teed into a download or extraction.
+type progressWriter struct {
+	reporter progressReporter
+	phase    string
+	id       string
+	total    int64
+	current  int64
+	lastPct  int64
+}
+
+func newProgressWriter(r progressReporter, phase, id string, total int64) *progressWriter {
+	return &progressWriter{reporter: r, phase: phase, id: id, total: total, lastPct: -1}
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.current += int64(len(b))
+	pct := int64(0)
+	if w.total > 0 {
+		pct = w.current * 100 / w.total
+	}
+	if pct != w.lastPct {
+		w.lastPct = pct
+		w.reporter.report(progressEvent{Phase: w.phase, ID: w.id, Current: w.current, Total: w.total})
+	}
+	return len(b), nil
+}
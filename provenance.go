@@ -0,0 +1,192 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	inTotoPayloadType   = "application/vnd.in-toto+json"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+
+	shpBuilderID    = "https://github.com/gaurav-gogia/shp"
+	commitBuildType = shpBuilderID + "/commit/v1"
+)
+
+// inTotoStatement is an in-toto attestation whose predicate is SLSA build
+// provenance.
+type inTotoStatement struct {
+	Type          string                   `json:"_type"`
+	Subject       []slsaResourceDescriptor `json:"subject"`
+	PredicateType string                   `json:"predicateType"`
+	Predicate     slsaProvenance           `json:"predicate"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string                   `json:"buildType"`
+	ExternalParameters   commitParameters         `json:"externalParameters"`
+	ResolvedDependencies []slsaResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// commitParameters are the inputs of shp commit that determine the layer.
+type commitParameters struct {
+	Rootfs          string `json:"rootfs"`
+	BaseManifest    string `json:"baseManifest,omitempty"`
+	Reproducible    bool   `json:"reproducible"`
+	SourceDateEpoch *int64 `json:"sourceDateEpoch,omitempty"`
+}
+
+type slsaResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaRunDetails struct {
+	Builder  slsaBuilder  `json:"builder"`
+	Metadata slsaMetadata `json:"metadata"`
+}
+
+type slsaBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version"`
+}
+
+type slsaMetadata struct {
+	StartedOn  time.Time `json:"startedOn"`
+	FinishedOn time.Time `json:"finishedOn"`
+}
+
+// dsseEnvelope is a signed in-toto statement, as verified by in-toto and
+// SLSA tooling.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     []byte          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// digestSet returns the in-toto digest set of a "sha256:<hex>" digest.
+func digestSet(digest string) map[string]string {
+	return map[string]string{"sha256": strings.TrimPrefix(digest, "sha256:")}
+}
+
+// builderVersion identifies the shp binary that built a layer: its module
+// version and VCS revision, and the Go toolchain, which determines the
+// compressed bytes of the layer.
+func builderVersion() map[string]string {
+	version := map[string]string{"go": runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	version["shp"] = info.Main.Version
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.modified":
+			version[s.Key] = s.Value
+		}
+	}
+	return version
+}
+
+// commitProvenance describes how shp commit built the layer out from the
+// rootfs with the given manifest. The rootfs is identified by the digest of
+// its manifest, which `shp manifest <rootfs> | sha256sum` reproduces.
+func commitProvenance(out string, params commitParameters, manifest []string, started, finished time.Time) (*inTotoStatement, error) {
+	layerDigest, err := fileDigest(out)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(strings.Join(manifest, "\n") + "\n"))
+	deps := []slsaResourceDescriptor{{
+		Name:   "rootfs",
+		URI:    "file://" + params.Rootfs,
+		Digest: map[string]string{"sha256": hex.EncodeToString(sum[:])},
+	}}
+	if params.BaseManifest != "" {
+		baseDigest, err := fileDigest(params.BaseManifest)
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, slsaResourceDescriptor{Name: "base-manifest", URI: "file://" + params.BaseManifest, Digest: digestSet(baseDigest)})
+	}
+	return &inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []slsaResourceDescriptor{{Name: filepath.Base(out), Digest: digestSet(layerDigest)}},
+		PredicateType: slsaProvenanceType,
+		Predicate: slsaProvenance{
+			BuildDefinition: slsaBuildDefinition{
+				BuildType:            commitBuildType,
+				ExternalParameters:   params,
+				ResolvedDependencies: deps,
+			},
+			RunDetails: slsaRunDetails{
+				Builder:  slsaBuilder{ID: shpBuilderID, Version: builderVersion()},
+				Metadata: slsaMetadata{StartedOn: started.UTC(), FinishedOn: finished.UTC()},
+			},
+		},
+	}, nil
+}
+
+// dssePAE is the pre-authentication encoding of DSSE, which is what is
+// signed rather than the payload alone.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// writeProvenance writes the statement to the new file path, in a DSSE
+// envelope signed with signer if it is set.
+func writeProvenance(path string, st *inTotoStatement, signer ed25519.PrivateKey) error {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	data := payload
+	if signer != nil {
+		keyID := sha256.Sum256(signer.Public().(ed25519.PublicKey))
+		env := dsseEnvelope{
+			PayloadType: inTotoPayloadType,
+			Payload:     payload,
+			Signatures: []dsseSignature{{
+				KeyID: hex.EncodeToString(keyID[:]),
+				Sig:   ed25519.Sign(signer, dssePAE(inTotoPayloadType, payload)),
+			}},
+		}
+		if data, err = json.MarshalIndent(env, "", "  "); err != nil {
+			return err
+		}
+	} else if data, err = json.MarshalIndent(st, "", "  "); err != nil {
+		return err
+	}
+	err = createFile(path, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, 0644)
+}
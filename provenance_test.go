@@ -0,0 +1,73 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteProvenanceSigned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []slsaResourceDescriptor{{Name: "layer.tar.gz", Digest: digestSet("sha256:" + hex.EncodeToString(make([]byte, 32)))}},
+		PredicateType: slsaProvenanceType,
+	}
+	path := filepath.Join(t.TempDir(), "provenance.json")
+	if err := writeProvenance(path, st, priv); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env dsseEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.PayloadType != inTotoPayloadType {
+		t.Fatalf("payload type is %q, want %q", env.PayloadType, inTotoPayloadType)
+	}
+	if len(env.Signatures) != 1 {
+		t.Fatalf("envelope has %d signatures, want 1", len(env.Signatures))
+	}
+	sig := env.Signatures[0]
+	keyID := sha256.Sum256(pub)
+	if sig.KeyID != hex.EncodeToString(keyID[:]) {
+		t.Errorf("key ID is %s, want %x", sig.KeyID, keyID)
+	}
+	if !ed25519.Verify(pub, dssePAE(env.PayloadType, env.Payload), sig.Sig) {
+		t.Fatal("signature does not verify over the PAE of the payload")
+	}
+	// The signature covers the type as well as the payload
+	if ed25519.Verify(pub, dssePAE("application/json", env.Payload), sig.Sig) {
+		t.Fatal("signature verifies for another payload type")
+	}
+
+	var got inTotoStatement
+	if err := json.Unmarshal(env.Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject[0].Name != "layer.tar.gz" {
+		t.Errorf("payload subject is %q, want layer.tar.gz", got.Subject[0].Name)
+	}
+}
+
+func TestDSSEPAE(t *testing.T) {
+	// The example of the DSSE protocol specification
+	got := string(dssePAE("http://example.com/HelloWorld", []byte("hello world")))
+	want := "DSSEv1 29 http://example.com/HelloWorld 11 hello world"
+	if got != want {
+		t.Fatalf("dssePAE = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,183 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"shp/pkg/container"
+)
+
+const (
+	psUsage   = "usage: shp ps [--json]"
+	rmUsage   = "usage: shp rm [--force] <container>..."
+	stopUsage = "usage: shp stop [-t <grace period>] <container>..."
+	killUsage = "usage: shp kill [-s <signal>] <container>..."
+
+	statusRunning  = "running"
+	statusStopping = "stopping"
+)
+
+func ps(args []string) {
+	switch {
+	case len(args) == 0:
+		handle(printContainers(false))
+	case len(args) == 1 && (args[0] == "--json" || args[0] == "-json"):
+		handle(printContainers(true))
+	default:
+		fmt.Println(psUsage)
+		os.Exit(1)
+	}
+}
+
+// printContainers lists the running containers, oldest first.
+func printContainers(asJSON bool) error {
+	states, err := listStates()
+	if err != nil {
+		return err
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Created.Before(states[j].Created) })
+	if asJSON {
+		if states == nil {
+			states = []*containerState{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(states)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tNAME\tPID\tROOTFS\tCOMMAND\tCREATED\tSTATUS")
+	for _, st := range states {
+		rootfs := st.Rootfs
+		if st.Image != "" {
+			rootfs = st.Image
+		}
+		status := st.Status
+		if status == "" {
+			status = statusRunning
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s ago\t%s\n", st.ID, st.Name, st.PID, rootfs,
+			strings.Join(st.Command, " "), time.Since(st.Created).Round(time.Second), status)
+	}
+	return w.Flush()
+}
+
+func rm(args []string) {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	force := fs.Bool("force", false, "kill the containers instead of stopping them gracefully")
+	fs.BoolVar(force, "f", false, "shorthand for --force")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Println(rmUsage)
+		os.Exit(1)
+	}
+	for _, ref := range fs.Args() {
+		st, err := findContainer(ref)
+		handle(err)
+		handle(removeContainer(st, *force))
+		fmt.Println(st.ID)
+	}
+}
+
+// removeContainer stops a container, with SIGTERM and SIGKILL after its
+// stop timeout or right away with SIGKILL, and waits until its state is
+// gone.
+func removeContainer(st *containerState, force bool) error {
+	if force {
+		if err := syscall.Kill(st.PID, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("cannot kill container %s: %w", st.ID, err)
+		}
+	}
+	return stopContainer(st, st.StopTimeout)
+}
+
+func stop(args []string) {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	grace := fs.Duration("time", -1, "grace period between SIGTERM and SIGKILL instead of the container's stop timeout")
+	fs.DurationVar(grace, "t", -1, "shorthand for --time")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fmt.Println(stopUsage)
+		os.Exit(1)
+	}
+	for _, ref := range fs.Args() {
+		st, err := findContainer(ref)
+		handle(err)
+		timeout := st.StopTimeout
+		if *grace >= 0 {
+			timeout = *grace
+		}
+		handle(stopContainer(st, timeout))
+		fmt.Println(st.ID)
+	}
+}
+
+// stopContainer sends a container SIGTERM, and SIGKILL if it has not
+// exited after timeout, and waits until its state is gone. Until then, its
+// record shows it as stopping.
+func stopContainer(st *containerState, timeout time.Duration) error {
+	// A paused container could not act on SIGTERM
+	if st.Status == statusPaused {
+		if err := freezeContainer(st, false); err != nil {
+			return err
+		}
+	}
+	if err := setStatus(st.ID, statusStopping); err != nil {
+		return err
+	}
+	if err := stopProcess(st.PID, timeout); err != nil {
+		return fmt.Errorf("cannot stop container %s: %w", st.ID, err)
+	}
+	return awaitCleanup(st.ID)
+}
+
+// kill sends a signal to the main process of containers, SIGKILL unless
+// another is given. A killed container is waited for like with stop;
+// other signals are left to the command to handle.
+func kill(args []string) {
+	fs := flag.NewFlagSet("kill", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	sig := syscall.SIGKILL
+	setSignal := func(v string) error {
+		s, err := parseSignal(v)
+		sig = s
+		return err
+	}
+	fs.Func("signal", "signal to send, e.g. SIGHUP, HUP or 1", setSignal)
+	fs.Func("s", "shorthand for --signal", setSignal)
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Println(err)
+		}
+		fmt.Println(killUsage)
+		os.Exit(1)
+	}
+	for _, ref := range fs.Args() {
+		st, err := findContainer(ref)
+		handle(err)
+		if sig == syscall.SIGKILL {
+			handle(setStatus(st.ID, statusStopping))
+		}
+		err = container.New(*st).Signal(sig)
+		exited := errors.Is(err, syscall.ESRCH)
+		if err != nil && !exited {
+			handle(err)
+		}
+		// A container that exited already is waited for as well
+		if sig == syscall.SIGKILL || exited {
+			handle(awaitCleanup(st.ID))
+		}
+		fmt.Println(st.ID)
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parsePublish parses a --publish value, [addr:]hostPort:containerPort[/tcp].
+// Like Docker, ports are published on every address of the host by default.
+func parsePublish(spec string) (portMapping, error) {
+	spec, proto, hasProto := strings.Cut(spec, "/")
+	if hasProto && proto != "tcp" {
+		return portMapping{}, fmt.Errorf("invalid port mapping %q: only tcp ports can be published", spec+"/"+proto)
+	}
+	m, err := parsePortMapping(spec, "0.0.0.0")
+	if err != nil {
+		return m, err
+	}
+	host, port, err := net.SplitHostPort(m.listen)
+	if err != nil || net.ParseIP(host) == nil {
+		return m, fmt.Errorf("invalid host address in %q", spec)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return m, fmt.Errorf("invalid host port in %q", spec)
+	}
+	return m, nil
+}
+
+func (m portMapping) String() string {
+	return fmt.Sprintf("%s->%d/tcp", m.listen, m.containerPort)
+}
+
+// listenPublished binds the published ports on the host before the
+// container starts, so that a port in use fails the run. Like docker-proxy,
+// the listeners proxy the connections DNAT does not see: those from the
+// host itself, and every connection on networks without DNAT rules.
+func listenPublished(mappings []portMapping) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, m := range mappings {
+		ln, err := net.Listen("tcp", m.listen)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("cannot publish port %s: %w", m.listen, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// publishRules returns the iptables rules that DNAT connections from other
+// hosts on the published port to the container and let them through the
+// FORWARD chain, tagged with the container ID. Loopback addresses are left
+// to the proxy, since routing does not let their traffic leave the host.
+func publishRules(id string, ip net.IP, m portMapping) [][]string {
+	host, port, _ := net.SplitHostPort(m.listen)
+	addr := net.ParseIP(host)
+	if addr.IsLoopback() {
+		return nil
+	}
+	comment := []string{"-m", "comment", "--comment", "shp:" + id}
+	dnat := []string{"-t", "nat", "PREROUTING", "-p", "tcp"}
+	if !addr.IsUnspecified() {
+		dnat = append(dnat, "-d", host)
+	}
+	dnat = append(dnat, "--dport", port, "-m", "addrtype", "--dst-type", "LOCAL")
+	dnat = append(append(dnat, comment...), "-j", "DNAT", "--to-destination", net.JoinHostPort(ip.String(), strconv.Itoa(m.containerPort)))
+	forward := []string{"FORWARD", "-d", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(m.containerPort)}
+	forward = append(append(forward, comment...), "-j", "ACCEPT")
+	return [][]string{dnat, forward}
+}
+
+// publish adds the DNAT rules of the published ports to the attachment,
+// which removes them again on detach.
+func (a *netAttachment) publish(mappings []portMapping) error {
+	for _, m := range mappings {
+		for _, rule := range publishRules(a.id, a.ip, m) {
+			if err := runTool("iptables", ruleArgs("-I", rule)...); err != nil {
+				return err
+			}
+			a.rules = append(a.rules, rule)
+		}
+	}
+	return nil
+}
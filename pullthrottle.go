@@ -0,0 +1,119 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	pullSlotsDir     = "pulls"
+	pullSlotPoll     = 200 * time.Millisecond
+	throttleInterval = 100 * time.Millisecond
+)
+
+// pullLimits throttles the downloads of a blob store so that pulls cannot
+// saturate a thin uplink. Concurrent is the number of blobs downloaded at
+// once by all shp processes on the host; Bandwidth caps the total download
+// rate in bytes per second. With both set, every concurrent download gets
+// an equal share of the bandwidth. Zero values are unlimited.
+type pullLimits struct {
+	Concurrent int
+	Bandwidth  int64
+}
+
+// acquirePullSlot blocks until one of n download slots below dir is free
+// and returns a function releasing it. Slots are flock'd files, so a slot
+// held by a crashed process frees up by itself.
+func acquirePullSlot(dir string, n int) (func(), error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create %s: %w", dir, err)
+	}
+	for {
+		for i := 0; i < n; i++ {
+			path := filepath.Join(dir, fmt.Sprintf("slot-%d.lock", i))
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+			if err != nil {
+				return nil, fmt.Errorf("cannot open lock %s: %w", path, err)
+			}
+			if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+				f.Close()
+				if err == syscall.EWOULDBLOCK {
+					continue
+				}
+				return nil, fmt.Errorf("cannot lock %s: %w", path, err)
+			}
+			return func() {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				f.Close()
+			}, nil
+		}
+		time.Sleep(pullSlotPoll)
+	}
+}
+
+// rateLimiter spreads writes over time so that they do not exceed a rate
+// in bytes per second, shared by all writers using it.
+type rateLimiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes may be written.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// writer returns w throttled to the limiter's rate. Writes are split into
+// chunks of a tenth of a second's worth, so the rate stays smooth.
+func (l *rateLimiter) writer(w io.Writer) io.Writer {
+	chunk := int(l.rate * int64(throttleInterval) / int64(time.Second))
+	if chunk < 1 {
+		chunk = 1
+	}
+	return &throttledWriter{w: w, l: l, chunk: chunk}
+}
+
+type throttledWriter struct {
+	w     io.Writer
+	l     *rateLimiter
+	chunk int
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > t.chunk {
+			n = t.chunk
+		}
+		t.l.wait(n)
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
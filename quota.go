@@ -0,0 +1,119 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+const quotaLock = "quota.lock"
+
+// quotaConfig is the "quotas" section of the config file. It limits what
+// each user running shp through sudo may have running at once, so that one
+// user's experiments cannot take over a shared host. Users are keyed by
+// name or UID; Default applies to users without an entry of their own.
+// Root is only limited by an explicit entry.
+type quotaConfig struct {
+	Default *userQuota           `json:"default,omitempty"`
+	Users   map[string]userQuota `json:"users,omitempty"`
+}
+
+// userQuota limits the running containers of a user and the sum of their
+// --memory and --cpus limits. Zero values are unlimited.
+type userQuota struct {
+	Containers int     `json:"containers,omitempty"`
+	Memory     string  `json:"memory,omitempty"`
+	CPUs       float64 `json:"cpus,omitempty"`
+}
+
+// invokingUID returns the UID of the user on whose behalf shp runs: the
+// user who ran sudo, or the real UID otherwise.
+func invokingUID() int {
+	if v := os.Getenv("SUDO_UID"); v != "" && os.Getuid() == 0 {
+		if uid, err := strconv.Atoi(v); err == nil {
+			return uid
+		}
+	}
+	return os.Getuid()
+}
+
+// lookup returns the quota of uid, or nil if the user is unlimited.
+func (c *quotaConfig) lookup(uid int) *userQuota {
+	if q, ok := c.Users[strconv.Itoa(uid)]; ok {
+		return &q
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		if q, ok := c.Users[u.Username]; ok {
+			return &q
+		}
+	}
+	if uid == 0 {
+		return nil
+	}
+	return c.Default
+}
+
+// checkQuota verifies that a container with the requested limits fits into
+// the quota of uid, given the containers the user already runs. When a
+// quota applies, the returned unlock must be called once the new container's
+// state is saved, so that concurrent runs of the same user cannot both
+// pass; otherwise it is a no-op.
+func checkQuota(cfg *quotaConfig, uid int, req resourceLimits) (func(), error) {
+	q := cfg.lookup(uid)
+	if q == nil {
+		return func() {}, nil
+	}
+	var memory int64
+	if q.Memory != "" {
+		var err error
+		if memory, err = parseSize(q.Memory); err != nil {
+			return nil, fmt.Errorf("invalid memory quota %q: %w", q.Memory, err)
+		}
+	}
+	// Without a limit a container could use up the whole quota by itself
+	if memory > 0 && req.memoryBytes <= 0 {
+		return nil, fmt.Errorf("--memory is required, uid %d has a memory quota", uid)
+	}
+	if q.CPUs > 0 && req.cpus <= 0 {
+		return nil, fmt.Errorf("--cpus is required, uid %d has a CPU quota", uid)
+	}
+
+	if err := os.MkdirAll(runtimeDir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create %s: %w", runtimeDir, err)
+	}
+	unlock, err := lockFile(filepath.Join(runtimeDir, quotaLock))
+	if err != nil {
+		return nil, err
+	}
+	states, err := listStates()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	count, used := 1, req
+	for _, st := range states {
+		if st.UID != uid {
+			continue
+		}
+		count++
+		used.memoryBytes += st.Memory
+		used.cpus += st.CPUs
+	}
+	switch {
+	case q.Containers > 0 && count > q.Containers:
+		err = fmt.Errorf("uid %d may run at most %d containers", uid, q.Containers)
+	case memory > 0 && used.memoryBytes > memory:
+		err = fmt.Errorf("uid %d would use %d bytes of memory, the quota is %d", uid, used.memoryBytes, memory)
+	case q.CPUs > 0 && used.cpus > q.CPUs:
+		err = fmt.Errorf("uid %d would use %.2f cpus, the quota is %.2f", uid, used.cpus, q.CPUs)
+	}
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("quota exceeded: %w", err)
+	}
+	return unlock, nil
+}
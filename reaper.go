@@ -0,0 +1,127 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// zombieReaper reaps the orphaned processes of a container. The child is
+// PID 1 of the container, so processes whose parent exits are reparented
+// to it, and shell scripts and daemons that do not wait for the children
+// they leave behind would otherwise fill the process table with zombies.
+// Processes the child starts itself are left to their exec.Cmd, which
+// waits for them.
+type zombieReaper struct {
+	mu sync.Mutex
+	// own maps the PIDs of the processes started with start to their start
+	// times, which tell them from later processes reusing the PID
+	own map[int]uint64
+}
+
+// reaper is the zombie reaper of the child.
+var reaper = &zombieReaper{own: make(map[int]uint64)}
+
+// procStat is the part of /proc/<pid>/stat the reaper needs.
+type procStat struct {
+	state     byte
+	ppid      int
+	startTime uint64
+}
+
+func readProcStat(pid int) (procStat, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	// The command name may contain spaces and parentheses; the fields
+	// after it start with the state
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return procStat{}, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return procStat{}, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, err
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return procStat{}, err
+	}
+	return procStat{state: fields[0][0], ppid: ppid, startTime: start}, nil
+}
+
+// start starts cmd as a process of the child, which the reaper leaves to
+// cmd.Wait. The lock keeps the reaper from reaping it before it is known.
+func (r *zombieReaper) start(cmd *exec.Cmd) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if st, err := readProcStat(cmd.Process.Pid); err == nil {
+		r.own[cmd.Process.Pid] = st.startTime
+	}
+	return nil
+}
+
+// run reaps orphans whenever a child of the child exits. It runs once
+// /proc of the container is mounted, for the rest of the child's life.
+func (r *zombieReaper) run() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	go func() {
+		// Orphans may have exited before the reaper started
+		for r.reap(); ; r.reap() {
+			<-sigs
+		}
+	}()
+}
+
+// reap waits for every zombie child of the child it did not start itself.
+func (r *zombieReaper) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	self := os.Getpid()
+	alive := make(map[int]bool)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		st, err := readProcStat(pid)
+		if err != nil || st.ppid != self {
+			continue
+		}
+		if start, ok := r.own[pid]; ok && start == st.startTime {
+			alive[pid] = true
+			continue
+		}
+		if st.state == 'Z' {
+			var ws syscall.WaitStatus
+			syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+		}
+	}
+	// Processes that were waited for are gone
+	for pid := range r.own {
+		if !alive[pid] {
+			delete(r.own, pid)
+		}
+	}
+}
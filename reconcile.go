@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// invocationFlags are run flags that are not part of a container's
+// definition: those shp adds when it re-executes run, and those about how
+// run returns rather than what it starts. The value tells whether the flag
+// takes an argument.
+var invocationFlags = map[string]bool{
+	"container-id":  true,
+	"ready-fd":      true,
+	"id-map-fd":     true,
+	"detach":        false,
+	"d":             false,
+	"wait-ready":    true,
+	"ready-timeout": true,
+	"idempotent":    false,
+}
+
+var containerIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// validateContainerID checks an ID chosen with --id. IDs name runtime
+// directories, so they are restricted like Docker's container names.
+func validateContainerID(id string) error {
+	if !containerIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid container id: %q", id)
+	}
+	return nil
+}
+
+// definitionArgs returns the run arguments that define a container: args
+// with the rootfs path made absolute and without invocation flags.
+func definitionArgs(args, pargs []string) ([]string, error) {
+	args, err := absRunArgs(args, pargs)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for i := 0; i < len(args)-len(pargs); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if takesValue, ok := invocationFlags[name]; ok && strings.HasPrefix(args[i], "-") {
+			if takesValue && !hasValue {
+				i++
+			}
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return append(out, args[len(args)-len(pargs):]...), nil
+}
+
+// definitionDigest identifies what a run starts: its definition arguments
+// and, for an image, the manifest the image resolves to, so pulling a new
+// version of a tag counts as a change.
+func definitionDigest(args, pargs []string) (string, error) {
+	args, err := definitionArgs(args, pargs)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, a := range args {
+		fmt.Fprintf(h, "%s\x00", a)
+	}
+	if fi, err := os.Stat(pargs[0]); err != nil || !fi.IsDir() {
+		img, err := lookupImage(pargs[0])
+		if err != nil {
+			return "", err
+		}
+		if img != nil {
+			fmt.Fprintf(h, "%s\x00", img.Digest)
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reconcile looks for a running container with the ID or name of a run.
+// Without --idempotent an ID in use is an error; with it, a container
+// with the same definition makes the run a no-op, reported by done, and
+// any other is stopped so the run replaces it.
+func reconcile(opts *runOptions, digest string) (done bool, err error) {
+	if opts.id == "" && opts.name == "" {
+		if opts.idempotent {
+			return false, fmt.Errorf("--idempotent requires --id or --name")
+		}
+		return false, nil
+	}
+	states, err := listStates()
+	if err != nil {
+		return false, err
+	}
+	var existing *containerState
+	for _, st := range states {
+		if opts.id != "" && st.ID == opts.id || opts.name != "" && st.Name == opts.name {
+			existing = st
+			break
+		}
+	}
+	switch {
+	case existing == nil:
+		return false, nil
+	case !opts.idempotent && opts.id != "":
+		return false, fmt.Errorf("container %s already exists", opts.id)
+	case !opts.idempotent:
+		return false, nil
+	case existing.Definition == digest:
+		if opts.detach {
+			fmt.Println(existing.ID)
+		} else {
+			fmt.Printf("Container %s is already running with this definition\n", existing.ID)
+		}
+		return true, nil
+	}
+	fmt.Printf("Replacing container %s\n", existing.ID)
+	if err := stopProcess(existing.PID, existing.StopTimeout); err != nil {
+		return false, fmt.Errorf("cannot stop container %s: %w", existing.ID, err)
+	}
+	// The new container may reuse the ID of the old one, whose runtime
+	// directory must be gone by then
+	return false, awaitCleanup(existing.ID)
+}
@@ -0,0 +1,218 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// dockerHubRegistry serves the docker.io registry's API
+	dockerHubRegistry = "registry-1.docker.io"
+
+	registryTimeout = 30 * time.Second
+	maxManifestSize = 4 << 20
+)
+
+// ociDescriptor points to a blob by digest, see the OCI image spec.
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociManifest is an image manifest, or an index of the manifests of an
+// image for several platforms.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+func (m *ociManifest) isIndex() bool {
+	return m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerList || m.MediaType == "" && len(m.Manifests) > 0
+}
+
+// registryClient fetches the manifests and blobs of a repository from an
+// OCI distribution registry. Registries that require authentication get
+// an anonymous bearer token for pulling.
+type registryClient struct {
+	ref    imageRef
+	base   string
+	client *http.Client
+	token  string
+}
+
+func newRegistryClient(ref imageRef) *registryClient {
+	host, scheme := ref.Registry, "https"
+	if host == defaultRegistry {
+		host = dockerHubRegistry
+	}
+	// Like Docker, registries on the local host may use plain HTTP
+	if name, _, _ := strings.Cut(host, ":"); name == "localhost" || name == "127.0.0.1" {
+		scheme = "http"
+	}
+	return &registryClient{
+		ref:  ref,
+		base: scheme + "://" + host + "/v2/" + ref.Repository,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: registryTimeout,
+		}},
+	}
+}
+
+// get requests path below the repository, authenticating once if the
+// registry asks for it. Redirects to blob storage elsewhere are followed
+// without the token.
+func (c *registryClient) get(path string, accept ...string) (*http.Response, error) {
+	for authenticated := false; ; authenticated = true {
+		req, err := http.NewRequest(http.MethodGet, c.base+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !authenticated {
+			resp.Body.Close()
+			if err := c.authenticate(resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate gets an anonymous pull token from the token service named
+// in a "Bearer realm=...,service=...,scope=..." challenge.
+func (c *registryClient) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("registry %s requires unsupported authentication %q", c.ref.Registry, scheme)
+	}
+	values := url.Values{}
+	var realm string
+	for _, m := range challengeParam.FindAllStringSubmatch(params, -1) {
+		if m[1] == "realm" {
+			realm = m[2]
+		} else {
+			values.Set(m[1], m[2])
+		}
+	}
+	if realm == "" {
+		return fmt.Errorf("registry %s sent no token realm", c.ref.Registry)
+	}
+	if values.Get("scope") == "" {
+		values.Set("scope", "repository:"+c.ref.Repository+":pull")
+	}
+	resp, err := c.client.Get(realm + "?" + values.Encode())
+	if err != nil {
+		return fmt.Errorf("cannot get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot get registry token: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("cannot parse registry token: %w", err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+// manifest fetches the manifest a tag or digest refers to and returns it
+// with its raw content and digest. Manifests fetched by digest are verified.
+func (c *registryClient) manifest(reference string) (*ociManifest, []byte, string, error) {
+	resp, err := c.get("/manifests/"+reference, mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerList, mediaTypeDockerManifest)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(data) > maxManifestSize {
+		return nil, nil, "", fmt.Errorf("manifest %s is too large", reference)
+	}
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return nil, nil, "", fmt.Errorf("digest mismatch: expected %s, got %s", reference, digest)
+	}
+	m := &ociManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, nil, "", fmt.Errorf("cannot parse manifest %s: %w", reference, err)
+	}
+	if m.MediaType == "" {
+		m.MediaType, _, _ = strings.Cut(resp.Header.Get("Content-Type"), ";")
+	}
+	return m, data, digest, nil
+}
+
+// platformManifest returns the digest of the manifest for this host's
+// platform in an index.
+func platformManifest(index *ociManifest) (string, error) {
+	for _, d := range index.Manifests {
+		if d.Platform != nil && d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+			return d.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no image for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// blob streams the blob with digest to w.
+func (c *registryClient) blob(digest string, w io.Writer) error {
+	resp, err := c.get("/blobs/" + digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
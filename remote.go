@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// remoteBinEnv names the shp executable on the remote host.
+const remoteBinEnv = "SHP_REMOTE_BIN"
+
+// runRemote runs an shp command on a remote Linux host over ssh, wiring up
+// stdio and propagating the remote exit status. This is the only mode
+// available on non-Linux clients.
+func runRemote(host string, args []string) error {
+	u, err := url.Parse(host)
+	if err != nil || u.Scheme != "ssh" || u.Hostname() == "" {
+		return fmt.Errorf("invalid host %q, expected ssh://[user@]host[:port]", host)
+	}
+
+	bin := os.Getenv(remoteBinEnv)
+	if bin == "" {
+		bin = "shp"
+	}
+	remote := []string{shellQuote(bin)}
+	for _, a := range args {
+		remote = append(remote, shellQuote(a))
+	}
+
+	var sshArgs []string
+	if u.Port() != "" {
+		sshArgs = append(sshArgs, "-p", u.Port())
+	}
+	if isTerminal(os.Stdin) {
+		sshArgs = append(sshArgs, "-t")
+	}
+	target := u.Hostname()
+	if u.User != nil {
+		target = u.User.Username() + "@" + target
+	}
+	// A target such as -oProxyCommand=... would be an option of ssh
+	if strings.HasPrefix(target, "-") {
+		return fmt.Errorf("invalid host %q: the destination cannot start with -", host)
+	}
+	sshArgs = append(sshArgs, "--", target, strings.Join(remote, " "))
+
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	return err
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,@%+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
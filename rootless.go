@@ -0,0 +1,138 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	subuidFile = "/etc/subuid"
+	subgidFile = "/etc/subgid"
+)
+
+// idRange is a range of subordinate IDs a user may map into its user
+// namespaces, from /etc/subuid or /etc/subgid.
+type idRange struct {
+	start, count int
+}
+
+// rootlessMapping is how a rootless container's user namespace maps IDs:
+// the invoking user becomes root in the container. With subordinate ranges
+// and the setuid newuidmap and newgidmap helpers, container IDs from 1 map
+// to the ranges too, so images with several users work; otherwise root is
+// the only ID in the container.
+type rootlessMapping struct {
+	uid, gid       int
+	subuid, subgid *idRange
+}
+
+func newRootlessMapping() (*rootlessMapping, error) {
+	m := &rootlessMapping{uid: os.Getuid(), gid: os.Getgid()}
+	u, err := user.LookupId(strconv.Itoa(m.uid))
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up uid %d: %w", m.uid, err)
+	}
+	_, uidErr := exec.LookPath("newuidmap")
+	_, gidErr := exec.LookPath("newgidmap")
+	if uidErr != nil || gidErr != nil {
+		return m, nil
+	}
+	subuid, err := readSubordinateIDs(subuidFile, u.Username, u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	subgid, err := readSubordinateIDs(subgidFile, u.Username, u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if subuid != nil && subgid != nil {
+		m.subuid, m.subgid = subuid, subgid
+	}
+	return m, nil
+}
+
+// readSubordinateIDs returns the first range of path that belongs to the
+// user, given by name or UID, or nil if there is none.
+func readSubordinateIDs(path, name, uid string) (*idRange, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(strings.TrimSpace(s.Text()), ":")
+		if len(fields) != 3 || fields[0] != name && fields[0] != uid {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || count < 1 {
+			return nil, fmt.Errorf("invalid entry in %s: %s", path, s.Text())
+		}
+		return &idRange{start, count}, nil
+	}
+	return nil, s.Err()
+}
+
+// helpers reports whether the maps are written by newuidmap and newgidmap
+// after the child started, rather than by the kernel interface at clone.
+func (m *rootlessMapping) helpers() bool {
+	return m.subuid != nil
+}
+
+// apply sets up the user namespace of cmd. Single-ID maps can be written
+// by an unprivileged user, so they are set right when cmd is cloned.
+func (m *rootlessMapping) apply(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	if m.helpers() {
+		return
+	}
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: m.uid, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: m.gid, Size: 1}}
+	// Unprivileged users may only map their group with setgroups denied
+	attr.GidMappingsEnableSetgroups = false
+}
+
+// writeMaps maps the subordinate ranges into the user namespace of pid.
+func (m *rootlessMapping) writeMaps(pid int) error {
+	p := strconv.Itoa(pid)
+	uids := []string{p, "0", strconv.Itoa(m.uid), "1", "1", strconv.Itoa(m.subuid.start), strconv.Itoa(m.subuid.count)}
+	if err := runTool("newuidmap", uids...); err != nil {
+		return err
+	}
+	gids := []string{p, "0", strconv.Itoa(m.gid), "1", "1", strconv.Itoa(m.subgid.start), strconv.Itoa(m.subgid.count)}
+	return runTool("newgidmap", gids...)
+}
+
+// waitIDMaps blocks the child until run has written its ID maps, then
+// executes shp again: a process keeps no capabilities across an exec done
+// while its user ID was unmapped, so only the new image has them.
+func waitIDMaps(fd int) {
+	f := os.NewFile(uintptr(fd), "idmap")
+	b := make([]byte, 1)
+	n, _ := f.Read(b)
+	f.Close()
+	if n != 1 {
+		handle(fmt.Errorf("ID mapping failed"))
+	}
+	args := []string{os.Args[0]}
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "--id-map-fd" || os.Args[i] == "-id-map-fd" {
+			i++
+			continue
+		}
+		args = append(args, os.Args[i])
+	}
+	handle(syscall.Exec("/proc/self/exe", args, os.Environ()))
+}
@@ -0,0 +1,332 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runtimeSpecFile is the OCI runtime configuration of a bundle directory.
+const runtimeSpecFile = "config.json"
+
+// ociSpec is the subset of the OCI runtime spec shp run --bundle honors.
+type ociSpec struct {
+	Process  *ociProcess `json:"process"`
+	Root     *ociRoot    `json:"root"`
+	Hostname string      `json:"hostname"`
+	Mounts   []ociMount  `json:"mounts"`
+	Linux    *ociLinux   `json:"linux"`
+}
+
+type ociProcess struct {
+	Terminal bool        `json:"terminal"`
+	Args     []string    `json:"args"`
+	Env      []string    `json:"env"`
+	Cwd      string      `json:"cwd"`
+	User     ociUser     `json:"user"`
+	Rlimits  []ociRlimit `json:"rlimits"`
+}
+
+type ociUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids"`
+}
+
+type ociRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options"`
+}
+
+type ociLinux struct {
+	Namespaces    []ociNamespace `json:"namespaces"`
+	MaskedPaths   []string       `json:"maskedPaths"`
+	ReadonlyPaths []string       `json:"readonlyPaths"`
+}
+
+type ociNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+// rlimitResources maps the rlimit types of the spec to their resource
+// numbers, which are the same on all architectures shp builds for.
+var rlimitResources = map[string]int{
+	"RLIMIT_CPU":        0,
+	"RLIMIT_FSIZE":      1,
+	"RLIMIT_DATA":       2,
+	"RLIMIT_STACK":      3,
+	"RLIMIT_CORE":       4,
+	"RLIMIT_RSS":        5,
+	"RLIMIT_NPROC":      6,
+	"RLIMIT_NOFILE":     7,
+	"RLIMIT_MEMLOCK":    8,
+	"RLIMIT_AS":         9,
+	"RLIMIT_LOCKS":      10,
+	"RLIMIT_SIGPENDING": 11,
+	"RLIMIT_MSGQUEUE":   12,
+	"RLIMIT_NICE":       13,
+	"RLIMIT_RTPRIO":     14,
+	"RLIMIT_RTTIME":     15,
+}
+
+// specMountFlags are the mount options of the spec that are mount flags
+// rather than file system data.
+var specMountFlags = map[string]struct {
+	set   bool
+	flags uintptr
+}{
+	"ro":          {true, syscall.MS_RDONLY},
+	"rw":          {false, syscall.MS_RDONLY},
+	"nosuid":      {true, syscall.MS_NOSUID},
+	"suid":        {false, syscall.MS_NOSUID},
+	"nodev":       {true, syscall.MS_NODEV},
+	"dev":         {false, syscall.MS_NODEV},
+	"noexec":      {true, syscall.MS_NOEXEC},
+	"exec":        {false, syscall.MS_NOEXEC},
+	"noatime":     {true, syscall.MS_NOATIME},
+	"atime":       {false, syscall.MS_NOATIME},
+	"nodiratime":  {true, syscall.MS_NODIRATIME},
+	"diratime":    {false, syscall.MS_NODIRATIME},
+	"relatime":    {true, syscall.MS_RELATIME},
+	"norelatime":  {false, syscall.MS_RELATIME},
+	"strictatime": {true, syscall.MS_STRICTATIME},
+	"sync":        {true, syscall.MS_SYNCHRONOUS},
+	"async":       {false, syscall.MS_SYNCHRONOUS},
+}
+
+// runtimeManagedMounts are the file systems shp sets up itself: it mounts
+// /proc, /dev and /dev/pts and keeps /sys of the rootfs, so these mounts of
+// a spec are skipped.
+var runtimeManagedMounts = map[string]string{
+	"/proc":          "proc",
+	"/dev":           "tmpfs",
+	"/dev/pts":       "devpts",
+	"/dev/mqueue":    "mqueue",
+	"/sys":           "sysfs",
+	"/sys/fs/cgroup": "cgroup",
+}
+
+// specMount is a mount of a spec: a bind volume or a tmpfs.
+type specMount struct {
+	volume
+	tmpfs bool
+	data  string
+}
+
+// applyBundle loads config.json from the bundle directory and applies it to
+// the run options. The rootfs and command of the bundle are returned by
+// bundleArgs, since they are positional arguments.
+func (opts *runOptions) applyBundle() error {
+	path := filepath.Join(opts.bundle, runtimeSpecFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read bundle: %w", err)
+	}
+	var spec ociSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return fmt.Errorf("%s: missing root.path", path)
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return fmt.Errorf("%s: missing process.args", path)
+	}
+
+	opts.bundleRootfs = spec.Root.Path
+	if !filepath.IsAbs(opts.bundleRootfs) {
+		opts.bundleRootfs = filepath.Join(opts.bundle, opts.bundleRootfs)
+	}
+	opts.bundleCommand = spec.Process.Args
+	opts.tty = opts.tty || spec.Process.Terminal
+	opts.readOnlyRootfs = opts.readOnlyRootfs || spec.Root.Readonly
+	// --workdir, --hostname and --env take precedence over the bundle
+	if opts.workdir == "" {
+		opts.workdir = spec.Process.Cwd
+	}
+	if opts.hostname == "" {
+		opts.hostname = spec.Hostname
+	}
+	for _, kv := range spec.Process.Env {
+		if name, _, ok := strings.Cut(kv, "="); !ok || name == "" {
+			return fmt.Errorf("%s: invalid environment variable %q", path, kv)
+		}
+	}
+	opts.env = append(spec.Process.Env, opts.env...)
+	if u := spec.Process.User; u.UID != 0 || u.GID != 0 || len(u.AdditionalGids) > 0 {
+		opts.user = &syscall.Credential{Uid: u.UID, Gid: u.GID, Groups: u.AdditionalGids}
+	}
+	for _, l := range spec.Process.Rlimits {
+		if _, ok := rlimitResources[l.Type]; !ok {
+			return fmt.Errorf("%s: unknown rlimit %s", path, l.Type)
+		}
+		if l.Soft > l.Hard {
+			return fmt.Errorf("%s: soft limit of %s above its hard limit", path, l.Type)
+		}
+	}
+	opts.rlimits = spec.Process.Rlimits
+
+	for _, m := range spec.Mounts {
+		sm, skip, err := parseSpecMount(m, opts.bundle)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !skip {
+			opts.mounts = append(opts.mounts, sm)
+		}
+	}
+
+	var namespaces []ociNamespace
+	if spec.Linux != nil {
+		namespaces = spec.Linux.Namespaces
+		opts.bundleMaskedPaths, opts.bundleReadOnlyPaths = spec.Linux.MaskedPaths, spec.Linux.ReadonlyPaths
+	}
+	if err := opts.applyNamespaces(namespaces); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// applyNamespaces maps the namespaces of a spec onto those shp creates.
+// Containers always get new pid, mount and uts namespaces; ipc and cgroup
+// namespaces are added on request, and a network namespace is empty unless
+// --network attaches one. Joining existing namespaces is not supported.
+func (opts *runOptions) applyNamespaces(namespaces []ociNamespace) error {
+	requested := make(map[string]bool)
+	for _, ns := range namespaces {
+		if ns.Path != "" {
+			return fmt.Errorf("cannot join the %s namespace %s: joining namespaces is not supported", ns.Type, ns.Path)
+		}
+		switch ns.Type {
+		case "pid", "mount", "uts":
+		case "ipc":
+			opts.cloneFlags |= syscall.CLONE_NEWIPC
+		case "cgroup":
+			opts.cloneFlags |= syscall.CLONE_NEWCGROUP
+		case "network":
+			if opts.network == hostNetwork {
+				opts.cloneFlags |= syscall.CLONE_NEWNET
+			}
+		case "user":
+			if !opts.rootless {
+				return fmt.Errorf("the bundle needs a user namespace; run it with --rootless")
+			}
+		default:
+			return fmt.Errorf("unknown namespace type %q", ns.Type)
+		}
+		requested[ns.Type] = true
+	}
+	for _, t := range []string{"pid", "mount", "uts"} {
+		if !requested[t] {
+			return fmt.Errorf("the bundle shares the host's %s namespace, which shp containers cannot", t)
+		}
+	}
+	if !requested["network"] && opts.network != hostNetwork {
+		return fmt.Errorf("the bundle shares the host's network namespace, which --network %s cannot", opts.network)
+	}
+	return nil
+}
+
+// parseSpecMount converts a mount of a spec. Bind mounts may name a source
+// relative to the bundle; mounts of file systems shp sets up itself are
+// skipped.
+func parseSpecMount(m ociMount, bundle string) (sm specMount, skip bool, err error) {
+	dest := filepath.Clean(m.Destination)
+	if !filepath.IsAbs(m.Destination) {
+		return sm, false, fmt.Errorf("mount destination must be absolute: %s", m.Destination)
+	}
+	var flags uintptr
+	var data []string
+	bind := m.Type == "bind"
+	for _, o := range m.Options {
+		if f, ok := specMountFlags[o]; ok {
+			if f.set {
+				flags |= f.flags
+			} else {
+				flags &^= f.flags
+			}
+			continue
+		}
+		switch o {
+		case "bind", "rbind":
+			bind = true
+		case "private", "rprivate", "slave", "rslave", "shared", "rshared", "unbindable", "runbindable":
+			// Container mounts are always private
+		default:
+			data = append(data, o)
+		}
+	}
+	switch {
+	case bind:
+		source := m.Source
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(bundle, source)
+		}
+		return specMount{volume: volume{source: source, target: dest, flags: flags}}, false, nil
+	case runtimeManagedMounts[dest] == m.Type || m.Type == "cgroup2" && dest == "/sys/fs/cgroup":
+		return sm, true, nil
+	case m.Type == "tmpfs":
+		return specMount{volume: volume{target: dest, flags: flags}, tmpfs: true, data: strings.Join(data, ",")}, false, nil
+	}
+	return sm, false, fmt.Errorf("unsupported mount of type %q at %s", m.Type, m.Destination)
+}
+
+// mount mounts a bind or tmpfs mount of a spec into rootfs.
+func (m specMount) mount(rootfs string) error {
+	if !m.tmpfs {
+		return m.volume.mount(rootfs)
+	}
+	target, err := securePath(rootfs, m.target)
+	if err != nil {
+		return err
+	}
+	if err := ensureMountTarget(target, true); err != nil {
+		return fmt.Errorf("cannot create mount target %s: %w", m.target, err)
+	}
+	if err := syscall.Mount("tmpfs", target, "tmpfs", m.flags, m.data); err != nil {
+		return fmt.Errorf("failed to mount tmpfs on %s: %w", m.target, err)
+	}
+	return nil
+}
+
+// bundleArgs appends the rootfs and command of a bundle to the run
+// arguments when they have no positional arguments, so the child, autostart
+// and unit files see them like those of any other container.
+func bundleArgs(opts *runOptions, args, pargs []string) ([]string, []string) {
+	if opts.bundle == "" || len(pargs) > 0 {
+		return args, pargs
+	}
+	pargs = append([]string{opts.bundleRootfs}, opts.bundleCommand...)
+	return append(args[:len(args):len(args)], pargs...), pargs
+}
+
+// setRlimits applies the rlimits of a bundle to the child, whose commands
+// inherit them. Raising a hard limit needs CAP_SYS_RESOURCE, so they are
+// set before privileges are dropped.
+func setRlimits(limits []ociRlimit) error {
+	for _, l := range limits {
+		if err := syscall.Setrlimit(rlimitResources[l.Type], &syscall.Rlimit{Cur: l.Soft, Max: l.Hard}); err != nil {
+			return fmt.Errorf("cannot set %s: %w", l.Type, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	dpkgStatus = "var/lib/dpkg/status"
+	apkDB      = "lib/apk/db/installed"
+)
+
+// rpmDBs are the locations of the rpm database formats. Reading them needs
+// BerkeleyDB or sqlite support, so they are queried with the host's rpm.
+var rpmDBs = []string{"var/lib/rpm/rpmdb.sqlite", "var/lib/rpm/Packages", "usr/lib/sysimage/rpm/rpmdb.sqlite"}
+
+// sbomPackage is one software component found in a rootfs.
+type sbomPackage struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+// imageSBOM lists the packages of a pulled image or a rootfs from the dpkg,
+// apk and rpm databases and any Java archives, the common way libraries
+// like log4j are shipped outside the package manager.
+func imageSBOM(ref string, asJSON bool) error {
+	rootfs := ref
+	if fi, err := os.Stat(ref); err != nil || !fi.IsDir() {
+		img, err := lookupImage(ref)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			return fmt.Errorf("no pulled image or rootfs %s", ref)
+		}
+		rootfs = img.rootfs()
+	}
+	pkgs, err := scanPackages(rootfs)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(pkgs)
+	}
+	for _, p := range pkgs {
+		fmt.Printf("%-5s %-40s %-20s %s\n", p.Type, p.Name, p.Version, p.Path)
+	}
+	return nil
+}
+
+func scanPackages(rootfs string) ([]sbomPackage, error) {
+	if err := validateRootfs(rootfs); err != nil {
+		return nil, err
+	}
+
+	var pkgs []sbomPackage
+	dpkg, err := parseControlDB(filepath.Join(rootfs, dpkgStatus), "deb", "Package", "Version", "Status")
+	if err != nil {
+		return nil, err
+	}
+	pkgs = append(pkgs, dpkg...)
+
+	apk, err := parseControlDB(filepath.Join(rootfs, apkDB), "apk", "P", "V", "")
+	if err != nil {
+		return nil, err
+	}
+	pkgs = append(pkgs, apk...)
+
+	rpm, err := queryRPM(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	pkgs = append(pkgs, rpm...)
+
+	jars, err := scanJars(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	pkgs = append(pkgs, jars...)
+
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Type != pkgs[j].Type {
+			return pkgs[i].Type < pkgs[j].Type
+		}
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	return pkgs, nil
+}
+
+// parseControlDB parses a stanza-based package database (blank-line
+// separated "Key: value" records, as used by dpkg, and "K:value" as used by
+// apk). If statusKey is set, only records whose status ends with
+// "installed" are kept. A missing database yields no packages.
+func parseControlDB(path, typ, nameKey, versionKey, statusKey string) ([]sbomPackage, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var pkgs []sbomPackage
+	rec := map[string]string{}
+	flush := func() {
+		if name := rec[nameKey]; name != "" && (statusKey == "" || strings.HasSuffix(rec[statusKey], "installed")) {
+			pkgs = append(pkgs, sbomPackage{Type: typ, Name: name, Version: rec[versionKey]})
+		}
+		rec = map[string]string{}
+	}
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64<<10), 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, " ") {
+			rec[key] = strings.TrimSpace(value)
+		}
+	}
+	flush()
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return pkgs, nil
+}
+
+// queryRPM lists the packages of the rpm databases in rootfs with the
+// host's rpm. A rootfs with an rpm database cannot be listed completely
+// without it, which is an error rather than a partial list.
+func queryRPM(rootfs string) ([]sbomPackage, error) {
+	var pkgs []sbomPackage
+	queried := make(map[string]bool)
+	for _, db := range rpmDBs {
+		dir := "/" + filepath.Dir(db)
+		if queried[dir] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(rootfs, db)); err != nil {
+			continue
+		}
+		queried[dir] = true
+		if _, err := exec.LookPath("rpm"); err != nil {
+			return nil, fmt.Errorf("rpm database %s found, but listing its packages needs rpm on the host", "/"+db)
+		}
+		out, err := exec.Command("rpm", "--root", rootfs, "--dbpath", dir, "-qa", "--qf", `%{NAME}\t%{VERSION}-%{RELEASE}\n`).Output()
+		if err != nil {
+			return nil, fmt.Errorf("cannot query rpm database %s: %w", "/"+db, err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if name, version, ok := strings.Cut(line, "\t"); ok {
+				pkgs = append(pkgs, sbomPackage{Type: "rpm", Name: name, Version: version})
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+// scanJars reports Java archives, deriving name and version from the
+// conventional "<name>-<version>.jar" file name.
+func scanJars(rootfs string) ([]sbomPackage, error) {
+	var pkgs []sbomPackage
+	err := filepath.WalkDir(rootfs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(rootfs, path)
+		if d.IsDir() && manifestSkip[rel] {
+			return fs.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".jar") {
+			return nil
+		}
+		name, version := strings.TrimSuffix(d.Name(), ".jar"), ""
+		if i := strings.LastIndex(name, "-"); i > 0 && i+1 < len(name) && name[i+1] >= '0' && name[i+1] <= '9' {
+			name, version = name[:i], name[i+1:]
+		}
+		pkgs = append(pkgs, sbomPackage{Type: "jar", Name: name, Version: version, Path: "/" + rel})
+		return nil
+	})
+	return pkgs, err
+}
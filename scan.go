@@ -0,0 +1,135 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// severities in ascending order; unknown severities rank lowest.
+var severities = []string{"unknown", "negligible", "low", "medium", "high", "critical"}
+
+func severityRank(s string) int {
+	s = strings.ToLower(s)
+	for i, name := range severities {
+		if name == s {
+			return i
+		}
+	}
+	return 0
+}
+
+// finding is a single vulnerability reported by a scanner.
+type finding struct {
+	ID       string `json:"id"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Severity string `json:"severity"`
+}
+
+// scanner inspects a rootfs for known vulnerabilities. Implementations
+// wrap external tools and translate their JSON reports.
+type scanner interface {
+	scan(rootfs string) ([]finding, error)
+}
+
+func newScanner(name string) (scanner, error) {
+	switch name {
+	case "trivy":
+		return trivyScanner{}, nil
+	case "grype":
+		return grypeScanner{}, nil
+	}
+	return nil, fmt.Errorf("unknown scanner %q (supported: trivy, grype)", name)
+}
+
+type trivyScanner struct{}
+
+func (trivyScanner) scan(rootfs string) ([]finding, error) {
+	var report struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				Severity         string
+			}
+		}
+	}
+	if err := runScanner(&report, "trivy", "rootfs", "--quiet", "--format", "json", rootfs); err != nil {
+		return nil, err
+	}
+	var out []finding
+	for _, r := range report.Results {
+		for _, v := range r.Vulnerabilities {
+			out = append(out, finding{ID: v.VulnerabilityID, Package: v.PkgName, Version: v.InstalledVersion, Severity: v.Severity})
+		}
+	}
+	return out, nil
+}
+
+type grypeScanner struct{}
+
+func (grypeScanner) scan(rootfs string) ([]finding, error) {
+	var report struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	if err := runScanner(&report, "grype", "dir:"+rootfs, "--quiet", "-o", "json"); err != nil {
+		return nil, err
+	}
+	var out []finding
+	for _, m := range report.Matches {
+		out = append(out, finding{ID: m.Vulnerability.ID, Package: m.Artifact.Name, Version: m.Artifact.Version, Severity: m.Vulnerability.Severity})
+	}
+	return out, nil
+}
+
+func runScanner(report interface{}, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("scanner %s failed: %w", name, err)
+	}
+	if err := json.Unmarshal(out, report); err != nil {
+		return fmt.Errorf("cannot parse %s report: %w", name, err)
+	}
+	return nil
+}
+
+// scanRootfs scans rootfs and fails if any finding is at or above the
+// threshold severity. All findings are printed either way.
+func scanRootfs(s scanner, rootfs, threshold string) error {
+	if severityRank(threshold) == 0 && strings.ToLower(threshold) != "unknown" {
+		return fmt.Errorf("invalid severity threshold %q", threshold)
+	}
+	findings, err := s.scan(rootfs)
+	if err != nil {
+		return err
+	}
+
+	blocked := 0
+	for _, f := range findings {
+		fmt.Printf("%-9s %-20s %s %s\n", strings.ToUpper(f.Severity), f.ID, f.Package, f.Version)
+		if severityRank(f.Severity) >= severityRank(threshold) {
+			blocked++
+		}
+	}
+	if blocked > 0 {
+		return fmt.Errorf("%s: %d vulnerabilities at or above %s severity", rootfs, blocked, threshold)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+//go:build linux && (amd64 || 386 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetSeccomp      = 22 // PR_SET_SECCOMP
+	seccompModeFilter = 2  // SECCOMP_MODE_FILTER
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets into struct seccomp_data; arguments are read as their low
+	// 32 bits, which come first on the supported little-endian
+	// architectures
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16
+
+	// System calls numbered alike on all architectures since Linux 5.0
+	sysFsopen   = 430
+	sysFsconfig = 431
+	sysFsmount  = 432
+	sysFspick   = 433
+	sysClone3   = 435
+
+	// x32 system calls on amd64 have this bit set
+	x32SyscallBit = 0x40000000
+
+	cloneNewFlags = syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC |
+		syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | 0x02000000 /* CLONE_NEWCGROUP */
+)
+
+// seccompDenied are the system calls the default filter fails with EPERM:
+// those that change mounts, namespaces, the kernel or the clock.
+var seccompDenied = append([]uint32{
+	syscall.SYS_MOUNT, syscall.SYS_UMOUNT2, syscall.SYS_PIVOT_ROOT,
+	sysOpenTree, sysMoveMount, sysFsopen, sysFsconfig, sysFsmount, sysFspick, sysMountSetattr,
+	syscall.SYS_UNSHARE, sysSetns,
+	syscall.SYS_KEXEC_LOAD, syscall.SYS_INIT_MODULE, syscall.SYS_DELETE_MODULE,
+	syscall.SYS_REBOOT, syscall.SYS_SWAPON, syscall.SYS_SWAPOFF, syscall.SYS_ACCT,
+	syscall.SYS_SETTIMEOFDAY, syscall.SYS_CLOCK_SETTIME, syscall.SYS_ADJTIMEX,
+	syscall.SYS_PERF_EVENT_OPEN, syscall.SYS_KEYCTL, syscall.SYS_ADD_KEY, syscall.SYS_REQUEST_KEY,
+	syscall.SYS_SYSLOG, syscall.SYS_QUOTACTL, syscall.SYS_VHANGUP, syscall.SYS_LOOKUP_DCOOKIE,
+	syscall.SYS_FANOTIFY_INIT,
+}, seccompArchDenied...)
+
+// seccompStrictDenied are the calls the strict filter denies on top: those
+// that inspect or modify other processes.
+var seccompStrictDenied = append([]uint32{
+	syscall.SYS_PTRACE, syscall.SYS_MOVE_PAGES,
+}, seccompArchStrictDenied...)
+
+// seccompFilter builds the BPF program of a named filter. Calls of other
+// architectures are fatal, so the filter cannot be bypassed through a
+// compat ABI. clone3 fails with ENOSYS, which makes libc fall back to
+// clone, whose flags the filter can inspect.
+func seccompFilter(name string) ([]syscall.SockFilter, error) {
+	denied := seccompDenied
+	switch name {
+	case seccompDefault:
+	case seccompStrict:
+		denied = append(append([]uint32(nil), denied...), seccompStrictDenied...)
+	default:
+		return nil, fmt.Errorf("unknown seccomp filter %q", name)
+	}
+	prog := []syscall.SockFilter{
+		bpfStmt(bpfLoad, seccompDataArch),
+		bpfJump(bpfJeq, auditArch, 1, 0),
+		bpfStmt(bpfRet, seccompRetKillProcess),
+		bpfStmt(bpfLoad, seccompDataNr),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, 0, 1),
+		bpfStmt(bpfRet, seccompRetErrno|uint32(syscall.EPERM)),
+		bpfJump(bpfJeq, sysClone3, 0, 1),
+		bpfStmt(bpfRet, seccompRetErrno|uint32(syscall.ENOSYS)),
+	}
+	for _, nr := range denied {
+		prog = append(prog,
+			bpfJump(bpfJeq, nr, 0, 1),
+			bpfStmt(bpfRet, seccompRetErrno|uint32(syscall.EPERM)),
+		)
+	}
+	// clone may create threads and processes, but no namespaces
+	return append(prog,
+		bpfJump(bpfJeq, syscall.SYS_CLONE, 1, 0),
+		bpfStmt(bpfRet, seccompRetAllow),
+		bpfStmt(bpfLoad, seccompDataArg0),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K, cloneNewFlags, 0, 1),
+		bpfStmt(bpfRet, seccompRetErrno|uint32(syscall.EPERM)),
+		bpfStmt(bpfRet, seccompRetAllow),
+	), nil
+}
+
+const (
+	bpfLoad = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfRet  = syscall.BPF_RET | syscall.BPF_K
+	bpfJeq  = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+)
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// installSeccomp installs the seccomp filter of a security profile, named
+// or read from an OCI profile, on the calling thread; threads and
+// processes it creates afterwards inherit the filter.
+func installSeccomp(p *securityProfile) error {
+	var filter []syscall.SockFilter
+	var err error
+	if p.seccompProfile != nil {
+		filter, err = p.seccompProfile.compile(p.boundingSet())
+	} else {
+		filter, err = seccompFilter(p.Seccomp)
+	}
+	if err != nil {
+		return err
+	}
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("cannot install seccomp filter: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build linux && !amd64 && !386 && !arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// ociSeccomp is an OCI seccomp profile, which cannot be compiled on this
+// architecture.
+type ociSeccomp struct{}
+
+func loadSeccompProfile(path string, caps []string) (*ociSeccomp, error) {
+	return nil, fmt.Errorf("seccomp filters are not supported on %s", runtime.GOARCH)
+}
+
+func installSeccomp(p *securityProfile) error {
+	return fmt.Errorf("seccomp filters are not supported on %s", runtime.GOARCH)
+}
@@ -0,0 +1,369 @@
+//go:build linux && (amd64 || 386 || arm64)
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	seccompRetKillThread = 0x00000000
+	seccompRetTrap       = 0x00030000
+	seccompRetTrace      = 0x7ff00000
+	seccompRetLog        = 0x7ffc0000
+
+	// bpfMaxInsns is BPF_MAXINSNS, the longest filter the kernel accepts
+	bpfMaxInsns = 4096
+)
+
+// dockerArches are the architecture names of includes and excludes in
+// Docker's seccomp profiles.
+var dockerArches = map[string]string{"amd64": "amd64", "386": "x86", "arm64": "arm64"}
+
+// ociSeccomp is a seccomp profile in the format of the OCI runtime
+// specification, which is also what Docker and Podman read.
+type ociSeccomp struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint32          `json:"defaultErrnoRet"`
+	Architectures   []string         `json:"architectures"`
+	Syscalls        []ociSeccompRule `json:"syscalls"`
+}
+
+type ociSeccompRule struct {
+	Names []string `json:"names"`
+	// Name is used by older Docker profiles instead of Names
+	Name     string          `json:"name"`
+	Action   string          `json:"action"`
+	ErrnoRet *uint32         `json:"errnoRet"`
+	Args     []ociSeccompArg `json:"args"`
+	// Includes and Excludes are Docker's conditions on the container:
+	// the rule applies if it matches all of Includes and none of Excludes
+	Includes *seccompCondition `json:"includes"`
+	Excludes *seccompCondition `json:"excludes"`
+}
+
+type ociSeccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+type seccompCondition struct {
+	Caps      []string `json:"caps"`
+	Arches    []string `json:"arches"`
+	MinKernel string   `json:"minKernel"`
+}
+
+// loadSeccompProfile reads an OCI seccomp profile and checks that it
+// compiles for a workload with the capabilities caps. The profile is read
+// before setup, as its path is on the host.
+func loadSeccompProfile(path string, caps []string) (*ociSeccomp, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read seccomp profile: %w", err)
+	}
+	var p ociSeccomp
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("cannot parse seccomp profile %s: %w", path, err)
+	}
+	if _, err := p.compile(caps); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// seccompAction returns the filter return value of an action.
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		errno = *errnoRet
+	}
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | errno&0xffff, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_TRACE":
+		return seccompRetTrace | errno&0xffff, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	}
+	return 0, fmt.Errorf("unsupported action %q", action)
+}
+
+// applies evaluates the Docker conditions of a rule: a workload must have
+// every capability and match the architecture and kernel of Includes, and
+// none of the capabilities, the architecture or the kernel of Excludes.
+func (r *ociSeccompRule) applies(caps []string, kernel [2]int) (bool, error) {
+	if c := r.Includes; c != nil {
+		for _, want := range c.Caps {
+			if !hasCapability(caps, want) {
+				return false, nil
+			}
+		}
+		if len(c.Arches) > 0 && !hasDockerArch(c.Arches) {
+			return false, nil
+		}
+		if ok, err := kernelAtLeast(kernel, c.MinKernel); err != nil || !ok {
+			return false, err
+		}
+	}
+	if c := r.Excludes; c != nil {
+		for _, want := range c.Caps {
+			if hasCapability(caps, want) {
+				return false, nil
+			}
+		}
+		if hasDockerArch(c.Arches) {
+			return false, nil
+		}
+		if c.MinKernel != "" {
+			ok, err := kernelAtLeast(kernel, c.MinKernel)
+			return !ok, err
+		}
+	}
+	return true, nil
+}
+
+func hasCapability(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == strings.TrimPrefix(name, "CAP_") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDockerArch(arches []string) bool {
+	for _, a := range arches {
+		if a == dockerArches[runtime.GOARCH] {
+			return true
+		}
+	}
+	return false
+}
+
+// kernelAtLeast reports whether kernel is at least version min, which is
+// empty for any kernel.
+func kernelAtLeast(kernel [2]int, min string) (bool, error) {
+	if min == "" {
+		return true, nil
+	}
+	v, err := parseKernelVersion(min)
+	if err != nil {
+		return false, err
+	}
+	return kernel[0] > v[0] || kernel[0] == v[0] && kernel[1] >= v[1], nil
+}
+
+// parseKernelVersion returns the major and minor version of a kernel
+// release such as 5.15.0-91-generic.
+func parseKernelVersion(v string) ([2]int, error) {
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) < 2 {
+		return [2]int{}, fmt.Errorf("invalid kernel version %q", v)
+	}
+	var out [2]int
+	for i := range out {
+		n := strings.IndexFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		if n < 0 {
+			n = len(parts[i])
+		}
+		var err error
+		if out[i], err = strconv.Atoi(parts[i][:n]); err != nil {
+			return [2]int{}, fmt.Errorf("invalid kernel version %q", v)
+		}
+	}
+	return out, nil
+}
+
+func hostKernelVersion() ([2]int, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return [2]int{}, err
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return parseKernelVersion(string(release))
+}
+
+// compile builds the BPF program of the profile. Like the named filters it
+// kills calls of other architectures and fails x32 calls, so a profile
+// listing compat architectures is enforced on native calls only. Rules are
+// checked in order and the first whose arguments match decides; a rule
+// naming calls unknown to this architecture is skipped, as profiles are
+// shared between architectures.
+func (p *ociSeccomp) compile(caps []string) ([]syscall.SockFilter, error) {
+	def, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Architectures) > 0 {
+		found := false
+		for _, a := range p.Architectures {
+			found = found || a == seccompArch
+		}
+		if !found {
+			return nil, fmt.Errorf("profile does not cover %s", seccompArch)
+		}
+	}
+	kernel, err := hostKernelVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	prog := []syscall.SockFilter{
+		bpfStmt(bpfLoad, seccompDataArch),
+		bpfJump(bpfJeq, auditArch, 1, 0),
+		bpfStmt(bpfRet, seccompRetKillProcess),
+		bpfStmt(bpfLoad, seccompDataNr),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, 0, 1),
+		bpfStmt(bpfRet, seccompRetErrno|uint32(syscall.EPERM)),
+	}
+	for i, r := range p.Syscalls {
+		action, err := seccompAction(r.Action, r.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if ok, err := r.applies(caps, kernel); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		} else if !ok {
+			continue
+		}
+		names := r.Names
+		if r.Name != "" {
+			names = append(names, r.Name)
+		}
+		for _, name := range names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+			block, err := seccompRuleBlock(nr, r.Args, action)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			prog = append(prog, block...)
+		}
+	}
+	prog = append(prog, bpfStmt(bpfRet, def))
+	if len(prog) > bpfMaxInsns {
+		return nil, fmt.Errorf("profile compiles to %d instructions, more than the kernel's %d", len(prog), bpfMaxInsns)
+	}
+	return prog, nil
+}
+
+// bpfFail marks the jumps of a rule block that leave the block because the
+// call does not match; seccompRuleBlock resolves them.
+const bpfFail = 0xff
+
+// seccompRuleBlock returns the instructions that return action for calls
+// of nr whose arguments match args. The block expects the call number in
+// the accumulator and leaves it there when the call does not match.
+func seccompRuleBlock(nr uint32, args []ociSeccompArg, action uint32) ([]syscall.SockFilter, error) {
+	if len(args) == 0 {
+		return []syscall.SockFilter{
+			bpfJump(bpfJeq, nr, 0, 1),
+			bpfStmt(bpfRet, action),
+		}, nil
+	}
+	block := []syscall.SockFilter{bpfJump(bpfJeq, nr, 0, bpfFail)}
+	for _, a := range args {
+		cmp, err := seccompArgCheck(a)
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, cmp...)
+	}
+	// Failed checks land on the reload of the call number that ends the
+	// block
+	block = append(block, bpfStmt(bpfRet, action), bpfStmt(bpfLoad, seccompDataNr))
+	for i := range block {
+		if block[i].Code&0x07 != syscall.BPF_JMP {
+			continue
+		}
+		skip := len(block) - i - 2
+		if skip > 0xfe {
+			return nil, fmt.Errorf("too many argument checks")
+		}
+		if block[i].Jt == bpfFail {
+			block[i].Jt = uint8(skip)
+		}
+		if block[i].Jf == bpfFail {
+			block[i].Jf = uint8(skip)
+		}
+	}
+	return block, nil
+}
+
+// seccompArgCheck compares a 64-bit argument word by word, falling
+// through when it matches and jumping to bpfFail when it does not.
+func seccompArgCheck(a ociSeccompArg) ([]syscall.SockFilter, error) {
+	if a.Index > 5 {
+		return nil, fmt.Errorf("invalid argument index %d", a.Index)
+	}
+	lo := uint32(seccompDataArg0 + 8*a.Index)
+	hi := lo + 4
+	vlo, vhi := uint32(a.Value), uint32(a.Value>>32)
+	jgt := uint16(syscall.BPF_JMP | syscall.BPF_JGT | syscall.BPF_K)
+	jge := uint16(syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K)
+
+	switch a.Op {
+	case "SCMP_CMP_EQ":
+		return []syscall.SockFilter{
+			bpfStmt(bpfLoad, hi), bpfJump(bpfJeq, vhi, 0, bpfFail),
+			bpfStmt(bpfLoad, lo), bpfJump(bpfJeq, vlo, 0, bpfFail),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []syscall.SockFilter{
+			bpfStmt(bpfLoad, hi), bpfJump(bpfJeq, vhi, 0, 2),
+			bpfStmt(bpfLoad, lo), bpfJump(bpfJeq, vlo, bpfFail, 0),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		and := uint16(syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K)
+		wlo, whi := uint32(a.ValueTwo), uint32(a.ValueTwo>>32)
+		return []syscall.SockFilter{
+			bpfStmt(bpfLoad, hi), bpfStmt(and, vhi), bpfJump(bpfJeq, whi, 0, bpfFail),
+			bpfStmt(bpfLoad, lo), bpfStmt(and, vlo), bpfJump(bpfJeq, wlo, 0, bpfFail),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		// A higher upper word matches, a lower one does not, and an equal
+		// one leaves the decision to the lower word
+		last := bpfJump(jgt, vlo, 0, bpfFail)
+		if a.Op == "SCMP_CMP_GE" {
+			last = bpfJump(jge, vlo, 0, bpfFail)
+		}
+		return []syscall.SockFilter{
+			bpfStmt(bpfLoad, hi), bpfJump(jgt, vhi, 3, 0), bpfJump(bpfJeq, vhi, 0, bpfFail),
+			bpfStmt(bpfLoad, lo), last,
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		last := bpfJump(jge, vlo, bpfFail, 0)
+		if a.Op == "SCMP_CMP_LE" {
+			last = bpfJump(jgt, vlo, bpfFail, 0)
+		}
+		return []syscall.SockFilter{
+			bpfStmt(bpfLoad, hi), bpfJump(jge, vhi, 0, 3), bpfJump(jgt, vhi, bpfFail, 0),
+			bpfStmt(bpfLoad, lo), last,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported argument operator %q", a.Op)
+}
@@ -0,0 +1,367 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	securityDefault    = "default"
+	securityRestricted = "restricted"
+	securityPrivileged = "privileged"
+
+	seccompDefault    = "default"
+	seccompStrict     = "strict"
+	seccompUnconfined = "unconfined"
+
+	// capAll keeps every capability in the bounding set
+	capAll = "ALL"
+	// unmaskAll unprotects every masked and read-only path
+	unmaskAll = "ALL"
+
+	prSetNoNewPrivs = 38 // PR_SET_NO_NEW_PRIVS
+
+	// open_tree, move_mount and mount_setattr are numbered alike on all
+	// architectures
+	sysOpenTree         = 428
+	sysMoveMount        = 429
+	sysMountSetattr     = 442
+	openTreeClone       = 0x1 // OPEN_TREE_CLONE
+	moveMountFEmptyPath = 0x4 // MOVE_MOUNT_F_EMPTY_PATH
+
+	appArmorProfiles = "/sys/kernel/security/apparmor/profiles"
+)
+
+// atFdcwd is AT_FDCWD, a variable since a negative constant cannot be
+// converted to uintptr.
+var atFdcwd = -0x64
+
+// defaultMaskedPaths are kernel interfaces that leak host information or
+// allow poking at host hardware; they are hidden from the workload unless a
+// profile says otherwise. They are the maskedPaths of Docker and runc.
+var defaultMaskedPaths = []string{
+	"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys",
+	"/proc/latency_stats", "/proc/timer_list", "/proc/timer_stats",
+	"/proc/sched_debug", "/proc/scsi", "/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
+// defaultReadOnlyPaths are kernel interfaces left readable but not
+// writable, since writes would change host-wide settings.
+var defaultReadOnlyPaths = []string{
+	"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+}
+
+// securityProfile bundles the kernel-enforced restrictions of a container,
+// selected with --security-profile as a preset or a JSON file, or as part
+// of a --profile.
+type securityProfile struct {
+	name string
+
+	// Capabilities is the bounding set of the workload; nil keeps the
+	// default set, an empty list drops every capability and ALL keeps
+	// them all.
+	Capabilities []string `json:"capabilities"`
+	// Seccomp names a filter, or is the absolute path of an OCI seccomp
+	// profile, which is read into seccompProfile
+	Seccomp         string   `json:"seccomp,omitempty"`
+	NoNewPrivileges bool     `json:"no_new_privileges"`
+	MaskedPaths     []string `json:"masked_paths,omitempty"`
+	ReadOnlyPaths   []string `json:"readonly_paths,omitempty"`
+	// AppArmor is the name of a loaded AppArmor profile the workload is
+	// confined by.
+	AppArmor string `json:"apparmor,omitempty"`
+
+	seccompProfile *ociSeccomp
+}
+
+// securityPresets are the profiles --security-profile accepts by name.
+// default matches Docker's defaults, restricted suits services that need
+// no privileges, and privileged keeps every capability without any filter
+// or masking.
+var securityPresets = map[string]securityProfile{
+	securityDefault: {
+		Seccomp:       seccompDefault,
+		MaskedPaths:   defaultMaskedPaths,
+		ReadOnlyPaths: defaultReadOnlyPaths,
+	},
+	securityRestricted: {
+		Capabilities:    []string{"CHOWN", "DAC_OVERRIDE", "FOWNER", "SETGID", "SETUID", "KILL", "NET_BIND_SERVICE"},
+		Seccomp:         seccompStrict,
+		NoNewPrivileges: true,
+		MaskedPaths:     defaultMaskedPaths,
+		ReadOnlyPaths:   defaultReadOnlyPaths,
+	},
+	securityPrivileged: {
+		Capabilities: []string{capAll},
+	},
+}
+
+// loadSecurityProfile returns a preset, or reads a custom profile from the
+// JSON file at v.
+func loadSecurityProfile(v string) (*securityProfile, error) {
+	p, ok := securityPresets[v]
+	if !ok {
+		if !strings.ContainsRune(v, '/') && !strings.HasSuffix(v, ".json") {
+			return nil, fmt.Errorf("unknown security profile %q, expected default, restricted, privileged or a file", v)
+		}
+		// The name is recorded in the container's state for exec, which
+		// may run from another directory
+		abs, err := filepath.Abs(v)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(abs)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read security profile: %w", err)
+		}
+		v = abs
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("cannot parse security profile %s: %w", v, err)
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid security profile %s: %w", v, err)
+	}
+	p.name = v
+	return &p, nil
+}
+
+func (p *securityProfile) validate() error {
+	for _, c := range p.Capabilities {
+		if _, ok := capabilities[c]; !ok && c != capAll {
+			return fmt.Errorf("unknown capability %q", c)
+		}
+	}
+	p.seccompProfile = nil
+	switch {
+	case p.Seccomp == "", p.Seccomp == seccompDefault, p.Seccomp == seccompStrict, p.Seccomp == seccompUnconfined:
+	case filepath.IsAbs(p.Seccomp):
+		sp, err := loadSeccompProfile(p.Seccomp, p.boundingSet())
+		if err != nil {
+			return err
+		}
+		p.seccompProfile = sp
+	default:
+		return fmt.Errorf("unknown seccomp filter %q, expected default, strict, unconfined or the absolute path of an OCI profile", p.Seccomp)
+	}
+	for _, path := range append(append([]string(nil), p.MaskedPaths...), p.ReadOnlyPaths...) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("path %q is not absolute", path)
+		}
+	}
+	return nil
+}
+
+// adjustPaths masks and write-protects further paths, and unprotects
+// those in unmask, or every path of the profile if it holds ALL. The lists of the profile
+// are copied rather than changed, since presets share them.
+func (p *securityProfile) adjustPaths(mask, readonly, unmask []string) {
+	keep := func(paths, add []string) []string {
+		out := []string{}
+		for _, path := range paths {
+			if !contains(unmask, unmaskAll) && !contains(unmask, path) && !contains(out, path) {
+				out = append(out, path)
+			}
+		}
+		for _, path := range add {
+			if !contains(out, path) {
+				out = append(out, path)
+			}
+		}
+		return out
+	}
+	p.MaskedPaths = keep(p.MaskedPaths, mask)
+	p.ReadOnlyPaths = keep(p.ReadOnlyPaths, readonly)
+}
+
+// checkHost verifies that the host can enforce the profile, so that run
+// fails early instead of the container failing during setup.
+func (p *securityProfile) checkHost() error {
+	if p.AppArmor == "" {
+		return nil
+	}
+	data, err := os.ReadFile(appArmorProfiles)
+	if err != nil {
+		return fmt.Errorf("AppArmor is not available: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// Lines look like "name (enforce)"
+		if i := strings.LastIndex(line, " ("); i >= 0 && line[:i] == p.AppArmor {
+			return nil
+		}
+	}
+	return fmt.Errorf("AppArmor profile %s is not loaded", p.AppArmor)
+}
+
+// openNullMount returns a detached bind mount of the host's /dev/null, to
+// mask files with once the rootfs is the root. The rootfs may lack device
+// nodes, and after pivot_root the host's mounts can no longer be bound.
+// Kernels before 5.2 cannot detach mounts, so it returns nil there and
+// files are masked with the /dev/null of the container.
+func openNullMount() (*os.File, error) {
+	path, err := syscall.BytePtrFromString(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := syscall.Syscall(sysOpenTree, uintptr(atFdcwd), uintptr(unsafe.Pointer(path)), openTreeClone|syscall.O_CLOEXEC)
+	if errno == syscall.ENOSYS {
+		return nil, nil
+	}
+	if errno != 0 {
+		return nil, fmt.Errorf("cannot clone mount of %s: %w", os.DevNull, errno)
+	}
+	return os.NewFile(fd, os.DevNull), nil
+}
+
+// protectPaths masks and write-protects paths the way runc applies the
+// maskedPaths and readonlyPaths of a spec: masked files are bind mounts of
+// /dev/null, masked directories empty read-only tmpfs mounts, and read-only
+// paths read-only bind mounts of themselves. It runs after pivot_root and
+// the /proc mount; null is the mount returned by openNullMount.
+func (p *securityProfile) protectPaths(null *os.File) error {
+	// The null mount can be attached once; later files are bound from
+	// the first masked file
+	var masked string
+	if null == nil && len(p.MaskedPaths) > 0 {
+		if err := checkNullDevice(); err != nil {
+			return err
+		}
+		masked = os.DevNull
+	}
+	for _, path := range p.MaskedPaths {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot mask %s: %w", path, err)
+		}
+		switch {
+		case fi.IsDir():
+			err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "size=0")
+		case masked == "":
+			err = moveMount(null, path)
+			masked = path
+		default:
+			err = syscall.Mount(masked, path, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot mask %s: %w", path, err)
+		}
+	}
+	for _, path := range p.ReadOnlyPaths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := remountReadOnly(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNullDevice verifies that /dev/null of the container is the null
+// device, and not a file of a volume that masked files would show.
+func checkNullDevice() error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(os.DevNull, &st); err != nil {
+		return fmt.Errorf("cannot mask files: %w", err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || uint64(st.Rdev) != uint64(mkdev(1, 3)) {
+		return fmt.Errorf("cannot mask files: %s is not the null device", os.DevNull)
+	}
+	return nil
+}
+
+func moveMount(from *os.File, to string) error {
+	path, err := syscall.BytePtrFromString(to)
+	if err != nil {
+		return err
+	}
+	empty := []byte{0}
+	_, _, errno := syscall.Syscall6(sysMoveMount, from.Fd(), uintptr(unsafe.Pointer(&empty[0])), uintptr(atFdcwd), uintptr(unsafe.Pointer(path)), moveMountFEmptyPath, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// remountReadOnly bind mounts path onto itself and makes that mount
+// read-only, leaving other mounts of the same file system writable.
+func remountReadOnly(path string) error {
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("cannot make %s read-only: %w", path, err)
+	}
+	if err := remountFlags(path, syscall.MS_RDONLY); err != nil {
+		return fmt.Errorf("cannot make %s read-only: %w", path, err)
+	}
+	return nil
+}
+
+// boundingSet returns the names of the capabilities the workload keeps.
+func (p *securityProfile) boundingSet() []string {
+	if p.Capabilities == nil {
+		return defaultCapabilities
+	}
+	for _, c := range p.Capabilities {
+		if c == capAll {
+			var all []string
+			for name := range capabilities {
+				all = append(all, name)
+			}
+			return all
+		}
+	}
+	return p.Capabilities
+}
+
+// restrictThread limits what commands forked from the calling thread may
+// do: their bounding set, their AppArmor confinement, and whether they may
+// gain privileges through set-user-ID binaries or make denied system calls.
+// It must run on the locked thread the commands are forked from, after all
+// privileged setup.
+func (p *securityProfile) restrictThread() error {
+	if err := pruneBoundingSet(p.boundingSet()); err != nil {
+		return err
+	}
+	if p.AppArmor != "" {
+		if err := setAppArmorExec(p.AppArmor); err != nil {
+			return err
+		}
+	}
+	if p.NoNewPrivileges {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			return fmt.Errorf("cannot set no_new_privs: %w", errno)
+		}
+	}
+	if p.Seccomp != "" && p.Seccomp != seccompUnconfined {
+		return installSeccomp(p)
+	}
+	return nil
+}
+
+// setAppArmorExec makes the next exec of the calling thread switch to an
+// AppArmor profile. Kernels before 5.8 only have the shared attr/exec file.
+func setAppArmorExec(profile string) error {
+	attr := "/proc/thread-self/attr/apparmor/exec"
+	if _, err := os.Stat(attr); err != nil {
+		attr = "/proc/thread-self/attr/exec"
+	}
+	f, err := os.OpenFile(attr, os.O_WRONLY, 0)
+	if err == nil {
+		_, err = f.WriteString("exec " + profile)
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot set AppArmor profile %s: %w", profile, err)
+	}
+	return nil
+}
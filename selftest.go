@@ -0,0 +1,337 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	selftestUsage = "usage: shp selftest"
+
+	// selftestPrefix marks the lines of a probe's output meant for
+	// selftest; everything else is output of shp itself
+	selftestPrefix = "selftest: "
+	selftestReady  = selftestPrefix + "ready"
+	selftestOK     = selftestPrefix + "ok"
+
+	// selftestPidsLimit is the pids.max of the cgroup probe, which tries
+	// to start twice as many processes
+	selftestPidsLimit = 32
+)
+
+// selftestCheck is a guarantee verified by running a probe container.
+type selftestCheck struct {
+	name string
+	// flags are the run flags of the probe container
+	flags []string
+	// probe is the argument of shp selftest-probe run inside the container
+	probe string
+	// bundle runs the probe from an OCI bundle, for namespaces run has no
+	// flag for
+	bundle []ociNamespace
+	// whileReady, if set, checks the host while the probe waits after
+	// reporting ready
+	whileReady func(nonce string) error
+}
+
+var selftestChecks = []selftestCheck{
+	{name: "pid isolation", probe: "pid"},
+	{
+		name:  "mount isolation",
+		flags: []string{"--cap-add", "SYS_ADMIN", "--security-opt", "seccomp=unconfined"},
+		probe: "mount",
+		whileReady: func(nonce string) error {
+			data, err := os.ReadFile("/proc/self/mountinfo")
+			if err != nil {
+				return err
+			}
+			if strings.Contains(string(data), nonce) {
+				return fmt.Errorf("a mount made in the container is visible on the host")
+			}
+			return nil
+		},
+	},
+	{
+		name:  "hostname isolation",
+		flags: []string{"--cap-add", "SYS_ADMIN", "--security-opt", "seccomp=unconfined"},
+		probe: "hostname",
+		whileReady: func(nonce string) error {
+			host, err := os.Hostname()
+			if err != nil {
+				return err
+			}
+			if host == nonce {
+				return fmt.Errorf("the container changed the hostname of the host")
+			}
+			return nil
+		},
+	},
+	{name: "cgroup enforcement", flags: []string{"--pids-limit", strconv.Itoa(selftestPidsLimit)}, probe: "cgroup"},
+	{name: "seccomp blocking", probe: "seccomp"},
+	{
+		name:  "network isolation",
+		probe: "network",
+		bundle: []ociNamespace{
+			{Type: "pid"}, {Type: "mount"}, {Type: "uts"}, {Type: "ipc"}, {Type: "network"},
+		},
+	},
+}
+
+func selftest(args []string) {
+	if len(args) != 0 {
+		fmt.Println(selftestUsage)
+		os.Exit(1)
+	}
+	failed, err := runSelftest(os.Stdout)
+	handle(err)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runSelftest runs every check in a probe container of its own and prints
+// its result, returning the number of failed checks.
+func runSelftest(w io.Writer) (int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("cannot resolve shp executable: %w", err)
+	}
+	rootfs, err := os.MkdirTemp("", "shp-selftest-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(rootfs)
+	for _, dir := range []string{"proc", "mnt"} {
+		if err := os.Mkdir(filepath.Join(rootfs, dir), 0755); err != nil {
+			return 0, err
+		}
+	}
+
+	failed := 0
+	for _, c := range selftestChecks {
+		err := c.run(self, rootfs)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %v\n", c.name, err)
+		} else {
+			fmt.Fprintf(w, "PASS  %s\n", c.name)
+		}
+	}
+	return failed, nil
+}
+
+// selftestVolumes are the volumes of probe containers: shp itself and the
+// host libraries it may be linked against.
+func selftestVolumes(self string) [][2]string {
+	vols := [][2]string{{self, "/shp"}}
+	for _, dir := range []string{"/lib", "/lib64", "/usr"} {
+		if _, err := os.Stat(dir); err == nil {
+			vols = append(vols, [2]string{dir, dir})
+		}
+	}
+	return vols
+}
+
+// run starts the probe container of the check and returns why it failed.
+func (c selftestCheck) run(self, rootfs string) error {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return err
+	}
+	nonce := "shp-selftest-" + hex.EncodeToString(buf[:])
+	probe := []string{"/shp", "selftest-probe", c.probe, nonce}
+
+	args := append([]string{"run"}, c.flags...)
+	if c.bundle != nil {
+		dir, err := writeSelftestBundle(self, rootfs, c.bundle, probe)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		args = append(args, "--bundle", dir)
+	} else {
+		for _, v := range selftestVolumes(self) {
+			args = append(args, "-v", v[0]+":"+v[1]+":ro")
+		}
+		args = append(append(args, rootfs), probe...)
+	}
+
+	cmd := exec.Command(self, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// The probe reports its result on the last of its lines; shp itself
+	// reports why a container could not start on its last line
+	var result, last string
+	var hostErr error
+	s := bufio.NewScanner(stdout)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == selftestReady:
+			if c.whileReady != nil {
+				hostErr = c.whileReady(nonce)
+			}
+			stdin.Close()
+		case strings.HasPrefix(line, selftestPrefix):
+			result = line
+		case line != "":
+			last = line
+		}
+	}
+	waitErr := cmd.Wait()
+	switch {
+	case hostErr != nil:
+		return hostErr
+	case result == selftestOK:
+		return nil
+	case result != "":
+		return errors.New(strings.TrimPrefix(result, selftestPrefix))
+	case last != "":
+		return fmt.Errorf("probe did not report: %s", last)
+	}
+	return fmt.Errorf("probe did not report: %v", waitErr)
+}
+
+// writeSelftestBundle writes an OCI bundle running probe in rootfs with
+// the given namespaces, and returns its directory.
+func writeSelftestBundle(self, rootfs string, namespaces []ociNamespace, probe []string) (string, error) {
+	dir, err := os.MkdirTemp("", "shp-selftest-bundle-")
+	if err != nil {
+		return "", err
+	}
+	spec := ociSpec{
+		Process: &ociProcess{Args: probe},
+		Root:    &ociRoot{Path: rootfs},
+		Linux:   &ociLinux{Namespaces: namespaces},
+	}
+	for _, v := range selftestVolumes(self) {
+		spec.Mounts = append(spec.Mounts, ociMount{Destination: v[1], Type: "bind", Source: v[0], Options: []string{"rbind", "ro", "nosuid", "nodev"}})
+	}
+	data, err := json.Marshal(spec)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, runtimeSpecFile), data, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// selftestProbe runs inside a probe container and prints its result.
+func selftestProbe(args []string) {
+	if len(args) != 2 {
+		fmt.Println("usage: shp selftest-probe <probe> <nonce>")
+		os.Exit(1)
+	}
+	if err := probeGuarantee(args[0], args[1]); err != nil {
+		fmt.Printf("%s%v\n", selftestPrefix, err)
+		os.Exit(1)
+	}
+	fmt.Println(selftestOK)
+}
+
+// probeGuarantee tries to break out of the container in the way a probe
+// names, and fails if it succeeds.
+func probeGuarantee(probe, nonce string) error {
+	switch probe {
+	case "pid":
+		if ppid := os.Getppid(); ppid != 1 {
+			return fmt.Errorf("the parent of the command is PID %d, not the container's init", ppid)
+		}
+		entries, err := os.ReadDir("/proc")
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if pid, err := strconv.Atoi(e.Name()); err == nil && pid > 1 && pid != os.Getpid() {
+				if data, _ := os.ReadFile(filepath.Join("/proc", e.Name(), "comm")); len(data) > 0 {
+					return fmt.Errorf("process %d (%s) outside the container is visible", pid, strings.TrimSpace(string(data)))
+				}
+			}
+		}
+	case "mount":
+		if err := syscall.Mount(nonce, "/mnt", "tmpfs", 0, ""); err != nil {
+			return fmt.Errorf("cannot mount in the container: %w", err)
+		}
+		waitHost()
+	case "hostname":
+		if err := syscall.Sethostname([]byte(nonce)); err != nil {
+			return fmt.Errorf("cannot set the hostname of the container: %w", err)
+		}
+		waitHost()
+	case "cgroup":
+		var procs []*exec.Cmd
+		defer func() {
+			for _, p := range procs {
+				p.Process.Kill()
+			}
+		}()
+		for i := 0; i < 2*selftestPidsLimit; i++ {
+			p := exec.Command("/shp", "selftest-probe", "sleep", nonce)
+			if err := p.Start(); err != nil {
+				if errors.Is(err, syscall.EAGAIN) {
+					return nil
+				}
+				return fmt.Errorf("cannot start processes: %w", err)
+			}
+			procs = append(procs, p)
+		}
+		return fmt.Errorf("started %d processes despite --pids-limit %d", len(procs), selftestPidsLimit)
+	case "sleep":
+		for {
+			time.Sleep(time.Hour)
+		}
+	case "seccomp":
+		if err := syscall.Unshare(0); !errors.Is(err, syscall.EPERM) {
+			return fmt.Errorf("unshare was not blocked by the default seccomp filter (%v)", err)
+		}
+	case "network":
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback == 0 {
+				return fmt.Errorf("interface %s of the host is visible", iface.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown probe %q", probe)
+	}
+	return nil
+}
+
+// waitHost reports that the probe is ready for the host to check it and
+// waits until it did, which selftest signals by closing stdin.
+func waitHost() {
+	fmt.Println(selftestReady)
+	io.Copy(io.Discard, os.Stdin)
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// runParallel runs independent setup steps concurrently and returns all of
+// their errors joined together, so one failing step does not hide another.
+// Steps must not depend on process-wide state changed by each other, such
+// as the working directory or root.
+func runParallel(steps ...func() error) error {
+	errs := make([]error, len(steps))
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		wg.Add(1)
+		go func(i int, step func() error) {
+			defer wg.Done()
+			errs[i] = step()
+		}(i, step)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -1,141 +1,834 @@
+//go:build linux
+
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
+
+	"shp/pkg/container"
 )
 
 const (
-	oldRootDir = ".old_root"
-	procFS     = "proc"
+	procFS = "proc"
 )
 
-// Isolator defines filesystem isolation strategies
-type Isolator interface {
-	Isolate(rootfs string) error
-}
-
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("usage: shp run <rootfs_path> <cmd> [options]")
+// dispatch runs a subcommand locally. args[0] is the subcommand name.
+func dispatch(args []string) {
+	if len(args) < 1 {
+		fmt.Println(runUsage)
 		return
 	}
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "run":
-		run(os.Args[2:])
+		run(args[1:])
 	case "child":
-		child(os.Args[2:])
+		child(args[1:])
+	case "generate":
+		generate(args[1:])
+	case "system":
+		system(args[1:])
+	case "state":
+		state(args[1:])
+	case "drain":
+		drain(args[1:])
+	case "manifest":
+		manifest(args[1:])
+	case "layer":
+		layer(args[1:])
+	case "image":
+		image(args[1:])
+	case "pull":
+		pull(args[1:])
+	case "bundle":
+		bundle(args[1:])
+	case "apply":
+		apply(args[1:])
+	case "ps":
+		ps(args[1:])
+	case "logs":
+		logs(args[1:])
+	case "rm":
+		rm(args[1:])
+	case "stop":
+		stop(args[1:])
+	case "kill":
+		kill(args[1:])
+	case "pause":
+		pause(args[1:])
+	case "unpause":
+		unpause(args[1:])
+	case "commit":
+		commit(args[1:])
+	case "capture":
+		capture(args[1:])
+	case "activity":
+		activity(args[1:])
+	case "trace":
+		trace(args[1:])
+	case "inspect":
+		inspect(args[1:])
+	case "snapshot":
+		snapshot(args[1:])
+	case "bench":
+		bench(args[1:])
+	case "selftest":
+		selftest(args[1:])
+	case "selftest-probe":
+		selftestProbe(args[1:])
+	case "exec":
+		execContainer(args[1:])
+	case "port-forward":
+		portForward(args[1:])
+	case "network":
+		network(args[1:])
+	case "stats":
+		stats(args[1:])
+	case "dns":
+		dnsServe(args[1:])
 	default:
-		fmt.Println("usage: shp run <rootfs_path> <cmd> [options]")
+		fmt.Println(runUsage)
 	}
 }
 
 func run(args []string) {
-	if len(args) < 2 {
-		fmt.Println("usage: shp run <rootfs_path> <cmd> [options]")
+	opts, pargs, err := parseRunOptions("run", args)
+	if err == nil {
+		args, pargs = bundleArgs(opts, args, pargs)
+	}
+	if err != nil || len(pargs) < 2 {
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Println(err)
+		}
+		fmt.Println(runUsage)
 		os.Exit(1)
 	}
+	if opts.readyFD != 0 {
+		// Only the background run may hold the pipe, not its commands
+		syscall.CloseOnExec(opts.readyFD)
+	}
+	if (opts.containerID != "" || opts.readyFD != 0) && !(opts.detach && opts.readyFD != 0) || opts.idMapFD != 0 {
+		handle(fmt.Errorf("--container-id, --ready-fd and --id-map-fd are reserved for internal use"))
+	}
+	if opts.waitReady != nil && !opts.detach {
+		handle(fmt.Errorf("--wait-ready requires --detach"))
+	}
+	if opts.detach && opts.autostart {
+		handle(fmt.Errorf("--detach cannot be combined with --autostart"))
+	}
+	if opts.detach && opts.tty {
+		handle(fmt.Errorf("--tty cannot be combined with --detach"))
+	}
+	if opts.logDriver == logDriverJournald && opts.logFile != "" {
+		handle(fmt.Errorf("--log-driver journald cannot be combined with --log-file"))
+	}
+	if opts.logDriver == logDriverJSONFile && opts.logFile == "" && !opts.detach {
+		handle(fmt.Errorf("--log-driver json-file requires --log-file or --detach"))
+	}
+	if opts.logDriver != "" && opts.logPolicy != logPolicyBlock {
+		handle(fmt.Errorf("--log-mode %s cannot be combined with --log-driver", opts.logPolicy))
+	}
+	if opts.journalNamespace != "" && opts.logDriver != logDriverJournald {
+		handle(fmt.Errorf("--journal-namespace requires --log-driver journald"))
+	}
+	definition, err := definitionDigest(args, pargs)
+	handle(err)
+	runArgs, err := definitionArgs(args, pargs)
+	handle(err)
+	if opts.readyFD == 0 {
+		done, err := reconcile(opts, definition)
+		handle(err)
+		if done {
+			return
+		}
+	}
+	if opts.detach && opts.readyFD == 0 {
+		handle(runDetached(args, opts))
+		return
+	}
+
+	if opts.autostart {
+		if err := validateName(opts.name); err != nil {
+			handle(fmt.Errorf("--autostart requires --name: %w", err))
+		}
+	}
+	handle(checkNotDraining())
+	if opts.faults.active() {
+		fmt.Printf("Warning: injecting faults %s\n", opts.faults.spec)
+	}
+	// An image runs on an overlay of its rootfs, which the checks below
+	// inspect in place of a directory. args, which the child gets, keep
+	// the image reference.
+	img, err := imageForRootfs(pargs[0])
+	handle(err)
+	if img != nil {
+		handle(opts.faults.pull(img.Ref))
+		pargs = append([]string{img.rootfs()}, pargs[1:]...)
+	}
+	handle(validateRootfs(pargs[0]))
+	spec, err := newContainerSpec(opts, pargs)
+	handle(err)
+	if img != nil {
+		spec.Image = img.Ref
+	}
+	handle(checkPolicy(spec))
+	if opts.verifyManifest != "" {
+		verify := verifyManifestCached
+		if opts.noPrepCache {
+			verify = verifyManifest
+		}
+		handle(verify(pargs[0], opts.verifyManifest, opts.manifestDigest))
+	}
+	if opts.scanner != "" {
+		s, err := newScanner(opts.scanner)
+		handle(err)
+		handle(scanRootfs(s, pargs[0], opts.scanSeverity))
+	}
+	if len(opts.mdns) > 0 {
+		handle(checkMDNS(opts))
+	}
+	if opts.watch != "" && opts.supervise.mode != restartNo {
+		handle(fmt.Errorf("--supervise cannot be combined with --watch"))
+	}
+	handle(opts.profile.checkHost())
+	dnsServers, err := dnsServers(opts)
+	handle(err)
+	if opts.integrityChecks && opts.integrityInterval <= 0 {
+		handle(fmt.Errorf("--integrity-interval must be positive"))
+	}
+	if opts.hooks.onAnomaly != "" && !opts.integrityChecks {
+		handle(fmt.Errorf("--on-anomaly requires --integrity-checks"))
+	}
+	if opts.netAccounting && (opts.name == "" || opts.network == hostNetwork) {
+		handle(fmt.Errorf("--net-accounting requires --name and a network other than host"))
+	}
+	// Networks and cgroups are set up from the host, which takes root
+	if opts.rootless && opts.network != hostNetwork {
+		handle(fmt.Errorf("--rootless containers can only use the host network"))
+	}
+	if len(opts.publish) > 0 && (opts.network == hostNetwork || opts.network == networkIsolatedEgress) {
+		handle(fmt.Errorf("--publish requires a network other than host and isolated-egress"))
+	}
+	if opts.rootless && (opts.limits.memoryBytes > 0 || opts.limits.cpus > 0 || opts.pidsLimit > 0) {
+		handle(fmt.Errorf("--rootless containers cannot have resource limits"))
+	}
+	published, err := listenPublished(opts.publish)
+	handle(err)
+	handle(admit(opts.admission, opts.limits, pargs[0], opts.admissionTimeout))
+	cfg, err := loadConfig()
+	handle(err)
+	uid := invokingUID()
+	unlockQuota, err := checkQuota(&cfg.Quotas, uid, opts.limits)
+	handle(err)
 
-	fargs := append([]string{"child"}, args...)
-	cmd := exec.Command("/proc/self/exe", fargs...)
+	// A detaching run already created the runtime directory
+	id := opts.containerID
+	if id == "" {
+		id, err = newContainerID(opts.id)
+		handle(err)
+	}
+	_, err = createRuntimeDir(id)
+	handle(err)
+
+	if len(dnsServers) > 0 {
+		handle(writeResolvConf(id, dnsServers))
+	}
+
+	// With the newuidmap helpers, the child waits on idMapSync until its
+	// ID maps are written. Rootless containers have no network to attach,
+	// so the pipe is always the child's first extra file.
+	fargs := []string{"child", "--container-id", id}
+	var mapping *rootlessMapping
+	var idMapSync *os.File
+	if opts.rootless {
+		mapping, err = newRootlessMapping()
+		handle(err)
+		if mapping.helpers() {
+			fargs = append(fargs, "--id-map-fd", "3")
+		}
+	}
+	cmd := exec.Command("/proc/self/exe", append(fargs, args...)...)
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | opts.cloneFlags,
+	}
+	if mapping != nil {
+		mapping.apply(cmd.SysProcAttr)
+		if mapping.helpers() {
+			r, w, err := os.Pipe()
+			handle(err)
+			cmd.ExtraFiles = []*os.File{r}
+			idMapSync = w
+		}
+	}
+
+	// The child waits on netSync until its network namespace is attached
+	var netSync *os.File
+	if opts.network != hostNetwork {
+		_, err := lookupNetwork(opts.network)
+		handle(err)
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+		r, w, err := os.Pipe()
+		handle(err)
+		cmd.ExtraFiles = []*os.File{r}
+		netSync = w
+	}
+
+	// The output of a detached container goes to output.log, the stdout of
+	// the background run, through a pipeline as well, which indexes it for
+	// shp logs
+	var logs *logPipeline
+	var logPath string
+	var driver lineDriver
+	switch {
+	case opts.logDriver != "":
+		driver, logPath, err = openLogDriver(opts, id, spec.Image)
+		handle(err)
+		rOut, wOut, err := os.Pipe()
+		handle(err)
+		rErr, wErr, err := os.Pipe()
+		handle(err)
+		cmd.Stdout, cmd.Stderr = wOut, wErr
+		driver.stream(rOut, false)
+		driver.stream(rErr, true)
+	case opts.logFile != "" || opts.detach:
+		sink := os.Stdout
+		logPath = scratchPath(id, detachedOutput)
+		if opts.logFile != "" {
+			sink, err = openLogSink(opts.logFile)
+			handle(err)
+			logPath, err = filepath.Abs(opts.logFile)
+			handle(err)
+		}
+		r, w, err := os.Pipe()
+		handle(err)
+		cmd.Stdout, cmd.Stderr = w, w
+		logs = newLogPipeline(r, sink, opts.logPolicy, opts.logBuffer)
+	}
+
+	var cgroup *containerCgroup
+	if !opts.rootless {
+		cgroup, err = createCgroup(id, opts.limits, opts.pidsLimit)
+	}
+	if err != nil {
+		removeState(id)
+		handle(err)
+	}
+	if cgroup != nil {
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.dir.Fd())
+	}
+
+	// Without a cgroup v2 group, the v1 freezer still lets shp pause the
+	// container
+	var freezer string
+	var leaveFreezer func()
+	if cgroup == nil && !opts.rootless {
+		if freezer, leaveFreezer, err = createFreezer(id); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	// The child puts the terminal into raw mode for --tty; it is restored
+	// however the child exits
+	var restoreTerminal func()
+	if opts.tty {
+		restoreTerminal = saveTerminal(os.Stdin)
+	}
+	err = cmd.Start()
+	if freezer != "" {
+		leaveFreezer()
+	}
+	if err != nil {
+		if cgroup != nil {
+			cgroup.remove()
+		}
+		if freezer != "" {
+			removeFreezer(freezer)
+		}
+		removeState(id)
+		handle(err)
+	}
+	// Signals sent to run reach the container instead of ending run before
+	// it cleaned up
+	stopRelay := forwardSignals(cmd.Process)
+	if idMapSync != nil {
+		cmd.ExtraFiles[0].Close()
+		if err := mapping.writeMaps(cmd.Process.Pid); err != nil {
+			idMapSync.Close()
+			cmd.Wait()
+			removeState(id)
+			handle(err)
+		}
+		idMapSync.Write([]byte{0})
+		idMapSync.Close()
+	}
+	if logs != nil {
+		// Only the container may hold the write end, so EOF follows its exit
+		cmd.Stdout.(*os.File).Close()
+		logs.start(scratchPath(id, logStatsFile), scratchPath(id, logIndexFile))
+	}
+	if driver != nil {
+		cmd.Stdout.(*os.File).Close()
+		cmd.Stderr.(*os.File).Close()
+	}
+	var attachment *netAttachment
+	if netSync != nil {
+		cmd.ExtraFiles[0].Close()
+		attachment, err = attachNetwork(id, cmd.Process.Pid, opts.network, opts.publish)
+		if err != nil {
+			netSync.Close()
+			cmd.Wait()
+			if cgroup != nil {
+				cgroup.remove()
+			}
+			if freezer != "" {
+				removeFreezer(freezer)
+			}
+			removeState(id)
+			handle(err)
+		}
+		netSync.Write([]byte{0})
+		netSync.Close()
+	}
+	st := &containerState{
+		ID:           id,
+		Name:         opts.name,
+		PID:          cmd.Process.Pid,
+		Rootfs:       spec.Rootfs,
+		Image:        spec.Image,
+		Volumes:      spec.Volumes,
+		Command:      spec.Command,
+		Labels:       opts.labels,
+		StopTimeout:  opts.stopTimeout,
+		Profile:      opts.profile.name,
+		Security:     opts.profile.securityProfile.name,
+		Seccomp:      opts.profile.Seccomp,
+		Capabilities: opts.profile.Capabilities,
+		NoExec:       opts.profile.NoExec,
+		Definition:   definition,
+		Args:         runArgs,
+		LogFile:      logPath,
+		LogDriver:    opts.logDriver,
+		UID:          uid,
+		Memory:       opts.limits.memoryBytes,
+		CPUs:         opts.limits.cpus,
+		Created:      time.Now(),
+	}
+	if attachment != nil {
+		st.Network = opts.network
+		st.IP = attachment.ip.String()
+		for i, m := range opts.publish {
+			st.Ports = append(st.Ports, m.String())
+			go acceptForward(published[i], cmd.Process.Pid, m.containerPort)
+		}
+	}
+	if cgroup != nil {
+		st.Cgroup = cgroup.path
+	}
+	st.Freezer = freezer
+	if err := saveState(st); err != nil {
+		fmt.Printf("Warning: cannot record container state: %v\n", err)
+	}
+	// Only containers that passed every check and started are started
+	// again at boot
+	if opts.autostart {
+		if err := saveAutostart(opts, args, pargs); err != nil {
+			fmt.Printf("Warning: cannot record autostart entry: %v\n", err)
+		}
+	}
+	unlockQuota()
+	var accounting *netAccountant
+	if opts.netAccounting {
+		if accounting, err = startNetAccounting(opts.name, cmd.Process.Pid); err != nil {
+			fmt.Printf("Warning: cannot account network usage: %v\n", err)
+		}
 	}
-	handle(cmd.Run())
+	var mdns *mdnsResponder
+	if len(opts.mdns) > 0 {
+		var ip net.IP
+		if attachment != nil {
+			ip = attachment.ip
+		}
+		if mdns, err = newContainerResponder(opts, ip); err != nil {
+			fmt.Printf("Warning: cannot advertise services via mDNS: %v\n", err)
+		} else {
+			go mdns.serve()
+		}
+	}
+	var hooks container.Hooks
+	opts.hooks.register(&hooks)
+	hooks.Run(context.Background(), container.PhaseStarted, *st)
+	cancelOOM := opts.faults.injectOOM(st, opts.hooks.onOOM)
+	var oom *oomWatcher
+	if opts.hooks.onOOM != "" {
+		if oom, err = watchOOM(st, opts.hooks.onOOM); err != nil {
+			fmt.Printf("Warning: cannot watch for OOM kills: %v\n", err)
+		}
+	}
+	var alerts *alertMonitor
+	if len(opts.alerts) > 0 {
+		alerts = startAlerts(st, opts.alerts, opts.limits.memoryBytes)
+	}
+	var integrity *integrityMonitor
+	if opts.integrityChecks {
+		if integrity, err = startIntegrityChecks(st, opts.profile, opts.integrityInterval, opts.hooks.onAnomaly); err != nil {
+			fmt.Printf("Warning: cannot check container integrity: %v\n", err)
+		}
+	}
+	var monitor *activityMonitor
+	if opts.activity {
+		if monitor, err = startActivityMonitor(st); err != nil {
+			fmt.Printf("Warning: cannot record container activity: %v\n", err)
+		}
+	}
+	exited := make(chan struct{})
+	if opts.readyFD != 0 {
+		go reportReady(os.NewFile(uintptr(opts.readyFD), "ready"), opts.waitReady, cmd.Process.Pid, attachment != nil, exited)
+	}
+	err = cmd.Wait()
+	stopRelay()
+	close(exited)
+	cancelOOM()
+	if restoreTerminal != nil {
+		restoreTerminal()
+	}
+	if oom != nil {
+		oom.close()
+	}
+	if alerts != nil {
+		alerts.close()
+	}
+	if integrity != nil {
+		integrity.close()
+	}
+	if monitor != nil {
+		monitor.close()
+	}
+	if accounting != nil {
+		// Before detaching, which deletes the interfaces with their counters
+		accounting.finish()
+	}
+	if mdns != nil {
+		mdns.shutdown()
+	}
+	if logs != nil {
+		logs.wait()
+	}
+	if driver != nil {
+		driver.wait()
+	}
+	if cgroup != nil {
+		// After the OOM watcher's last look at the cgroup's events
+		cgroup.remove()
+	}
+	if freezer != "" {
+		removeFreezer(freezer)
+	}
+	closeListeners(published)
+	if attachment != nil {
+		attachment.detach()
+	}
+	exitCode := exitStatus(cmd.ProcessState)
+	st.ExitCode = &exitCode
+	hooks.Run(context.Background(), container.PhaseExited, *st)
+	removeState(id)
+	// The child exits with the status of the command
+	code, err := commandExitCode(err)
+	handle(err)
+	os.Exit(code)
 }
 
 func child(args []string) {
-	if len(args) < 2 {
-		fmt.Println("usage: shp child <rootfs_path> <cmd> [options]")
+	// Per-thread state such as the capability bounding set must be set on
+	// the thread that later forks the command
+	runtime.LockOSThread()
+
+	opts, pargs, err := parseRunOptions("child", args)
+	if err != nil || len(pargs) < 2 {
+		fmt.Println("usage: shp child [flags] <rootfs_path> <cmd> [options]")
 		os.Exit(1)
 	}
+	if opts.idMapFD != 0 {
+		waitIDMaps(opts.idMapFD)
+	}
 
-	rootfs := args[0]
-	cmdArgs := args[1:]
+	rootfs := pargs[0]
+	cmdArgs := pargs[1:]
+	progress := newProgressReporter(opts.progress, os.Stderr)
+	img, err := imageForRootfs(rootfs)
+	handle(err)
+	if img != nil {
+		rootfs = img.rootfs()
+	}
+
+	// run attaches the network while the rootfs is prepared; only the
+	// hostname files need its address
+	netReady := make(chan error, 1)
+	if opts.network != hostNetwork {
+		progress.report(progressEvent{Phase: phaseNetwork, Message: opts.network})
+		go func() {
+			netReady <- waitNetwork(os.NewFile(3, "netsync"))
+		}()
+	}
 
+	progress.report(progressEvent{Phase: phaseValidate, Message: rootfs})
 	handle(validateRootfs(rootfs))
+	health, err := newHealthCheck(opts)
+	handle(err)
 	binPath := getCmdPath(cmdArgs[0])
 
-	cmd := exec.Command(binPath, cmdArgs[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-
-	// Try pivot_root first, fall back to chroot
-	err := (&PivotRootIsolator{}).Isolate(rootfs)
-	if err != nil {
-		fmt.Printf("pivot_root failed: %v\nFalling back to chroot...\n", err)
-		handle((&ChrootIsolator{}).Isolate(rootfs))
+	env := passthroughEnv(os.Environ(), opts.envPassthrough)
+	handle(container.MakeMountsPrivate())
+	if img != nil {
+		env = imageEnv(img, env)
+		rootfs, err = mountImage(img, opts.containerID, opts.storageQuota)
+		handle(err)
+	}
+	for _, kv := range opts.env {
+		name, value, _ := strings.Cut(kv, "=")
+		env = setEnv(env, name, value)
+	}
+	hostname := opts.hostname
+	if hostname == "" {
+		hostname = opts.containerID
+	}
+	var initScript *os.File
+	if opts.initScript != "" {
+		initScript, err = openInitScript(opts.initScript)
+		handle(err)
+	}
+	var nullMount *os.File
+	if len(opts.profile.MaskedPaths) > 0 {
+		nullMount, err = openNullMount()
+		handle(err)
 	}
 
-	handle(mountProc())
-	handle(cmd.Run())
-}
-
-// PivotRootIsolator uses pivot_root for filesystem isolation
-type PivotRootIsolator struct{}
-
-func (p *PivotRootIsolator) Isolate(rootfs string) error {
-	absNewRoot, err := filepath.Abs(rootfs)
-	if err != nil {
-		return fmt.Errorf("cannot get absolute path for %s: %w", rootfs, err)
+	// Mounts stay sequential among themselves since volume targets may nest
+	var hints []string
+	var ip net.IP
+	handle(runParallel(
+		func() error {
+			// Cgroup limits must be read before the host /sys becomes unreachable
+			if opts.envHints {
+				limits, err := currentLimits()
+				if err != nil {
+					fmt.Printf("Warning: cannot derive env hints: %v\n", err)
+				}
+				hints = envHints(limits, env)
+			}
+			return nil
+		},
+		func() error {
+			if err := setupDev(rootfs, opts.rootless); err != nil {
+				return err
+			}
+			if opts.network != hostNetwork {
+				if err := <-netReady; err != nil {
+					return err
+				}
+				ip = containerIP()
+			}
+			if err := setupHostname(rootfs, opts.containerID, hostname, ip); err != nil {
+				return err
+			}
+			if opts.tz != "" {
+				if err := mountTimezone(rootfs, opts.tz); err != nil {
+					return err
+				}
+			}
+			if len(opts.dns) > 0 {
+				if err := mountResolvConf(rootfs, opts.containerID); err != nil {
+					return err
+				}
+			}
+			for _, v := range opts.volumes {
+				if err := v.mount(rootfs); err != nil {
+					return err
+				}
+			}
+			for _, m := range opts.mounts {
+				if err := m.mount(rootfs); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	))
+	// Like Docker and runc, a missing working directory is created, after
+	// volumes it may be part of
+	if opts.workdir != "" {
+		dir, err := securePath(rootfs, opts.workdir)
+		handle(err)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			handle(fmt.Errorf("cannot create working directory %s: %w", opts.workdir, err))
+		}
 	}
-	err = syscall.Mount(absNewRoot, absNewRoot, "", syscall.MS_BIND|syscall.MS_REC, "")
-	if err != nil {
-		return fmt.Errorf("failed to bind mount new root: %w", err)
+	// --user overrides the user of the bundle, and is resolved after volumes
+	// that may provide /etc/passwd
+	if opts.userSpec != "" {
+		u, err := resolveUser(rootfs, opts.userSpec)
+		if err != nil {
+			handle(fmt.Errorf("cannot resolve user %s: %w", opts.userSpec, err))
+		}
+		opts.user = u.cred
+		if u.home != "" && !hasEnv(opts.env, "HOME") {
+			env = setEnv(env, "HOME", u.home)
+		}
 	}
-	err = syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, "")
-	if err != nil {
-		return fmt.Errorf("failed to set mount propagation to private: %w", err)
+	env = append(env, hints...)
+	if opts.tz != "" {
+		env = setEnv(env, "TZ", opts.tz)
+	}
+	var tty *containerTTY
+	newCmd := func() *exec.Cmd {
+		cmd := exec.Command(binPath, cmdArgs[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+		cmd.Env = env
+		cmd.Dir = opts.workdir
+		if opts.user != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: opts.user}
+		}
+		if tty != nil {
+			tty.attach(cmd)
+		}
+		return cmd
 	}
 
-	oldRoot := filepath.Join(absNewRoot, oldRootDir)
-	if err := os.MkdirAll(oldRoot, 0700); err != nil {
-		return fmt.Errorf("cannot create old_root directory: %w", err)
+	// In a user namespace, proc can only be mounted while another proc
+	// mount is visible, so rootless containers mount it before isolation
+	if opts.rootless {
+		progress.report(progressEvent{Phase: phaseMount, Message: procFS})
+		target, err := securePath(rootfs, "/"+procFS)
+		handle(err)
+		handle(mountProc(target))
 	}
 
-	if err := syscall.PivotRoot(absNewRoot, oldRoot); err != nil {
-		return fmt.Errorf("pivot_root failed: %w", err)
+	// Try pivot_root first, fall back to chroot
+	progress.report(progressEvent{Phase: phaseIsolate})
+	err = (&container.PivotRootIsolator{}).Isolate(rootfs)
+	pivoted := err == nil
+	if err != nil {
+		fmt.Printf("pivot_root failed: %v\nFalling back to chroot...\n", err)
+		handle((&container.ChrootIsolator{}).Isolate(rootfs))
+		fmt.Println("Using chroot for filesystem isolation")
+	} else {
+		fmt.Println("Successfully using pivot_root")
 	}
 
-	if err := syscall.Chdir("/"); err != nil {
-		return fmt.Errorf("chdir to / failed after pivot_root: %w", err)
+	if !opts.rootless {
+		progress.report(progressEvent{Phase: phaseMount, Message: procFS})
+		handle(mountProc(procFS))
 	}
+	handle(opts.profile.mountProtections(nullMount))
 
-	// Unmount old root - non-critical, log but don't fail
-	if err := syscall.Unmount("/"+oldRootDir, syscall.MNT_DETACH); err != nil {
-		fmt.Printf("Warning: unmounting old root failed: %v\n", err)
+	// Init scripts may need privileges to add users or fix ownership
+	if initScript != nil {
+		progress.report(progressEvent{Phase: phaseInit, Message: opts.initScript})
+		handle(runInitScript(initScript, env))
 	}
 
-	// Remove old root directory - non-critical, log but don't fail
-	if err := os.Remove("/" + oldRootDir); err != nil {
-		fmt.Printf("Warning: removing old root directory failed: %v\n", err)
+	if opts.profile.ReadOnlyRootfs {
+		// The chroot fallback has no mount of its own to remount
+		if !pivoted {
+			handle(fmt.Errorf("a read-only rootfs requires pivot_root"))
+		}
+		if err := remountFlags("/", syscall.MS_RDONLY); err != nil {
+			handle(fmt.Errorf("cannot make rootfs read-only: %w", err))
+		}
 	}
 
-	fmt.Println("Successfully using pivot_root")
-	return nil
-}
+	handle(setRlimits(opts.rlimits))
+
+	// The terminal comes from the devpts instance of the container
+	if opts.tty {
+		tty, err = openTTY()
+		handle(err)
+	}
 
-// ChrootIsolator uses chroot for filesystem isolation (fallback)
-type ChrootIsolator struct{}
+	// Setup is complete; nothing after this point needs extra privileges
+	handle(opts.profile.restrictThread())
+	opts.faults.delayStart()
 
-func (c *ChrootIsolator) Isolate(rootfs string) error {
-	if err := syscall.Chroot(rootfs); err != nil {
-		return fmt.Errorf("chroot failed: %w", err)
+	// Orphans of the container's processes are reparented to the child
+	reaper.run()
+
+	// The container exits with the main command, sidecars are only helpers
+	sidecars, err := startSidecars(opts.sidecars, env, opts.profile)
+	handle(err)
+
+	if tty != nil {
+		handle(tty.proxy())
 	}
-	if err := syscall.Chdir("/"); err != nil {
-		return fmt.Errorf("chdir to / failed after chroot: %w", err)
+	start := func() (*exec.Cmd, error) {
+		cmd := newCmd()
+		if err := reaper.start(cmd); err != nil {
+			return nil, err
+		}
+		progress.report(progressEvent{Phase: phaseStarted, Message: fmt.Sprintf("pid %d", cmd.Process.Pid)})
+		return cmd, nil
 	}
-	fmt.Println("Using chroot for filesystem isolation")
-	return nil
+
+	if opts.watch != "" {
+		w, err := newWatcher(opts.watch)
+		handle(err)
+		err = superviseWatched(start, w, opts.watchSignal, opts.stopTimeout)
+		if tty != nil {
+			tty.close()
+		}
+		stopSidecars(sidecars, opts.stopTimeout)
+		code, err := commandExitCode(err)
+		handle(err)
+		os.Exit(code)
+	}
+
+	var stopHealth chan struct{}
+	if health != nil {
+		stopHealth = make(chan struct{})
+		health.configure(env, opts.workdir, opts.user)
+		go health.run(stopHealth, opts.profile, func(status string, err error) {
+			fmt.Fprintf(os.Stderr, "health: %s\n", status)
+			msg := status
+			if err != nil {
+				msg = fmt.Sprintf("%s: %v", status, err)
+			}
+			progress.report(progressEvent{Phase: phaseHealth, Message: msg})
+		})
+	}
+	if opts.supervise.mode != restartNo {
+		err = superviseCommand(start, opts.supervise)
+	} else {
+		cmd, serr := start()
+		handle(serr)
+		stopRelay := forwardSignals(cmd.Process)
+		err = cmd.Wait()
+		stopRelay()
+	}
+	if stopHealth != nil {
+		close(stopHealth)
+	}
+	if tty != nil {
+		tty.close()
+	}
+	stopSidecars(sidecars, opts.stopTimeout)
+	code, err := commandExitCode(err)
+	handle(err)
+	os.Exit(code)
 }
 
 func validateRootfs(rootfs string) error {
@@ -154,13 +847,6 @@ func getCmdPath(cmdPath string) string {
 	return filepath.Join("/bin/", cmdPath)
 }
 
-func mountProc() error {
-	return syscall.Mount(procFS, procFS, procFS, 0, "")
-}
-
-func handle(err error) {
-	if err != nil {
-		fmt.Printf("\n%s\n", err.Error())
-		os.Exit(1)
-	}
+func mountProc(target string) error {
+	return syscall.Mount(procFS, target, procFS, 0, "")
 }
@@ -0,0 +1,151 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	sidecarMinDelay = time.Second
+	sidecarMaxDelay = 30 * time.Second
+)
+
+// parseSidecar splits a --sidecar value into the command and its arguments.
+func parseSidecar(v string) ([]string, error) {
+	args := strings.Fields(v)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty sidecar command")
+	}
+	return args, nil
+}
+
+// sidecar is a helper process, such as a log shipper or a tunnel, running
+// in the namespaces of the container next to the main command. It is
+// restarted with backoff whenever it exits, until the main command exits.
+type sidecar struct {
+	path string
+	args []string
+
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startSidecars starts supervising the sidecars of the container. Paths are
+// resolved the same way as the main command.
+func startSidecars(specs [][]string, env []string, profile *containerProfile) ([]*sidecar, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	// Sidecars do not read the terminal; stdin is a pipe at EOF, which
+	// unlike /dev/null is there in every rootfs
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	w.Close()
+	var out []*sidecar
+	for _, args := range specs {
+		s := &sidecar{path: getCmdPath(args[0]), args: args, stop: make(chan struct{}), done: make(chan struct{})}
+		go s.run(stdin, env, profile)
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (s *sidecar) run(stdin *os.File, env []string, profile *containerProfile) {
+	defer close(s.done)
+	// The bounding set is per thread: the thread sidecars are forked from
+	// must drop setup-era privileges just like the main command's
+	runtime.LockOSThread()
+	if err := profile.restrictThread(); err != nil {
+		fmt.Fprintf(os.Stderr, "sidecar %s: %v\n", s.args[0], err)
+		return
+	}
+	delay := sidecarMinDelay
+	for {
+		cmd := exec.Command(s.path, s.args[1:]...)
+		cmd.Stdin = stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = env
+
+		s.mu.Lock()
+		select {
+		case <-s.stop:
+			s.mu.Unlock()
+			return
+		default:
+		}
+		err := reaper.start(cmd)
+		if err == nil {
+			s.cmd = cmd
+		}
+		s.mu.Unlock()
+
+		started := time.Now()
+		if err == nil {
+			err = cmd.Wait()
+		}
+		s.mu.Lock()
+		s.cmd = nil
+		s.mu.Unlock()
+
+		// A sidecar that ran for a while gets restarted quickly again
+		if time.Since(started) > sidecarMaxDelay {
+			delay = sidecarMinDelay
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		fmt.Fprintf(os.Stderr, "sidecar %s: exited (%s), restarting in %v\n", s.args[0], exitDescription(err), delay)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > sidecarMaxDelay {
+			delay = sidecarMaxDelay
+		}
+	}
+}
+
+func (s *sidecar) signal(sig syscall.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != nil {
+		s.cmd.Process.Signal(sig)
+	}
+}
+
+// stopSidecars sends SIGTERM to the sidecars and kills those still running
+// after timeout. It must be called before the child exits, since the exit
+// of the container's PID 1 kills them without a grace period.
+func stopSidecars(sidecars []*sidecar, timeout time.Duration) {
+	for _, s := range sidecars {
+		close(s.stop)
+		s.signal(syscall.SIGTERM)
+	}
+	expired := time.After(timeout)
+	for _, s := range sidecars {
+		select {
+		case <-s.done:
+		case <-expired:
+			for _, s := range sidecars {
+				s.signal(syscall.SIGKILL)
+			}
+			<-s.done
+		}
+	}
+}
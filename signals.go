@@ -0,0 +1,114 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// relayedSignals returns the catchable signals relayed into containers:
+// all but the synchronous ones, SIGCHLD and SIGURG, which the Go runtime
+// uses, SIGWINCH, which terminals send to the foreground group or the child
+// applies to the container's terminal itself, and the job control signals,
+// which stop and continue run, the child and the command together.
+func relayedSignals() []os.Signal {
+	sigs := []os.Signal{
+		syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGABRT,
+		syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGALRM, syscall.SIGTERM,
+		syscall.SIGXCPU, syscall.SIGXFSZ, syscall.SIGVTALRM, syscall.SIGIO, syscall.SIGPWR,
+	}
+	// Real-time signals, above the two glibc reserves for threads
+	for sig := 34; sig <= 64; sig++ {
+		sigs = append(sigs, syscall.Signal(sig))
+	}
+	return sigs
+}
+
+// keyboardSignal reports whether sig is one the terminal on stdin generates
+// from the keyboard. The terminal sends it to its whole foreground process
+// group, which run, the child and a command without --tty share, so it is
+// not relayed again.
+func keyboardSignal(sig os.Signal) bool {
+	if sig != syscall.SIGINT && sig != syscall.SIGQUIT {
+		return false
+	}
+	var t syscall.Termios
+	return ioctl(os.Stdin.Fd(), syscall.TCGETS, unsafe.Pointer(&t)) == nil && t.Lflag&syscall.ISIG != 0
+}
+
+// signaler is a process that can be sent signals, such as an *os.Process.
+type signaler interface {
+	Signal(sig os.Signal) error
+}
+
+// forwardSignals relays the catchable signals received by run to the child,
+// and those received by the child (which is PID 1 of the container) to the
+// containerized process, and returns a function that stops the relay.
+func forwardSignals(p signaler) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, relayedSignals()...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if !keyboardSignal(sig) {
+					p.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// commandExitCode returns the exit status shp exits with once the command
+// waited for returned err: that of the command, with 128 plus the signal
+// number if it was killed, or err if it could not be waited for.
+func commandExitCode(err error) (int, error) {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		return exitStatus(exitErr.ProcessState), nil
+	}
+	return 0, err
+}
+
+// signalNames maps the names accepted on the command line to signals.
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal parses a signal given as "SIGHUP", "HUP" or a number.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n < 65 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal: %s", s)
+}
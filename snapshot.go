@@ -0,0 +1,99 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const snapshotUsage = "usage: shp snapshot create <container> [name] | ls <container> | rollback <container> <name> | rm <container> <name>"
+
+func snapshot(args []string) {
+	if len(args) < 2 {
+		fmt.Println(snapshotUsage)
+		os.Exit(1)
+	}
+	cmd, ref, rest := args[0], args[1], args[2:]
+	switch {
+	case cmd == "create" && len(rest) <= 1:
+		name := time.Now().UTC().Format("20060102T150405Z")
+		if len(rest) == 1 {
+			name = rest[0]
+		}
+		handle(withSnapshotter(ref, func(s snapshotter, st *containerState) error {
+			if err := validateSnapshotName(name); err != nil {
+				return err
+			}
+			if err := s.snapshot(st.ID, name); err != nil {
+				return fmt.Errorf("cannot snapshot container %s: %w", st.ID, err)
+			}
+			fmt.Println(name)
+			return nil
+		}))
+	case cmd == "ls" && len(rest) == 0:
+		handle(withSnapshotter(ref, func(s snapshotter, st *containerState) error {
+			snaps, err := s.snapshots(st.ID)
+			if err != nil {
+				return err
+			}
+			sort.Slice(snaps, func(i, j int) bool { return snaps[i].Created.Before(snaps[j].Created) })
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tCREATED")
+			for _, snap := range snaps {
+				fmt.Fprintf(w, "%s\t%s ago\n", snap.Name, time.Since(snap.Created).Round(time.Second))
+			}
+			return w.Flush()
+		}))
+	case cmd == "rollback" && len(rest) == 1:
+		handle(withSnapshotter(ref, func(s snapshotter, st *containerState) error {
+			if err := validateSnapshotName(rest[0]); err != nil {
+				return err
+			}
+			return s.rollback(st.ID, rest[0])
+		}))
+	case cmd == "rm" && len(rest) == 1:
+		handle(withSnapshotter(ref, func(s snapshotter, st *containerState) error {
+			if err := validateSnapshotName(rest[0]); err != nil {
+				return err
+			}
+			return s.deleteSnapshot(st.ID, rest[0])
+		}))
+	default:
+		fmt.Println(snapshotUsage)
+		os.Exit(1)
+	}
+}
+
+// withSnapshotter calls fn with the storage driver of a running container
+// started from an image, if the driver takes native snapshots.
+func withSnapshotter(ref string, fn func(snapshotter, *containerState) error) error {
+	st, err := findContainer(ref)
+	if err != nil {
+		return err
+	}
+	if st.Image == "" {
+		return fmt.Errorf("container %s was not started from an image; only image containers have snapshots", st.ID)
+	}
+	driver, err := openStorageDriver()
+	if err != nil {
+		return err
+	}
+	s, ok := driver.(snapshotter)
+	if !ok {
+		return fmt.Errorf("the storage driver does not support snapshots; use btrfs or zfs")
+	}
+	return fn(s, st)
+}
+
+// validateSnapshotName rejects names that are unsafe as file names and
+// invalid as zfs snapshot names.
+func validateSnapshotName(name string) error {
+	if !containerIDPattern.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q, expected %s", name, containerIDPattern)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"shp/pkg/container"
+)
+
+// containerSpec and volumeSpec are the public types of the container
+// library.
+type (
+	containerSpec = container.Spec
+	volumeSpec    = container.VolumeSpec
+)
+
+func newContainerSpec(opts *runOptions, pargs []string) (*containerSpec, error) {
+	rootfs, err := filepath.Abs(pargs[0])
+	if err != nil {
+		return nil, err
+	}
+	spec := &containerSpec{
+		Name:     opts.name,
+		Rootfs:   rootfs,
+		Command:  pargs[1:],
+		Env:      opts.envPassthrough,
+		Labels:   opts.labels,
+		Memory:   opts.limits.memoryBytes,
+		CPUs:     opts.limits.cpus,
+		Pids:     opts.pidsLimit,
+		Timezone: opts.tz,
+		Network:  opts.network,
+		User:     opts.userSpec,
+		Rootless: opts.rootless,
+
+		Profile:         opts.profile.name,
+		SecurityProfile: opts.profile.securityProfile.name,
+		Seccomp:         opts.profile.Seccomp,
+		Privileged:      opts.profile.securityProfile.name == securityPrivileged,
+		Capabilities:    append([]string{}, opts.profile.boundingSet()...),
+	}
+	sort.Strings(spec.Capabilities)
+	if spec.User == "" && opts.user != nil {
+		spec.User = fmt.Sprintf("%d:%d", opts.user.Uid, opts.user.Gid)
+	}
+	for _, v := range opts.volumes {
+		spec.Volumes = append(spec.Volumes, volumeSpec{Source: v.source, Target: v.target, Options: v.options()})
+	}
+	return spec, nil
+}
+
+// options renders the volume's mount flags in -v option syntax.
+func (v volume) options() []string {
+	flag := func(bit uintptr, on, off string) string {
+		if v.flags&bit != 0 {
+			return on
+		}
+		return off
+	}
+	return []string{
+		flag(syscall.MS_RDONLY, "ro", "rw"),
+		flag(syscall.MS_NOEXEC, "noexec", "exec"),
+		flag(syscall.MS_NOSUID, "nosuid", "suid"),
+		flag(syscall.MS_NODEV, "nodev", "dev"),
+	}
+}
@@ -0,0 +1,264 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"shp/pkg/container"
+)
+
+const (
+	stateFile = "state.json"
+
+	// cleanupTimeout bounds how long the run of a stopped container may
+	// take to tear down its network, cgroup and runtime directory
+	cleanupTimeout = 10 * time.Second
+)
+
+// runtimeDir holds the runtime directories of containers. Rootless
+// containers keep theirs in the invoking user's runtime directory.
+var runtimeDir = userRuntimeDir()
+
+func userRuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		return filepath.Join(dir, "shp")
+	}
+	return "/run/shp"
+}
+
+// containerState is the runtime record of a running container.
+type containerState = container.State
+
+// newContainerID returns id, the ID chosen with --id, if it is not in use
+// and a random ID if it is empty.
+func newContainerID(id string) (string, error) {
+	if id != "" {
+		if _, err := os.Lstat(containerDir(id)); err == nil {
+			return "", fmt.Errorf("container %s already exists", id)
+		}
+		return id, nil
+	}
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("cannot generate container id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func containerDir(id string) string {
+	return filepath.Join(runtimeDir, id)
+}
+
+// createRuntimeDir creates the per-container runtime directory. Every
+// scratch artifact of the container (state, generated config files,
+// sockets) lives below it, so deleting the container never leaves litter
+// behind. The directory must be a real directory owned by the caller and
+// accessible to nobody else.
+func createRuntimeDir(id string) (string, error) {
+	if err := os.MkdirAll(runtimeDir, 0700); err != nil {
+		return "", fmt.Errorf("cannot create %s: %w", runtimeDir, err)
+	}
+	dir := containerDir(id)
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("cannot create %s: %w", dir, err)
+	}
+	if err := checkRuntimeDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func checkRuntimeDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok {
+		return fmt.Errorf("runtime directory %s is not a directory", dir)
+	}
+	if int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("runtime directory %s is owned by uid %d", dir, st.Uid)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("runtime directory %s has unsafe mode %o", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// scratchPath returns the location of a scratch artifact of a container.
+func scratchPath(id, name string) string {
+	return filepath.Join(containerDir(id), name)
+}
+
+func saveState(st *containerState) error {
+	store, err := openStore(runtimeDir)
+	if err != nil {
+		return err
+	}
+	return store.update(func(tx storeTx) error {
+		return putRecord(tx, bucketContainers, st.ID, st)
+	})
+}
+
+// setStatus records the status of a container, unless its record is gone
+// already because the container exited.
+func setStatus(id, status string) error {
+	store, err := openStore(runtimeDir)
+	if err != nil {
+		return err
+	}
+	return store.update(func(tx storeTx) error {
+		st := &containerState{}
+		found, err := getRecord(tx, bucketContainers, id, st)
+		if err != nil || !found {
+			return err
+		}
+		st.Status = status
+		return putRecord(tx, bucketContainers, id, st)
+	})
+}
+
+func loadState(id string) (*containerState, error) {
+	store, err := openStore(runtimeDir)
+	if err != nil {
+		return nil, err
+	}
+	st := &containerState{}
+	err = store.view(func(tx storeTx) error {
+		found, err := getRecord(tx, bucketContainers, id, st)
+		if err == nil && !found {
+			err = fmt.Errorf("no state recorded for container %s", id)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// removeState deletes the runtime directory of a container. It is first
+// renamed out of the way so that a partially removed directory is never
+// mistaken for a container.
+func removeState(id string) error {
+	store, err := openStore(runtimeDir)
+	if err != nil {
+		return err
+	}
+	if err := store.update(func(tx storeTx) error { return tx.delete(bucketContainers, id) }); err != nil {
+		return err
+	}
+	if err := releaseStorage(id); err != nil {
+		fmt.Printf("Warning: cannot remove rootfs of container %s: %v\n", id, err)
+	}
+	dir := containerDir(id)
+	trash := filepath.Join(runtimeDir, ".deleted-"+id)
+	if err := os.Rename(dir, trash); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot remove %s: %w", dir, err)
+	}
+	return os.RemoveAll(trash)
+}
+
+// awaitCleanup waits until the run of a stopped container has removed its
+// runtime directory, so the ID and name can be used again. A run that is
+// gone itself left a stale record, which is removed like listStates does.
+func awaitCleanup(id string) error {
+	deadline := time.Now().Add(cleanupTimeout)
+	for {
+		if _, err := os.Stat(containerDir(id)); os.IsNotExist(err) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return removeState(id)
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// listStates returns the records of all containers that are still running.
+// Records left behind by containers that died without cleanup are removed.
+func listStates() ([]*containerState, error) {
+	store, err := openStore(runtimeDir)
+	if err != nil {
+		return nil, err
+	}
+	var records map[string][]byte
+	err = store.view(func(tx storeTx) error {
+		records, err = tx.list(bucketContainers)
+		return err
+	})
+	// Users without access to the runtime directory see no containers
+	if errors.Is(err, fs.ErrPermission) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var states []*containerState
+	for id, data := range records {
+		st := &containerState{}
+		if err := json.Unmarshal(data, st); err != nil {
+			fmt.Printf("Warning: cannot parse state of container %s: %v\n", id, err)
+			continue
+		}
+		if !processAlive(st.PID) {
+			removeState(st.ID)
+			continue
+		}
+		states = append(states, st)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states, nil
+}
+
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
+
+// findContainer looks up a running container by ID, name, host PID of its
+// init process or unique ID prefix, in that order, as IDs may be numeric.
+func findContainer(ref string) (*containerState, error) {
+	states, err := listStates()
+	if err != nil {
+		return nil, err
+	}
+	var matches []*containerState
+	for _, st := range states {
+		if st.ID == ref || st.Name == ref {
+			return st, nil
+		}
+		if strings.HasPrefix(st.ID, ref) {
+			matches = append(matches, st)
+		}
+	}
+	if pid, err := strconv.Atoi(ref); err == nil {
+		for _, st := range states {
+			if st.PID == pid {
+				return st, nil
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", ref)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("container reference %s is ambiguous", ref)
+}
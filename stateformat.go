@@ -0,0 +1,179 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	stateUsage = "usage: shp state migrate [--dry-run] | convert <file|kv>"
+
+	bucketMeta = "meta"
+	formatKey  = "format"
+
+	// stateFormatVersion is the version of the records this shp writes.
+	// Changing a record incompatibly means bumping it and adding the
+	// migration to stateMigrations.
+	stateFormatVersion = 1
+)
+
+// stateFormat is the meta record of a store naming its format version.
+// Stores from before versioning have none and are version 0.
+type stateFormat struct {
+	Version  int       `json:"version"`
+	Migrated time.Time `json:"migrated"`
+}
+
+// stateMigration upgrades the records of a store to version from the
+// version before it.
+type stateMigration struct {
+	version     int
+	description string
+	apply       func(tx storeTx) error
+}
+
+var stateMigrations = []stateMigration{
+	{1, "record the state format version", func(storeTx) error { return nil }},
+}
+
+var (
+	checkedFormatsMu sync.Mutex
+	checkedFormats   = make(map[string]bool)
+)
+
+func state(args []string) {
+	switch {
+	case len(args) >= 1 && args[0] == "migrate":
+		fs := flag.NewFlagSet("state migrate", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		dryRun := fs.Bool("dry-run", false, "print the migrations without applying them")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+			fmt.Println(stateUsage)
+			os.Exit(1)
+		}
+		handle(migrateFormats(*dryRun))
+	case len(args) == 2 && args[0] == "convert" && (args[1] == backendFile || args[1] == backendKV):
+		handle(migrateState(args[1]))
+	default:
+		fmt.Println(stateUsage)
+		os.Exit(1)
+	}
+}
+
+// readFormat returns the format version of a store and the migrations it
+// is missing.
+func readFormat(tx storeTx) (int, []stateMigration, error) {
+	var f stateFormat
+	if _, err := getRecord(tx, bucketMeta, formatKey, &f); err != nil {
+		return 0, nil, err
+	}
+	if f.Version > stateFormatVersion {
+		return f.Version, nil, fmt.Errorf("state has format version %d, newer than the %d this shp supports; upgrade shp", f.Version, stateFormatVersion)
+	}
+	var pending []stateMigration
+	for _, m := range stateMigrations {
+		if m.version > f.Version {
+			pending = append(pending, m)
+		}
+	}
+	return f.Version, pending, nil
+}
+
+// upgradeFormat applies the missing migrations of a store in a single
+// transaction, so a store is never left between two versions by the kv
+// backend; the file backend applies the writes of each record atomically.
+func upgradeFormat(store stateStore) (from int, applied []stateMigration, err error) {
+	err = store.update(func(tx storeTx) error {
+		from, applied, err = readFormat(tx)
+		if err != nil || len(applied) == 0 {
+			return err
+		}
+		for _, m := range applied {
+			if err := m.apply(tx); err != nil {
+				return fmt.Errorf("migration to format version %d failed: %w", m.version, err)
+			}
+		}
+		return putRecord(tx, bucketMeta, formatKey, stateFormat{Version: stateFormatVersion, Migrated: time.Now()})
+	})
+	return from, applied, err
+}
+
+// checkFormat upgrades the store of root the first time a process opens
+// it. Roots that do not exist yet have nothing to upgrade, and users who
+// may not write a root keep reading it as it is.
+func checkFormat(root string, store stateStore) error {
+	checkedFormatsMu.Lock()
+	defer checkedFormatsMu.Unlock()
+	if checkedFormats[root] {
+		return nil
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil
+	}
+	var pending []stateMigration
+	err := store.view(func(tx storeTx) error {
+		var err error
+		_, pending, err = readFormat(tx)
+		return err
+	})
+	if err == nil && len(pending) > 0 {
+		_, _, err = upgradeFormat(store)
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", root, err)
+	}
+	checkedFormats[root] = true
+	return nil
+}
+
+// migrateFormats upgrades both state roots, or with dryRun prints the
+// migrations an upgrade would apply.
+func migrateFormats(dryRun bool) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	for _, root := range []string{runtimeDir, stateDir} {
+		store, err := newStore(root, cfg.StateBackend)
+		if err != nil {
+			return err
+		}
+		var from int
+		var pending []stateMigration
+		if dryRun {
+			err = store.view(func(tx storeTx) error {
+				from, pending, err = readFormat(tx)
+				return err
+			})
+		} else {
+			from, pending, err = upgradeFormat(store)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", root, err)
+		}
+		if len(pending) == 0 {
+			fmt.Printf("%s: format version %d is current\n", root, from)
+			continue
+		}
+		verb := "migrated"
+		if dryRun {
+			verb = "would migrate"
+		}
+		fmt.Printf("%s: %s from format version %d to %d\n", root, verb, from, stateFormatVersion)
+		for _, m := range pending {
+			fmt.Printf("  %d: %s\n", m.version, m.description)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	statsUsage = `usage: shp stats [--no-stream] [--json] [<container>...]
+       shp stats --networks [--json]
+       shp stats --usage [YYYY-MM]`
+
+	statsInterval = time.Second
+)
+
+// containerStats is the live resource usage of a running container. The
+// cgroup figures are missing for containers without a cgroup v2 group.
+type containerStats struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Network string `json:"network"`
+	netCounters
+	*cgroupStats
+}
+
+// cgroupStats is the usage a container's cgroup accounts for, including
+// its exec sessions.
+type cgroupStats struct {
+	CPUPercent  float64 `json:"cpu_percent"`
+	MemoryBytes uint64  `json:"memory_bytes"`
+	MemoryLimit uint64  `json:"memory_limit"`
+	PIDs        uint64  `json:"pids"`
+	BlockRead   uint64  `json:"block_read_bytes"`
+	BlockWrite  uint64  `json:"block_write_bytes"`
+
+	cpuUsec uint64
+	read    time.Time
+}
+
+func stats(args []string) {
+	if len(args) >= 1 && len(args) <= 2 && (args[0] == "--usage" || args[0] == "-usage") {
+		month := time.Now().Format(monthLayout)
+		if len(args) == 2 {
+			month = args[1]
+		}
+		handle(printNetUsage(month))
+		return
+	}
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	asJSON := fs.Bool("json", false, "print JSON, a line per container and sample when streaming")
+	noStream := fs.Bool("no-stream", false, "print a single sample instead of refreshing")
+	networks := fs.Bool("networks", false, "print the traffic of every container and network")
+	if err := fs.Parse(args); err != nil || *networks && fs.NArg() > 0 {
+		fmt.Println(statsUsage)
+		os.Exit(1)
+	}
+	if *networks {
+		handle(printNetStats(*asJSON))
+		return
+	}
+	var ids map[string]bool
+	if fs.NArg() > 0 {
+		ids = make(map[string]bool)
+		for _, ref := range fs.Args() {
+			st, err := findContainer(ref)
+			handle(err)
+			ids[st.ID] = true
+		}
+	}
+	handle(streamStats(ids, *asJSON, !*noStream))
+}
+
+// streamStats prints the usage of the containers in ids, or of all, every
+// statsInterval until they exited, or once unless stream is set. CPU usage
+// is measured over the interval, so the first figures come after one.
+func streamStats(ids map[string]bool, asJSON, stream bool) error {
+	last := make(map[string]*cgroupStats)
+	if _, err := sampleStats(ids, last); err != nil {
+		return err
+	}
+	redraw := stream && !asJSON && isTTY(os.Stdout)
+	for {
+		time.Sleep(statsInterval)
+		all, err := sampleStats(ids, last)
+		if err != nil {
+			return err
+		}
+		switch {
+		case asJSON && !stream:
+			if all == nil {
+				all = []containerStats{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(all)
+		case asJSON:
+			enc := json.NewEncoder(os.Stdout)
+			now := time.Now().UTC()
+			for _, s := range all {
+				enc.Encode(struct {
+					Time time.Time `json:"time"`
+					containerStats
+				}{now, s})
+			}
+		default:
+			if redraw {
+				// Home the cursor and clear the screen, like top
+				fmt.Print("\x1b[H\x1b[2J")
+			} else if stream {
+				fmt.Println()
+			}
+			if err := printStatsTable(all); err != nil {
+				return err
+			}
+		}
+		if !stream || ids != nil && len(all) == 0 {
+			return nil
+		}
+	}
+}
+
+// sampleStats reads the usage of the running containers in ids, or of all
+// if ids is nil, oldest first. CPU usage is the share of a CPU used since
+// the sample in last, which is updated.
+func sampleStats(ids map[string]bool, last map[string]*cgroupStats) ([]containerStats, error) {
+	states, err := listStates()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Created.Before(states[j].Created) })
+	var out []containerStats
+	for _, st := range states {
+		if ids != nil && !ids[st.ID] {
+			continue
+		}
+		s, ok := netStats(st)
+		if !ok {
+			continue
+		}
+		if st.Cgroup != "" {
+			if cg, err := readCgroupStats(st.Cgroup); err == nil {
+				if prev := last[st.ID]; prev != nil && cg.read.After(prev.read) && cg.cpuUsec >= prev.cpuUsec {
+					cg.CPUPercent = float64(cg.cpuUsec-prev.cpuUsec) / float64(cg.read.Sub(prev.read).Microseconds()) * 100
+				}
+				last[st.ID] = cg
+				s.cgroupStats = cg
+			}
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// readCgroupStats reads the usage of the cgroup v2 group at dir. Figures of
+// controllers that are not enabled stay zero.
+func readCgroupStats(dir string) (*cgroupStats, error) {
+	cg := &cgroupStats{read: time.Now()}
+	current, err := readCgroupValue(dir, "memory.current")
+	if err != nil {
+		return nil, err
+	}
+	cg.MemoryBytes = current
+	if cg.MemoryLimit, err = readCgroupValue(dir, "memory.max"); err != nil {
+		cg.MemoryLimit = hostMemory()
+	}
+	cg.PIDs, _ = readCgroupValue(dir, "pids.current")
+	cg.cpuUsec = readCgroupKey(filepath.Join(dir, "cpu.stat"), "usage_usec")
+	if data, err := os.ReadFile(filepath.Join(dir, "io.stat")); err == nil {
+		// A line per device: "8:0 rbytes=... wbytes=... rios=... wios=..."
+		for _, field := range strings.Fields(string(data)) {
+			key, value, _ := strings.Cut(field, "=")
+			n, _ := strconv.ParseUint(value, 10, 64)
+			switch key {
+			case "rbytes":
+				cg.BlockRead += n
+			case "wbytes":
+				cg.BlockWrite += n
+			}
+		}
+	}
+	return cg, nil
+}
+
+// readCgroupValue reads a cgroup file holding a single number; "max" is an
+// error, as the file sets no limit.
+func readCgroupValue(dir, name string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKey returns the value of key in a flat keyed cgroup file such
+// as cpu.stat, or zero.
+func readCgroupKey(path, key string) uint64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if k, v, ok := strings.Cut(s.Text(), " "); ok && k == key {
+			n, _ := strconv.ParseUint(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// hostMemory returns the memory of the host, the limit of a cgroup without
+// memory.max, from /proc/meminfo.
+func hostMemory() uint64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// MemTotal:       16318664 kB
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+func printStatsTable(all []containerStats) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tNAME\tCPU %\tMEM USAGE / LIMIT\tMEM %\tPIDS\tNET RX / TX\tBLOCK READ / WRITE")
+	for _, s := range all {
+		net := "-"
+		if s.Network != hostNetwork {
+			net = formatSize(int64(s.RxBytes)) + " / " + formatSize(int64(s.TxBytes))
+		}
+		if s.cgroupStats == nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t%s\t-\n", s.ID, s.Name, net)
+			continue
+		}
+		var memPercent float64
+		if s.MemoryLimit > 0 {
+			memPercent = float64(s.MemoryBytes) / float64(s.MemoryLimit) * 100
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2f%%\t%s / %s\t%.2f%%\t%d\t%s\t%s / %s\n", s.ID, s.Name, s.CPUPercent,
+			formatSize(int64(s.MemoryBytes)), formatSize(int64(s.MemoryLimit)), memPercent, s.PIDs, net,
+			formatSize(int64(s.BlockRead)), formatSize(int64(s.BlockWrite)))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,450 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	driverOverlay = "overlay"
+	driverVFS     = "vfs"
+	driverBtrfs   = "btrfs"
+	driverZFS     = "zfs"
+
+	// containersDir holds the rootfs copies and clones of the drivers
+	// that do not keep them in the runtime directory
+	containersDir = "containers"
+	// zfsBaseSnapshot is the snapshot of an image dataset containers are
+	// cloned from
+	zfsBaseSnapshot = "base"
+)
+
+// storageDriver keeps the rootfs of images and gives every container of an
+// image a writable rootfs of its own. It is chosen with storage_driver in
+// the config file; changing it applies to images pulled and containers
+// started afterwards, so images should be pulled again.
+type storageDriver interface {
+	// createImage creates dest, the rootfs of an image, with unpack
+	// filling the directory it is given
+	createImage(dest string, unpack func(dir string) error) error
+	// removeImage deletes the rootfs of an image
+	removeImage(path string) error
+	// mount makes a writable rootfs for container id from the rootfs of
+	// an image, in the container's mount namespace, and returns its path.
+	// A positive quota limits the space its writes may take.
+	mount(base, id string, quota int64) (string, error)
+	// release deletes what mount left outside the runtime directory of
+	// container id; it is called whenever the state of a container is
+	// removed, so it must do nothing for containers without a rootfs
+	release(id string) error
+}
+
+// snapshotter is implemented by the drivers that take native snapshots of
+// the rootfs of containers, for shp snapshot. Snapshots are deleted along
+// with the container.
+type snapshotter interface {
+	snapshot(id, name string) error
+	snapshots(id string) ([]storageSnapshot, error)
+	rollback(id, name string) error
+	deleteSnapshot(id, name string) error
+}
+
+type storageSnapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// openStorageDriver returns the configured storage driver.
+func openStorageDriver() (storageDriver, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.StorageDriver {
+	case "", driverOverlay:
+		return overlayDriver{layers: cfg.LayersDir}, nil
+	case driverVFS:
+		return vfsDriver{layers: cfg.LayersDir}, nil
+	case driverBtrfs:
+		return btrfsDriver{}, nil
+	case driverZFS:
+		if cfg.ZFSDataset == "" {
+			return nil, fmt.Errorf("the zfs storage driver needs zfs_dataset in the config file")
+		}
+		return zfsDriver{dataset: cfg.ZFSDataset}, nil
+	}
+	return nil, fmt.Errorf("unknown storage driver: %s", cfg.StorageDriver)
+}
+
+// releaseStorage deletes the rootfs of a container kept by the storage
+// driver.
+func releaseStorage(id string) error {
+	driver, err := openStorageDriver()
+	if err != nil {
+		return err
+	}
+	return driver.release(id)
+}
+
+// containerRootfs is where drivers other than overlay keep the rootfs of a
+// container: next to the images, as it is as large as an image rootfs and
+// the runtime directory usually is a tmpfs.
+func containerRootfs(id string) string {
+	return filepath.Join(imagesRoot(), containersDir, id)
+}
+
+// unpackDir creates dest by unpacking into a temporary directory made by
+// mkdir, which is renamed to dest once it is complete.
+func unpackDir(dest string, mkdir func(string) error, remove func(string) error, unpack func(string) error) error {
+	tmp := filepath.Join(filepath.Dir(dest), ".tmp-"+filepath.Base(dest))
+	if err := remove(tmp); err != nil {
+		return err
+	}
+	if err := mkdir(tmp); err != nil {
+		return fmt.Errorf("cannot create rootfs: %w", err)
+	}
+	if err := unpack(tmp); err != nil {
+		remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		remove(tmp)
+		return fmt.Errorf("cannot commit rootfs: %w", err)
+	}
+	return nil
+}
+
+func errNoStorageQuota(driver string) error {
+	return fmt.Errorf("the %s storage driver does not support storage quotas", driver)
+}
+
+func mkdirRootfs(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	// The rootfs must be accessible whatever the umask
+	return os.Chmod(dir, 0755)
+}
+
+// overlayDriver mounts an overlay of the image's rootfs, with the writable
+// layer in the runtime directory of the container, or below layers. It is
+// the default.
+type overlayDriver struct {
+	layers string
+}
+
+func (overlayDriver) createImage(dest string, unpack func(string) error) error {
+	return unpackDir(dest, mkdirRootfs, os.RemoveAll, unpack)
+}
+
+func (overlayDriver) removeImage(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (d overlayDriver) mount(base, id string, quota int64) (string, error) {
+	if quota > 0 {
+		return "", errNoStorageQuota(driverOverlay)
+	}
+	upper, work, merged := scratchPath(id, imageUpperDir), scratchPath(id, imageWorkDir), scratchPath(id, imageMergedDir)
+	if d.layers != "" {
+		// The upper and work directories must be on the same file system
+		upper, work = filepath.Join(d.layers, id, imageUpperDir), filepath.Join(d.layers, id, imageWorkDir)
+		if err := os.MkdirAll(filepath.Join(d.layers, id), 0700); err != nil {
+			return "", err
+		}
+	}
+	for _, dir := range []string{upper, work, merged} {
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+	}
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", base, upper, work)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return "", err
+	}
+	return merged, nil
+}
+
+func (d overlayDriver) release(id string) error {
+	if d.layers == "" {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(d.layers, id))
+}
+
+// vfsDriver copies the image's rootfs for every container. It works on any
+// file system, and copies are cheap where cp can reflink them, such as on
+// XFS. The copies are kept below layers, if set.
+type vfsDriver struct {
+	layers string
+}
+
+func (d vfsDriver) rootfs(id string) string {
+	if d.layers != "" {
+		return filepath.Join(d.layers, id)
+	}
+	return containerRootfs(id)
+}
+
+func (vfsDriver) createImage(dest string, unpack func(string) error) error {
+	return unpackDir(dest, mkdirRootfs, os.RemoveAll, unpack)
+}
+
+func (vfsDriver) removeImage(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (d vfsDriver) mount(base, id string, quota int64) (string, error) {
+	if quota > 0 {
+		return "", errNoStorageQuota(driverVFS)
+	}
+	dest := d.rootfs(id)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", err
+	}
+	if err := runTool("cp", "-a", "--reflink=auto", base, dest); err != nil {
+		os.RemoveAll(dest)
+		return "", err
+	}
+	return dest, nil
+}
+
+func (d vfsDriver) release(id string) error {
+	return os.RemoveAll(d.rootfs(id))
+}
+
+// btrfsDriver unpacks images into subvolumes and gives containers
+// snapshots of them. The images directory must be on btrfs.
+type btrfsDriver struct{}
+
+func (btrfsDriver) createImage(dest string, unpack func(string) error) error {
+	mkdir := func(dir string) error {
+		if err := runTool("btrfs", "subvolume", "create", dir); err != nil {
+			return err
+		}
+		return os.Chmod(dir, 0755)
+	}
+	return unpackDir(dest, mkdir, deleteSubvolume, unpack)
+}
+
+func (btrfsDriver) removeImage(path string) error {
+	return deleteSubvolume(path)
+}
+
+// mount snapshots the image's subvolume. A quota is a limit on the data
+// exclusive to the snapshot, which needs quotas enabled on the file system
+// with btrfs quota enable.
+func (btrfsDriver) mount(base, id string, quota int64) (string, error) {
+	dest := containerRootfs(id)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", err
+	}
+	if err := runTool("btrfs", "subvolume", "snapshot", base, dest); err != nil {
+		return "", err
+	}
+	if quota > 0 {
+		if err := runTool("btrfs", "qgroup", "limit", "-e", strconv.FormatInt(quota, 10), dest); err != nil {
+			deleteSubvolume(dest)
+			return "", err
+		}
+	}
+	return dest, nil
+}
+
+func (d btrfsDriver) release(id string) error {
+	snaps, err := d.snapshots(id)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		if err := deleteSubvolume(filepath.Join(btrfsSnapshotDir(id), snap.Name)); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(btrfsSnapshotDir(id)); err != nil {
+		return err
+	}
+	return deleteSubvolume(containerRootfs(id))
+}
+
+// btrfsSnapshotDir holds the read-only snapshots of a container.
+func btrfsSnapshotDir(id string) string {
+	return filepath.Join(imagesRoot(), containersDir, ".snapshots", id)
+}
+
+func (btrfsDriver) snapshot(id, name string) error {
+	dest := filepath.Join(btrfsSnapshotDir(id), name)
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("snapshot %s already exists", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	return runTool("btrfs", "subvolume", "snapshot", "-r", containerRootfs(id), dest)
+}
+
+func (btrfsDriver) snapshots(id string) ([]storageSnapshot, error) {
+	entries, err := os.ReadDir(btrfsSnapshotDir(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snaps []storageSnapshot
+	for _, e := range entries {
+		snap := storageSnapshot{Name: e.Name()}
+		if fi, err := e.Info(); err == nil {
+			snap.Created = fi.ModTime()
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// rollback is not supported: the rootfs of a running container is the
+// subvolume itself, which cannot be replaced while it is the root.
+func (btrfsDriver) rollback(id, name string) error {
+	return fmt.Errorf("the btrfs storage driver cannot roll back a running container")
+}
+
+func (btrfsDriver) deleteSnapshot(id, name string) error {
+	path := filepath.Join(btrfsSnapshotDir(id), name)
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return fmt.Errorf("no such snapshot: %s", name)
+	}
+	return deleteSubvolume(path)
+}
+
+// deleteSubvolume deletes a btrfs subvolume, if it exists.
+func deleteSubvolume(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return runTool("btrfs", "subvolume", "delete", path)
+}
+
+// zfsDriver unpacks images into datasets below dataset and gives containers
+// clones of their snapshots. Clones use legacy mount points, so they are
+// mounted in the mount namespace of their container only.
+type zfsDriver struct {
+	dataset string
+}
+
+func (d zfsDriver) imageDataset(path string) string {
+	return d.dataset + "/" + imagesDir + "/" + filepath.Base(path)
+}
+
+func (d zfsDriver) containerDataset(id string) string {
+	return d.dataset + "/" + containersDir + "/" + id
+}
+
+// createImage unpacks into a dataset mounted at a temporary path, which
+// moves to dest once the base snapshot is taken.
+func (d zfsDriver) createImage(dest string, unpack func(string) error) error {
+	ds := d.imageDataset(dest)
+	tmp := filepath.Join(filepath.Dir(dest), ".tmp-"+filepath.Base(dest))
+	if err := d.destroy(ds, "-r"); err != nil {
+		return err
+	}
+	if err := runTool("zfs", "create", "-p", "-o", "mountpoint="+tmp, ds); err != nil {
+		return err
+	}
+	err := os.Chmod(tmp, 0755)
+	if err == nil {
+		err = unpack(tmp)
+	}
+	if err == nil {
+		err = runTool("zfs", "snapshot", ds+"@"+zfsBaseSnapshot)
+	}
+	if err == nil {
+		err = runTool("zfs", "set", "mountpoint="+dest, ds)
+	}
+	if err != nil {
+		d.destroy(ds, "-r")
+		return err
+	}
+	return nil
+}
+
+func (d zfsDriver) removeImage(path string) error {
+	return d.destroy(d.imageDataset(path), "-r")
+}
+
+// mount clones the image's base snapshot. A quota is the quota of the
+// clone, which counts the data the container wrote and its snapshots.
+func (d zfsDriver) mount(base, id string, quota int64) (string, error) {
+	ds := d.containerDataset(id)
+	args := []string{"clone", "-p", "-o", "mountpoint=legacy"}
+	if quota > 0 {
+		args = append(args, "-o", "quota="+strconv.FormatInt(quota, 10))
+	}
+	if err := runTool("zfs", append(args, d.imageDataset(base)+"@"+zfsBaseSnapshot, ds)...); err != nil {
+		return "", err
+	}
+	dest := containerRootfs(id)
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return "", err
+	}
+	if err := syscall.Mount(ds, dest, "zfs", 0, ""); err != nil {
+		return "", fmt.Errorf("cannot mount %s: %w", ds, err)
+	}
+	return dest, nil
+}
+
+func (d zfsDriver) release(id string) error {
+	if err := d.destroy(d.containerDataset(id), "-r"); err != nil {
+		return err
+	}
+	if err := os.Remove(containerRootfs(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d zfsDriver) snapshot(id, name string) error {
+	return runTool("zfs", "snapshot", d.containerDataset(id)+"@"+name)
+}
+
+func (d zfsDriver) snapshots(id string) ([]storageSnapshot, error) {
+	out, err := exec.Command("zfs", "list", "-H", "-p", "-t", "snapshot", "-d", "1", "-o", "name,creation", d.containerDataset(id)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list snapshots of container %s: %w", id, err)
+	}
+	var snaps []storageSnapshot
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, created, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		_, name, _ = strings.Cut(name, "@")
+		secs, _ := strconv.ParseInt(created, 10, 64)
+		snaps = append(snaps, storageSnapshot{Name: name, Created: time.Unix(secs, 0)})
+	}
+	return snaps, nil
+}
+
+// rollback rolls the clone back while the container runs, discarding
+// later snapshots; its processes see the files change under them.
+func (d zfsDriver) rollback(id, name string) error {
+	return runTool("zfs", "rollback", "-r", d.containerDataset(id)+"@"+name)
+}
+
+func (d zfsDriver) deleteSnapshot(id, name string) error {
+	return runTool("zfs", "destroy", d.containerDataset(id)+"@"+name)
+}
+
+// destroy destroys a dataset, if it exists.
+func (d zfsDriver) destroy(ds string, flags ...string) error {
+	if exec.Command("zfs", "list", "-H", "-o", "name", ds).Run() != nil {
+		return nil
+	}
+	return runTool("zfs", append(append([]string{"destroy"}, flags...), ds)...)
+}
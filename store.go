@@ -0,0 +1,353 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Buckets group the records of a store by kind
+	bucketContainers = "containers"
+	bucketImages     = "images"
+	bucketNetworks   = "networks"
+
+	backendFile = "file"
+	backendKV   = "kv"
+
+	storeLock = "store.lock"
+)
+
+var storeBuckets = []string{bucketContainers, bucketImages, bucketNetworks, bucketMeta}
+
+// stateStore keeps the records of one state root, JSON documents grouped
+// in buckets: the runtime directory holds the containers, /var/lib/shp the
+// images and networks. The backend is chosen with state_backend in the
+// config file.
+type stateStore interface {
+	// view runs fn on a read-only snapshot of the store
+	view(fn func(tx storeTx) error) error
+	// update runs fn exclusively and applies its writes once it succeeds
+	update(fn func(tx storeTx) error) error
+}
+
+// storeTx reads and writes the records of a store. get returns nil for a
+// record that does not exist.
+type storeTx interface {
+	get(bucket, key string) ([]byte, error)
+	list(bucket string) (map[string][]byte, error)
+	put(bucket, key string, data []byte) error
+	delete(bucket, key string) error
+}
+
+// openStore returns the store of root with the configured backend,
+// upgraded to the current format.
+func openStore(root string) (stateStore, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	store, err := newStore(root, cfg.StateBackend)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFormat(root, store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func newStore(root, backend string) (stateStore, error) {
+	switch backend {
+	case "", backendFile:
+		return &fileStore{root: root}, nil
+	case backendKV:
+		return &kvStore{path: filepath.Join(root, kvStoreFile)}, nil
+	}
+	return nil, fmt.Errorf("unknown state backend: %s", backend)
+}
+
+// getRecord unmarshals the record key of bucket into v and reports whether
+// it exists.
+func getRecord(tx storeTx, bucket, key string, v interface{}) (bool, error) {
+	data, err := tx.get(bucket, key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("cannot parse %s record %s: %w", bucket, key, err)
+	}
+	return true, nil
+}
+
+func putRecord(tx storeTx, bucket, key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tx.put(bucket, key, data)
+}
+
+// fileLayout is where the file backend keeps the records of a bucket,
+// the layout shp has always used: a file per record, dir/<key><suffix>,
+// or one JSON object holding all records in index.
+type fileLayout struct {
+	dir, suffix string
+	index       string
+}
+
+var fileLayouts = map[string]fileLayout{
+	bucketContainers: {suffix: string(filepath.Separator) + stateFile},
+	bucketImages:     {index: filepath.Join(imagesDir, imageIndexFile)},
+	bucketNetworks:   {dir: networksDir, suffix: ".json"},
+	bucketMeta:       {suffix: ".json"},
+}
+
+// fileStore is the default backend. Every record is replaced atomically,
+// but the writes of a transaction are applied one at a time.
+type fileStore struct {
+	root string
+}
+
+func (s *fileStore) path(bucket, key string) string {
+	l := fileLayouts[bucket]
+	if l.index != "" {
+		return filepath.Join(s.root, l.index)
+	}
+	return filepath.Join(s.root, l.dir, key+l.suffix)
+}
+
+func (s *fileStore) view(fn func(tx storeTx) error) error {
+	return fn(&fileTx{store: s})
+}
+
+func (s *fileStore) update(fn func(tx storeTx) error) error {
+	if err := os.MkdirAll(s.root, 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %w", s.root, err)
+	}
+	unlock, err := lockFile(filepath.Join(s.root, storeLock))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	tx := &fileTx{store: s, writable: true, pending: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// fileTx buffers writes in pending, where a nil record is a deletion.
+type fileTx struct {
+	store    *fileStore
+	writable bool
+	pending  map[string]map[string][]byte
+}
+
+func (tx *fileTx) get(bucket, key string) ([]byte, error) {
+	if data, ok := tx.pending[bucket][key]; ok {
+		return data, nil
+	}
+	if fileLayouts[bucket].index != "" {
+		records, err := tx.readIndex(bucket)
+		return records[key], err
+	}
+	path := tx.store.path(bucket, key)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+func (tx *fileTx) list(bucket string) (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	l := fileLayouts[bucket]
+	if l.index != "" {
+		var err error
+		if records, err = tx.readIndex(bucket); err != nil {
+			return nil, err
+		}
+	} else {
+		dir := filepath.Join(tx.store.root, l.dir)
+		paths, err := filepath.Glob(filepath.Join(dir, "*"+l.suffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			key := strings.TrimSuffix(strings.TrimPrefix(path, dir+string(filepath.Separator)), l.suffix)
+			// Runtime directories being deleted are hidden
+			if strings.HasPrefix(key, ".") {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("cannot read %s: %w", path, err)
+			}
+			records[key] = data
+		}
+	}
+	for key, data := range tx.pending[bucket] {
+		if data == nil {
+			delete(records, key)
+		} else {
+			records[key] = data
+		}
+	}
+	return records, nil
+}
+
+func (tx *fileTx) readIndex(bucket string) (map[string][]byte, error) {
+	path := tx.store.path(bucket, "")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string][]byte{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	records := make(map[string][]byte, len(raw))
+	for key, data := range raw {
+		records[key] = data
+	}
+	return records, nil
+}
+
+func (tx *fileTx) put(bucket, key string, data []byte) error {
+	if !tx.writable {
+		return fmt.Errorf("store is read-only")
+	}
+	if tx.pending[bucket] == nil {
+		tx.pending[bucket] = make(map[string][]byte)
+	}
+	tx.pending[bucket][key] = data
+	return nil
+}
+
+func (tx *fileTx) delete(bucket, key string) error {
+	return tx.put(bucket, key, nil)
+}
+
+func (tx *fileTx) commit() error {
+	for bucket, writes := range tx.pending {
+		if fileLayouts[bucket].index != "" {
+			records, err := tx.list(bucket)
+			if err != nil {
+				return err
+			}
+			raw := make(map[string]json.RawMessage, len(records))
+			for key, data := range records {
+				raw[key] = data
+			}
+			data, err := json.MarshalIndent(raw, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := writeFileAtomic(tx.store.path(bucket, ""), data); err != nil {
+				return err
+			}
+			continue
+		}
+		for key, data := range writes {
+			path := tx.store.path(bucket, key)
+			if data == nil {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("cannot remove %s: %w", path, err)
+				}
+			} else if err := writeFileAtomic(path, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with a file holding data.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %w", filepath.Dir(path), err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return nil
+}
+
+// migrateState moves the records of both state roots from the other
+// backend to backend. Records are copied before they are deleted, so an
+// interrupted migration can be run again.
+func migrateState(backend string) error {
+	from := backendFile
+	if backend == backendFile {
+		from = backendKV
+	}
+	for _, root := range []string{runtimeDir, stateDir} {
+		src, err := newStore(root, from)
+		if err != nil {
+			return err
+		}
+		dst, err := newStore(root, backend)
+		if err != nil {
+			return err
+		}
+		moved := make(map[string]map[string][]byte)
+		err = src.view(func(tx storeTx) error {
+			for _, bucket := range storeBuckets {
+				records, err := tx.list(bucket)
+				if err != nil && !errors.Is(err, fs.ErrPermission) {
+					return err
+				}
+				moved[bucket] = records
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		copyRecords := func(tx storeTx, del bool) error {
+			for bucket, records := range moved {
+				for key, data := range records {
+					var err error
+					if del {
+						err = tx.delete(bucket, key)
+					} else {
+						err = tx.put(bucket, key, data)
+					}
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if err := dst.update(func(tx storeTx) error { return copyRecords(tx, false) }); err != nil {
+			return err
+		}
+		if err := src.update(func(tx storeTx) error { return copyRecords(tx, true) }); err != nil {
+			return err
+		}
+		for bucket, records := range moved {
+			if len(records) > 0 {
+				fmt.Printf("%s: moved %s (%d)\n", root, bucket, len(records))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	restartNo        = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+
+	restartMinDelay = time.Second
+	restartMaxDelay = 30 * time.Second
+)
+
+// restartPolicy says when the container init restarts the main command:
+// never, after a non-zero exit or after any exit, at most max times (0 for
+// no limit).
+type restartPolicy struct {
+	mode string
+	max  int
+}
+
+// parseRestartPolicy parses a --supervise value such as "on-failure:3".
+func parseRestartPolicy(v string) (restartPolicy, error) {
+	mode, max, hasMax := strings.Cut(v, ":")
+	p := restartPolicy{mode: mode}
+	switch mode {
+	case restartNo:
+		if hasMax {
+			return p, fmt.Errorf("invalid supervise policy: %s", v)
+		}
+		return p, nil
+	case restartOnFailure, restartAlways:
+	default:
+		return p, fmt.Errorf("invalid supervise policy: %s", v)
+	}
+	if hasMax {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("invalid restart count in supervise policy: %s", v)
+		}
+		p.max = n
+	}
+	return p, nil
+}
+
+// restarts reports whether the policy restarts a command that exited with
+// err after it was restarted count times.
+func (p restartPolicy) restarts(err error, count int) bool {
+	if p.max > 0 && count >= p.max {
+		return false
+	}
+	switch p.mode {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// superviseCommand runs the main command and restarts it in place according
+// to the policy, so namespaces, mounts and the network stay as they are.
+// Signals received by the container init are relayed to the current
+// process; termination signals also end the supervision.
+func superviseCommand(start func() (*exec.Cmd, error), p restartPolicy) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, relayedSignals()...)
+	defer signal.Stop(sigs)
+	terminating := func(s os.Signal) bool {
+		return s == syscall.SIGTERM || s == syscall.SIGINT || s == syscall.SIGQUIT
+	}
+
+	stopping := false
+	delay := restartMinDelay
+	for count := 0; ; count++ {
+		cmd, err := start()
+		if err != nil {
+			return err
+		}
+		started := time.Now()
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+	wait:
+		for {
+			select {
+			case s := <-sigs:
+				if !keyboardSignal(s) {
+					cmd.Process.Signal(s)
+				}
+				stopping = stopping || terminating(s)
+			case err = <-exited:
+				break wait
+			}
+		}
+		if stopping || !p.restarts(err, count) {
+			return err
+		}
+
+		// A command that ran for a while is restarted quickly again
+		if time.Since(started) > restartMaxDelay {
+			delay = restartMinDelay
+		}
+		fmt.Fprintf(os.Stderr, "supervise: command exited (%s), restarting in %v\n", exitDescription(err), delay)
+		for timer := time.After(delay); timer != nil; {
+			select {
+			case s := <-sigs:
+				if terminating(s) {
+					return err
+				}
+			case <-timer:
+				timer = nil
+			}
+		}
+		if delay *= 2; delay > restartMaxDelay {
+			delay = restartMaxDelay
+		}
+	}
+}
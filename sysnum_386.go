@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// The syscall package does not define SYS_SETNS and SYS_BPF on 386.
+const (
+	sysSetns = 346
+	sysBPF   = 357
+)
+
+// auditArch is AUDIT_ARCH_I386, the architecture seccomp filters expect.
+const auditArch = 0x40000003
+
+// seccompArchDenied extends the seccomp filters with calls specific
+// to 386 or missing from the syscall package.
+var seccompArchDenied = []uint32{
+	syscall.SYS_IOPL, syscall.SYS_IOPERM, syscall.SYS_UMOUNT,
+	341, // name_to_handle_at
+	342, // open_by_handle_at
+	343, // clock_adjtime
+	350, // finit_module
+	357, // bpf
+}
+
+// seccompArchStrictDenied extends the strict seccomp filter likewise.
+var seccompArchStrictDenied = []uint32{
+	347, // process_vm_readv
+	348, // process_vm_writev
+	374, // userfaultfd
+}
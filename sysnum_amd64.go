@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// The syscall package does not define SYS_SETNS and SYS_BPF on amd64.
+const (
+	sysSetns = 308
+	sysBPF   = 321
+)
+
+// auditArch is AUDIT_ARCH_X86_64, the architecture seccomp filters expect.
+const auditArch = 0xc000003e
+
+// seccompArchDenied extends the seccomp filters with calls specific
+// to amd64 or missing from the syscall package.
+var seccompArchDenied = []uint32{
+	syscall.SYS_IOPL, syscall.SYS_IOPERM,
+	303, // name_to_handle_at
+	304, // open_by_handle_at
+	305, // clock_adjtime
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+}
+
+// seccompArchStrictDenied extends the strict seccomp filter likewise.
+var seccompArchStrictDenied = []uint32{
+	310, // process_vm_readv
+	311, // process_vm_writev
+	323, // userfaultfd
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+const (
+	sysSetns = syscall.SYS_SETNS
+	sysBPF   = syscall.SYS_BPF
+)
+
+// auditArch is AUDIT_ARCH_AARCH64, the architecture seccomp filters expect.
+const auditArch = 0xc00000b7
+
+// seccompArchDenied extends the seccomp filters with calls missing
+// from the common list or from the syscall package.
+var seccompArchDenied = []uint32{
+	syscall.SYS_NAME_TO_HANDLE_AT, syscall.SYS_OPEN_BY_HANDLE_AT, syscall.SYS_CLOCK_ADJTIME,
+	syscall.SYS_FINIT_MODULE, syscall.SYS_BPF,
+	294, // kexec_file_load
+}
+
+// seccompArchStrictDenied extends the strict seccomp filter likewise.
+var seccompArchStrictDenied = []uint32{
+	syscall.SYS_PROCESS_VM_READV, syscall.SYS_PROCESS_VM_WRITEV,
+	282, // userfaultfd
+}
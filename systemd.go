@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const generateUsage = "usage: shp generate systemd <container>"
+
+const unitTemplate = `[Unit]
+Description=shp container %s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+SyslogIdentifier=%s
+ExecStart=%s
+KillMode=mixed
+TimeoutStopSec=10
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func generate(args []string) {
+	if len(args) != 2 || args[0] != "systemd" {
+		fmt.Println(generateUsage)
+		os.Exit(1)
+	}
+	st, err := findContainer(args[1])
+	handle(err)
+	unit, err := systemdUnit(st)
+	handle(err)
+	fmt.Print(unit)
+}
+
+// systemdUnit renders a service unit that runs a container again as a
+// host service, with the run arguments recorded in its state.
+func systemdUnit(st *containerState) (string, error) {
+	if len(st.Args) == 0 {
+		return "", fmt.Errorf("container %s has no recorded run arguments; run it again with this version of shp", st.ID)
+	}
+	name := st.Name
+	if name == "" {
+		name = st.ID
+	}
+	// A line break would end the directive and start another
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("container name %q contains control characters", name)
+	}
+	name = strings.ReplaceAll(name, "%", "%%")
+
+	self, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve shp executable: %w", err)
+	}
+	execArgs := append([]string{self, "run"}, st.Args...)
+	quoted := make([]string, len(execArgs))
+	for i, a := range execArgs {
+		quoted[i] = systemdQuote(a)
+	}
+	return fmt.Sprintf(unitTemplate, name, name, strings.Join(quoted, " ")), nil
+}
+
+// systemdQuote quotes s for use as a single word in an Exec* directive,
+// escaping systemd's specifier and variable expansion characters.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\n\"';\\") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,223 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"shp/pkg/container"
+)
+
+// ttyDrainTimeout bounds the wait for the output of a terminal after its
+// command exited, as background processes may keep it open.
+const ttyDrainTimeout = time.Second
+
+// ioctl issues a terminal ioctl whose argument is a pointer.
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTTY reports whether f is a terminal.
+func isTTY(f *os.File) bool {
+	var t syscall.Termios
+	return ioctl(f.Fd(), syscall.TCGETS, unsafe.Pointer(&t)) == nil
+}
+
+// saveTerminal returns a function restoring the current settings of the
+// terminal f, or nil if f is not a terminal.
+func saveTerminal(f *os.File) func() {
+	var t syscall.Termios
+	if ioctl(f.Fd(), syscall.TCGETS, unsafe.Pointer(&t)) != nil {
+		return nil
+	}
+	return func() {
+		ioctl(f.Fd(), syscall.TCSETS, unsafe.Pointer(&t))
+	}
+}
+
+// makeRaw puts the terminal f into raw mode like cfmakeraw(3), so that
+// every key reaches the container's terminal unprocessed.
+func makeRaw(f *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(f.Fd(), syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return ioctl(f.Fd(), syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+// copyWinsize sets the window size of the terminal to to that of from.
+func copyWinsize(from, to *os.File) error {
+	var ws struct{ row, col, xpixel, ypixel uint16 }
+	if err := ioctl(from.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return err
+	}
+	return ioctl(to.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// containerTTY is the pseudo-terminal of a container run with --tty. It is
+// allocated from the container's own devpts instance, so the command sees
+// a terminal below its /dev/pts, and the child proxies it to its stdio.
+type containerTTY struct {
+	master *os.File
+	slave  *os.File
+	// output is closed once the output of the terminal is copied
+	output chan struct{}
+	winch  chan os.Signal
+}
+
+// openTTY allocates a pseudo-terminal from /dev/ptmx. It runs after
+// isolation, when /dev/ptmx refers to the devpts instance of the container.
+func openTTY() (*containerTTY, error) {
+	master, slave, err := container.OpenPTY()
+	if err != nil {
+		return nil, err
+	}
+	return &containerTTY{master: master, slave: slave, output: make(chan struct{})}, nil
+}
+
+// attach makes the terminal the controlling terminal and stdio of cmd.
+func (t *containerTTY) attach(cmd *exec.Cmd) {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = t.slave, t.slave, t.slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+}
+
+// proxy puts the terminal of the child's stdin, if it has one, into raw
+// mode, and copies input to the container's terminal and its output back.
+// Resizes of the outer terminal, which signal SIGWINCH to its foreground
+// process group and so to the child, are applied to the container's
+// terminal, whose kernel then signals the command.
+func (t *containerTTY) proxy() error {
+	if isTTY(os.Stdin) {
+		if err := makeRaw(os.Stdin); err != nil {
+			return fmt.Errorf("cannot put the terminal into raw mode: %w", err)
+		}
+		copyWinsize(os.Stdin, t.master)
+		t.winch = make(chan os.Signal, 1)
+		signal.Notify(t.winch, syscall.SIGWINCH)
+		go func() {
+			for range t.winch {
+				copyWinsize(os.Stdin, t.master)
+			}
+		}()
+	}
+	// Both directions are spliced in the kernel where the files allow it
+	go spliceCopy(t.master, os.Stdin, nil)
+	go func() {
+		// Reading the master fails with EIO once no process has the
+		// terminal open any more, which spliceCopy takes as the end
+		spliceCopy(os.Stdout, t.master, nil)
+		close(t.output)
+	}()
+	return nil
+}
+
+// close waits for the output of the exited command to be copied and
+// releases the terminal. The outer terminal is restored by run, which
+// also restores it when the child fails.
+func (t *containerTTY) close() {
+	if t.winch != nil {
+		signal.Stop(t.winch)
+		close(t.winch)
+	}
+	t.slave.Close()
+	select {
+	case <-t.output:
+	case <-time.After(ttyDrainTimeout):
+	}
+	t.master.Close()
+}
+
+// execTerminal proxies the terminal of an exec session run with --tty,
+// which Container.Exec allocated from the container's devpts instance. Like
+// the child does for run --tty, it puts the caller's terminal into raw
+// mode and applies its resizes, through Process.Resize.
+type execTerminal struct {
+	proc    *container.Process
+	restore func()
+	// output is closed once the output of the terminal is copied
+	output chan struct{}
+	winch  chan os.Signal
+}
+
+// proxyExecTerminal copies input to the session's terminal and its output
+// back, through rec if the session is recorded.
+func proxyExecTerminal(proc *container.Process, rec *sessionRecorder) (*execTerminal, error) {
+	t := &execTerminal{proc: proc, output: make(chan struct{})}
+	if isTTY(os.Stdin) {
+		t.restore = saveTerminal(os.Stdin)
+		if err := makeRaw(os.Stdin); err != nil {
+			return nil, fmt.Errorf("cannot put the terminal into raw mode: %w", err)
+		}
+		t.resize()
+		t.winch = make(chan os.Signal, 1)
+		signal.Notify(t.winch, syscall.SIGWINCH)
+		go func() {
+			for range t.winch {
+				t.resize()
+			}
+		}()
+	}
+	var in io.Reader = os.Stdin
+	var out io.Writer = os.Stdout
+	if rec != nil {
+		in, out = &recordedStream{rec, "i", os.Stdin}, &recordedStream{rec, "o", os.Stdout}
+	}
+	// The end of the input does not close the terminal, which would also
+	// end the output
+	go io.Copy(proc.Stdin, in)
+	go func() {
+		// Reading the terminal fails with EIO once no process has it open
+		io.Copy(out, proc.Stdout)
+		close(t.output)
+	}()
+	return t, nil
+}
+
+// resize gives the session's terminal the window size of the caller's.
+func (t *execTerminal) resize() {
+	var ws struct{ row, col, xpixel, ypixel uint16 }
+	if ioctl(os.Stdin.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&ws)) == nil {
+		t.proc.Resize(ws.col, ws.row)
+	}
+}
+
+// drain waits until every process of the session closed the terminal and
+// its output is copied, which Process.Wait requires since it closes the
+// terminal. Like with ssh, background processes that keep the terminal
+// open keep the session going.
+func (t *execTerminal) drain() {
+	<-t.output
+}
+
+// close stops applying resizes and restores the caller's terminal.
+func (t *execTerminal) close() {
+	if t.winch != nil {
+		signal.Stop(t.winch)
+		close(t.winch)
+	}
+	if t.restore != nil {
+		t.restore()
+	}
+}
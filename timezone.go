@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	zoneinfoDir   = "/usr/share/zoneinfo"
+	localtimePath = "etc/localtime"
+)
+
+// zoneinfoPath resolves a time zone name such as "Europe/Berlin" to the
+// matching zoneinfo file on the host.
+func zoneinfoPath(tz string) (string, error) {
+	if tz == "" || filepath.IsAbs(tz) || strings.Contains(tz, "..") {
+		return "", fmt.Errorf("invalid time zone name: %q", tz)
+	}
+	path := filepath.Join(zoneinfoDir, tz)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("unknown time zone %s: %w", tz, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("unknown time zone %s: not a zoneinfo file", tz)
+	}
+	return path, nil
+}
+
+// mountTimezone bind-mounts the host zoneinfo file for tz read-only onto
+// /etc/localtime inside rootfs. Minimal images often ship /etc/localtime as
+// a symlink into a zoneinfo tree; it is resolved within the rootfs like any
+// mount target, so the mount lands on the file it points to, which is
+// created empty if the image lacks it.
+func mountTimezone(rootfs, tz string) error {
+	src, err := zoneinfoPath(tz)
+	if err != nil {
+		return err
+	}
+
+	target, err := securePath(rootfs, localtimePath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(target); err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("cannot mount time zone: /%s is not a file", localtimePath)
+	}
+	if err := ensureMountTarget(target, false); err != nil {
+		return fmt.Errorf("cannot create /%s: %w", localtimePath, err)
+	}
+
+	if err := syscall.Mount(src, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %w", src, err)
+	}
+	if err := remountFlags(target, syscall.MS_RDONLY); err != nil {
+		return fmt.Errorf("failed to remount %s read-only: %w", target, err)
+	}
+	return nil
+}
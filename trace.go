@@ -0,0 +1,369 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	traceUsage = "usage: shp trace [--probes syscalls,tcp] [--json] <container>"
+
+	traceSyscalls = "syscalls"
+	traceTCP      = "tcp"
+	tracePoll     = time.Second
+
+	// An event of the ring buffer is the probe's index, the pid_tgid and
+	// monotonic time of the kernel, the task's comm and then the record
+	// of the tracepoint
+	traceKindOffset = 0
+	tracePIDOffset  = 8
+	traceTimeOffset = 16
+	traceCommOffset = 24
+	traceCommLen    = 16
+	traceHeaderLen  = 40
+
+	ipprotoTCP = 6
+)
+
+// traceTracepoints are the tracepoints the probes of shp trace attach to.
+// Their records have a stable layout described by tracefs, so the probes
+// need no kernel headers or BTF to read them.
+var traceTracepoints = map[string]string{
+	traceSyscalls: "raw_syscalls/sys_enter",
+	traceTCP:      "sock/inet_sock_set_state",
+}
+
+// tracefsDirs are where tracefs is mounted, before and after Linux 4.1.
+var tracefsDirs = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// tcpStates names the TCP states of inet_sock_set_state records.
+var tcpStates = []string{"", "ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT",
+	"CLOSE", "CLOSE_WAIT", "LAST_ACK", "LISTEN", "CLOSING", "NEW_SYN_RECV"}
+
+// traceProbe is a tracepoint of a probe and the layout of its records.
+type traceProbe struct {
+	name   string
+	id     int
+	size   int
+	fields map[string]traceField
+}
+
+type traceField struct {
+	offset int
+	size   int
+}
+
+// traceEvent is a system call made by a process of the container, or a
+// state change of one of its TCP connections.
+type traceEvent struct {
+	Time        time.Time `json:"time"`
+	Probe       string    `json:"probe"`
+	PID         int       `json:"pid"`
+	TID         int       `json:"tid"`
+	Comm        string    `json:"comm"`
+	Syscall     string    `json:"syscall,omitempty"`
+	Args        []uint64  `json:"args,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	OldState    string    `json:"old_state,omitempty"`
+	NewState    string    `json:"new_state,omitempty"`
+}
+
+func trace(args []string) {
+	// Accept the container before the flags too, as in
+	// `shp trace web --probes tcp`
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append(append([]string{}, args[1:]...), args[0])
+	}
+	fs := flag.NewFlagSet("trace", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	probeList := fs.String("probes", traceSyscalls+","+traceTCP, "comma-separated probes to attach: syscalls, tcp")
+	asJSON := fs.Bool("json", false, "print the events as JSON lines")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Println(traceUsage)
+		os.Exit(1)
+	}
+	st, err := findContainer(fs.Arg(0))
+	handle(err)
+	probes, err := loadTraceProbes(strings.Split(*probeList, ","))
+	handle(err)
+	cgroupID, level, err := traceCgroup(st)
+	handle(err)
+	session, err := openTraceSession(cgroupID, level, probes)
+	handle(err)
+	defer session.close()
+
+	epoch := monotonicEpoch()
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	if !*asJSON {
+		fmt.Fprintf(out, "%-29s %7s %7s %-16s %-8s %s\n", "TIME", "PID", "TID", "COMM", "PROBE", "DETAIL")
+	}
+	for processAlive(st.PID) {
+		err := session.read(tracePoll, func(rec []byte) {
+			e, ok := decodeTraceEvent(rec, probes, epoch)
+			switch {
+			case !ok:
+			case *asJSON:
+				enc.Encode(e)
+			default:
+				fmt.Fprintf(out, "%-29s %7d %7d %-16s %-8s %s\n", e.Time.Local().Format(logsTimeFormat), e.PID, e.TID, e.Comm, e.Probe, e.detail())
+			}
+		})
+		handle(err)
+		handle(out.Flush())
+	}
+}
+
+// loadTraceProbes reads the layout of the tracepoints of the named probes
+// from tracefs, which is mounted if it is not yet.
+func loadTraceProbes(names []string) ([]*traceProbe, error) {
+	dir, err := tracefsEvents()
+	if err != nil {
+		return nil, err
+	}
+	var probes []*traceProbe
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		tp, ok := traceTracepoints[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown probe %q; probes are %s and %s", name, traceSyscalls, traceTCP)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		p, err := readTraceFormat(filepath.Join(dir, tp, "format"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read tracepoint %s: %w", tp, err)
+		}
+		p.name = name
+		probes = append(probes, p)
+	}
+	return probes, nil
+}
+
+// tracefsEvents returns the events directory of tracefs, mounting tracefs
+// at /sys/kernel/tracing if no mount has one.
+func tracefsEvents() (string, error) {
+	for _, dir := range tracefsDirs {
+		if _, err := os.Stat(filepath.Join(dir, "events")); err == nil {
+			return filepath.Join(dir, "events"), nil
+		}
+	}
+	if err := syscall.Mount("tracefs", tracefsDirs[0], "tracefs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return "", fmt.Errorf("cannot mount tracefs: %w", err)
+	}
+	return filepath.Join(tracefsDirs[0], "events"), nil
+}
+
+// readTraceFormat parses the format file of a tracepoint:
+//
+//	ID: 443
+//	format:
+//		field:long id;	offset:8;	size:8;	signed:1;
+func readTraceFormat(path string) (*traceProbe, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &traceProbe{fields: make(map[string]traceField)}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if id, ok := strings.CutPrefix(line, "ID: "); ok {
+			if p.id, err = strconv.Atoi(id); err != nil {
+				return nil, fmt.Errorf("bad ID %q", id)
+			}
+			continue
+		}
+		decl, ok := strings.CutPrefix(line, "field:")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(decl, ";")
+		words := strings.Fields(parts[0])
+		if len(parts) < 3 || len(words) == 0 {
+			continue
+		}
+		name, _, _ := strings.Cut(words[len(words)-1], "[")
+		var f traceField
+		for _, attr := range parts[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(attr), ":")
+			switch key {
+			case "offset":
+				f.offset, err = strconv.Atoi(value)
+			case "size":
+				f.size, err = strconv.Atoi(value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("bad field %q", decl)
+			}
+		}
+		p.fields[name] = f
+		if end := f.offset + f.size; end > p.size {
+			p.size = end
+		}
+	}
+	if p.id == 0 || p.size == 0 {
+		return nil, fmt.Errorf("no tracepoint format in %s", path)
+	}
+	return p, nil
+}
+
+// traceCgroup returns the ID of a container's cgroup v2 group, which is
+// the inode of its directory, and its depth in the hierarchy, so the
+// probes match the container's exec sessions in groups below it too.
+func traceCgroup(st *containerState) (uint64, int, error) {
+	if st.Cgroup == "" {
+		return 0, 0, fmt.Errorf("container %s has no cgroup to trace; tracing requires cgroup v2", st.ID)
+	}
+	var fi syscall.Stat_t
+	if err := syscall.Stat(st.Cgroup, &fi); err != nil {
+		return 0, 0, fmt.Errorf("cannot read cgroup of container %s: %w", st.ID, err)
+	}
+	mounts, err := readMounts(os.Getpid())
+	if err != nil {
+		return 0, 0, err
+	}
+	root := ""
+	for _, mnt := range mounts {
+		if mnt.Type == "cgroup2" && len(mnt.Target) > len(root) &&
+			(st.Cgroup == mnt.Target || strings.HasPrefix(st.Cgroup, strings.TrimSuffix(mnt.Target, "/")+"/")) {
+			root = mnt.Target
+		}
+	}
+	if root == "" {
+		return 0, 0, fmt.Errorf("cgroup %s of container %s is not on a cgroup v2 mount", st.Cgroup, st.ID)
+	}
+	level := 0
+	if rel, err := filepath.Rel(root, st.Cgroup); err == nil && rel != "." {
+		level = len(strings.Split(rel, "/"))
+	}
+	return uint64(fi.Ino), level, nil
+}
+
+// decodeTraceEvent reads an event of the ring buffer. Connections of other
+// protocols than TCP are skipped.
+func decodeTraceEvent(rec []byte, probes []*traceProbe, epoch time.Time) (traceEvent, bool) {
+	var e traceEvent
+	if len(rec) < traceHeaderLen {
+		return e, false
+	}
+	kind := binary.LittleEndian.Uint64(rec[traceKindOffset:])
+	if kind >= uint64(len(probes)) {
+		return e, false
+	}
+	p := probes[kind]
+	pidTgid := binary.LittleEndian.Uint64(rec[tracePIDOffset:])
+	e.Time = epoch.Add(time.Duration(binary.LittleEndian.Uint64(rec[traceTimeOffset:])))
+	e.Probe, e.PID, e.TID = p.name, int(pidTgid>>32), int(uint32(pidTgid))
+	comm := rec[traceCommOffset : traceCommOffset+traceCommLen]
+	if i := strings.IndexByte(string(comm), 0); i >= 0 {
+		comm = comm[:i]
+	}
+	e.Comm = string(comm)
+	r := rec[traceHeaderLen:]
+	if len(r) < p.size {
+		return e, false
+	}
+	switch p.name {
+	case traceSyscalls:
+		nr := p.uint(r, "id", 0)
+		e.Syscall = syscallName(uint32(nr))
+		if e.Syscall == "" {
+			e.Syscall = "syscall_" + strconv.FormatUint(nr, 10)
+		}
+		if f, ok := p.fields["args"]; ok {
+			width := f.size / 6
+			for i := 0; i < 6; i++ {
+				e.Args = append(e.Args, readUint(r[f.offset+i*width:], width))
+			}
+		}
+	case traceTCP:
+		if p.uint(r, "protocol", 0) != ipprotoTCP {
+			return e, false
+		}
+		src, dst := "saddr", "daddr"
+		if p.uint(r, "family", 0) == syscall.AF_INET6 {
+			src, dst = "saddr_v6", "daddr_v6"
+		}
+		e.Source = net.JoinHostPort(p.ip(r, src).String(), strconv.FormatUint(p.uint(r, "sport", 0), 10))
+		e.Destination = net.JoinHostPort(p.ip(r, dst).String(), strconv.FormatUint(p.uint(r, "dport", 0), 10))
+		e.OldState, e.NewState = tcpState(p.uint(r, "oldstate", 0)), tcpState(p.uint(r, "newstate", 0))
+	}
+	return e, true
+}
+
+// uint reads the integer field name of a record, or returns def if the
+// tracepoint has no such field.
+func (p *traceProbe) uint(r []byte, name string, def uint64) uint64 {
+	f, ok := p.fields[name]
+	if !ok {
+		return def
+	}
+	return readUint(r[f.offset:], f.size)
+}
+
+// ip reads the address field name of a record.
+func (p *traceProbe) ip(r []byte, name string) net.IP {
+	f, ok := p.fields[name]
+	if !ok {
+		return nil
+	}
+	return net.IP(append([]byte(nil), r[f.offset:f.offset+f.size]...))
+}
+
+// readUint reads a native integer of size bytes.
+func readUint(b []byte, size int) uint64 {
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b))
+	default:
+		return binary.LittleEndian.Uint64(b)
+	}
+}
+
+func tcpState(s uint64) string {
+	if s < uint64(len(tcpStates)) && tcpStates[s] != "" {
+		return tcpStates[s]
+	}
+	return strconv.FormatUint(s, 10)
+}
+
+func (e traceEvent) detail() string {
+	if e.Probe == traceTCP {
+		return fmt.Sprintf("%s > %s %s -> %s", e.Source, e.Destination, e.OldState, e.NewState)
+	}
+	args := make([]string, len(e.Args))
+	for i, a := range e.Args {
+		args[i] = "0x" + strconv.FormatUint(a, 16)
+	}
+	return e.Syscall + "(" + strings.Join(args, ", ") + ")"
+}
+
+// monotonicEpoch returns the time at which CLOCK_MONOTONIC, the clock of
+// the kernel's event timestamps, was zero.
+func monotonicEpoch() time.Time {
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, 1, uintptr(unsafe.Pointer(&ts)), 0) // CLOCK_MONOTONIC
+	return time.Now().Add(-time.Duration(ts.Nano()))
+}
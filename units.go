@@ -0,0 +1,54 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a byte size with an optional binary suffix
+// (k, m, g, t; case-insensitive, an optional trailing "b" is ignored).
+func parseSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "b")
+
+	shift := 0
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'k':
+			shift = 10
+		case 'm':
+			shift = 20
+		case 'g':
+			shift = 30
+		case 't':
+			shift = 40
+		}
+		if shift > 0 {
+			v = v[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n << shift, nil
+}
+
+// formatSize renders a byte size like parseSize accepts it, with one
+// decimal, e.g. 1.2G.
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1<<10 {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	v, unit := float64(n)/(1<<10), 0
+	for v >= 1<<10 && unit < len(units)-1 {
+		v, unit = v/(1<<10), unit+1
+	}
+	return strings.TrimSuffix(strconv.FormatFloat(v, 'f', 1, 64), ".0") + string(units[unit])
+}
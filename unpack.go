@@ -0,0 +1,223 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// whiteoutOpaque in a directory hides everything lower layers put there
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	xattrPAXPrefix = "SCHILY.xattr."
+)
+
+// unpackLayers applies the layers of an image in order to the new directory
+// dest, which the storage driver creates. It is unpacked next to dest
+// first, so dest only ever holds complete images. Encrypted layers are
+// decrypted with key.
+func unpackLayers(store *blobStore, layers []ociDescriptor, key []byte, dest string) error {
+	driver, err := openStorageDriver()
+	if err != nil {
+		return err
+	}
+	// Datasets take their space from the pool rather than the images
+	// directory
+	if _, ok := driver.(zfsDriver); !ok {
+		var need int64
+		for _, l := range layers {
+			size, err := unpackedSize(store, l)
+			if err != nil {
+				return err
+			}
+			need += size
+		}
+		if err := checkSpace(filepath.Dir(dest), need, "unpack the image"); err != nil {
+			return err
+		}
+	}
+	return driver.createImage(dest, func(dir string) error {
+		for _, l := range layers {
+			if err := unpackLayer(store, l, key, dir); err != nil {
+				return fmt.Errorf("cannot unpack layer %s: %w", l.Digest, err)
+			}
+		}
+		return nil
+	})
+}
+
+func unpackLayer(store *blobStore, l ociDescriptor, key []byte, root string) error {
+	blob, err := store.path(l.Digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	mediaType := l.MediaType
+	if strings.HasSuffix(mediaType, mediaTypeOCICryptSuffix) {
+		return fmt.Errorf("layer %s is encrypted with ocicrypt, which is not supported", shortDigest(l.Digest))
+	}
+	if base, ok := strings.CutSuffix(mediaType, mediaTypeEncryptedSuffix); ok {
+		if key == nil {
+			return fmt.Errorf("layer is encrypted, pull with --key")
+		}
+		if r, err = newLayerDecrypter(r, key); err != nil {
+			return err
+		}
+		mediaType = base
+	}
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(mediaType, "zstd"):
+		return fmt.Errorf("unsupported layer compression: %s", mediaType)
+	}
+	return applyLayer(root, r)
+}
+
+// applyLayer extracts a layer tarball into root on top of the layers
+// below it, honoring whiteouts. Paths are resolved like securePath, so
+// symlinks in the image can never make an entry land outside root.
+func applyLayer(root string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	// An opaque whiteout only hides what lower layers created
+	created := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := path.Split(name)
+		parent, err := securePath(root, dir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		switch {
+		case base == whiteoutOpaque:
+			err = clearLowerEntries(parent, created)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			err = os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)))
+		default:
+			target := filepath.Join(parent, base)
+			created[target] = true
+			err = extractEntry(root, target, hdr, tr)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot extract %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func clearLowerEntries(dir string, created map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if !created[p] {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extractEntry creates target from a tar entry, replacing what a lower
+// layer left there; directories are merged instead.
+func extractEntry(root, target string, hdr *tar.Header, r io.Reader) error {
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return os.Lchown(target, hdr.Uid, hdr.Gid)
+	case tar.TypeLink:
+		src, err := securePath(root, path.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		return os.Link(src, target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := map[byte]uint32{tar.TypeChar: syscall.S_IFCHR, tar.TypeBlock: syscall.S_IFBLK, tar.TypeFifo: syscall.S_IFIFO}[hdr.Typeflag]
+		if err := syscall.Mknod(target, kind|mode, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	// Ownership first, since chown clears set-user-ID bits
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := syscall.Chmod(target, mode); err != nil {
+		return err
+	}
+	for k, v := range hdr.PAXRecords {
+		if attr, ok := strings.CutPrefix(k, xattrPAXPrefix); ok {
+			if err := syscall.Setxattr(target, attr, []byte(v), 0); err != nil {
+				fmt.Printf("Warning: cannot set %s on %s: %v\n", attr, hdr.Name, err)
+			}
+		}
+	}
+	mtime := syscall.NsecToTimespec(hdr.ModTime.UnixNano())
+	return syscall.UtimesNano(target, []syscall.Timespec{mtime, mtime})
+}
+
+// mkdev encodes a device number like the kernel's new_encode_dev.
+func mkdev(major, minor int64) int {
+	return int(minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32)
+}
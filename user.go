@@ -0,0 +1,133 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// containerUser is the identity --user resolves to in the rootfs.
+type containerUser struct {
+	cred *syscall.Credential
+	// home is the home directory of a user found in /etc/passwd
+	home string
+}
+
+// validateUserSpec checks the syntax of --user: user[:group], each a name
+// or a numeric ID.
+func validateUserSpec(spec string) error {
+	user, group, hasGroup := strings.Cut(spec, ":")
+	if user == "" || hasGroup && (group == "" || strings.Contains(group, ":")) {
+		return fmt.Errorf("invalid user %q, expected user[:group]", spec)
+	}
+	return nil
+}
+
+// readColonFile returns the colon-separated entries of a passwd or group
+// file of the rootfs. A missing file has no entries.
+func readColonFile(rootfs, path string) ([][]string, error) {
+	full, err := securePath(rootfs, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(full)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, s.Err()
+}
+
+// resolveUser resolves --user against /etc/passwd and /etc/group of the
+// rootfs like Docker: names must exist there, numeric IDs need not. The
+// group defaults to the primary group of the user, or 0, and the user gets
+// the supplementary groups /etc/group lists it in.
+func resolveUser(rootfs, spec string) (*containerUser, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	passwd, err := readColonFile(rootfs, "/etc/passwd")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read /etc/passwd: %w", err)
+	}
+	groups, err := readColonFile(rootfs, "/etc/group")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read /etc/group: %w", err)
+	}
+
+	u := &containerUser{cred: &syscall.Credential{}}
+	var name string
+	uid, numeric := parseID(userPart)
+	found := false
+	for _, e := range passwd {
+		if len(e) < 6 || !(numeric && e[2] == userPart || !numeric && e[0] == userPart) {
+			continue
+		}
+		id, ok := parseID(e[2])
+		gid, gok := parseID(e[3])
+		if !ok || !gok {
+			return nil, fmt.Errorf("invalid /etc/passwd entry of %s", e[0])
+		}
+		name, uid, u.cred.Gid, u.home, found = e[0], id, gid, e[5], true
+		break
+	}
+	if !found && !numeric {
+		return nil, fmt.Errorf("user %s not found in /etc/passwd of the rootfs", userPart)
+	}
+	u.cred.Uid = uid
+
+	if hasGroup {
+		gid, numeric := parseID(groupPart)
+		found := numeric
+		for _, e := range groups {
+			if len(e) >= 3 && !numeric && e[0] == groupPart {
+				if gid, found = parseID(e[2]); !found {
+					return nil, fmt.Errorf("invalid /etc/group entry of %s", e[0])
+				}
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("group %s not found in /etc/group of the rootfs", groupPart)
+		}
+		u.cred.Gid = gid
+	}
+
+	// Go sets no supplementary groups for an empty list
+	u.cred.Groups = []uint32{}
+	if name != "" {
+		for _, e := range groups {
+			if len(e) < 4 {
+				continue
+			}
+			for _, member := range strings.Split(e[3], ",") {
+				if gid, ok := parseID(e[2]); ok && member == name && gid != u.cred.Gid {
+					u.cred.Groups = append(u.cred.Groups, gid)
+					break
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// parseID parses a numeric user or group ID.
+func parseID(s string) (uint32, bool) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err == nil
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const sysClassNet = "/sys/class/net"
+
+// parseVLANParent splits a parent interface such as eth0.100 or bond0.42
+// into the underlying interface and the VLAN ID.
+func parseVLANParent(parent string) (string, int, bool) {
+	i := strings.LastIndex(parent, ".")
+	if i <= 0 {
+		return "", 0, false
+	}
+	vid, err := strconv.Atoi(parent[i+1:])
+	if err != nil || vid < 1 || vid > 4094 {
+		return "", 0, false
+	}
+	return parent[:i], vid, true
+}
+
+// checkParent verifies that parent can carry macvlan or ipvlan links. A
+// missing VLAN subinterface is fine as long as its underlying interface
+// exists, since ensureParent creates it on demand.
+func checkParent(parent string) error {
+	if len(parent) > maxIfNameLen {
+		return fmt.Errorf("parent interface name %s is too long", parent)
+	}
+	link := parent
+	if _, err := net.InterfaceByName(parent); err != nil {
+		base, _, ok := parseVLANParent(parent)
+		if !ok {
+			return fmt.Errorf("parent interface %s: %w", parent, err)
+		}
+		if _, err := net.InterfaceByName(base); err != nil {
+			return fmt.Errorf("parent interface %s of VLAN %s: %w", base, parent, err)
+		}
+		link = base
+	}
+	// Traffic of a bond member is delivered to the bond, so links on the
+	// member itself would never receive anything
+	if master, err := os.Readlink(filepath.Join(sysClassNet, link, "master")); err == nil {
+		return fmt.Errorf("interface %s is enslaved to %s, use %s as parent instead", link, filepath.Base(master), filepath.Base(master))
+	}
+	return nil
+}
+
+// ensureParent creates the parent of a macvlan or ipvlan network if it is a
+// VLAN subinterface that does not exist, e.g. after a reboot, and brings it
+// up. It reports whether the subinterface was created.
+func ensureParent(parent string) (bool, error) {
+	if ifc, err := net.InterfaceByName(parent); err == nil {
+		if ifc.Flags&net.FlagUp == 0 {
+			return false, runTool("ip", "link", "set", parent, "up")
+		}
+		return false, nil
+	}
+	base, vid, ok := parseVLANParent(parent)
+	if !ok {
+		return false, fmt.Errorf("parent interface %s does not exist", parent)
+	}
+	if err := runTool("ip", "link", "add", "link", base, "name", parent, "type", "vlan", "id", strconv.Itoa(vid)); err != nil {
+		return false, err
+	}
+	return true, runTool("ip", "link", "set", parent, "up")
+}
@@ -0,0 +1,163 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultVolumeFlags are applied to every bind volume unless overridden by
+// the "suid" or "dev" options, so a writable shared volume cannot be used to
+// smuggle setuid binaries or device nodes into the container.
+const defaultVolumeFlags = syscall.MS_NOSUID | syscall.MS_NODEV
+
+// volume is a host path bind-mounted into the container.
+type volume struct {
+	source string
+	target string
+	flags  uintptr
+}
+
+// parseVolume parses a -v specification of the form
+// host:container[:opt,...] where opt is one of ro, rw, exec, noexec, suid,
+// nosuid, dev or nodev.
+func parseVolume(spec string) (volume, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return volume{}, fmt.Errorf("invalid volume %q, expected host:container[:options]", spec)
+	}
+
+	source, err := filepath.Abs(parts[0])
+	if err != nil {
+		return volume{}, fmt.Errorf("cannot get absolute path for %s: %w", parts[0], err)
+	}
+	if !filepath.IsAbs(parts[1]) {
+		return volume{}, fmt.Errorf("volume target must be absolute: %s", parts[1])
+	}
+
+	v := volume{source: source, target: filepath.Clean(parts[1]), flags: defaultVolumeFlags}
+	if len(parts) == 3 {
+		for _, opt := range strings.Split(parts[2], ",") {
+			switch opt {
+			case "ro":
+				v.flags |= syscall.MS_RDONLY
+			case "rw":
+				v.flags &^= syscall.MS_RDONLY
+			case "noexec":
+				v.flags |= syscall.MS_NOEXEC
+			case "exec":
+				v.flags &^= syscall.MS_NOEXEC
+			case "nosuid":
+				v.flags |= syscall.MS_NOSUID
+			case "suid":
+				v.flags &^= syscall.MS_NOSUID
+			case "nodev":
+				v.flags |= syscall.MS_NODEV
+			case "dev":
+				v.flags &^= syscall.MS_NODEV
+			default:
+				return volume{}, fmt.Errorf("unknown volume option %q in %s", opt, spec)
+			}
+		}
+	}
+	return v, nil
+}
+
+// parseTmpfs parses a --tmpfs specification of the form
+// container[:opt,...] where opt is size=<size>, mode=<octal> or a mount
+// flag such as ro or noexec. Like volumes, tmpfs mounts are nosuid and
+// nodev unless the options say otherwise.
+func parseTmpfs(spec string) (specMount, error) {
+	target, options, _ := strings.Cut(spec, ":")
+	if !filepath.IsAbs(target) {
+		return specMount{}, fmt.Errorf("tmpfs target must be absolute: %s", target)
+	}
+	m := specMount{volume: volume{target: filepath.Clean(target), flags: defaultVolumeFlags}, tmpfs: true}
+	var data []string
+	for _, opt := range strings.Split(options, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		if f, ok := specMountFlags[opt]; ok {
+			if f.set {
+				m.flags |= f.flags
+			} else {
+				m.flags &^= f.flags
+			}
+			continue
+		}
+		switch key {
+		case "":
+		case "size":
+			n, err := parseSize(value)
+			if err != nil {
+				return specMount{}, fmt.Errorf("invalid tmpfs size in %s: %w", spec, err)
+			}
+			data = append(data, fmt.Sprintf("size=%d", n))
+		case "mode":
+			if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+				return specMount{}, fmt.Errorf("invalid tmpfs mode %q in %s", value, spec)
+			}
+			data = append(data, opt)
+		default:
+			return specMount{}, fmt.Errorf("unknown tmpfs option %q in %s", opt, spec)
+		}
+	}
+	m.data = strings.Join(data, ",")
+	return m, nil
+}
+
+// mount bind-mounts the volume into rootfs and applies its mount flags.
+// Bind mounts ignore most flags on creation, so they are set by a remount.
+func (v volume) mount(rootfs string) error {
+	info, err := os.Stat(v.source)
+	if err != nil {
+		return fmt.Errorf("volume source %s: %w", v.source, err)
+	}
+	target, err := securePath(rootfs, v.target)
+	if err != nil {
+		return err
+	}
+	if err := ensureMountTarget(target, info.IsDir()); err != nil {
+		return fmt.Errorf("cannot create volume target %s: %w", v.target, err)
+	}
+
+	if err := syscall.Mount(v.source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s to %s: %w", v.source, v.target, err)
+	}
+	if err := remountFlags(target, v.flags); err != nil {
+		return fmt.Errorf("failed to remount volume %s: %w", v.target, err)
+	}
+	if err := remountSubmounts(target, v.flags); err != nil {
+		return fmt.Errorf("failed to remount volume %s: %w", v.target, err)
+	}
+	return nil
+}
+
+// remountSubmounts applies flags to the mounts below the recursive bind
+// mount at target. They keep their own flags otherwise, so a read-only
+// volume of a directory with mounts in it would stay writable below them.
+func remountSubmounts(target string, flags uintptr) error {
+	// Mountinfo lists mount points with their symlinks resolved
+	target, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+	// The mount namespace is the caller's, whose PID may be that of another
+	// namespace
+	mounts, _, err := readMountinfo("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	for path := range mounts {
+		if strings.HasPrefix(path, target+"/") {
+			if err := remountFlags(path, flags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+	watchDebounce = 200 * time.Millisecond
+)
+
+// watcher reports changes anywhere below a directory using inotify. New
+// subdirectories are watched as they appear.
+type watcher struct {
+	fd      int
+	changes chan string
+}
+
+func newWatcher(root string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init failed: %w", err)
+	}
+	w := &watcher{fd: fd, changes: make(chan string, 1)}
+	dirs := make(map[int]string)
+	if err := w.addTree(root, dirs); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go w.read(dirs)
+	return w, nil
+}
+
+func (w *watcher) addTree(root string, dirs map[int]string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return fmt.Errorf("cannot watch %s: %w", path, err)
+		}
+		dirs[wd] = path
+		return nil
+	})
+}
+
+func (w *watcher) read(dirs map[int]string) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := ""
+			if ev.Len > 0 {
+				raw := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+				name = string(raw[:clen(raw)])
+			}
+			path := filepath.Join(dirs[int(ev.Wd)], name)
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.addTree(path, dirs)
+			}
+			select {
+			case w.changes <- path:
+			default:
+			}
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+		}
+	}
+}
+
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// superviseWatched runs the command and restarts it whenever the watched
+// tree changes, or sends it sig instead if sig is non-zero. A command that
+// exits on its own is started again on the next change. Termination
+// signals are forwarded to the command, and end the container when no
+// command is running. It must be called on the thread the command is
+// forked from.
+func superviseWatched(start func() (*exec.Cmd, error), w *watcher, sig syscall.Signal, stopTimeout time.Duration) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
+
+	var cmd *exec.Cmd
+	var exited chan error
+	launch := func() error {
+		c, err := start()
+		if err != nil {
+			return err
+		}
+		cmd, exited = c, make(chan error, 1)
+		go func(ch chan error) { ch <- c.Wait() }(exited)
+		return nil
+	}
+	if err := launch(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case s := <-sigs:
+			if cmd == nil {
+				return nil
+			}
+			if !keyboardSignal(s) {
+				cmd.Process.Signal(s)
+			}
+		case err := <-exited:
+			fmt.Fprintf(os.Stderr, "watch: command exited (%v), waiting for changes\n", exitDescription(err))
+			cmd, exited = nil, nil
+		case path := <-w.changes:
+			// Let bursts of writes (editors, builds) settle first
+			time.Sleep(watchDebounce)
+			select {
+			case <-w.changes:
+			default:
+			}
+			if cmd != nil && sig != 0 {
+				fmt.Fprintf(os.Stderr, "watch: %s changed, sending %v\n", path, sig)
+				cmd.Process.Signal(sig)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "watch: %s changed, restarting\n", path)
+			if cmd != nil {
+				cmd.Process.Signal(syscall.SIGTERM)
+				select {
+				case <-exited:
+				case <-time.After(stopTimeout):
+					cmd.Process.Kill()
+					<-exited
+				}
+			}
+			if err := launch(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func exitDescription(err error) string {
+	if err == nil {
+		return "status 0"
+	}
+	return err.Error()
+}
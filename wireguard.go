@@ -0,0 +1,174 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	driverWireGuard = "wireguard"
+
+	defaultWireGuardPort = 51820
+	wgLinkPrefix         = "wg-"
+	wgKeepalive          = "25"
+)
+
+// wgPeer is another shp host of a WireGuard mesh and the container subnet
+// it routes.
+type wgPeer struct {
+	PublicKey string `json:"public_key"`
+	Endpoint  string `json:"endpoint"`
+	Subnet    string `json:"subnet"`
+}
+
+// parseWireGuardPeer parses a --peer value "<public key>,<host:port>,<subnet>".
+func parseWireGuardPeer(v string) (wgPeer, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != 3 {
+		return wgPeer{}, fmt.Errorf("invalid peer %q, expected <public key>,<host:port>,<subnet>", v)
+	}
+	p := wgPeer{PublicKey: parts[0], Endpoint: parts[1], Subnet: parts[2]}
+	if key, err := base64.StdEncoding.DecodeString(p.PublicKey); err != nil || len(key) != 32 {
+		return wgPeer{}, fmt.Errorf("invalid peer public key: %s", p.PublicKey)
+	}
+	if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+		return wgPeer{}, fmt.Errorf("invalid peer endpoint %s: %w", p.Endpoint, err)
+	}
+	if _, _, err := net.ParseCIDR(p.Subnet); err != nil {
+		return wgPeer{}, fmt.Errorf("invalid peer subnet %s: %w", p.Subnet, err)
+	}
+	return p, nil
+}
+
+func wireGuardLink(n *networkConfig) string {
+	return wgLinkPrefix + n.Name
+}
+
+func wireGuardKeyPath(n *networkConfig) string {
+	return filepath.Join(stateDir, networksDir, n.Name+".key")
+}
+
+// validateWireGuard checks the mesh settings of a wireguard network. The
+// host and peer container subnets must not overlap, since each is routed to
+// exactly one host.
+func validateWireGuard(n *networkConfig) error {
+	if len(wireGuardLink(n)) > maxIfNameLen {
+		return fmt.Errorf("wireguard network names are limited to %d characters", maxIfNameLen-len(wgLinkPrefix))
+	}
+	if n.ListenPort < 1 || n.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port: %d", n.ListenPort)
+	}
+	subnets := []string{n.Subnet}
+	for _, p := range n.Peers {
+		subnets = append(subnets, p.Subnet)
+	}
+	for i, a := range subnets {
+		_, na, _ := net.ParseCIDR(a)
+		for _, b := range subnets[i+1:] {
+			_, nb, _ := net.ParseCIDR(b)
+			if na != nil && nb != nil && (na.Contains(nb.IP) || nb.Contains(na.IP)) {
+				return fmt.Errorf("subnets %s and %s overlap", a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// createWireGuardKey generates the host's private key for a wireguard
+// network and returns the public key to hand to the other hosts.
+func createWireGuardKey(n *networkConfig) (string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate wireguard key: %w", err)
+	}
+	path := wireGuardKeyPath(n)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("cannot create %s: %w", filepath.Dir(path), err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key.Bytes()) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return "", fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// wireGuardPublicKey derives the public key of the host from its private
+// key for a wireguard network.
+func wireGuardPublicKey(n *networkConfig) (string, error) {
+	data, err := os.ReadFile(wireGuardKeyPath(n))
+	if err != nil {
+		return "", fmt.Errorf("cannot read wireguard key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid wireguard key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid wireguard key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// ensureWireGuard brings up the WireGuard interface of a network and routes
+// each peer's container subnet over it. Traffic to the peers is exempt from
+// the bridge's NAT so containers see each other's real addresses.
+func ensureWireGuard(n *networkConfig) error {
+	link := wireGuardLink(n)
+	if _, err := net.InterfaceByName(link); err != nil {
+		if err := runTool("ip", "link", "add", link, "type", "wireguard"); err != nil {
+			return err
+		}
+	}
+	if err := runTool("wg", "set", link, "listen-port", strconv.Itoa(n.ListenPort), "private-key", wireGuardKeyPath(n)); err != nil {
+		return err
+	}
+	for _, p := range n.Peers {
+		if err := runTool("wg", "set", link, "peer", p.PublicKey, "endpoint", p.Endpoint,
+			"allowed-ips", p.Subnet, "persistent-keepalive", wgKeepalive); err != nil {
+			return err
+		}
+	}
+	if err := runTool("ip", "link", "set", link, "up"); err != nil {
+		return err
+	}
+	for _, p := range n.Peers {
+		if err := runTool("ip", "route", "replace", p.Subnet, "dev", link); err != nil {
+			return err
+		}
+	}
+	noNAT := wireGuardNATRule(n)
+	if runTool("iptables", ruleArgs("-C", noNAT)...) == nil {
+		return nil
+	}
+	return runTool("iptables", ruleArgs("-I", noNAT)...)
+}
+
+func wireGuardNATRule(n *networkConfig) []string {
+	return []string{"-t", "nat", "POSTROUTING", "-s", n.Subnet, "-o", wireGuardLink(n), "-j", "RETURN"}
+}
+
+// removeWireGuard tears down the WireGuard interface, which also drops the
+// routes over it, and deletes the host key.
+func removeWireGuard(n *networkConfig) error {
+	link := wireGuardLink(n)
+	if _, err := net.InterfaceByName(link); err == nil {
+		if err := runTool("ip", "link", "del", link); err != nil {
+			return err
+		}
+	}
+	runTool("iptables", ruleArgs("-D", wireGuardNATRule(n))...)
+	if err := os.Remove(wireGuardKeyPath(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
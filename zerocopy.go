@@ -0,0 +1,143 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+	spliceChunk    = 1 << 20
+)
+
+// spliceCopy copies src to dst inside the kernel with splice(2), moving data
+// through an intermediate pipe so neither end has to be a pipe itself (for
+// example a PTY master and a client socket). It waits for readiness through
+// the Go poller, so non-blocking descriptors do not spin. If the kernel
+// cannot splice between the two files, it falls back to copying through a
+// buffer. counted is called with the size of every chunk transferred and
+// may be nil.
+func spliceCopy(dst, src *os.File, counted func(n int64)) (int64, error) {
+	if counted == nil {
+		counted = func(int64) {}
+	}
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return fallbackCopy(dst, src, counted)
+	}
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return fallbackCopy(dst, src, counted)
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return fallbackCopy(dst, src, counted)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	var total int64
+	for {
+		var n int64
+		var serr error
+		err := srcConn.Read(func(fd uintptr) bool {
+			n, serr = splice(int(fd), p[1], spliceChunk, spliceMove|spliceMore|spliceNonblock)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EINVAL && total == 0 {
+			return fallbackCopy(dst, src, counted)
+		}
+		if err != nil || n == 0 {
+			if err == syscall.EIO {
+				// A PTY master reports EIO once the slave side is closed
+				err = nil
+			}
+			return total, err
+		}
+
+		for remaining := n; remaining > 0; {
+			var m int64
+			werr := dstConn.Write(func(fd uintptr) bool {
+				m, serr = splice(p[0], int(fd), int(remaining), spliceMove|spliceMore|spliceNonblock)
+				return serr != syscall.EAGAIN
+			})
+			if werr == nil {
+				werr = serr
+			}
+			if werr == syscall.EINTR {
+				continue
+			}
+			if werr == syscall.EINVAL && total == 0 {
+				// Some files, such as those opened with O_APPEND, can only be
+				// spliced from; the chunk already in the pipe is copied first
+				if err := copyPipe(dst, p[0], remaining); err != nil {
+					return 0, err
+				}
+				counted(remaining)
+				n, err := fallbackCopy(dst, src, counted)
+				return remaining + n, err
+			}
+			if werr != nil {
+				return total, werr
+			}
+			remaining -= m
+			total += m
+			counted(m)
+		}
+	}
+}
+
+// splice moves up to n bytes from rfd to wfd. syscall.Splice counts them
+// in an int on 32-bit architectures.
+func splice(rfd, wfd, n, flags int) (int64, error) {
+	m, err := syscall.Splice(rfd, nil, wfd, nil, n, flags)
+	return int64(m), err
+}
+
+// copyPipe copies n bytes waiting in the pipe fd to dst.
+func copyPipe(dst *os.File, fd int, n int64) error {
+	buf := make([]byte, n)
+	for read := 0; read < len(buf); {
+		m, err := syscall.Read(fd, buf[read:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		read += m
+	}
+	_, err := dst.Write(buf)
+	return err
+}
+
+func fallbackCopy(dst, src *os.File, counted func(n int64)) (int64, error) {
+	buf := make([]byte, 64<<10)
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+			counted(int64(n))
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}